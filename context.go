@@ -2,6 +2,8 @@ package lokas
 
 import (
 	"bufio"
+	"crypto/tls"
+	"net"
 	"time"
 )
 
@@ -23,4 +25,18 @@ type Context struct {
 	LongPacketPicker      LongPacketPicker     // check and pick long packet when recv
 	LongPacketCreator     LongPacketCreator    // create long packet for send
 	MaxPacketWriteLen     int                  // data size for long packet
+	TLSConfig             *tls.Config          // tls config for listening or dialing, nil means plaintext
+	Codec                 PacketCodec          // default codec of the connections,replaced per connection by the handshake
+}
+
+// AllowAddr invoke IPChecker with the ip of the remote address,allowed if no checker
+func (this *Context) AllowAddr(addr string) bool {
+	if this.IPChecker == nil {
+		return true
+	}
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		ip = addr
+	}
+	return this.IPChecker(ip)
 }
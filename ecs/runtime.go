@@ -32,6 +32,9 @@ func CreateRuntime(updateTime int64, timeScale float32, server bool) lokas.IRunt
 func (this *Runtime) Init(updateTime int64, timeScale float32, server bool) {
 	this.sign = make(chan int, 0)
 	this.timer = util.CreateTimer(updateTime, timeScale, this.sign)
+	this.objContainer = map[string]interface{}{}
+	this.entityPool = map[util.ID]lokas.IEntity{}
+	this.isServer = server
 }
 
 func (this *Runtime) GetEntity(id util.ID) lokas.IEntity {
@@ -227,9 +227,27 @@ type IRegistry interface {
 	RegisterActorLocal(actor IActor) error
 	UnregisterActorLocal(actor IActor) error
 	GetActorIdsByTypeAndServerId(serverId int32, typ string) []util.ID
+	GetLeaseId() (clientv3.LeaseID, bool, error) //process lease,expired when the process is down
+
+	// built-in topics,used by actors when nats is not connected
+	SubscribeTopic(topic string, actorId util.ID) error
+	UnsubscribeTopic(topic string, actorId util.ID) error
+	UnsubscribeAllTopics(actorId util.ID)
+	GetTopicSubscribers(topic string) []util.ID
+	GetTopicProcesses(topic string) []util.ProcessId
 
 	GetServiceRegisterMgr() IServiceRegisterMgr
 	GetServiceDiscoverMgr() IServiceDiscoverMgr
+
+	// watch cluster topology events matching mask, call the returned func to stop watching
+	Watch(mask RegistryEventType, sink RegistryEventSink) func()
+	OnProcessJoined(sink RegistryEventSink) func()
+	OnProcessLeft(sink RegistryEventSink) func()
+	OnServiceAdded(sink RegistryEventSink) func()
+	OnServiceRemoved(sink RegistryEventSink) func()
+	OnServiceUpdated(sink RegistryEventSink) func()
+	OnActorRegistered(sink RegistryEventSink) func()
+	OnActorUnregistered(sink RegistryEventSink) func()
 }
 
 type IServiceRegisterMgr interface {
@@ -245,6 +263,18 @@ type IServiceDiscoverMgr interface {
 
 	// if serviceId is zero, get a random serviceId; if lineId is zero, get a random lineId
 	FindRandServiceInfo(serviceType string, serviceId uint16, lineId uint16) (*ServiceInfo, bool)
+
+	// find services matching the selector such as "version=1.2,region!=eu", if serviceId is zero, search all serviceIds,
+	// the results are copies
+	FindServiceListBySelector(serviceType string, serviceId uint16, selector string) ([]*ServiceInfo, error)
+	FindRandServiceInfoBySelector(serviceType string, serviceId uint16, selector string) (*ServiceInfo, error)
+
+	// send percent(0-100) of the traffic of serviceType to the services matching the canary selector,
+	// only applied to PickServiceInfo and RouteMsgToServiceSticky,RouteMsgToService addresses an explicit line
+	SetCanary(serviceType string, selector string, percent int) error
+	RemoveCanary(serviceType string)
+	// pick a service line by key, the same key always get the same line while the services are unchanged
+	PickServiceInfo(serviceType string, serviceId uint16, key uint64) (*ServiceInfo, bool)
 }
 
 // IRouter interface for router
@@ -253,8 +283,12 @@ type IRouter interface {
 	RouteMsgLocal(msg *protocol.RouteMessage) error
 
 	// RouteMsgByAvatar(fromActorId util.ID, toActorId util.ID, transId uint32, reqType uint8, msg protocol.ISerializable) error
+	// route to the line given,the canary setting is not applied
 	RouteMsgToService(fromActorId util.ID, serviceType string, serviceId uint16, lineId uint16, transId uint32, reqType uint8, msg protocol.ISerializable, protocolType protocol.TYPE) error
 
+	// route to a line picked by fromActorId, follow the canary setting of the service type
+	RouteMsgToServiceSticky(fromActorId util.ID, serviceType string, serviceId uint16, transId uint32, reqType uint8, msg protocol.ISerializable, protocolType protocol.TYPE) error
+
 	// RouteData(fromActorId util.ID, toActorId util.ID, transId uint32, reqType uint8, msg protocol.ISerializable) error
 
 	RouteDataByService(routeDataMsg *protocol.RouteDataMsg, serviceType string, serviceId uint16, lineId uint16) error
@@ -262,6 +296,9 @@ type IRouter interface {
 	RouteMsgWithPid(routeMsg *protocol.RouteMessage, pid util.ProcessId) error
 
 	RouteDataMsgLocal(dataMsg *protocol.RouteDataMsg) error
+
+	// publish to the built-in topic,fan out once per subscribing process via proxy then to local subscribers
+	PublishTopic(fromActorId util.ID, topic string, msg protocol.ISerializable) error
 }
 
 // IContext context interface
@@ -467,3 +504,10 @@ type LongPacketPicker func(data []byte) (bool, int, []byte)
 // args: data:binary to create  idx: long packet index
 // return: 1.long packet
 type LongPacketCreator func(data []byte, idx int) ([]byte, error)
+
+// encode the packets before written and decode the packets read,e.g. compression and encryption
+// return the data as is if nothing to do
+type PacketCodec interface {
+	Encode(data []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+}
@@ -0,0 +1,414 @@
+package lox
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/log/flog"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/rox"
+	"github.com/nomos/go-lokas/util"
+	"github.com/nomos/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	USER_COLLECTION       = "user"
+	AVATAR_MAP_COLLECTION = "avatarmap"
+)
+
+// HashPassword the bcrypt hash stored as User.Password
+func HashPassword(password string, cost int) (string, error) {
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func CheckPassword(hash string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+var AccountCtor = accountCtor{}
+
+type accountCtor struct{}
+
+func (this accountCtor) Type() string {
+	return "Account"
+}
+
+func (this accountCtor) Create() lokas.IModule {
+	ret := &Account{
+		Http:    HttpCtor.Create().(*Http),
+		Creator: ClaimUserCreator,
+		Cost:    bcrypt.DefaultCost,
+	}
+	ret.SetType(this.Type())
+	return ret
+}
+
+var _ lokas.IModule = (*Account)(nil)
+
+// Account the account service on http,the users and the avatar maps are kept in mongo,
+// the tokens are signed by the SigningKey of the process and consumed by the LoginHandShake of the gates
+//
+//	POST /account/register   username,password
+//	POST /account/login      username,password
+//	POST /account/refresh    refresh_token
+//	POST /account/avatar     auth(header or form),game_id,server_id,name
+type Account struct {
+	*Http
+	RSA      bool //sign with SigningKeyPrivate and verify with SigningKeyPublic
+	Creator  JwtClaimCreator
+	Cost     int       //bcrypt cost
+	Migrator *Migrator //migrate the users and the avatar maps lazily on load,nil if none
+}
+
+func (this *Account) Type() string {
+	return AccountCtor.Type()
+}
+
+func (this *Account) Load(conf lokas.IConfig) error {
+	err := this.Http.Load(conf)
+	if err != nil {
+		return err
+	}
+	this.RSA = conf.GetBool("rsa")
+	if conf.IsSet("bcrypt_cost") {
+		this.Cost = conf.GetInt("bcrypt_cost")
+	}
+	this.Use(rox.CorsAllowAll().MiddleWare)
+	this.Use(rox.FormParser)
+	this.Use(rox.RequestLogger)
+	this.Use(rox.ErrHandler)
+
+	this.HandleFunc("/account/register", this.registerHandler).Methods("POST")
+	this.HandleFunc("/account/login", this.loginHandler).Methods("POST")
+	this.HandleFunc("/account/refresh", this.refreshHandler).Methods("POST")
+	this.HandleFunc("/account/avatar", this.createAvatarHandler).Methods("POST")
+	return nil
+}
+
+func (this *Account) Start() error {
+	mongo := this.GetProcess().GetMongo()
+	err := mongo.Collection(USER_COLLECTION).EnsureIndexes(context.TODO(), []string{"username"}, nil)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	err = mongo.Collection(AVATAR_MAP_COLLECTION).EnsureIndexes(context.TODO(), []string{"userid,gameid,serverid"}, nil)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	return this.Http.Start()
+}
+
+func (this *Account) Unload() error {
+	return this.Http.Unload()
+}
+
+func (this *Account) OnStart() error {
+	return this.Http.OnStart()
+}
+
+func (this *Account) OnStop() error {
+	return this.Http.OnStop()
+}
+
+// Register create the user with the hashed password
+func (this *Account) Register(userName string, password string) (*User, error) {
+	if userName == "" {
+		return nil, protocol.ERR_PARAM_NOT_EXIST
+	}
+	if password == "" {
+		return nil, protocol.ERR_PASSWORD_EMPTY
+	}
+	hash, err := HashPassword(password, this.Cost)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	user := &User{
+		Id:           this.GetProcess().GenId(),
+		Avatars:      map[string]util.ID{},
+		AgentsParams: map[string]string{},
+		UserName:     userName,
+		Password:     hash,
+		Version:      int32(this.Migrator.Version(USER_COLLECTION)),
+	}
+	_, err = this.GetProcess().GetMongo().Collection(USER_COLLECTION).InsertOne(context.TODO(), user)
+	if qmgo.IsDup(err) {
+		return nil, protocol.ERR_ACC_EXIST
+	}
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	log.Info("Account:Register", UserId(user), flog.UserName(userName))
+	return user, nil
+}
+
+// Login verify the password and the account state
+func (this *Account) Login(userName string, password string) (*User, error) {
+	if userName == "" {
+		return nil, protocol.ERR_PARAM_NOT_EXIST
+	}
+	if password == "" {
+		return nil, protocol.ERR_PASSWORD_EMPTY
+	}
+	user, err := this.loadUser(bson.M{"username": userName})
+	if err == qmgo.ErrNoSuchDocuments {
+		return nil, protocol.ERR_ACC_AUTH
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !CheckPassword(user.Password, password) {
+		return nil, protocol.ERR_ACC_AUTH
+	}
+	err = user.CheckLogin()
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Refresh verify the refresh token,which must be the latest one issued to the user
+func (this *Account) Refresh(refreshToken string) (*User, error) {
+	identity, err := this.authenticator().AuthenticateRefresh([]byte(refreshToken))
+	if err != nil {
+		return nil, err
+	}
+	user, err := this.getUser(identity.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if user.RefreshToken == "" || user.RefreshToken != refreshToken {
+		return nil, protocol.ERR_TOKEN_VALIDATE
+	}
+	err = user.CheckLogin()
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// CreateAvatar create the avatar of the user on the server,one avatar per server
+func (this *Account) CreateAvatar(userId util.ID, gameId string, serverId int32, name string) (*User, *AvatarMap, error) {
+	if gameId == "" {
+		return nil, nil, protocol.ERR_PARAM_NOT_EXIST
+	}
+	user, err := this.getUser(userId)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = user.CheckLogin()
+	if err != nil {
+		return nil, nil, err
+	}
+	if has, _ := user.HasAvatarByServer(gameId, serverId); has {
+		return nil, nil, protocol.ERR_GAME_ACC_EXIST
+	}
+	mongo := this.GetProcess().GetMongo()
+	am := &AvatarMap{
+		Id:         this.GetProcess().GenId(),
+		UserId:     user.Id,
+		GameId:     gameId,
+		ServerId:   serverId,
+		UserName:   user.UserName,
+		AvatarName: name,
+		Version:    int32(this.Migrator.Version(AVATAR_MAP_COLLECTION)),
+	}
+	_, err = mongo.Collection(AVATAR_MAP_COLLECTION).InsertOne(context.TODO(), am)
+	if qmgo.IsDup(err) {
+		return nil, nil, protocol.ERR_GAME_ACC_EXIST
+	}
+	if err != nil {
+		log.Error(err.Error())
+		return nil, nil, protocol.ERR_GAME_ACC_CREATE_FAILED
+	}
+	key := ServerKey(gameId, serverId)
+	err = mongo.Collection(USER_COLLECTION).UpdateId(context.TODO(), user.Id, bson.M{"$set": bson.M{"avatars." + key: am.Id}})
+	if err != nil {
+		log.Error(err.Error())
+		return nil, nil, protocol.ERR_GAME_ACC_CREATE_FAILED
+	}
+	user.Avatars[key] = am.Id
+	log.Info("Account:CreateAvatar", UserId(user), flog.AvatarId(am.Id), flog.GameId(gameId), flog.ServerId(serverId))
+	return user, am, nil
+}
+
+// SetAccState set the account state for d,0 means forever,the refresh token is revoked for the frozen and forbidden accounts
+func (this *Account) SetAccState(userId util.ID, state AccState, d time.Duration) error {
+	set := bson.M{
+		"state":       state,
+		"stateexpire": int64(0),
+	}
+	if d > 0 {
+		set["stateexpire"] = time.Now().Add(d).Unix()
+	}
+	if state == ACC_FROST || state == ACC_FORBIDDEN {
+		set["refreshtoken"] = ""
+	}
+	err := this.GetProcess().GetMongo().Collection(USER_COLLECTION).UpdateId(context.TODO(), userId, bson.M{"$set": set})
+	if err == qmgo.ErrNoSuchDocuments {
+		return protocol.ERR_ACC_NOT_FIND
+	}
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	log.Info("Account:SetAccState", flog.UserId(userId), zap.Uint32("state", uint32(state)), zap.Duration("duration", d))
+	return nil
+}
+
+func (this *Account) getUser(id util.ID) (*User, error) {
+	user, err := this.loadUser(bson.M{"_id": id})
+	if err == qmgo.ErrNoSuchDocuments {
+		return nil, protocol.ERR_ACC_NOT_FIND
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// loadUser find the user migrated to the current version
+func (this *Account) loadUser(filter bson.M) (*User, error) {
+	user := &User{}
+	err := this.Migrator.Load(this.GetProcess().GetMongo().Collection(USER_COLLECTION), filter, user)
+	if err != nil {
+		if err != qmgo.ErrNoSuchDocuments {
+			log.Error(err.Error())
+		}
+		return nil, err
+	}
+	if user.Avatars == nil {
+		user.Avatars = map[string]util.ID{}
+	}
+	return user, nil
+}
+
+func (this *Account) authenticator() *JwtAuthenticator {
+	conf := this.GetProcess().Config()
+	key := conf.GetString("SigningKey")
+	if this.RSA {
+		key = conf.GetString("SigningKeyPublic")
+	}
+	ret := NewJwtAuthenticator(key, this.RSA)
+	ret.Creator = this.Creator
+	return ret
+}
+
+// issue sign the token and the refresh token,the refresh token is saved to revoke the older ones
+func (this *Account) issue(user *User) (string, string, error) {
+	a := this.GetProcess()
+	claim := user.ClaimUser()
+	token, err := SignToken(this.Creator, claim, a, TOKEN_EXPIRE_TIME, this.RSA)
+	if err != nil {
+		return "", "", err
+	}
+	refreshToken, err := SignRefreshToken(this.Creator, claim, a, this.RSA)
+	if err != nil {
+		return "", "", err
+	}
+	err = a.GetMongo().Collection(USER_COLLECTION).UpdateId(context.TODO(), user.Id, bson.M{"$set": bson.M{"token": token, "refreshtoken": refreshToken}})
+	if err != nil {
+		log.Error(err.Error())
+		return "", "", err
+	}
+	user.Token = token
+	user.RefreshToken = refreshToken
+	return token, refreshToken, nil
+}
+
+func (this *Account) writeUser(w rox.ResponseWriter, user *User) {
+	token, refreshToken, err := this.issue(user)
+	if err != nil {
+		accountFailed(w, err)
+		return
+	}
+	w.AddContent("token", token)
+	w.AddContent("refresh_token", refreshToken)
+	w.AddData("user_id", user.Id)
+	w.AddData("avatars", user.Avatars)
+	w.AddData("state", user.GetAccState())
+	w.OK()
+}
+
+func accountFailed(w rox.ResponseWriter, err error) {
+	if code, ok := err.(protocol.ErrCode); ok {
+		w.Failed(code)
+		return
+	}
+	log.Error(err.Error())
+	w.Failed(protocol.ERR_INTERNAL_SERVER)
+}
+
+func (this *Account) registerHandler(w rox.ResponseWriter, r *http.Request, a lokas.IProcess) {
+	user, err := this.Register(r.Form.Get("username"), r.Form.Get("password"))
+	if err != nil {
+		accountFailed(w, err)
+		return
+	}
+	this.writeUser(w, user)
+}
+
+func (this *Account) loginHandler(w rox.ResponseWriter, r *http.Request, a lokas.IProcess) {
+	user, err := this.Login(r.Form.Get("username"), r.Form.Get("password"))
+	if err != nil {
+		accountFailed(w, err)
+		return
+	}
+	this.writeUser(w, user)
+}
+
+func (this *Account) refreshHandler(w rox.ResponseWriter, r *http.Request, a lokas.IProcess) {
+	token := r.Form.Get("refresh_token")
+	if token == "" {
+		w.Failed(protocol.ERR_PARAM_NOT_EXIST)
+		return
+	}
+	user, err := this.Refresh(token)
+	if err != nil {
+		accountFailed(w, err)
+		return
+	}
+	this.writeUser(w, user)
+}
+
+func (this *Account) createAvatarHandler(w rox.ResponseWriter, r *http.Request, a lokas.IProcess) {
+	token := r.Header.Get("auth")
+	if token == "" {
+		token = r.Form.Get("auth")
+	}
+	identity, err := this.authenticator().Authenticate([]byte(token))
+	if err != nil {
+		accountFailed(w, err)
+		return
+	}
+	serverId, err := strconv.Atoi(r.Form.Get("server_id"))
+	if err != nil {
+		w.Failed(protocol.ERR_PARAM_TYPE)
+		return
+	}
+	user, am, err := this.CreateAvatar(identity.UserId, strings.TrimSpace(r.Form.Get("game_id")), int32(serverId), r.Form.Get("name"))
+	if err != nil {
+		accountFailed(w, err)
+		return
+	}
+	w.AddData("avatar_id", am.Id)
+	this.writeUser(w, user)
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/nomos/go-lokas/protocol"
 	"github.com/nomos/go-lokas/util"
 	"go.uber.org/zap"
+	"sync"
 	"time"
 )
 
@@ -38,10 +39,12 @@ type ActiveSession struct {
 	Protocol    protocol.TYPE
 	manager     lokas.ISessionManager
 	done        chan struct{}
+	doneMu      sync.Mutex
 	OnCloseFunc func(conn lokas.IConn)
 	OnOpenFunc  func(conn lokas.IConn)
 	OnVerified  func(conn lokas.IConn)
 	MsgHandler  func(msg *protocol.BinaryMessage)
+	Reliable    *ReliableLink
 	timeout     time.Duration
 	pingIndex   uint32
 }
@@ -163,14 +166,18 @@ func (this *ActiveSession) PongHandler(pong *protocol.Pong) {
 }
 
 func (this *ActiveSession) start() {
-	this.done = make(chan struct{})
+	done := make(chan struct{})
+	conn := this.Conn
+	this.doneMu.Lock()
+	this.done = done
+	this.doneMu.Unlock()
 	go func() {
 		ticker := time.NewTicker(this.timeout / 5)
 		defer func() {
 			ticker.Stop()
-			this.Conn.Close()
+			conn.Close()
 		}()
-		this.Conn.SetReadDeadline(time.Now().Add(this.timeout))
+		conn.SetReadDeadline(time.Now().Add(this.timeout))
 	Loop:
 		for {
 			select {
@@ -178,7 +185,7 @@ func (this *ActiveSession) start() {
 				ping := &protocol.Ping{Time: time.Now()}
 				this.pingIndex++
 				data, _ := protocol.MarshalMessage(this.pingIndex, ping, this.Protocol)
-				_, err := this.Conn.Write(data)
+				_, err := conn.Write(data)
 				if err != nil {
 					log.Error(err.Error())
 					break Loop
@@ -192,6 +199,20 @@ func (this *ActiveSession) start() {
 					)
 					return
 				}
+				if this.Reliable != nil {
+					msg, err = this.Reliable.Unwrap(msg, this.Protocol)
+					if err != nil {
+						log.Error(err.Error())
+						return
+					}
+					if ack := this.Reliable.PendingAck(this.Protocol); ack != nil {
+						conn.Write(ack)
+					}
+					if msg == nil {
+						continue
+					}
+					cmdId = msg.CmdId
+				}
 				if cmdId == protocol.TAG_Pong {
 					this.PongHandler(msg.Body.(*protocol.Pong))
 					continue
@@ -204,7 +225,7 @@ func (this *ActiveSession) start() {
 				//}
 				log.Infof("handleMsg", msg)
 				this.handleMsg(msg)
-			case <-this.done:
+			case <-done:
 				log.Warn("closing", flog.FuncInfo(this, "start")...)
 				this.closeSession()
 				break Loop
@@ -213,9 +234,13 @@ func (this *ActiveSession) start() {
 	}()
 }
 
+// stop end the loop started,called by both Disconnect and OnClose
 func (this *ActiveSession) stop() {
+	this.doneMu.Lock()
+	defer this.doneMu.Unlock()
 	if this.done != nil {
-		this.done <- struct{}{}
+		//closed instead of sent,the loop may have exited on a write error
+		close(this.done)
 		this.done = nil
 	}
 }
@@ -237,6 +237,9 @@ func (this *Actor) StartMessagePump() {
 			this.Sub.Drain()
 			this.Sub = nil
 		}
+		if this.process != nil {
+			this.process.UnsubscribeAllTopics(this.GetId())
+		}
 
 		close(this.MQChan)
 		this.MQChan = nil
@@ -541,6 +544,11 @@ func (this *Actor) Subscribe(key string) error {
 		return protocol.ERR_MQ_SUBJ_PREFIX_ERR
 	}
 
+	//未连接nats时使用内置的主题
+	if !mq.IsConnected() {
+		return this.process.SubscribeTopic(key, this.GetId())
+	}
+
 	if this.Sub == nil {
 		log.Warn("actor is not create subscriber", this.LogInfo().Append(zap.String("key", key))...)
 		return nil
@@ -556,6 +564,10 @@ func (this *Actor) Unsubscribe(key string) error {
 		return protocol.ERR_MQ_SUBJ_PREFIX_ERR
 	}
 
+	if !mq.IsConnected() {
+		return this.process.UnsubscribeTopic(key, this.GetId())
+	}
+
 	if this.Sub == nil {
 		log.Warn("actor is not create subscriber", this.LogInfo().Append(zap.String("key", key))...)
 		return nil
@@ -565,6 +577,9 @@ func (this *Actor) Unsubscribe(key string) error {
 }
 
 func (this *Actor) Publish(key string, msg protocol.ISerializable) error {
+	if !mq.IsConnected() {
+		return this.process.PublishTopic(this.GetId(), key, msg)
+	}
 	return mq.Publsih(key, msg)
 }
 
@@ -46,8 +46,21 @@ type Avatar struct {
 	ClientHost   string
 }
 
+// SendEvent send the message to the client by the current gate session
 func (this *Avatar) SendEvent(msg protocol.ISerializable) error {
-	return this.SendReply(this.AvatarSession.GateId, 0, msg)
+	gateId, gatePid := this.AvatarSession.GetGate()
+	if gatePid == 0 {
+		return this.SendReply(gateId, 0, msg)
+	}
+	_, err := msg.GetId()
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	routeMsg := protocol.NewRouteMessage(this.GetId(), gateId, 0, msg, true)
+	routeMsg.ToPid = gatePid
+	this.GetProcess().RouteMsg(routeMsg)
+	return nil
 }
 
 func (this *Avatar) handleMsg(actorId util.ID, transId uint32, msg protocol.ISerializable) (protocol.ISerializable, error) {
@@ -109,8 +122,23 @@ func (this *Avatar) OnUpdate() {
 
 	this.Updater(this, this.GetProcess())
 	if this.Dirty() {
-		this.Serialize(this.GetProcess())
+		this.save(false)
+	}
+}
+
+// save enqueue the components to the saver of the manager if configured,otherwise serialize synchronously
+func (this *Avatar) save(full bool) error {
+	if saver := this.saver(); saver != nil {
+		return saver.Save(this, full)
 	}
+	return this.Serialize(this.GetProcess())
+}
+
+func (this *Avatar) saver() *AvatarSaver {
+	if this.manager == nil {
+		return nil
+	}
+	return this.manager.Saver
 }
 
 // func (this *Avatar) Start() error {
@@ -145,7 +173,14 @@ func (this *Avatar) OnUpdate() {
 // }
 
 func (this *Avatar) Start() error {
-
+	//follow the gate session taken over by new logins
+	if this.GetProcess().GetEtcd() != nil {
+		err := this.AvatarSession.WatchAvatarSession(this.GetProcess())
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+	}
 	this.GetProcess().RegisterActorLocal(this)
 	this.GetProcess().RegisterActorRemote(this)
 	this.StartMessagePump()
@@ -156,11 +191,19 @@ func (this *Avatar) Stop() error {
 	this.Actor.Stop()
 	this.Dirty()
 	log.Warn("save player state", flog.AvatarId(this.GetId()))
-	err := this.Serialize(this.GetProcess())
+	err := this.save(true)
 	if err != nil {
 		log.Error(err.Error())
 		return err
 	}
+	//written before unregistered,so that the avatar loaded elsewhere reads the latest state
+	if saver := this.saver(); saver != nil {
+		err = saver.FlushId(this.GetId())
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+	}
 	this.RemoveAll()
 	this.GetProcess().UnregisterActorLocal(this)
 	this.GetProcess().UnregisterActorRemote(this)
@@ -13,6 +13,21 @@ const (
 	ACC_FORBIDDEN AccState = 9
 )
 
+func String2AccState(s string) (AccState, bool) {
+	switch s {
+	case "normal":
+		return ACC_NORMAL, true
+	case "mute":
+		return ACC_MUTE, true
+	case "frost":
+		return ACC_FROST, true
+	case "forbidden":
+		return ACC_FORBIDDEN, true
+	default:
+		return ACC_NORMAL, false
+	}
+}
+
 type AvatarMap struct {
 	Id         util.ID `bson:"_id"`
 	UserId     util.ID
@@ -20,4 +35,5 @@ type AvatarMap struct {
 	ServerId   int32
 	UserName   string
 	AvatarName string
+	Version    int32 `bson:"_v" json:"-"` //the schema version of the document,see Migrator
 }
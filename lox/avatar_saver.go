@@ -0,0 +1,551 @@
+package lox
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/log/flog"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+	"github.com/nomos/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+const AVATAR_COLLECTION = "avatar"
+
+// SaveEntry the snapshot of one component,saved as the field of the document with _id Id,
+// or as the whole document if Field is empty
+type SaveEntry struct {
+	Collection string   `bson:"collection"`
+	Id         util.ID  `bson:"id"`
+	Field      string   `bson:"field"`
+	Data       bson.Raw `bson:"data"`
+}
+
+type saveKey struct {
+	collection string
+	id         util.ID
+	field      string
+}
+
+func (this *SaveEntry) key() saveKey {
+	return saveKey{collection: this.Collection, id: this.Id, field: this.Field}
+}
+
+// SaveWriter write the entries of one collection,entries of the same document are written together
+type SaveWriter func(collection string, entries []*SaveEntry) error
+
+// MongoSaveWriter $set the fields of each document in one unordered bulk write,documents are upserted
+func MongoSaveWriter(db *qmgo.Database) SaveWriter {
+	return func(collection string, entries []*SaveEntry) error {
+		coll, err := db.Collection(collection).CloneCollection()
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		docs := map[util.ID]bson.M{}
+		ids := []util.ID{}
+		models := []mongo.WriteModel{}
+		for _, e := range entries {
+			//the whole document
+			if e.Field == "" {
+				models = append(models, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": e.Id}).SetReplacement(e.Data).SetUpsert(true))
+				continue
+			}
+			set, ok := docs[e.Id]
+			if !ok {
+				set = bson.M{}
+				docs[e.Id] = set
+				ids = append(ids, e.Id)
+			}
+			set[e.Field] = e.Data
+		}
+		for _, id := range ids {
+			models = append(models, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": id}).SetUpdate(bson.M{"$set": docs[id]}).SetUpsert(true))
+		}
+		_, err = coll.BulkWrite(context.TODO(), models, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		return nil
+	}
+}
+
+type SaverConfig struct {
+	Collection  string        //collection of the avatars
+	Workers     int           //entries of one document are always written by the same worker
+	Batch       int           //max entries of one write,a write is triggered once a worker has so many pending
+	Interval    time.Duration //pending entries are written at least once per interval
+	Retry       int           //times a failed write is retried before being put back to pending
+	Journal     string        //path of the journal,no journal if empty
+	JournalSize int64         //the journal is rewritten with the entries not written once larger
+	Sync        bool          //fsync the journal on each enqueue
+}
+
+// LoadSaverConfig read the saver section,nil if not configured
+func LoadSaverConfig(conf lokas.IConfig) *SaverConfig {
+	if !conf.IsSet("saver") {
+		return nil
+	}
+	return &SaverConfig{
+		Collection:  conf.GetString("saver.collection"),
+		Workers:     conf.GetInt("saver.workers"),
+		Batch:       conf.GetInt("saver.batch"),
+		Interval:    conf.GetDuration("saver.interval"),
+		Retry:       conf.GetInt("saver.retry"),
+		Journal:     conf.GetString("saver.journal"),
+		JournalSize: int64(conf.GetSizeInBytes("saver.journal_size")),
+		Sync:        conf.GetBool("saver.sync"),
+	}
+}
+
+type saverShard struct {
+	mu       sync.Mutex
+	pending  map[saveKey]*SaveEntry
+	inflight map[saveKey]*SaveEntry
+	notify   chan struct{}
+	flushReq chan chan error
+}
+
+// AvatarSaver write-behind saver of a process,the latest snapshot of a field wins,
+// entries are journaled before being queued so that they are written again after a crash
+type AvatarSaver struct {
+	Config  SaverConfig
+	Mapper  *ComponentMapper //snapshot the mapped components,required by Save so that the saver writes what the game serializer writes
+	writer  SaveWriter
+	shards  []*saverShard
+	jmu     sync.Mutex
+	journal *os.File
+	size    int64
+	wg      sync.WaitGroup
+	done    chan struct{}
+	started bool
+	stopped bool
+}
+
+func NewAvatarSaver(config SaverConfig, writer SaveWriter) *AvatarSaver {
+	if config.Collection == "" {
+		config.Collection = AVATAR_COLLECTION
+	}
+	if config.Workers <= 0 {
+		config.Workers = 4
+	}
+	if config.Batch <= 0 {
+		config.Batch = 100
+	}
+	if config.Interval <= 0 {
+		config.Interval = time.Second
+	}
+	if config.Retry < 0 {
+		config.Retry = 0
+	}
+	if config.JournalSize <= 0 {
+		config.JournalSize = 64 << 20
+	}
+	ret := &AvatarSaver{
+		Config: config,
+		writer: writer,
+		done:   make(chan struct{}),
+	}
+	for i := 0; i < config.Workers; i++ {
+		ret.shards = append(ret.shards, &saverShard{
+			pending:  map[saveKey]*SaveEntry{},
+			inflight: map[saveKey]*SaveEntry{},
+			notify:   make(chan struct{}, 1),
+			flushReq: make(chan chan error),
+		})
+	}
+	return ret
+}
+
+func (this *AvatarSaver) SetWriter(writer SaveWriter) {
+	this.writer = writer
+}
+
+// Start replay the journal and start the workers
+func (this *AvatarSaver) Start() error {
+	this.jmu.Lock()
+	defer this.jmu.Unlock()
+	if this.started {
+		return nil
+	}
+	if this.Config.Journal != "" {
+		err := this.openJournal()
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+	}
+	this.started = true
+	for _, shard := range this.shards {
+		this.wg.Add(1)
+		go this.work(shard)
+	}
+	return nil
+}
+
+// Stop write all the pending entries,the entries failed are kept in the journal
+func (this *AvatarSaver) Stop() error {
+	this.jmu.Lock()
+	if !this.started || this.stopped {
+		this.jmu.Unlock()
+		return nil
+	}
+	this.stopped = true
+	this.jmu.Unlock()
+	close(this.done)
+	this.wg.Wait()
+	var err error
+	if this.Pending() > 0 {
+		err = protocol.ERR_DB_ERROR
+		log.Error("saver stopped with entries not written", zap.Int("pending", this.Pending()))
+	}
+	this.jmu.Lock()
+	defer this.jmu.Unlock()
+	if this.journal != nil {
+		this.journal.Close()
+		this.journal = nil
+	}
+	return err
+}
+
+// Save snapshot the entity by the Mapper and enqueue the entries
+func (this *AvatarSaver) Save(entity lokas.IEntity, full bool) error {
+	if this.Mapper == nil {
+		return protocol.ERR_SAVER_NO_MAPPER
+	}
+	entries, err := this.Mapper.Snapshot(entity, full)
+	if err != nil {
+		return err
+	}
+	return this.Enqueue(entries...)
+}
+
+// Enqueue journal the entries and queue them for the workers
+func (this *AvatarSaver) Enqueue(entries ...*SaveEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	this.jmu.Lock()
+	defer this.jmu.Unlock()
+	if this.stopped {
+		return protocol.ERR_SAVER_STOPPED
+	}
+	if this.journal != nil {
+		err := this.appendJournal(entries)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+	}
+	for _, e := range entries {
+		shard := this.shard(e.Id)
+		shard.mu.Lock()
+		shard.pending[e.key()] = e
+		full := len(shard.pending) >= this.Config.Batch
+		shard.mu.Unlock()
+		if full {
+			select {
+			case shard.notify <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+// Flush write all the entries enqueued before
+func (this *AvatarSaver) Flush() error {
+	this.jmu.Lock()
+	started := this.started
+	this.jmu.Unlock()
+	if !started {
+		return nil
+	}
+	var ret error
+	for _, shard := range this.shards {
+		err := this.flush(shard)
+		if err == protocol.ERR_SAVER_STOPPED {
+			return err
+		}
+		if err != nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+// FlushId write the entries of the document id enqueued before,with the others of the same worker
+func (this *AvatarSaver) FlushId(id util.ID) error {
+	this.jmu.Lock()
+	started := this.started
+	this.jmu.Unlock()
+	if !started {
+		return nil
+	}
+	return this.flush(this.shard(id))
+}
+
+func (this *AvatarSaver) flush(shard *saverShard) error {
+	ch := make(chan error, 1)
+	select {
+	case shard.flushReq <- ch:
+	case <-this.done:
+		return protocol.ERR_SAVER_STOPPED
+	}
+	return <-ch
+}
+
+// Pending the count of entries not written
+func (this *AvatarSaver) Pending() int {
+	ret := 0
+	for _, shard := range this.shards {
+		shard.mu.Lock()
+		ret += len(shard.pending) + len(shard.inflight)
+		shard.mu.Unlock()
+	}
+	return ret
+}
+
+func (this *AvatarSaver) shard(id util.ID) *saverShard {
+	return this.shards[uint64(id)%uint64(len(this.shards))]
+}
+
+func (this *AvatarSaver) work(shard *saverShard) {
+	defer this.wg.Done()
+	ticker := time.NewTicker(this.Config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shard.notify:
+			this.write(shard, true)
+		case <-ticker.C:
+			this.write(shard, false)
+		case ch := <-shard.flushReq:
+			ch <- this.write(shard, false)
+		case <-this.done:
+			this.write(shard, false)
+			return
+		}
+	}
+}
+
+// write the pending entries of the shard batch by batch,only the full batches if onlyFull
+func (this *AvatarSaver) write(shard *saverShard, onlyFull bool) error {
+	for {
+		batch := this.take(shard, onlyFull)
+		if len(batch) == 0 {
+			return nil
+		}
+		err := this.writeBatch(batch)
+		shard.mu.Lock()
+		for _, e := range batch {
+			delete(shard.inflight, e.key())
+			if err != nil {
+				//newer snapshots enqueued meanwhile win
+				if _, ok := shard.pending[e.key()]; !ok {
+					shard.pending[e.key()] = e
+				}
+			}
+		}
+		shard.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		this.compact()
+	}
+}
+
+func (this *AvatarSaver) take(shard *saverShard, onlyFull bool) []*SaveEntry {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if onlyFull && len(shard.pending) < this.Config.Batch {
+		return nil
+	}
+	ret := make([]*SaveEntry, 0, this.Config.Batch)
+	for k, e := range shard.pending {
+		if len(ret) >= this.Config.Batch {
+			break
+		}
+		delete(shard.pending, k)
+		shard.inflight[k] = e
+		ret = append(ret, e)
+	}
+	return ret
+}
+
+func (this *AvatarSaver) writeBatch(batch []*SaveEntry) error {
+	colls := map[string][]*SaveEntry{}
+	for _, e := range batch {
+		colls[e.Collection] = append(colls[e.Collection], e)
+	}
+	for coll, entries := range colls {
+		var err error
+		delay := time.Millisecond * 100
+		for i := 0; i <= this.Config.Retry; i++ {
+			if i > 0 {
+				time.Sleep(delay)
+				if delay *= 2; delay > this.Config.Interval {
+					delay = this.Config.Interval
+				}
+			}
+			if this.writer == nil {
+				err = protocol.ERR_DB_ERROR
+				continue
+			}
+			err = this.writer(coll, entries)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			log.Error("save avatars failed", zap.String("collection", coll), zap.Int("count", len(entries)), flog.Error(err))
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *AvatarSaver) openJournal() error {
+	f, err := os.OpenFile(this.Config.Journal, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	var offset int64
+	replayed := 0
+	for {
+		raw, err := bson.NewFromIOReader(r)
+		if err != nil {
+			if err != io.EOF {
+				log.Warn("journal truncated", zap.String("journal", this.Config.Journal), zap.Int64("offset", offset), flog.Error(err))
+			}
+			break
+		}
+		e := &SaveEntry{}
+		err = bson.Unmarshal(raw, e)
+		if err != nil {
+			log.Warn("journal truncated", zap.String("journal", this.Config.Journal), zap.Int64("offset", offset), flog.Error(err))
+			break
+		}
+		offset += int64(len(raw))
+		shard := this.shard(e.Id)
+		shard.pending[e.key()] = e
+		replayed++
+	}
+	//drop the partial entry written by a crash
+	err = f.Truncate(offset)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if replayed > 0 {
+		log.Warn("journal replayed", zap.String("journal", this.Config.Journal), zap.Int("count", replayed))
+	}
+	this.journal = f
+	this.size = offset
+	return nil
+}
+
+func (this *AvatarSaver) appendJournal(entries []*SaveEntry) error {
+	buf := []byte{}
+	for _, e := range entries {
+		data, err := bson.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, data...)
+	}
+	_, err := this.journal.Write(buf)
+	if err != nil {
+		return err
+	}
+	this.size += int64(len(buf))
+	if this.Config.Sync {
+		return this.journal.Sync()
+	}
+	return nil
+}
+
+// compact truncate the journal once all the entries are written,
+// or rewrite it with the entries not written when it grows too large
+func (this *AvatarSaver) compact() {
+	this.jmu.Lock()
+	defer this.jmu.Unlock()
+	if this.journal == nil || this.size == 0 {
+		return
+	}
+	left := []*SaveEntry{}
+	for _, shard := range this.shards {
+		shard.mu.Lock()
+		for _, e := range shard.inflight {
+			if _, ok := shard.pending[e.key()]; !ok {
+				left = append(left, e)
+			}
+		}
+		for _, e := range shard.pending {
+			left = append(left, e)
+		}
+		shard.mu.Unlock()
+	}
+	if len(left) > 0 && this.size < this.Config.JournalSize {
+		return
+	}
+	err := this.rewriteJournal(left)
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
+
+func (this *AvatarSaver) rewriteJournal(entries []*SaveEntry) error {
+	if len(entries) == 0 {
+		err := this.journal.Truncate(0)
+		if err != nil {
+			return err
+		}
+		_, err = this.journal.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		this.size = 0
+		return nil
+	}
+	tmp := this.Config.Journal + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	old, size := this.journal, this.size
+	this.journal = f
+	this.size = 0
+	err = this.appendJournal(entries)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, this.Config.Journal)
+	}
+	if err != nil {
+		this.journal, this.size = old, size
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	old.Close()
+	return nil
+}
@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"errors"
 	"github.com/nomos/go-lokas/log/flog"
+	"sync"
 
 	"github.com/nomos/go-lokas"
 	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/protocol"
 	"github.com/nomos/go-lokas/util"
 	"go.etcd.io/etcd/api/v3/mvccpb"
 	clientv3 "go.etcd.io/etcd/client/v3"
@@ -26,11 +28,13 @@ type AvatarSession struct {
 	Id               util.ID
 	UserId           util.ID
 	GateId           util.ID
+	GatePid          util.ProcessId //process of the gate session,0 if unknown
 	UserName         string
 	GameId           string
 	ServerId         int32
 	watchChan        clientv3.WatchChan `bson:"-",json:"-"`
-	done             chan struct{}      `bson:"-",json:"-"`
+	cancelWatch      context.CancelFunc
+	gateMu           sync.RWMutex
 	onGateWayChanged func(session *AvatarSession)
 	onSessionClosed  func()
 }
@@ -63,60 +67,139 @@ func (this *AvatarSession) ChangeUserName(a lokas.IProcess, name string) error {
 	return nil
 }
 
+// StartAvatarSession watch the gate changes of the session until StopAvatarSession or the key is deleted
 func (this *AvatarSession) StartAvatarSession() {
+	watchChan := this.watchChan
 	go func() {
-		if this.watchChan == nil {
+		if watchChan == nil {
 			if this.onSessionClosed != nil {
 				log.Errorf("AvatarSession:onSessionClosed")
 				this.onSessionClosed()
 			}
 			return
 		}
-		this.done = make(chan struct{})
 	Loop:
 		for {
-			select {
-			case msg := <-this.watchChan:
-				for _, e := range msg.Events {
-					switch e.Type {
-					case mvccpb.PUT:
-						sess := NewAvatarSession(0)
-						err := json.Unmarshal(e.Kv.Value, sess)
-						if err != nil {
-							log.Error(err.Error())
-							break Loop
-						}
-						if sess.GateId != this.GateId {
-							if this.onGateWayChanged != nil {
-								this.onGateWayChanged(sess)
-							}
-						}
-					case mvccpb.DELETE:
+			msg, ok := <-watchChan
+			if !ok || msg.Canceled {
+				break Loop
+			}
+			for _, e := range msg.Events {
+				switch e.Type {
+				case mvccpb.PUT:
+					sess := NewAvatarSession(0)
+					err := json.Unmarshal(e.Kv.Value, sess)
+					if err != nil {
+						log.Error(err.Error())
 						break Loop
 					}
+					if sess.GateId != this.GetGateId() {
+						log.Info("avatar gate changed", flog.AvatarId(this.Id), zap.Int64("gate", sess.GateId.Int64()), zap.Uint16("gate_pid", uint16(sess.GatePid)))
+						this.SetGate(sess.GateId, sess.GatePid)
+						if this.onGateWayChanged != nil {
+							this.onGateWayChanged(sess)
+						}
+					}
+				case mvccpb.DELETE:
+					break Loop
 				}
-			case <-this.done:
-				break Loop
 			}
 		}
 		if this.onSessionClosed != nil {
 			this.onSessionClosed()
 		}
-		if this.done != nil {
-			close(this.done)
-			this.done = nil
-		}
-		if this.watchChan != nil {
-			this.watchChan = nil
-		}
 	}()
 }
 
 func (this *AvatarSession) StopAvatarSession() {
 	log.Warn("AvatarSession StopAvatarSession")
-	if this.done != nil {
-		this.done <- struct{}{}
+	if this.cancelWatch != nil {
+		this.cancelWatch()
+	}
+}
+
+// watch the key after the revision,the previous watch is cancelled
+func (this *AvatarSession) watch(a lokas.IProcess, key string, rev int64) {
+	if this.cancelWatch != nil {
+		this.cancelWatch()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	this.cancelWatch = cancel
+	this.watchChan = a.GetEtcd().Watch(ctx, key, clientv3.WithRev(rev))
+}
+
+// WatchAvatarSession load the gate of the session and start watching the gate changes,
+// the session of a new login replaces the gate
+func (this *AvatarSession) WatchAvatarSession(a lokas.IProcess) error {
+	key := AVATAR_SESSION_KEY.Assemble(this.Id)
+	res, err := a.GetEtcd().Get(context.TODO(), key)
+	if err != nil {
+		log.Error(err.Error())
+		return err
 	}
+	if len(res.Kvs) > 0 {
+		sess := NewAvatarSession(0)
+		err = json.Unmarshal(res.Kvs[0].Value, sess)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		this.SetGate(sess.GateId, sess.GatePid)
+		if this.UserId == 0 {
+			this.UserId = sess.UserId
+		}
+	}
+	this.watch(a, key, res.Header.Revision+1)
+	this.StartAvatarSession()
+	return nil
+}
+
+// TakeoverAvatarSession bind the avatar to the gate session atomically,
+// return the session replaced,nil if the avatar was not bound
+func TakeoverAvatarSession(a lokas.IProcess, avatarId util.ID, userId util.ID, gateId util.ID, gatePid util.ProcessId) (*AvatarSession, error) {
+	etcd := a.GetEtcd()
+	key := AVATAR_SESSION_KEY.Assemble(avatarId)
+	for i := 0; i < 5; i++ {
+		res, err := etcd.Get(context.TODO(), key)
+		if err != nil {
+			log.Error(err.Error())
+			return nil, err
+		}
+		sess := NewAvatarSession(avatarId)
+		var old *AvatarSession
+		cmp := clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+		if len(res.Kvs) > 0 {
+			old = NewAvatarSession(0)
+			err = json.Unmarshal(res.Kvs[0].Value, old)
+			if err != nil {
+				log.Error(err.Error())
+				return nil, err
+			}
+			sess.UserName = old.UserName
+			sess.GameId = old.GameId
+			sess.ServerId = old.ServerId
+			cmp = clientv3.Compare(clientv3.ModRevision(key), "=", res.Kvs[0].ModRevision)
+		}
+		sess.UserId = userId
+		sess.GateId = gateId
+		sess.GatePid = gatePid
+		data, err := json.Marshal(sess)
+		if err != nil {
+			log.Error(err.Error())
+			return nil, err
+		}
+		txn, err := etcd.Txn(context.TODO()).If(cmp).Then(clientv3.OpPut(key, string(data))).Commit()
+		if err != nil {
+			log.Error(err.Error())
+			return nil, err
+		}
+		if txn.Succeeded {
+			return old, nil
+		}
+		//another login took over meanwhile
+	}
+	log.Error("takeover avatar session failed", flog.AvatarId(avatarId))
+	return nil, protocol.ERR_ETCD_ERROR
 }
 
 func (this *AvatarSession) GetGameId() string {
@@ -128,9 +211,25 @@ func (this *AvatarSession) GetServerId() int32 {
 }
 
 func (this *AvatarSession) GetGateId() util.ID {
+	this.gateMu.RLock()
+	defer this.gateMu.RUnlock()
 	return this.GateId
 }
 
+// GetGate return the gate session and its process
+func (this *AvatarSession) GetGate() (util.ID, util.ProcessId) {
+	this.gateMu.RLock()
+	defer this.gateMu.RUnlock()
+	return this.GateId, this.GatePid
+}
+
+func (this *AvatarSession) SetGate(id util.ID, pid util.ProcessId) {
+	this.gateMu.Lock()
+	defer this.gateMu.Unlock()
+	this.GateId = id
+	this.GatePid = pid
+}
+
 func (this *AvatarSession) GetUserId() util.ID {
 	return this.UserId
 }
@@ -182,7 +281,7 @@ func (this *AvatarSession) Deserialize(a lokas.IProcess) error {
 	this.UserName = sess.UserName
 	this.GameId = sess.GameId
 	this.ServerId = sess.ServerId
-	this.GateId = sess.GateId
+	this.SetGate(sess.GateId, sess.GatePid)
 	log.Warn("AvatarSession Deserialize", lokas.LogAvatarSessionInfo(this).Append(zap.Any("res", res.Kvs))...)
 	return nil
 }
@@ -207,6 +306,8 @@ func (this *AvatarSession) FetchData(a lokas.IProcess) error {
 }
 
 func (this *AvatarSession) SetGateId(id util.ID) {
+	this.gateMu.Lock()
+	defer this.gateMu.Unlock()
 	this.GateId = id
 }
 
@@ -229,6 +330,6 @@ func (this *AvatarSession) Serialize(a lokas.IProcess) error {
 		log.Error(err.Error())
 		return err
 	}
-	this.watchChan = etcd.Watch(context.TODO(), key, clientv3.WithRev(res.Header.Revision))
+	this.watch(a, key, res.Header.Revision)
 	return nil
 }
@@ -50,6 +50,8 @@ type AvatarManager struct {
 	Avatars   map[util.ID]*Avatar
 	AvatarCnt int32
 	Option    lokas.IGameHandler
+	Saver     *AvatarSaver //write-behind saver of the avatars,nil to serialize synchronously,its Mapper must be set before started
+	Migrator  *Migrator    //migrate the avatar maps lazily on load,nil if none
 	Mu        sync.Mutex
 	Ctx       context.Context
 	Cancel    context.CancelFunc
@@ -94,7 +96,7 @@ func (this *AvatarManager) CreateAvatar(id util.ID) error {
 
 	a := this.GetProcess()
 	var am AvatarMap
-	err := a.GetMongo().Collection("avatarmap").Find(context.TODO(), bson.M{"_id": id}).One(&am)
+	err := this.Migrator.Load(a.GetMongo().Collection(AVATAR_MAP_COLLECTION), bson.M{"_id": id}, &am)
 	if err != nil {
 		log.Error(err.Error())
 		return err
@@ -122,6 +124,12 @@ func (this *AvatarManager) CreateAvatar(id util.ID) error {
 		avatar.Stop()
 		return err
 	}
+	if inbox, ok := this.GetProcess().Get(InboxCtor.Type()).(*Inbox); ok {
+		err = inbox.Deliver(avatar)
+		if err != nil {
+			log.Error("deliver inbox failed", flog.AvatarId(id), flog.Error(err))
+		}
+	}
 	log.Info("CreateAvatar", flog.AvatarId(id), flog.UserName(avatar.UserName), flog.ServerId(avatar.ServerId))
 	this.Avatars[id] = avatar
 	atomic.AddInt32(&this.AvatarCnt, 1)
@@ -148,6 +156,9 @@ func (this *AvatarManager) RemoveAvatar(id util.ID) {
 }
 
 func (this *AvatarManager) Load(conf lokas.IConfig) error {
+	if config := LoadSaverConfig(conf); config != nil {
+		this.Saver = NewAvatarSaver(*config, nil)
+	}
 	return nil
 }
 
@@ -156,6 +167,19 @@ func (this *AvatarManager) Unload() error {
 }
 
 func (this *AvatarManager) Start() error {
+	if this.Saver != nil {
+		//the snapshots must be what the serializer of the game handler writes
+		if this.Saver.Mapper == nil {
+			log.Error(protocol.ERR_SAVER_NO_MAPPER.Error())
+			return protocol.ERR_SAVER_NO_MAPPER
+		}
+		this.Saver.SetWriter(MongoSaveWriter(this.GetProcess().GetMongo()))
+		err := this.Saver.Start()
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+	}
 	this.StartMessagePump()
 	return nil
 }
@@ -168,6 +192,13 @@ func (this *AvatarManager) Stop() error {
 			log.Error(err.Error())
 		}
 	}
+	//flush the snapshots of the avatars stopped
+	if this.Saver != nil {
+		saveErr := this.Saver.Stop()
+		if saveErr != nil {
+			err = saveErr
+		}
+	}
 	this.Cancel()
 	if err != nil {
 		log.Error(err.Error())
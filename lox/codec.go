@@ -0,0 +1,273 @@
+package lox
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"reflect"
+	"sync"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/network/codec"
+	"github.com/nomos/go-lokas/protocol"
+)
+
+// CodecOffer sent by the client right after connected,before any other message
+type CodecOffer struct {
+	Compress  []string //supported compressions in the order of preference
+	Threshold int32    //compress the packets not smaller,0 means default
+	PublicKey []byte   //x25519 public key,empty for no encryption
+}
+
+func (this *CodecOffer) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *CodecOffer) Serializable() protocol.ISerializable {
+	return this
+}
+
+// CodecAccept the codec chosen by the gate,both sides switch to it after this message
+type CodecAccept struct {
+	Compress  string
+	Threshold int32
+	PublicKey []byte //x25519 public key of the gate,empty if not encrypted
+	Signature []byte //both the public keys signed by the SignKey of the gate
+}
+
+func (this *CodecAccept) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *CodecAccept) Serializable() protocol.ISerializable {
+	return this
+}
+
+// CodecConfig the codecs allowed by the gate
+type CodecConfig struct {
+	Compress  []string //allowed compressions,none if empty
+	Threshold int
+	Encrypt   bool               //encrypt the connection if the client offers a key
+	Require   bool               //reject the clients not offering encryption
+	SignKey   ed25519.PrivateKey //sign the key exchange,the clients verify it with the public key,required by Encrypt
+}
+
+// LoadCodecConfig read codec.compress,codec.threshold,codec.encrypt,codec.require and codec.sign_key,
+// the base64 ed25519 seed,nil if not configured
+func LoadCodecConfig(conf lokas.IConfig) (*CodecConfig, error) {
+	if !conf.IsSet("codec") {
+		return nil, nil
+	}
+	ret := &CodecConfig{
+		Compress:  conf.GetStringSlice("codec.compress"),
+		Threshold: conf.GetInt("codec.threshold"),
+		Encrypt:   conf.GetBool("codec.encrypt"),
+		Require:   conf.GetBool("codec.require"),
+	}
+	if ret.Threshold <= 0 {
+		ret.Threshold = codec.DefaultThreshold
+	}
+	if s := conf.GetString("codec.sign_key"); s != "" {
+		seed, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			log.Error("codec sign_key invalid")
+			return nil, protocol.ERR_CONFIG_ERROR
+		}
+		ret.SignKey = ed25519.NewKeyFromSeed(seed)
+	}
+	if (ret.Encrypt || ret.Require) && ret.SignKey == nil {
+		log.Error("codec encrypt needs sign_key")
+		return nil, protocol.ERR_CONFIG_ERROR
+	}
+	return ret, nil
+}
+
+// Accept choose the codec for the offer,the first compression of the client allowed by the gate is used
+func (this *CodecConfig) Accept(offer *CodecOffer) (*CodecAccept, *codec.Codec, error) {
+	accept := &CodecAccept{Threshold: int32(this.Threshold)}
+	if offer.Threshold > 0 {
+		accept.Threshold = offer.Threshold
+	}
+pick:
+	for _, c := range offer.Compress {
+		for _, allowed := range this.Compress {
+			if c == allowed && codec.Pick([]string{c}) == c {
+				accept.Compress = c
+				break pick
+			}
+		}
+	}
+	var send, recv []byte
+	if this.Encrypt && len(offer.PublicKey) > 0 {
+		if this.SignKey == nil {
+			log.Error("codec sign key not set")
+			return nil, nil, protocol.ERR_CODEC_FAILED
+		}
+		pair, err := codec.GenerateKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		send, recv, err = pair.SessionKeys(offer.PublicKey, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		accept.PublicKey = pair.Public
+		accept.Signature = codec.SignExchange(this.SignKey, offer.PublicKey, pair.Public)
+	} else if this.Require {
+		return nil, nil, protocol.ERR_CODEC_FAILED
+	}
+	if accept.Compress == codec.COMPRESS_NONE && send == nil {
+		return accept, nil, nil
+	}
+	c, err := codec.New(accept.Compress, int(accept.Threshold), send, recv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return accept, c, nil
+}
+
+type codecSwitcher interface {
+	SwitchCodec(data []byte, c lokas.PacketCodec) error
+}
+
+// acceptCodec reply the offer and switch the connection to the chosen codec
+func (this *PassiveSession) acceptCodec(transId uint32, offer *CodecOffer) error {
+	if this.Codec == nil {
+		this.Codec = &CodecConfig{}
+	}
+	accept, c, err := this.Codec.Accept(offer)
+	if err != nil {
+		return err
+	}
+	data, err := protocol.MarshalMessage(transId, accept, this.Protocol)
+	if err != nil {
+		return err
+	}
+	switcher, ok := this.GetConn().(codecSwitcher)
+	if !ok {
+		if c != nil {
+			return protocol.ERR_CODEC_FAILED
+		}
+		return this.write(data)
+	}
+	if c == nil {
+		return switcher.SwitchCodec(data, nil)
+	}
+	err = switcher.SwitchCodec(data, c)
+	if err != nil {
+		return err
+	}
+	this.encrypted = c.Encrypted()
+	return nil
+}
+
+// clientCodec the negotiation state of a client,the codec is installed by the read loop on CodecAccept,
+// so that the packets following the accept are decoded by it
+type clientCodec struct {
+	mu        sync.Mutex
+	key       *codec.KeyPair
+	serverKey ed25519.PublicKey //verify the key exchange signed by the gate
+	pending   bool
+}
+
+func (this *clientCodec) offer(compress []string, threshold int, serverKey ed25519.PublicKey) (*CodecOffer, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	ret := &CodecOffer{
+		Compress:  compress,
+		Threshold: int32(threshold),
+	}
+	this.key = nil
+	this.serverKey = serverKey
+	if serverKey != nil {
+		pair, err := codec.GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		this.key = pair
+		ret.PublicKey = pair.Public
+	}
+	this.pending = true
+	return ret, nil
+}
+
+// accept return the negotiated codec if data is the CodecAccept of a pending offer
+func (this *clientCodec) accept(data []byte, p protocol.TYPE) (*codec.Codec, bool) {
+	if protocol.GetCmdId16(data) != TAG_CODEC_ACCEPT {
+		return nil, false
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if !this.pending {
+		return nil, false
+	}
+	this.pending = false
+	msg, err := protocol.UnmarshalMessage(data, p)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, false
+	}
+	accept, ok := msg.Body.(*CodecAccept)
+	if !ok {
+		return nil, false
+	}
+	var send, recv []byte
+	if len(accept.PublicKey) > 0 {
+		if this.key == nil {
+			log.Error("codec key not offered")
+			return nil, false
+		}
+		if !codec.VerifyExchange(this.serverKey, this.key.Public, accept.PublicKey, accept.Signature) {
+			log.Error("codec key exchange not signed by the gate")
+			return nil, false
+		}
+		send, recv, err = this.key.SessionKeys(accept.PublicKey, false)
+		if err != nil {
+			log.Error(err.Error())
+			return nil, false
+		}
+	}
+	if accept.Compress == codec.COMPRESS_NONE && send == nil {
+		return nil, true
+	}
+	c, err := codec.New(accept.Compress, int(accept.Threshold), send, recv)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, false
+	}
+	return c, true
+}
+
+func (this *clientCodec) cancel() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.pending = false
+}
+
+// negotiate send the offer by call and wait for the accept,no other message should be sent meanwhile,
+// encrypt needs the public key of the gate to verify the key exchange,the connection should be closed if failed
+func (this *clientCodec) negotiate(call func(req interface{}) (interface{}, error), compress []string, threshold int, encrypt bool, serverKey ed25519.PublicKey) error {
+	if !encrypt {
+		serverKey = nil
+	} else if len(serverKey) != ed25519.PublicKeySize {
+		log.Error("codec server key not set")
+		return protocol.ERR_CODEC_FAILED
+	}
+	offer, err := this.offer(compress, threshold, serverKey)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	resp, err := call(offer)
+	if err != nil {
+		this.cancel()
+		log.Error(err.Error())
+		return err
+	}
+	accept, ok := resp.(*CodecAccept)
+	if !ok || encrypt && !codec.VerifyExchange(serverKey, offer.PublicKey, accept.PublicKey, accept.Signature) {
+		log.Error("codec not accepted")
+		return protocol.ERR_CODEC_FAILED
+	}
+	return nil
+}
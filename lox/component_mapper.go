@@ -0,0 +1,286 @@
+package lox
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/log/flog"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.uber.org/zap"
+)
+
+// COMPONENT_VERSION the schema version stored in each component document
+const COMPONENT_VERSION = "_v"
+
+// ComponentMigration upgrade the component document by one version in place
+type ComponentMigration func(doc bson.M) error
+
+// ComponentMapper map the components of an entity to mongo,each component is a sub-document named by
+// the component name in the document with _id of the entity,or a document of its own collection,
+// only the dirty components are written
+type ComponentMapper struct {
+	Collection  string
+	tags        []protocol.BINARY_TAG
+	collections map[protocol.BINARY_TAG]string
+	migrations  map[protocol.BINARY_TAG][]ComponentMigration
+}
+
+func NewComponentMapper(collection string) *ComponentMapper {
+	if collection == "" {
+		collection = AVATAR_COLLECTION
+	}
+	return &ComponentMapper{
+		Collection:  collection,
+		tags:        []protocol.BINARY_TAG{},
+		collections: map[protocol.BINARY_TAG]string{},
+		migrations:  map[protocol.BINARY_TAG][]ComponentMigration{},
+	}
+}
+
+// Register map the component types,they are created with defaults on load if missing
+func (this *ComponentMapper) Register(tags ...protocol.BINARY_TAG) *ComponentMapper {
+	for _, tag := range tags {
+		if _, err := protocol.GetTypeRegistry().GetTypeByTag(tag); err != nil {
+			log.Panic("component type not registered", zap.Uint16("tag", uint16(tag)))
+		}
+		if !this.IsMapped(tag) {
+			this.tags = append(this.tags, tag)
+		}
+	}
+	return this
+}
+
+// RegisterSeparate map the component to a collection of its own
+func (this *ComponentMapper) RegisterSeparate(tag protocol.BINARY_TAG, collection string) *ComponentMapper {
+	this.Register(tag)
+	this.collections[tag] = collection
+	return this
+}
+
+// RegisterMigration append the migration from the current version of the component,
+// the version of a component is the count of its migrations
+func (this *ComponentMapper) RegisterMigration(tag protocol.BINARY_TAG, migration ComponentMigration) *ComponentMapper {
+	this.migrations[tag] = append(this.migrations[tag], migration)
+	return this
+}
+
+func (this *ComponentMapper) IsMapped(tag protocol.BINARY_TAG) bool {
+	for _, t := range this.tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *ComponentMapper) Version(tag protocol.BINARY_TAG) int {
+	return len(this.migrations[tag])
+}
+
+// Field the field name of the component,empty if it is stored in a collection of its own
+func (this *ComponentMapper) Field(tag protocol.BINARY_TAG) string {
+	if _, ok := this.collections[tag]; ok {
+		return ""
+	}
+	return protocol.GetTypeRegistry().GetTagName(tag)
+}
+
+func (this *ComponentMapper) collection(tag protocol.BINARY_TAG) string {
+	if coll, ok := this.collections[tag]; ok {
+		return coll
+	}
+	return this.Collection
+}
+
+// Snapshot marshal the dirty mapped components,all of them if full,the dirty marks are cleared
+func (this *ComponentMapper) Snapshot(entity lokas.IEntity, full bool) ([]*SaveEntry, error) {
+	ret := []*SaveEntry{}
+	for _, tag := range this.tags {
+		c := entity.Get(tag)
+		if c == nil || !full && !c.Dirty() {
+			continue
+		}
+		data, err := this.marshal(tag, c)
+		if err != nil {
+			log.Error(err.Error())
+			return nil, err
+		}
+		ret = append(ret, &SaveEntry{
+			Collection: this.collection(tag),
+			Id:         entity.GetId(),
+			Field:      this.Field(tag),
+			Data:       data,
+		})
+	}
+	entity.SetDirty(false)
+	return ret, nil
+}
+
+// marshal the component with its schema version
+func (this *ComponentMapper) marshal(tag protocol.BINARY_TAG, c lokas.IComponent) (bson.Raw, error) {
+	data, err := bson.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	data = bsoncore.AppendInt32Element(data[:len(data)-1], COMPONENT_VERSION, int32(this.Version(tag)))
+	data = append(data, 0)
+	binary.LittleEndian.PutUint32(data, uint32(len(data)))
+	return data, nil
+}
+
+// Decode set the components from their documents keyed by the component names,
+// the documents are migrated to the current versions,the missing components are created with defaults,
+// the components migrated or created stay dirty so that they are written back
+func (this *ComponentMapper) Decode(entity lokas.IEntity, docs map[string]bson.Raw) error {
+	for _, tag := range this.tags {
+		name := protocol.GetTypeRegistry().GetTagName(tag)
+		doc, ok := docs[name]
+		if !ok {
+			if entity.Get(tag) == nil {
+				entity.GetOrCreate(tag)
+			}
+			continue
+		}
+		doc, migrated, err := this.migrate(tag, doc)
+		if err != nil {
+			log.Error("migrate component failed", flog.ActorId(entity.GetId()), zap.String("component", name), flog.Error(err))
+			return err
+		}
+		s, err := protocol.GetTypeRegistry().GetInterfaceByTag(tag)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		c, ok := s.(lokas.IComponent)
+		if !ok {
+			log.Error("not a component", zap.String("component", name))
+			return protocol.ERR_TYPE_NOT_FOUND
+		}
+		err = bson.Unmarshal(doc, c)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		entity.Remove(tag)
+		entity.Add(c)
+		c.SetDirty(migrated)
+	}
+	return nil
+}
+
+// migrate run the migrations from the version of the document
+func (this *ComponentMapper) migrate(tag protocol.BINARY_TAG, doc bson.Raw) (bson.Raw, bool, error) {
+	version := 0
+	if v, err := doc.LookupErr(COMPONENT_VERSION); err == nil {
+		if i, ok := v.AsInt64OK(); ok {
+			version = int(i)
+		}
+	}
+	migrations := this.migrations[tag]
+	if version >= len(migrations) {
+		return doc, false, nil
+	}
+	m := bson.M{}
+	err := bson.Unmarshal(doc, &m)
+	if err != nil {
+		return nil, false, err
+	}
+	_, err = applyMigrations(migrations, m)
+	if err != nil {
+		return nil, false, err
+	}
+	delete(m, COMPONENT_VERSION)
+	ret, err := bson.Marshal(m)
+	if err != nil {
+		return nil, false, err
+	}
+	return ret, true, nil
+}
+
+// Load read the mapped components of the entity
+func (this *ComponentMapper) Load(db *qmgo.Database, entity lokas.IEntity) error {
+	docs := map[string]bson.Raw{}
+	var main bson.Raw
+	err := db.Collection(this.Collection).Find(context.TODO(), bson.M{"_id": entity.GetId()}).One(&main)
+	if err != nil && err != qmgo.ErrNoSuchDocuments {
+		log.Error(err.Error())
+		return err
+	}
+	for _, tag := range this.tags {
+		name := protocol.GetTypeRegistry().GetTagName(tag)
+		if coll, ok := this.collections[tag]; ok {
+			var doc bson.Raw
+			err = db.Collection(coll).Find(context.TODO(), bson.M{"_id": entity.GetId()}).One(&doc)
+			if err == qmgo.ErrNoSuchDocuments {
+				continue
+			}
+			if err != nil {
+				log.Error(err.Error())
+				return err
+			}
+			docs[name] = doc
+			continue
+		}
+		if main == nil {
+			continue
+		}
+		v, err := main.LookupErr(name)
+		if err != nil {
+			continue
+		}
+		if v.Type != bsontype.EmbeddedDocument {
+			log.Error("component document invalid", flog.ActorId(entity.GetId()), zap.String("component", name))
+			return protocol.ERR_DB_ERROR
+		}
+		docs[name] = v.Document()
+	}
+	return this.Decode(entity, docs)
+}
+
+// Save write the dirty mapped components of the entity,all of them if full
+func (this *ComponentMapper) Save(db *qmgo.Database, entity lokas.IEntity, full bool) error {
+	entries, err := this.Snapshot(entity, full)
+	if err != nil {
+		return err
+	}
+	colls := map[string][]*SaveEntry{}
+	for _, e := range entries {
+		colls[e.Collection] = append(colls[e.Collection], e)
+	}
+	writer := MongoSaveWriter(db)
+	for coll, entries := range colls {
+		err = writer(coll, entries)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Serializer the serializer for the GameHandler
+func (this *ComponentMapper) Serializer() func(avatar lokas.IActor, process lokas.IProcess) error {
+	return func(avatar lokas.IActor, process lokas.IProcess) error {
+		entity, ok := avatar.(lokas.IEntity)
+		if !ok {
+			return protocol.ERR_TYPE_NOT_FOUND
+		}
+		return this.Save(process.GetMongo(), entity, false)
+	}
+}
+
+// Deserializer the deserializer for the GameHandler
+func (this *ComponentMapper) Deserializer() func(avatar lokas.IActor, process lokas.IProcess) error {
+	return func(avatar lokas.IActor, process lokas.IProcess) error {
+		entity, ok := avatar.(lokas.IEntity)
+		if !ok {
+			return protocol.ERR_TYPE_NOT_FOUND
+		}
+		return this.Load(process.GetMongo(), entity)
+	}
+}
@@ -2,15 +2,20 @@ package lox
 
 import (
 	"context"
+	"crypto/tls"
 	"github.com/nomos/go-lokas"
 	"github.com/nomos/go-lokas/log/flog"
 	"sync"
+	"time"
 
 	"github.com/nomos/go-lokas/log"
 	"github.com/nomos/go-lokas/network"
+	"github.com/nomos/go-lokas/network/kcp"
 	"github.com/nomos/go-lokas/network/tcp"
+	"github.com/nomos/go-lokas/network/tlsconf"
 	"github.com/nomos/go-lokas/network/ws"
 	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
 )
 
 type ConnType int
@@ -18,6 +23,7 @@ type ConnType int
 const (
 	TCP       ConnType = 0
 	Websocket ConnType = 1
+	KCP       ConnType = 2
 )
 
 func String2ConnType(s string) ConnType {
@@ -26,6 +32,8 @@ func String2ConnType(s string) ConnType {
 		return TCP
 	case "ws":
 		return Websocket
+	case "kcp":
+		return KCP
 	default:
 		panic("not a valid conn type")
 	}
@@ -37,6 +45,8 @@ func (this ConnType) String() string {
 		return "tcp"
 	case Websocket:
 		return "ws"
+	case KCP:
+		return "kcp"
 	default:
 		panic("not a valid conn type")
 	}
@@ -54,8 +64,10 @@ func (this gateCtor) Create() lokas.IModule {
 		ISessionManager: network.NewDefaultSessionManager(true),
 		Ctx:             ctx,
 		Cancel:          cancel,
+		groups:          map[string]map[util.ID]*PassiveSession{},
 	}
 	ret.SetType("Gate")
+	ret.MsgHandler = ret.handleMsg
 	return ret
 }
 
@@ -67,12 +79,25 @@ type Gate struct {
 	Host               string
 	Port               string
 	AuthFunc           func(data []byte) (interface{}, error)
+	Authenticator      Authenticator   //verify the handshake,AuthFunc is used if nil
+	HandshakeTimeout   time.Duration   //close the session if the handshake is not verified in time,0 means no limit
+	ResumeGrace        time.Duration   //how long a dropped session can be resumed,0 means disabled
+	ResumeBufferSize   int             //max outbound messages kept per session for replay
+	Reliable           bool            //sequence numbers,acks and duplicate suppression on the client link
+	TLS                *tlsconf.Loader //listen with tls if set,not supported by kcp
+	Limiter            *GateLimiter    //per ip and per session flood protection,nil means unlimited
+	Router             *GateRouter     //forward the client messages by command id,nil means ClientMsgHandler only
+	Codec              *CodecConfig    //compression and encryption negotiated with the clients,plaintext only if nil
+	SingleSession      bool            //one session per avatar,a new login takes over the avatar and kicks the old session
 	SessionCreatorFunc func(conn lokas.IConn) lokas.ISession
 	Protocol           protocol.TYPE
 	connType           ConnType
 	server             lokas.Server
 	started            bool
 	mu                 sync.Mutex
+	groups             map[string]map[util.ID]*PassiveSession
+	groupMu            sync.Mutex
+	groupTopicMu       sync.Mutex //serialize the membership changes with the group topic subscriptions
 	Ctx                context.Context
 	Cancel             context.CancelFunc
 }
@@ -94,15 +119,25 @@ func (this *Gate) LoadCustom(host, port string, protocolType protocol.TYPE, conn
 	if this.SessionCreatorFunc != nil {
 		sessionFunc = this.SessionCreatorFunc
 	}
+	var ipChecker func(ip string) bool
+	if this.Limiter != nil {
+		ipChecker = this.Limiter.CheckIP
+	}
+	var tlsConfig *tls.Config
+	if this.TLS != nil {
+		tlsConfig = this.TLS.ServerConfig()
+	}
 	if this.connType == Websocket {
 		log.Info("creating ws gate on " + this.Protocol.String() + " Protocol Host:" + this.Host + " Port:" + this.Port)
 		context := &lokas.Context{
 			SessionCreator:    sessionFunc,
 			Splitter:          protocol.Split,
+			IPChecker:         ipChecker,
 			ChanSize:          200,
 			LongPacketPicker:  protocol.PickLongPacket(this.Protocol),
 			LongPacketCreator: protocol.CreateLongPacket(this.Protocol),
 			MaxPacketWriteLen: protocol.DEFAULT_PACKET_LEN,
+			TLSConfig:         tlsConfig,
 		}
 		this.server = ws.NewWsServer(context)
 	}
@@ -111,14 +146,33 @@ func (this *Gate) LoadCustom(host, port string, protocolType protocol.TYPE, conn
 		context := &lokas.Context{
 			SessionCreator:    sessionFunc,
 			Splitter:          protocol.Split,
+			IPChecker:         ipChecker,
 			ReadBufferSize:    1024 * 1024,
 			ChanSize:          200,
 			LongPacketPicker:  protocol.PickLongPacket(this.Protocol),
 			LongPacketCreator: protocol.CreateLongPacket(this.Protocol),
 			MaxPacketWriteLen: protocol.DEFAULT_PACKET_LEN,
+			TLSConfig:         tlsConfig,
 		}
 		this.server = tcp.NewServer(context)
 	}
+	if this.connType == KCP {
+		if tlsConfig != nil {
+			log.Warn("tls is not supported by kcp gate,listening in plaintext")
+		}
+		log.Info("creating kcp gate on " + this.Protocol.String() + " Protocol Host:" + this.Host + " Port:" + this.Port)
+		context := &lokas.Context{
+			SessionCreator:    sessionFunc,
+			Splitter:          protocol.Split,
+			IPChecker:         ipChecker,
+			ReadBufferSize:    1024 * 1024,
+			ChanSize:          200,
+			LongPacketPicker:  protocol.PickLongPacket(this.Protocol),
+			LongPacketCreator: protocol.CreateLongPacket(this.Protocol),
+			MaxPacketWriteLen: protocol.DEFAULT_PACKET_LEN,
+		}
+		this.server = kcp.NewServer(context)
+	}
 
 	return nil
 }
@@ -134,6 +188,45 @@ func (this *Gate) Load(conf lokas.IConfig) error {
 	this.Port = conf.Get("port").(string)
 	this.Protocol = protocol.String2Type(conf.Get("protocol").(string))
 	this.connType = String2ConnType(conf.Get("conn").(string))
+	this.ResumeGrace = conf.GetDuration("resume_grace")
+	this.ResumeBufferSize = conf.GetInt("resume_buffer")
+	this.Reliable = conf.GetBool("reliable")
+	this.SingleSession = conf.GetBool("single_session")
+	this.HandshakeTimeout = conf.GetDuration("handshake_timeout")
+	auth, err := LoadAuthenticator(conf)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	if auth != nil {
+		this.Authenticator = auth
+	}
+	router, err := LoadGateRouter(conf)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	if router != nil {
+		this.Router = router
+	}
+	codecConf, err := LoadCodecConfig(conf)
+	if err != nil {
+		return err
+	}
+	if codecConf != nil {
+		this.Codec = codecConf
+	}
+	if limit := LoadGateLimitConfig(conf); limit != nil {
+		this.Limiter = NewGateLimiter(limit)
+	}
+	if opts := tlsconf.FromConfig(conf); opts != nil {
+		loader, err := tlsconf.NewLoader(opts)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		this.TLS = loader
+	}
 
 	return this.LoadCustom(conf.GetString("host"), conf.GetString("port"), protocol.String2Type(conf.GetString("protocol")), String2ConnType(conf.GetString("conn")))
 }
@@ -141,13 +234,69 @@ func (this *Gate) Load(conf lokas.IConfig) error {
 func (this *Gate) SessionCreator(conn lokas.IConn) lokas.ISession {
 	sess := NewPassiveSession(conn, this.GetProcess().GenId(), this)
 	sess.AuthFunc = this.AuthFunc
+	sess.Authenticator = this.Authenticator
+	sess.HandshakeTimeout = this.HandshakeTimeout
 	sess.Protocol = this.Protocol
+	sess.ResumeGrace = this.ResumeGrace
+	sess.ResumeBufferSize = this.ResumeBufferSize
+	sess.ResumeFunc = this.ResumeSession
+	sess.Reliable = this.Reliable
+	sess.Router = this.Router
+	sess.Codec = this.Codec
+	if this.SingleSession {
+		sess.TakeoverFunc = this.takeover
+	}
+	if this.Limiter != nil {
+		ip := RemoteIP(conn.RemoteAddr())
+		sess.Limiter = this.Limiter.Acquire(ip)
+		if sess.Limiter == nil {
+			//the session only serves the closed connection,it is never registered nor started
+			log.Warn("connection refused by limit:" + ip)
+			sess.refused = true
+			conn.Close()
+			return sess
+		}
+	}
 	this.ISessionManager.AddSession(sess.GetId(), sess)
 	this.GetProcess().AddActor(sess)
 	this.GetProcess().StartActor(sess)
 	return sess
 }
 
+// ResumeSession re-attach the connection of sess to the detached session presenting the resume token
+func (this *Gate) ResumeSession(sess *PassiveSession, transId uint32, msg *SessionResume) (*PassiveSession, error) {
+	s := this.ISessionManager.GetSession(msg.SessionId)
+	if s == nil {
+		return nil, protocol.ERR_SESSION_RESUME_FAILED
+	}
+	target, ok := s.(*PassiveSession)
+	if !ok || target == sess {
+		return nil, protocol.ERR_SESSION_RESUME_FAILED
+	}
+	err := target.attach(sess.GetConn(), transId, msg.Token, msg.LastSeq)
+	if err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// GetSessionByUserId return the verified session of the user authenticated by the Authenticator
+func (this *Gate) GetSessionByUserId(userId util.ID) *PassiveSession {
+	var ret *PassiveSession
+	this.ISessionManager.Range(func(id util.ID, session lokas.ISession) bool {
+		sess, ok := session.(*PassiveSession)
+		if !ok || !sess.IsVerified() {
+			return false
+		}
+		if identity := sess.GetIdentity(); identity != nil && identity.UserId == userId {
+			ret = sess
+			return true
+		}
+		return false
+	})
+	return ret
+}
+
 func (this *Gate) Unload() error {
 	return nil
 }
@@ -0,0 +1,378 @@
+package lox
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/network/httpclient"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+	"github.com/nomos/jwt-go"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_HMAC_MAX_SKEW     = time.Minute * 5
+	DEFAULT_AUTH_HTTP_TIMEOUT = time.Second * 5
+)
+
+// Identity 握手验证通过的用户身份,绑定在PassiveSession上供后续路由使用
+type Identity struct {
+	UserId   util.ID
+	AvatarId util.ID     //the avatar chosen in the LoginHandShake,0 if not logged in with an avatar
+	User     interface{} //the user decoded by the authenticator,*User for jwt
+	Reply    interface{} //json encoded as the handshake reply,the handshake is echoed if nil
+}
+
+// Authenticator 验证Gate的握手数据,拒绝时返回protocol.ErrCode或*protocol.ErrMsg作为原因下发给客户端
+type Authenticator interface {
+	Authenticate(data []byte) (*Identity, error)
+}
+
+type AuthenticatorFunc func(data []byte) (*Identity, error)
+
+func (this AuthenticatorFunc) Authenticate(data []byte) (*Identity, error) {
+	return this(data)
+}
+
+// AuthFuncAuthenticator adapt the legacy Gate.AuthFunc,the returned value is used as the reply
+func AuthFuncAuthenticator(f func(data []byte) (interface{}, error)) Authenticator {
+	return AuthenticatorFunc(func(data []byte) (*Identity, error) {
+		ret, err := f(data)
+		if err != nil {
+			return nil, err
+		}
+		return &Identity{Reply: ret}, nil
+	})
+}
+
+// AuthChain try the authenticators in order,the first accepted one wins,the last reject reason is returned
+func AuthChain(auths ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(data []byte) (*Identity, error) {
+		var err error = protocol.ERR_AUTH_FAILED
+		for _, auth := range auths {
+			var identity *Identity
+			identity, err = auth.Authenticate(data)
+			if err == nil {
+				return identity, nil
+			}
+		}
+		return nil, err
+	})
+}
+
+// authReject convert the authenticate error to the typed message sent to the client
+func authReject(err error) *protocol.ErrMsg {
+	var errMsg *protocol.ErrMsg
+	if errors.As(err, &errMsg) {
+		return errMsg
+	}
+	var code protocol.ErrCode
+	if errors.As(err, &code) {
+		return protocol.NewError(code)
+	}
+	return protocol.NewError(protocol.ERR_AUTH_FAILED)
+}
+
+// ClaimUserCreator the default JwtClaimCreator with *User
+func ClaimUserCreator(user interface{}, expire time.Duration) JwtClaimWithUser {
+	ret := &ClaimUser{
+		Create: time.Now(),
+		Expire: int64(expire),
+	}
+	if u, ok := user.(*User); ok {
+		ret.User = u
+	}
+	return ret
+}
+
+// JwtAuthenticator 握手数据为jwt token,与http接口的JwtSign签发的token通用
+type JwtAuthenticator struct {
+	Key         string //SigningKey,or the PEM public key if RSA
+	RSA         bool
+	Creator     JwtClaimCreator
+	UserCreator UserCreator
+}
+
+func NewJwtAuthenticator(key string, rsa bool) *JwtAuthenticator {
+	return &JwtAuthenticator{
+		Key:         key,
+		RSA:         rsa,
+		Creator:     ClaimUserCreator,
+		UserCreator: CreateUser,
+	}
+}
+
+// Authenticate accept the access tokens only
+func (this *JwtAuthenticator) Authenticate(data []byte) (*Identity, error) {
+	return this.authenticate(data, TOKEN_ACCESS)
+}
+
+// AuthenticateRefresh accept the refresh tokens only
+func (this *JwtAuthenticator) AuthenticateRefresh(data []byte) (*Identity, error) {
+	return this.authenticate(data, TOKEN_REFRESH)
+}
+
+func (this *JwtAuthenticator) authenticate(data []byte, tokenType string) (*Identity, error) {
+	t := strings.TrimPrefix(strings.TrimSpace(string(data)), "Bearer ")
+	t = strings.Trim(t, "\"")
+	if t == "" {
+		return nil, protocol.ERR_TOKEN_VALIDATE
+	}
+	token, err := jwt.ParseWithClaims(t, this.Creator(this.UserCreator(), 0), func(token *jwt.Token) (interface{}, error) {
+		if this.RSA {
+			return jwt.ParseRSAPublicKeyFromPEM([]byte(this.Key))
+		}
+		return []byte(this.Key), nil
+	})
+	if err != nil || !token.Valid {
+		if ve, ok := err.(*jwt.ValidationError); ok && protocol.ERR_TOKEN_EXPIRED.Is(ve.Inner) {
+			return nil, protocol.ERR_TOKEN_EXPIRED
+		}
+		return nil, protocol.ERR_TOKEN_VALIDATE
+	}
+	if GetTokenType(token.Claims) != tokenType {
+		return nil, protocol.ERR_TOKEN_VALIDATE
+	}
+	ret := &Identity{}
+	if claim, ok := token.Claims.(JwtClaimWithUser); ok {
+		ret.User = claim.GetUser()
+		if user, ok := ret.User.(*User); ok && user != nil {
+			ret.UserId = user.Id
+		}
+	}
+	return ret, nil
+}
+
+// LoginAuthenticator 握手数据为LoginHandShake,Token为账户服务签发的jwt,校验用户,账户状态和角色归属
+type LoginAuthenticator struct {
+	*JwtAuthenticator
+}
+
+func NewLoginAuthenticator(key string, rsa bool) *LoginAuthenticator {
+	return &LoginAuthenticator{
+		JwtAuthenticator: NewJwtAuthenticator(key, rsa),
+	}
+}
+
+func (this *LoginAuthenticator) Authenticate(data []byte) (*Identity, error) {
+	hs := &LoginHandShake{}
+	err := hs.Unmarshal(data)
+	if err != nil {
+		return nil, protocol.ERR_MSG_FORMAT
+	}
+	identity, err := this.JwtAuthenticator.Authenticate([]byte(hs.Token))
+	if err != nil {
+		return nil, err
+	}
+	user, ok := identity.User.(*User)
+	if !ok || user == nil || user.Id != hs.UserId {
+		return nil, protocol.ERR_TOKEN_VALIDATE
+	}
+	err = user.CheckLogin()
+	if err != nil {
+		return nil, err
+	}
+	if hs.AvatarId != 0 {
+		has, id := user.HasAvatarByServer(hs.GameId, hs.ServerId)
+		if !has || id != hs.AvatarId {
+			return nil, protocol.ERR_GAME_ACC_NOT_FOUND
+		}
+		identity.AvatarId = hs.AvatarId
+	}
+	return identity, nil
+}
+
+// HmacHandShake 共享密钥签名的握手数据,Sign=hex(hmac_sha256(secret,"UserId:Timestamp:Nonce"))
+type HmacHandShake struct {
+	UserId    util.ID
+	Timestamp int64
+	Nonce     string
+	Sign      string
+}
+
+func hmacSign(secret string, userId util.ID, timestamp int64, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%d:%d:%s", userId, timestamp, nonce)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignHmacHandShake create the handshake data for HmacAuthenticator
+func SignHmacHandShake(secret string, userId util.ID) ([]byte, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	hs := &HmacHandShake{
+		UserId:    userId,
+		Timestamp: time.Now().Unix(),
+		Nonce:     hex.EncodeToString(b),
+	}
+	hs.Sign = hmacSign(secret, hs.UserId, hs.Timestamp, hs.Nonce)
+	return json.Marshal(hs)
+}
+
+// HmacAuthenticator 验证共享密钥签名的握手,签名时间超过MaxSkew视为过期,MaxSkew内重复的Nonce视为重放
+type HmacAuthenticator struct {
+	Secret  string
+	MaxSkew time.Duration
+
+	mu      sync.Mutex
+	nonces  map[string]time.Time //the nonces seen with the time they expire
+	sweepAt time.Time
+}
+
+func NewHmacAuthenticator(secret string) *HmacAuthenticator {
+	return &HmacAuthenticator{
+		Secret:  secret,
+		MaxSkew: DEFAULT_HMAC_MAX_SKEW,
+	}
+}
+
+func (this *HmacAuthenticator) Authenticate(data []byte) (*Identity, error) {
+	var hs HmacHandShake
+	err := json.Unmarshal(data, &hs)
+	if err != nil {
+		return nil, protocol.ERR_MSG_FORMAT
+	}
+	expect := hmacSign(this.Secret, hs.UserId, hs.Timestamp, hs.Nonce)
+	if !hmac.Equal([]byte(expect), []byte(hs.Sign)) {
+		return nil, protocol.ERR_TOKEN_VALIDATE
+	}
+	skew := time.Since(time.Unix(hs.Timestamp, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if this.MaxSkew > 0 && skew > this.MaxSkew {
+		return nil, protocol.ERR_TOKEN_EXPIRED
+	}
+	if !this.useNonce(hs.UserId, hs.Nonce, time.Unix(hs.Timestamp, 0)) {
+		return nil, protocol.ERR_HANDSHAKE_REPLAYED
+	}
+	return &Identity{UserId: hs.UserId}, nil
+}
+
+// useNonce record the nonce until the handshake signed at ts expired,return false if it was seen,
+// the nonces are not tracked if MaxSkew is 0 for they never expire
+func (this *HmacAuthenticator) useNonce(userId util.ID, nonce string, ts time.Time) bool {
+	if this.MaxSkew <= 0 {
+		return true
+	}
+	now := time.Now()
+	key := userId.String() + ":" + nonce
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.nonces == nil {
+		this.nonces = map[string]time.Time{}
+	}
+	if expire, ok := this.nonces[key]; ok && now.Before(expire) {
+		return false
+	}
+	if now.After(this.sweepAt) {
+		for k, expire := range this.nonces {
+			if !now.Before(expire) {
+				delete(this.nonces, k)
+			}
+		}
+		this.sweepAt = now.Add(time.Second)
+	}
+	this.nonces[key] = ts.Add(this.MaxSkew)
+	return true
+}
+
+// HttpAuthResponse 验证服务的应答,Code为0表示通过,否则作为拒绝原因的错误码,user_id为字符串形式的id
+type HttpAuthResponse struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	UserId  util.ID         `json:"user_id"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// HttpAuthenticator post the handshake data to an auth service and accept it by the response
+type HttpAuthenticator struct {
+	Url    string
+	Client *http.Client
+}
+
+func NewHttpAuthenticator(url string, timeout time.Duration) *HttpAuthenticator {
+	if timeout <= 0 {
+		timeout = DEFAULT_AUTH_HTTP_TIMEOUT
+	}
+	return &HttpAuthenticator{
+		Url:    url,
+		Client: httpclient.NewTimeoutClient(timeout, timeout),
+	}
+}
+
+func (this *HttpAuthenticator) Authenticate(data []byte) (*Identity, error) {
+	resp, err := this.Client.Post(this.Url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Error("auth service unavailable", zap.String("url", this.Url), zap.Error(err))
+		return nil, protocol.ERR_AUTH_SERVICE_FAILED
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Error("auth service failed", zap.String("url", this.Url), zap.Int("status", resp.StatusCode))
+		return nil, protocol.ERR_AUTH_SERVICE_FAILED
+	}
+	var ret HttpAuthResponse
+	err = json.Unmarshal(body, &ret)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, protocol.ERR_AUTH_SERVICE_FAILED
+	}
+	if ret.Code != 0 {
+		return nil, protocol.NewErrorMsg(int32(ret.Code), ret.Message)
+	}
+	identity := &Identity{UserId: ret.UserId}
+	if len(ret.Data) > 0 {
+		identity.Reply = ret.Data
+	}
+	return identity, nil
+}
+
+// LoadAuthenticator create the authenticator from the "auth" section of the gate config,nil if not configured
+//
+//	auth:
+//	  type: jwt        # jwt,login,hmac or http
+//	  key: xxx         # jwt SigningKey,or the PEM public key when rsa is true
+//	  rsa: false
+//	  secret: xxx      # hmac shared secret
+//	  max_skew: 5m
+//	  url: http://auth/verify
+//	  timeout: 5s
+func LoadAuthenticator(conf lokas.IConfig) (Authenticator, error) {
+	switch conf.GetString("auth.type") {
+	case "":
+		return nil, nil
+	case "jwt":
+		return NewJwtAuthenticator(conf.GetString("auth.key"), conf.GetBool("auth.rsa")), nil
+	case "login":
+		return NewLoginAuthenticator(conf.GetString("auth.key"), conf.GetBool("auth.rsa")), nil
+	case "hmac":
+		ret := NewHmacAuthenticator(conf.GetString("auth.secret"))
+		if conf.IsSet("auth.max_skew") {
+			ret.MaxSkew = conf.GetDuration("auth.max_skew")
+		}
+		return ret, nil
+	case "http":
+		return NewHttpAuthenticator(conf.GetString("auth.url"), conf.GetDuration("auth.timeout")), nil
+	default:
+		return nil, protocol.ERR_CONFIG_ERROR
+	}
+}
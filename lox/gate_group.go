@@ -0,0 +1,252 @@
+package lox
+
+import (
+	"reflect"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/log/flog"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+	"go.uber.org/zap"
+)
+
+const GATE_GROUP_TOPIC_PREFIX = "gate_group/"
+
+// GroupTopic the topic subscribed by the gates holding members of the group
+func GroupTopic(group string) string {
+	return GATE_GROUP_TOPIC_PREFIX + group
+}
+
+// GroupJoin add the sessions to the group,
+// sent to a gate session actor to join the session itself,or to a gate actor with SessionIds
+type GroupJoin struct {
+	Group      string
+	SessionIds []util.ID
+}
+
+func (this *GroupJoin) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *GroupJoin) Serializable() protocol.ISerializable {
+	return this
+}
+
+// GroupLeave remove the sessions from the group,from all the groups if Group is empty
+type GroupLeave struct {
+	Group      string
+	SessionIds []util.ID
+}
+
+func (this *GroupLeave) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *GroupLeave) Serializable() protocol.ISerializable {
+	return this
+}
+
+// GroupPublish the message published to a group,delivered by each gate to its local members
+type GroupPublish struct {
+	Group string
+	Body  []byte
+}
+
+func (this *GroupPublish) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *GroupPublish) Serializable() protocol.ISerializable {
+	return this
+}
+
+func NewGroupPublish(group string, msg protocol.ISerializable) (*GroupPublish, error) {
+	body, err := protocol.MarshalBinary(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &GroupPublish{
+		Group: group,
+		Body:  body,
+	}, nil
+}
+
+func (this *GroupPublish) Message() (protocol.ISerializable, error) {
+	return unmarshalProxyBody(this.Body)
+}
+
+// PublishGroup send msg to all the members of the group on every gate,the message is published once per gate process
+func PublishGroup(process lokas.IProcess, fromActorId util.ID, group string, msg protocol.ISerializable) error {
+	publish, err := NewGroupPublish(group, msg)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	return process.PublishTopic(fromActorId, GroupTopic(group), publish)
+}
+
+// JoinGroup add the local session to the group,the gate subscribes the group topic with its first member
+func (this *Gate) JoinGroup(group string, sessionId util.ID) error {
+	s := this.ISessionManager.GetSession(sessionId)
+	if s == nil {
+		return protocol.ERR_SESSION_NOT_FOUND
+	}
+	sess, ok := s.(*PassiveSession)
+	if !ok {
+		return protocol.ERR_SESSION_NOT_FOUND
+	}
+	this.groupTopicMu.Lock()
+	defer this.groupTopicMu.Unlock()
+	this.groupMu.Lock()
+	members, ok := this.groups[group]
+	if !ok {
+		members = map[util.ID]*PassiveSession{}
+		this.groups[group] = members
+	}
+	members[sessionId] = sess
+	this.groupMu.Unlock()
+	if !ok {
+		err := this.GetProcess().SubscribeTopic(GroupTopic(group), this.GetId())
+		if err != nil {
+			log.Error(err.Error())
+			this.groupMu.Lock()
+			delete(this.groups, group)
+			this.groupMu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// LeaveGroup remove the session from the group,the topic is unsubscribed with the last member
+func (this *Gate) LeaveGroup(group string, sessionId util.ID) {
+	this.groupTopicMu.Lock()
+	defer this.groupTopicMu.Unlock()
+	this.groupMu.Lock()
+	members, ok := this.groups[group]
+	if !ok {
+		this.groupMu.Unlock()
+		return
+	}
+	delete(members, sessionId)
+	empty := len(members) == 0
+	if empty {
+		delete(this.groups, group)
+	}
+	this.groupMu.Unlock()
+	if empty {
+		err := this.GetProcess().UnsubscribeTopic(GroupTopic(group), this.GetId())
+		if err != nil {
+			log.Error(err.Error())
+		}
+	}
+}
+
+// LeaveAllGroups remove the session from all its groups
+func (this *Gate) LeaveAllGroups(sessionId util.ID) {
+	this.groupMu.Lock()
+	groups := []string{}
+	for group, members := range this.groups {
+		if _, ok := members[sessionId]; ok {
+			groups = append(groups, group)
+		}
+	}
+	this.groupMu.Unlock()
+	for _, group := range groups {
+		this.LeaveGroup(group, sessionId)
+	}
+}
+
+// GroupMembers return the local members of the group
+func (this *Gate) GroupMembers(group string) []util.ID {
+	this.groupMu.Lock()
+	defer this.groupMu.Unlock()
+	ret := make([]util.ID, 0, len(this.groups[group]))
+	for id := range this.groups[group] {
+		ret = append(ret, id)
+	}
+	return ret
+}
+
+// PublishGroupLocal encode the message once and write it to the local members of the group
+func (this *Gate) PublishGroupLocal(group string, msg protocol.ISerializable) error {
+	this.groupMu.Lock()
+	members := make([]*PassiveSession, 0, len(this.groups[group]))
+	for _, sess := range this.groups[group] {
+		members = append(members, sess)
+	}
+	this.groupMu.Unlock()
+	if len(members) == 0 {
+		return nil
+	}
+	data, err := protocol.MarshalMessage(0, msg, this.Protocol)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	for _, sess := range members {
+		err := sess.writeData(data)
+		if err != nil {
+			log.Warn("publish group msg failed", lokas.LogActorInfo(sess).Append(zap.String("group", group), flog.Error(err))...)
+		}
+	}
+	return nil
+}
+
+// RemoveSession remove the session from the manager and its groups
+func (this *Gate) RemoveSession(id util.ID) {
+	this.LeaveAllGroups(id)
+	this.ISessionManager.RemoveSession(id)
+}
+
+// handleGroupMsg handle the group messages sent to the gate or to one of its sessions,false if msg is not a group message
+func (this *Gate) handleGroupMsg(sessionId util.ID, msg protocol.ISerializable) (bool, error) {
+	switch body := msg.(type) {
+	case *GroupJoin:
+		ids := body.SessionIds
+		if len(ids) == 0 && sessionId != 0 {
+			ids = []util.ID{sessionId}
+		}
+		var lastErr error
+		for _, id := range ids {
+			err := this.JoinGroup(body.Group, id)
+			if err != nil {
+				lastErr = err
+			}
+		}
+		return true, lastErr
+	case *GroupLeave:
+		ids := body.SessionIds
+		if len(ids) == 0 && sessionId != 0 {
+			ids = []util.ID{sessionId}
+		}
+		for _, id := range ids {
+			if body.Group == "" {
+				this.LeaveAllGroups(id)
+			} else {
+				this.LeaveGroup(body.Group, id)
+			}
+		}
+		return true, nil
+	case *GroupPublish:
+		inner, err := body.Message()
+		if err != nil {
+			log.Error(err.Error())
+			return true, err
+		}
+		return true, this.PublishGroupLocal(body.Group, inner)
+	}
+	return false, nil
+}
+
+func (this *Gate) handleMsg(actorId util.ID, transId uint32, msg protocol.ISerializable) (protocol.ISerializable, error) {
+	ok, err := this.handleGroupMsg(0, msg)
+	if err != nil {
+		return nil, err
+	}
+	if ok && transId != 0 {
+		return NewResponse(true), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,95 @@
+package lox
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/log/flog"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+	"go.uber.org/zap"
+)
+
+type KickReason int32
+
+const (
+	KICK_DUPLICATE_LOGIN KickReason = iota + 1 //the avatar logged in from another connection
+	KICK_ADMIN                                 //kicked by the admin
+)
+
+func (this KickReason) String() string {
+	switch this {
+	case KICK_DUPLICATE_LOGIN:
+		return "duplicate login"
+	case KICK_ADMIN:
+		return "admin"
+	default:
+		return "unknown"
+	}
+}
+
+// SessionKicked sent to the gate session replaced,and forwarded to its client before the connection is closed
+type SessionKicked struct {
+	AvatarId int64
+	Reason   KickReason
+}
+
+func (this *SessionKicked) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *SessionKicked) Serializable() protocol.ISerializable {
+	return this
+}
+
+func NewSessionKicked(avatarId util.ID, reason KickReason) *SessionKicked {
+	return &SessionKicked{
+		AvatarId: avatarId.Int64(),
+		Reason:   reason,
+	}
+}
+
+// takeover bind the avatar of the session to it and kick the session replaced
+func (this *Gate) takeover(sess *PassiveSession) error {
+	identity := sess.GetIdentity()
+	process := this.GetProcess()
+	old, err := TakeoverAvatarSession(process, identity.AvatarId, identity.UserId, sess.GetId(), process.PId())
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	if old == nil || old.GateId == 0 || old.GateId == sess.GetId() {
+		return nil
+	}
+	log.Warn("duplicate login,kick the old session", lokas.LogActorInfo(sess).Append(flog.AvatarId(identity.AvatarId)).Append(zap.Int64("old_gate", old.GateId.Int64()))...)
+	msg := protocol.NewRouteMessage(sess.GetId(), old.GateId, 0, NewSessionKicked(identity.AvatarId, KICK_DUPLICATE_LOGIN), true)
+	msg.ToPid = old.GatePid
+	process.RouteMsg(msg)
+	return nil
+}
+
+// kick forward the message to the client and close the connection after a while for it to be flushed,
+// the session is not kept for resuming
+func (this *PassiveSession) kick(msg *SessionKicked) {
+	log.Warn("session kicked", lokas.LogActorInfo(this).Append(zap.Int64("avatar", msg.AvatarId)).Append(zap.String("reason", msg.Reason.String()))...)
+	err := this.WriteMessage(0, msg)
+	if err != nil {
+		log.Error(err.Error())
+	}
+	this.connMu.Lock()
+	this.replay = nil
+	this.resumeToken = ""
+	this.resumeGen++
+	conn, lastConn := this.Conn, this.lastConn
+	this.connMu.Unlock()
+	if conn == nil {
+		//detached,close it now
+		this.close(lastConn)
+		return
+	}
+	time.AfterFunc(time.Second, func() {
+		conn.Close()
+	})
+}
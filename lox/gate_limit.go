@@ -0,0 +1,357 @@
+package lox
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/protocol"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_GATE_BAN_WINDOW = time.Hour
+)
+
+// RateLimit token bucket of Rate per second,up to Burst
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// GateLimitConfig gate flood protection,zero values mean unlimited
+//
+//	limit:
+//	  conn_per_ip: 10
+//	  msg_rate: 50           # messages per second per session
+//	  msg_burst: 100
+//	  byte_rate: 65536       # bytes per second per session
+//	  byte_burst: 131072
+//	  cmd_rate:              # messages per second per command id,burst is twice the rate
+//	    "1001": 5
+//	  ban_after_kicks: 3     # ban the ip after so many kicks within ban_window
+//	  ban_window: 1m         # 1h if not set
+//	  ban_duration: 10m
+type GateLimitConfig struct {
+	ConnPerIP     int
+	Msg           RateLimit
+	Byte          RateLimit
+	Cmd           map[protocol.BINARY_TAG]RateLimit
+	BanAfterKicks int
+	BanWindow     time.Duration
+	BanDuration   time.Duration
+}
+
+// LoadGateLimitConfig read the "limit" section of the gate config,nil if not configured
+func LoadGateLimitConfig(conf lokas.IConfig) *GateLimitConfig {
+	if !conf.IsSet("limit") {
+		return nil
+	}
+	ret := &GateLimitConfig{
+		ConnPerIP:     conf.GetInt("limit.conn_per_ip"),
+		Msg:           RateLimit{Rate: conf.GetFloat64("limit.msg_rate"), Burst: conf.GetFloat64("limit.msg_burst")},
+		Byte:          RateLimit{Rate: conf.GetFloat64("limit.byte_rate"), Burst: conf.GetFloat64("limit.byte_burst")},
+		Cmd:           map[protocol.BINARY_TAG]RateLimit{},
+		BanAfterKicks: conf.GetInt("limit.ban_after_kicks"),
+		BanWindow:     conf.GetDuration("limit.ban_window"),
+		BanDuration:   conf.GetDuration("limit.ban_duration"),
+	}
+	for k, v := range conf.GetStringMapString("limit.cmd_rate") {
+		cmdId, err := strconv.Atoi(k)
+		if err != nil {
+			log.Warn("invalid cmd id in limit.cmd_rate", zap.String("cmd", k))
+			continue
+		}
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.Warn("invalid rate in limit.cmd_rate", zap.String("cmd", k), zap.String("rate", v))
+			continue
+		}
+		ret.Cmd[protocol.BINARY_TAG(cmdId)] = RateLimit{Rate: rate, Burst: rate * 2}
+	}
+	return ret
+}
+
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	if limit.Burst < limit.Rate {
+		limit.Burst = limit.Rate
+	}
+	return &tokenBucket{
+		limit:  limit,
+		tokens: limit.Burst,
+		last:   time.Now(),
+	}
+}
+
+func (this *tokenBucket) take(n float64, now time.Time) bool {
+	this.tokens += now.Sub(this.last).Seconds() * this.limit.Rate
+	if this.tokens > this.limit.Burst {
+		this.tokens = this.limit.Burst
+	}
+	this.last = now
+	if this.tokens < n {
+		return false
+	}
+	this.tokens -= n
+	return true
+}
+
+// GateLimitStats counters of the gate limiter,exposed by the admin command
+type GateLimitStats struct {
+	Accepted      int64
+	RefusedConn   int64 //refused by conn_per_ip
+	RefusedBanned int64 //refused by the ban list
+	Kicked        int64
+	Banned        int64
+	Conns         int
+	IPs           int
+	KickedIPs     int //ips with kicks remembered
+	Bans          map[string]time.Time
+}
+
+// GateLimiter per ip connection limits,per session rate limits and the temporary ban list of a gate
+type GateLimiter struct {
+	Config *GateLimitConfig
+
+	mu      sync.Mutex
+	conns   map[string]int
+	bans    map[string]time.Time
+	kicks   map[string][]time.Time
+	sweepAt time.Time
+
+	accepted      int64
+	refusedConn   int64
+	refusedBanned int64
+	kicked        int64
+	banned        int64
+}
+
+func NewGateLimiter(config *GateLimitConfig) *GateLimiter {
+	return &GateLimiter{
+		Config: config,
+		conns:  map[string]int{},
+		bans:   map[string]time.Time{},
+		kicks:  map[string][]time.Time{},
+	}
+}
+
+// RemoteIP return the ip of the remote address without port
+func RemoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// CheckIP used as lokas.Context.IPChecker,refuse the banned ips and the ones reached conn_per_ip at accept,
+// the connection is counted by Acquire which checks again
+func (this *GateLimiter) CheckIP(ip string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.checkIP(ip)
+}
+
+func (this *GateLimiter) checkIP(ip string) bool {
+	if until, ok := this.bans[ip]; ok {
+		if time.Now().Before(until) {
+			atomic.AddInt64(&this.refusedBanned, 1)
+			return false
+		}
+		delete(this.bans, ip)
+	}
+	if this.Config.ConnPerIP > 0 && this.conns[ip] >= this.Config.ConnPerIP {
+		atomic.AddInt64(&this.refusedConn, 1)
+		return false
+	}
+	return true
+}
+
+// Acquire check the ip and count the connection at once,so a burst of connections never exceeds conn_per_ip,
+// return the limiter of the new session which is released when the session closed,nil if refused
+func (this *GateLimiter) Acquire(ip string) *SessionLimiter {
+	this.mu.Lock()
+	if !this.checkIP(ip) {
+		this.mu.Unlock()
+		return nil
+	}
+	this.conns[ip]++
+	this.mu.Unlock()
+	atomic.AddInt64(&this.accepted, 1)
+	ret := &SessionLimiter{
+		gate: this,
+		ip:   ip,
+	}
+	if this.Config.Msg.Rate > 0 {
+		ret.msg = newTokenBucket(this.Config.Msg)
+	}
+	if this.Config.Byte.Rate > 0 {
+		ret.bytes = newTokenBucket(this.Config.Byte)
+	}
+	if len(this.Config.Cmd) > 0 {
+		ret.cmds = map[protocol.BINARY_TAG]*tokenBucket{}
+	}
+	return ret
+}
+
+func (this *GateLimiter) release(ip string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.conns[ip]--
+	if this.conns[ip] <= 0 {
+		delete(this.conns, ip)
+	}
+}
+
+// kick record the kick of the ip,ban it after BanAfterKicks kicks within BanWindow
+func (this *GateLimiter) kick(ip string) {
+	atomic.AddInt64(&this.kicked, 1)
+	if this.Config.BanAfterKicks <= 0 || this.Config.BanDuration <= 0 {
+		return
+	}
+	now := time.Now()
+	window := this.banWindow()
+	this.mu.Lock()
+	this.sweep(now, window)
+	kicks := append(this.kicks[ip], now)
+	i := 0
+	for i < len(kicks) && now.Sub(kicks[i]) > window {
+		i++
+	}
+	kicks = kicks[i:]
+	this.kicks[ip] = kicks
+	ban := len(kicks) >= this.Config.BanAfterKicks
+	this.mu.Unlock()
+	if ban {
+		this.Ban(ip, this.Config.BanDuration)
+	}
+}
+
+func (this *GateLimiter) banWindow() time.Duration {
+	if this.Config.BanWindow > 0 {
+		return this.Config.BanWindow
+	}
+	return DEFAULT_GATE_BAN_WINDOW
+}
+
+// sweep forget the kicks out of the window and the bans expired,at most once a window,called with the lock held
+func (this *GateLimiter) sweep(now time.Time, window time.Duration) {
+	if now.Before(this.sweepAt) {
+		return
+	}
+	this.sweepAt = now.Add(window)
+	for ip, kicks := range this.kicks {
+		if len(kicks) == 0 || now.Sub(kicks[len(kicks)-1]) > window {
+			delete(this.kicks, ip)
+		}
+	}
+	for ip, until := range this.bans {
+		if !now.Before(until) {
+			delete(this.bans, ip)
+		}
+	}
+}
+
+// Ban refuse the connections from ip for d
+func (this *GateLimiter) Ban(ip string, d time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.bans[ip] = time.Now().Add(d)
+	delete(this.kicks, ip)
+	atomic.AddInt64(&this.banned, 1)
+	log.Warn("ip banned", zap.String("ip", ip), zap.Duration("duration", d))
+}
+
+// Unban remove ip from the ban list,return false if it was not banned
+func (this *GateLimiter) Unban(ip string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	_, ok := this.bans[ip]
+	delete(this.bans, ip)
+	return ok
+}
+
+func (this *GateLimiter) Stats() *GateLimitStats {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	ret := &GateLimitStats{
+		Accepted:      atomic.LoadInt64(&this.accepted),
+		RefusedConn:   atomic.LoadInt64(&this.refusedConn),
+		RefusedBanned: atomic.LoadInt64(&this.refusedBanned),
+		Kicked:        atomic.LoadInt64(&this.kicked),
+		Banned:        atomic.LoadInt64(&this.banned),
+		IPs:           len(this.conns),
+		KickedIPs:     len(this.kicks),
+		Bans:          map[string]time.Time{},
+	}
+	for _, n := range this.conns {
+		ret.Conns += n
+	}
+	now := time.Now()
+	for ip, until := range this.bans {
+		if now.Before(until) {
+			ret.Bans[ip] = until
+		}
+	}
+	return ret
+}
+
+// SessionLimiter the token buckets of a session,only used in the session read loop
+type SessionLimiter struct {
+	gate     *GateLimiter
+	ip       string
+	msg      *tokenBucket
+	bytes    *tokenBucket
+	cmds     map[protocol.BINARY_TAG]*tokenBucket
+	released int32
+}
+
+// Allow take the tokens of a client packet,false if any limit is exceeded
+func (this *SessionLimiter) Allow(data []byte) bool {
+	now := time.Now()
+	if this.msg != nil && !this.msg.take(1, now) {
+		return false
+	}
+	if this.bytes != nil && !this.bytes.take(float64(len(data)), now) {
+		return false
+	}
+	if this.cmds != nil && len(data) >= protocol.HEADER_SIZE {
+		cmdId := protocol.GetCmdId16(data)
+		if limit, ok := this.gate.Config.Cmd[cmdId]; ok {
+			bucket := this.cmds[cmdId]
+			if bucket == nil {
+				bucket = newTokenBucket(limit)
+				this.cmds[cmdId] = bucket
+			}
+			if !bucket.take(1, now) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Kick record the kick of the session ip
+func (this *SessionLimiter) Kick() {
+	this.gate.kick(this.ip)
+}
+
+// Release give back the connection count of the ip
+func (this *SessionLimiter) Release() {
+	if atomic.CompareAndSwapInt32(&this.released, 0, 1) {
+		this.gate.release(this.ip)
+	}
+}
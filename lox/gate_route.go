@@ -0,0 +1,275 @@
+package lox
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/log/flog"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+	"go.uber.org/zap"
+)
+
+type RouteTarget int
+
+const (
+	ROUTE_AVATAR  RouteTarget = iota //the avatar of the session
+	ROUTE_SERVICE                    //a service picked by the sticky line of the avatar
+	ROUTE_LOCAL                      //a handler registered on the gate
+	ROUTE_ROOM                       //the room bound to the session by RoomBind
+)
+
+func String2RouteTarget(s string) (RouteTarget, error) {
+	switch s {
+	case "avatar":
+		return ROUTE_AVATAR, nil
+	case "service":
+		return ROUTE_SERVICE, nil
+	case "local":
+		return ROUTE_LOCAL, nil
+	case "room":
+		return ROUTE_ROOM, nil
+	}
+	return 0, protocol.ERR_CONFIG_ERROR
+}
+
+// GateHandler handle a client message on the gate,the returned message is sent back with the TransId of the request
+type GateHandler func(sess *PassiveSession, msg *protocol.BinaryMessage) (protocol.ISerializable, error)
+
+// GateRoute the destination of the client messages of command ids From..To,or of the types declared in Package
+type GateRoute struct {
+	Name      string
+	From      protocol.BINARY_TAG
+	To        protocol.BINARY_TAG
+	Package   string //import path prefix of the message types,matched when no id range is set
+	Target    RouteTarget
+	Service   string //service type for ROUTE_SERVICE
+	ServiceId uint16
+	Handler   string //handler name for ROUTE_LOCAL
+	Mute      bool   //refused with ERR_ACC_MUTE for the muted users,such as the chat messages
+}
+
+func (this *GateRoute) match(cmdId protocol.BINARY_TAG) bool {
+	if this.To != 0 {
+		return cmdId >= this.From && cmdId <= this.To
+	}
+	if this.Package == "" {
+		return false
+	}
+	t, err := protocol.GetTypeRegistry().GetTypeByTag(cmdId)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(t.PkgPath(), this.Package)
+}
+
+// GateRouter forward the verified client messages by command id,
+// the messages are wrapped as RouteDataMsg from the session actor,so the replies are written back to the client with the original TransId
+type GateRouter struct {
+	Routes   []*GateRoute
+	Handlers map[string]GateHandler
+	AvatarId func(sess *PassiveSession) util.ID //the avatar of the session,the authenticated avatar or user id by default
+}
+
+func NewGateRouter() *GateRouter {
+	return &GateRouter{
+		Routes:   []*GateRoute{},
+		Handlers: map[string]GateHandler{},
+		AvatarId: func(sess *PassiveSession) util.ID {
+			identity := sess.GetIdentity()
+			if identity == nil {
+				return 0
+			}
+			if identity.AvatarId != 0 {
+				return identity.AvatarId
+			}
+			return identity.UserId
+		},
+	}
+}
+
+// LoadGateRouter read the "routes" section of the gate config,nil if not configured
+//
+//	routes:
+//	  game:
+//	    cmd: 1000-1999,2500     # id ranges,inclusive
+//	    target: avatar
+//	  chat:
+//	    package: github.com/xx/protocol/chat
+//	    target: service
+//	    service: chat
+//	    service_id: 1
+//	    mute: true              # refused for the muted users
+//	  gm:
+//	    cmd: 3000
+//	    target: local
+//	    handler: gm
+//	  battle:
+//	    cmd: 4000-4999
+//	    target: room
+func LoadGateRouter(conf lokas.IConfig) (*GateRouter, error) {
+	if !conf.IsSet("routes") {
+		return nil, nil
+	}
+	ret := NewGateRouter()
+	for name := range conf.GetStringMap("routes") {
+		prefix := "routes." + name + "."
+		target, err := String2RouteTarget(conf.GetString(prefix + "target"))
+		if err != nil {
+			log.Error("invalid route target", zap.String("route", name), zap.String("target", conf.GetString(prefix+"target")))
+			return nil, err
+		}
+		base := GateRoute{
+			Name:      name,
+			Package:   conf.GetString(prefix + "package"),
+			Target:    target,
+			Service:   conf.GetString(prefix + "service"),
+			ServiceId: uint16(conf.GetInt(prefix + "service_id")),
+			Handler:   conf.GetString(prefix + "handler"),
+			Mute:      conf.GetBool(prefix + "mute"),
+		}
+		cmds := conf.GetString(prefix + "cmd")
+		if cmds == "" {
+			ret.Add(&base)
+			continue
+		}
+		for _, s := range strings.Split(cmds, ",") {
+			route := base
+			route.From, route.To, err = parseCmdRange(strings.TrimSpace(s))
+			if err != nil {
+				log.Error("invalid route cmd range", zap.String("route", name), zap.String("cmd", s))
+				return nil, err
+			}
+			ret.Add(&route)
+		}
+	}
+	return ret, nil
+}
+
+func parseCmdRange(s string) (protocol.BINARY_TAG, protocol.BINARY_TAG, error) {
+	parts := strings.SplitN(s, "-", 2)
+	from, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 16)
+	if err != nil {
+		return 0, 0, protocol.ERR_CONFIG_ERROR
+	}
+	to := from
+	if len(parts) == 2 {
+		to, err = strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 16)
+		if err != nil || to < from {
+			return 0, 0, protocol.ERR_CONFIG_ERROR
+		}
+	}
+	return protocol.BINARY_TAG(from), protocol.BINARY_TAG(to), nil
+}
+
+// Add add a route,the id ranges are matched before the packages,the narrower range first
+func (this *GateRouter) Add(route *GateRoute) {
+	this.Routes = append(this.Routes, route)
+	sort.SliceStable(this.Routes, func(i, j int) bool {
+		a, b := this.Routes[i], this.Routes[j]
+		if (a.To == 0) != (b.To == 0) {
+			return a.To != 0
+		}
+		return a.To-a.From < b.To-b.From
+	})
+}
+
+// Handle register the handler of the ROUTE_LOCAL routes named name
+func (this *GateRouter) Handle(name string, handler GateHandler) {
+	this.Handlers[name] = handler
+}
+
+func (this *GateRouter) Match(cmdId protocol.BINARY_TAG) *GateRoute {
+	for _, route := range this.Routes {
+		if route.match(cmdId) {
+			return route
+		}
+	}
+	return nil
+}
+
+// Route forward the client message,false if no route matched
+func (this *GateRouter) Route(sess *PassiveSession, msg *protocol.BinaryMessage) (bool, error) {
+	route := this.Match(msg.CmdId)
+	if route == nil {
+		return false, nil
+	}
+	if route.Mute && isMuted(sess) {
+		return true, protocol.ERR_ACC_MUTE
+	}
+	switch route.Target {
+	case ROUTE_LOCAL:
+		handler := this.Handlers[route.Handler]
+		if handler == nil {
+			log.Error("gate handler not found", zap.String("route", route.Name), zap.String("handler", route.Handler))
+			return true, protocol.ERR_MSG_HANDLER_NOT_FOUND
+		}
+		resp, err := handler(sess, msg)
+		if err != nil {
+			return true, err
+		}
+		if resp != nil && msg.TransId != 0 {
+			return true, sess.WriteMessage(msg.TransId, resp)
+		}
+		return true, nil
+	case ROUTE_AVATAR:
+		avatarId := this.AvatarId(sess)
+		if avatarId == 0 {
+			return true, protocol.ERR_ACTOR_NOT_FOUND
+		}
+		return true, this.forward(sess, msg, avatarId, 0)
+	case ROUTE_ROOM:
+		roomId := sess.GetRoomId()
+		if roomId == 0 {
+			return true, protocol.ERR_ROOM_NOT_JOINED
+		}
+		return true, this.forward(sess, msg, roomId, 0)
+	case ROUTE_SERVICE:
+		process := sess.GetProcess()
+		serviceInfo, ok := process.GetServiceDiscoverMgr().PickServiceInfo(route.Service, route.ServiceId, uint64(this.AvatarId(sess)))
+		if !ok {
+			log.Warn("route client msg err, not find service", flog.ServiceInfo(route.Service, route.ServiceId, 0).Append(protocol.LogCmdId(msg.CmdId))...)
+			return true, protocol.ERR_SERVICE_NOT_FOUND
+		}
+		return true, this.forward(sess, msg, serviceInfo.ActorId, serviceInfo.ProcessId)
+	}
+	return false, nil
+}
+
+// isMuted the user of the session is muted by the state carried in its token
+func isMuted(sess *PassiveSession) bool {
+	identity := sess.GetIdentity()
+	if identity == nil {
+		return false
+	}
+	user, ok := identity.User.(*User)
+	return ok && user != nil && user.IsMuted()
+}
+
+// forward wrap the message as RouteDataMsg,
+// the data is delivered to the local actor directly,and to a remote process as RouteMessage since the proxy only carries RouteMessage
+func (this *GateRouter) forward(sess *PassiveSession, msg *protocol.BinaryMessage, toActor util.ID, pid util.ProcessId) error {
+	body, err := json.Marshal(msg.Body)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	dataMsg := protocol.NewRouteDataMsg(sess.GetId(), toActor, msg.TransId, msg.CmdId, protocol.REQ_TYPE_MAIN, body, sess.Protocol)
+	process := sess.GetProcess()
+	if pid == 0 {
+		pid, err = process.GetProcessIdByActor(toActor)
+		if err != nil {
+			log.Warn("route client msg err, actor not found", dataMsg.LogInfo()...)
+			return protocol.ERR_ACTOR_NOT_FOUND
+		}
+	}
+	dataMsg.ToPid = pid
+	if pid == process.PId() {
+		return process.RouteDataMsgLocal(dataMsg)
+	}
+	return process.Send(pid, protocol.NewRouteMsg(dataMsg.FromActor, toActor, msg.TransId, msg.Body, protocol.REQ_TYPE_MAIN))
+}
@@ -6,17 +6,46 @@ import (
 )
 
 const (
-	TAG_USER             = 130
-	TAG_JWT              = 131
-	TAG_CLAIM_USER       = 132
-	TAG_AVATAR_MAP       = 133
-	TAG_AVATAR           = 134
-	TAG_ADMIN_CMD        = 135
-	TAG_ADMIN_CMD_RESULT = 136
-	TAG_CREATE_AVATAR    = 137
-	TAG_KICK_AVATAR      = 138
-	TAG_RESPONSE         = 140
-	TAG_CONSOLE_EVENT    = 221
+	TAG_USER               = 130
+	TAG_JWT                = 131
+	TAG_CLAIM_USER         = 132
+	TAG_AVATAR_MAP         = 133
+	TAG_AVATAR             = 134
+	TAG_ADMIN_CMD          = 135
+	TAG_ADMIN_CMD_RESULT   = 136
+	TAG_CREATE_AVATAR      = 137
+	TAG_KICK_AVATAR        = 138
+	TAG_RESPONSE           = 140
+	TAG_PROXY_MESSAGE      = 144
+	TAG_TOPIC_MESSAGE      = 145
+	TAG_SESSION_TOKEN      = 146
+	TAG_SESSION_RESUME     = 147
+	TAG_SESSION_RESUMED    = 148
+	TAG_RELIABLE_MESSAGE   = 149
+	TAG_GROUP_JOIN         = 150
+	TAG_GROUP_LEAVE        = 151
+	TAG_GROUP_PUBLISH      = 152
+	TAG_CODEC_OFFER        = 153
+	TAG_CODEC_ACCEPT       = 154
+	TAG_SESSION_KICKED     = 155
+	TAG_LEADERBOARD_ENTRY  = 156
+	TAG_LEADERBOARD_UPDATE = 157
+	TAG_LEADERBOARD_QUERY  = 158
+	TAG_LEADERBOARD_AROUND = 159
+	TAG_LEADERBOARD_PAGE   = 160
+	TAG_MATCH_TEAM         = 161
+	TAG_MATCH_JOIN         = 162
+	TAG_MATCH_CANCEL       = 163
+	TAG_MATCH_FOUND        = 164
+	TAG_MATCH_ROOM         = 165
+	TAG_MATCH_CANCELED     = 166
+	TAG_ROOM_JOIN          = 167
+	TAG_ROOM_LEAVE         = 168
+	TAG_ROOM_INFO          = 169
+	TAG_ROOM_BIND          = 170
+	TAG_ROOM_CLOSED        = 171
+	TAG_ROOM_CLOSE         = 172
+	TAG_CONSOLE_EVENT      = 221
 )
 
 func init() {
@@ -30,5 +59,34 @@ func init() {
 	protocol.GetTypeRegistry().RegistryType(TAG_AVATAR, reflect.TypeOf((*Avatar)(nil)).Elem())
 	protocol.GetTypeRegistry().RegistryType(TAG_ADMIN_CMD, reflect.TypeOf((*AdminCommand)(nil)).Elem())
 	protocol.GetTypeRegistry().RegistryType(TAG_ADMIN_CMD_RESULT, reflect.TypeOf((*AdminCommandResult)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_PROXY_MESSAGE, reflect.TypeOf((*ProxyMessage)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_TOPIC_MESSAGE, reflect.TypeOf((*TopicMessage)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_SESSION_TOKEN, reflect.TypeOf((*SessionToken)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_SESSION_RESUME, reflect.TypeOf((*SessionResume)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_SESSION_RESUMED, reflect.TypeOf((*SessionResumed)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_RELIABLE_MESSAGE, reflect.TypeOf((*ReliableMessage)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_GROUP_JOIN, reflect.TypeOf((*GroupJoin)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_GROUP_LEAVE, reflect.TypeOf((*GroupLeave)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_GROUP_PUBLISH, reflect.TypeOf((*GroupPublish)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_CODEC_OFFER, reflect.TypeOf((*CodecOffer)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_CODEC_ACCEPT, reflect.TypeOf((*CodecAccept)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_SESSION_KICKED, reflect.TypeOf((*SessionKicked)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_LEADERBOARD_ENTRY, reflect.TypeOf((*LeaderboardEntry)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_LEADERBOARD_UPDATE, reflect.TypeOf((*LeaderboardUpdate)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_LEADERBOARD_QUERY, reflect.TypeOf((*LeaderboardQuery)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_LEADERBOARD_AROUND, reflect.TypeOf((*LeaderboardAround)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_LEADERBOARD_PAGE, reflect.TypeOf((*LeaderboardPage)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_MATCH_TEAM, reflect.TypeOf((*MatchTeam)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_MATCH_JOIN, reflect.TypeOf((*MatchJoin)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_MATCH_CANCEL, reflect.TypeOf((*MatchCancel)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_MATCH_FOUND, reflect.TypeOf((*MatchFound)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_MATCH_ROOM, reflect.TypeOf((*MatchRoom)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_MATCH_CANCELED, reflect.TypeOf((*MatchCanceled)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_ROOM_JOIN, reflect.TypeOf((*RoomJoin)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_ROOM_LEAVE, reflect.TypeOf((*RoomLeave)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_ROOM_INFO, reflect.TypeOf((*RoomInfo)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_ROOM_BIND, reflect.TypeOf((*RoomBind)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_ROOM_CLOSED, reflect.TypeOf((*RoomClosed)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_ROOM_CLOSE, reflect.TypeOf((*RoomClose)(nil)).Elem())
 	protocol.GetTypeRegistry().RegistryType(TAG_CONSOLE_EVENT, reflect.TypeOf((*ConsoleEvent)(nil)).Elem())
 }
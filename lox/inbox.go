@@ -0,0 +1,356 @@
+package lox
+
+import (
+	"context"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/log/flog"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+	"github.com/nomos/qmgo"
+	"github.com/nomos/qmgo/options"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.uber.org/zap"
+)
+
+const INBOX_COLLECTION = "inbox"
+
+var InboxCtor = inboxCtor{}
+
+type inboxCtor struct{}
+
+func (this inboxCtor) Type() string {
+	return "Inbox"
+}
+
+func (this inboxCtor) Create() lokas.IModule {
+	return NewInbox()
+}
+
+// InboxMessage a message kept for an avatar not loaded,delivered in the order of Id
+type InboxMessage struct {
+	Id     util.ID             `bson:"_id"`
+	To     util.ID             `bson:"to"`
+	From   util.ID             `bson:"from"`
+	Cmd    protocol.BINARY_TAG `bson:"cmd"`
+	Data   []byte              `bson:"data"`             //binary message of the body
+	Expire time.Time           `bson:"expire,omitempty"` //not stored if never expires,the ttl index skips it
+}
+
+// InboxStore the storage of the inbox messages
+type InboxStore interface {
+	Insert(m *InboxMessage) error
+	Find(to util.ID) ([]*InboxMessage, error) //the messages of the avatar in the order of Id
+	Remove(ids []util.ID) error
+}
+
+type mongoInboxStore struct {
+	db         *qmgo.Database
+	collection string
+}
+
+// MongoInboxStore keep the messages in the collection,the expired ones are removed by the ttl index
+func MongoInboxStore(db *qmgo.Database, collection string) InboxStore {
+	return &mongoInboxStore{
+		db:         db,
+		collection: collection,
+	}
+}
+
+func (this *mongoInboxStore) ensureIndexes() error {
+	coll := this.db.Collection(this.collection)
+	err := coll.EnsureIndexes(context.TODO(), nil, []string{"to"})
+	if err != nil {
+		return err
+	}
+	expire := int32(0)
+	return coll.CreateOneIndex(context.TODO(), options.IndexModel{Key: []string{"expire"}, ExpireAfterSeconds: &expire})
+}
+
+func (this *mongoInboxStore) Insert(m *InboxMessage) error {
+	_, err := this.db.Collection(this.collection).InsertOne(context.TODO(), m)
+	return err
+}
+
+func (this *mongoInboxStore) Find(to util.ID) ([]*InboxMessage, error) {
+	ret := []*InboxMessage{}
+	err := this.db.Collection(this.collection).Find(context.TODO(), bson.M{"to": to}).Sort("_id").All(&ret)
+	if err != nil && err != qmgo.ErrNoSuchDocuments {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (this *mongoInboxStore) Remove(ids []util.ID) error {
+	_, err := this.db.Collection(this.collection).RemoveAll(context.TODO(), bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
+
+type inboxFlush chan struct{}
+
+var _ lokas.IModule = (*Inbox)(nil)
+
+// Inbox store the messages of the persistent types routed to avatars not loaded,
+// and deliver them when the avatar is created
+type Inbox struct {
+	process    lokas.IProcess
+	Collection string
+	TTL        time.Duration //messages expire after,0 means never
+	Max        int           //max messages of an avatar,the oldest are dropped,0 means no limit
+	MaxSize    int           //max bytes of a message
+	Store      InboxStore    //MongoInboxStore of the Collection if not set before started
+	persistent map[protocol.BINARY_TAG]bool
+	queue      chan interface{}
+	done       chan struct{}
+	started    bool
+}
+
+func NewInbox() *Inbox {
+	return &Inbox{
+		Collection: INBOX_COLLECTION,
+		TTL:        time.Hour * 24 * 30,
+		Max:        100,
+		MaxSize:    1 << 16,
+		persistent: map[protocol.BINARY_TAG]bool{},
+		queue:      make(chan interface{}, 1024),
+		done:       make(chan struct{}),
+	}
+}
+
+func (this *Inbox) Type() string {
+	return InboxCtor.Type()
+}
+
+func (this *Inbox) GetProcess() lokas.IProcess {
+	return this.process
+}
+
+func (this *Inbox) SetProcess(process lokas.IProcess) {
+	this.process = process
+}
+
+// RegisterPersistent the message types kept for the avatars not loaded
+func (this *Inbox) RegisterPersistent(tags ...protocol.BINARY_TAG) {
+	for _, tag := range tags {
+		this.persistent[tag] = true
+	}
+}
+
+// IsPersistent whether the message is kept,replies and requests waiting for replies are not
+func (this *Inbox) IsPersistent(msg *protocol.RouteMessage) bool {
+	if msg.TransId != 0 || msg.Body == nil {
+		return false
+	}
+	id, err := msg.Body.GetId()
+	if err != nil {
+		return false
+	}
+	return this.persistent[id]
+}
+
+func (this *Inbox) Load(conf lokas.IConfig) error {
+	if conf == nil {
+		return nil
+	}
+	if conf.IsSet("collection") {
+		this.Collection = conf.GetString("collection")
+	}
+	if conf.IsSet("ttl") {
+		this.TTL = conf.GetDuration("ttl")
+	}
+	if conf.IsSet("max") {
+		this.Max = conf.GetInt("max")
+	}
+	if conf.IsSet("max_size") {
+		this.MaxSize = int(conf.GetSizeInBytes("max_size"))
+	}
+	for _, name := range conf.GetStringSlice("types") {
+		tag := protocol.GetTypeRegistry().GetTagByName(name)
+		if tag == 0 {
+			log.Error("inbox type not found", zap.String("type", name))
+			return protocol.ERR_TYPE_NOT_FOUND
+		}
+		this.RegisterPersistent(tag)
+	}
+	return nil
+}
+
+func (this *Inbox) Unload() error {
+	return nil
+}
+
+func (this *Inbox) Start() error {
+	if this.Store == nil {
+		store := MongoInboxStore(this.process.GetMongo(), this.Collection).(*mongoInboxStore)
+		err := store.ensureIndexes()
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		this.Store = store
+	}
+	this.started = true
+	go this.work()
+	return nil
+}
+
+// Stop write the messages queued
+func (this *Inbox) Stop() error {
+	if !this.started {
+		return nil
+	}
+	this.flush()
+	this.started = false
+	close(this.done)
+	return nil
+}
+
+func (this *Inbox) OnStart() error {
+	return nil
+}
+
+func (this *Inbox) OnStop() error {
+	return nil
+}
+
+// Put queue the message to be stored,the order of the messages is kept,
+// called by the router so the message is dropped instead of waiting when the queue is full
+func (this *Inbox) Put(msg *protocol.RouteMessage) error {
+	data, err := protocol.MarshalBinaryMessage(0, msg.Body)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	if this.MaxSize > 0 && len(data) > this.MaxSize {
+		log.Warn("inbox message too large", msg.LogInfo().Append(zap.Int("size", len(data)))...)
+		return protocol.ERR_MSG_LEN_INVALID
+	}
+	cmd, _ := msg.Body.GetId()
+	m := &InboxMessage{
+		Id:   this.process.GenId(),
+		To:   msg.ToActor,
+		From: msg.FromActor,
+		Cmd:  cmd,
+		Data: data,
+	}
+	if this.TTL > 0 {
+		m.Expire = time.Now().Add(this.TTL)
+	}
+	select {
+	case this.queue <- m:
+		return nil
+	case <-this.done:
+		return protocol.ERR_ACTOR_NOT_FOUND
+	default:
+		log.Warn("inbox queue full,message dropped", msg.LogInfo()...)
+		return protocol.ERR_INBOX_FULL
+	}
+}
+
+func (this *Inbox) work() {
+	for {
+		select {
+		case v := <-this.queue:
+			switch v := v.(type) {
+			case *InboxMessage:
+				err := this.store(v)
+				if err != nil {
+					log.Error("store inbox message failed", flog.AvatarId(v.To), protocol.LogCmdId(v.Cmd), flog.Error(err))
+				}
+			case inboxFlush:
+				close(v)
+			}
+		case <-this.done:
+			return
+		}
+	}
+}
+
+// flush wait for the messages queued before to be stored
+func (this *Inbox) flush() {
+	if !this.started {
+		return
+	}
+	ch := make(inboxFlush)
+	select {
+	case this.queue <- ch:
+	case <-this.done:
+		return
+	}
+	select {
+	case <-ch:
+	case <-this.done:
+	}
+}
+
+func (this *Inbox) store(m *InboxMessage) error {
+	err := this.Store.Insert(m)
+	if err != nil {
+		return err
+	}
+	if this.Max <= 0 {
+		return nil
+	}
+	msgs, err := this.Store.Find(m.To)
+	if err != nil {
+		return err
+	}
+	if len(msgs) <= this.Max {
+		return nil
+	}
+	ids := make([]util.ID, 0, len(msgs)-this.Max)
+	for _, o := range msgs[:len(msgs)-this.Max] {
+		ids = append(ids, o.Id)
+	}
+	err = this.Store.Remove(ids)
+	if err != nil {
+		return err
+	}
+	log.Warn("inbox full,oldest messages dropped", flog.AvatarId(m.To), zap.Int("count", len(ids)))
+	return nil
+}
+
+// Fetch the messages of the avatar not expired in order
+func (this *Inbox) Fetch(id util.ID) ([]*InboxMessage, error) {
+	this.flush()
+	ret, err := this.Store.Find(id)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	now := time.Now()
+	msgs := ret[:0]
+	for _, m := range ret {
+		if m.Expire.IsZero() || m.Expire.After(now) {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs, nil
+}
+
+// Deliver send the messages kept to the actor and remove them,the messages stored meanwhile are kept for the next delivery
+func (this *Inbox) Deliver(actor lokas.IActor) error {
+	msgs, err := this.Fetch(actor.GetId())
+	if err != nil || len(msgs) == 0 {
+		return err
+	}
+	ids := make([]util.ID, 0, len(msgs))
+	for _, m := range msgs {
+		ids = append(ids, m.Id)
+		msg, err := protocol.UnmarshalBinaryMessage(m.Data)
+		if err != nil {
+			log.Error("unmarshal inbox message failed", flog.AvatarId(m.To), protocol.LogCmdId(m.Cmd), flog.Error(err))
+			continue
+		}
+		actor.ReceiveMessage(protocol.NewRouteMessage(m.From, m.To, 0, msg.Body, true))
+	}
+	err = this.Store.Remove(ids)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	log.Info("inbox delivered", flog.AvatarId(actor.GetId()), zap.Int("count", len(msgs)))
+	return nil
+}
@@ -16,9 +16,15 @@ import (
 const TOKEN_EXPIRE_TIME = time.Minute * 10
 const REFRESH_TOKEN_EXPIRE_TIME = time.Hour * 24 * 30
 
+const (
+	TOKEN_ACCESS  = ""
+	TOKEN_REFRESH = "refresh" //only accepted by the refresh api
+)
+
 type JwtClaim struct {
 	Create time.Time
 	Expire int64
+	Type   string `json:",omitempty"`
 }
 
 func NewJwtClaim(expire time.Duration) *JwtClaim {
@@ -34,6 +40,29 @@ type JwtClaimWithUser interface {
 	SetUser(user interface{})
 }
 
+// JwtClaimWithType the claim telling the refresh tokens from the access tokens,
+// the claims without it are taken as access tokens
+type JwtClaimWithType interface {
+	GetTokenType() string
+	SetTokenType(t string)
+}
+
+// GetTokenType return the token type of the claim,TOKEN_ACCESS if the claim has no type
+func GetTokenType(claim jwt.Claims) string {
+	if c, ok := claim.(JwtClaimWithType); ok {
+		return c.GetTokenType()
+	}
+	return TOKEN_ACCESS
+}
+
+// SetTokenType mark the claim with the token type if it has one
+func SetTokenType(claim JwtClaimWithUser, t string) JwtClaimWithUser {
+	if c, ok := claim.(JwtClaimWithType); ok {
+		c.SetTokenType(t)
+	}
+	return claim
+}
+
 type UserCreator func() interface{}
 
 type JwtClaimCreator func(user interface{}, expire time.Duration) JwtClaimWithUser
@@ -46,6 +75,14 @@ func (this *JwtClaim) Valid() error {
 	return nil
 }
 
+func (this *JwtClaim) GetTokenType() string {
+	return this.Type
+}
+
+func (this *JwtClaim) SetTokenType(t string) {
+	this.Type = t
+}
+
 func (this *JwtClaim) Marshal() ([]byte, error) {
 	return protocol.MarshalBinary(this)
 }
@@ -74,13 +111,17 @@ func JwtAuth(rsa bool, creator JwtClaimCreator, userCreator UserCreator) func(w
 			w.Failed(protocol.ERR_TOKEN_VALIDATE)
 			return
 		}
-		var key string
-		if rsa {
-			key = a.Config().GetString("SigningKeyPublic")
-		} else {
-			key = a.Config().GetString("SigningKey")
+		token, err := jwt.ParseWithClaims(split[1], creator(userCreator(), time.Hour*24), func(token *jwt.Token) (interface{}, error) {
+			if rsa {
+				return jwt.ParseRSAPublicKeyFromPEM([]byte(a.Config().GetString("SigningKeyPublic")))
+			}
+			return []byte(a.Config().GetString("SigningKey")), nil
+		})
+		if err == nil && token.Valid && GetTokenType(token.Claims) != TOKEN_ACCESS {
+			log.Warn("refresh token used as access token", zap.String("token", t))
+			w.Failed(protocol.ERR_TOKEN_VALIDATE)
+			return
 		}
-		token, err := jwt.ParseWithClaims(split[1], creator(userCreator(), time.Hour*24), func(token *jwt.Token) (interface{}, error) { return []byte(key), nil })
 		if err != nil || token.Valid != true {
 			// 过期或者非正确处理
 			log.Warn("token invalid", zap.String("token", t), zap.Error(err))
@@ -101,17 +142,32 @@ func JwtAuth(rsa bool, creator JwtClaimCreator, userCreator UserCreator) func(w
 }
 
 func SignToken(creator JwtClaimCreator, user interface{}, a lokas.IProcess, expire time.Duration, rsa bool) (string, error) {
+	return signToken(creator, user, a, expire, rsa, TOKEN_ACCESS)
+}
+
+// SignRefreshToken sign the refresh token,which is refused as an access token
+func SignRefreshToken(creator JwtClaimCreator, user interface{}, a lokas.IProcess, rsa bool) (string, error) {
+	return signToken(creator, user, a, REFRESH_TOKEN_EXPIRE_TIME, rsa, TOKEN_REFRESH)
+}
+
+func signToken(creator JwtClaimCreator, user interface{}, a lokas.IProcess, expire time.Duration, rsa bool, tokenType string) (string, error) {
 	var claim *jwt.Token
-	var key string
+	var key interface{}
 	if rsa {
-		key = a.Config().GetString("SigningKeyPrivate")
-		claim = jwt.NewWithClaims(jwt.SigningMethodRS256, creator(user, expire))
+		//the PEM private key is parsed,RS256 refuses the raw bytes
+		privateKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(a.Config().GetString("SigningKeyPrivate")))
+		if err != nil {
+			log.Error("parse SigningKeyPrivate failed", zap.Error(err))
+			return "", err
+		}
+		key = privateKey
+		claim = jwt.NewWithClaims(jwt.SigningMethodRS256, SetTokenType(creator(user, expire), tokenType))
 	} else {
-		key = a.Config().GetString("SigningKey")
-		claim = jwt.NewWithClaims(jwt.SigningMethodHS256, creator(user, expire))
+		key = []byte(a.Config().GetString("SigningKey"))
+		claim = jwt.NewWithClaims(jwt.SigningMethodHS256, SetTokenType(creator(user, expire), tokenType))
 	}
 
-	token, err := claim.SignedString([]byte(key))
+	token, err := claim.SignedString(key)
 	if err != nil {
 		log.Error("sign token failed", zap.Error(err))
 		return "", err
@@ -134,7 +190,7 @@ func JwtSign(rsa bool, creator JwtClaimCreator) func(w rox.ResponseWriter, r *ht
 			w.Response(http.StatusInternalServerError, "服务器繁忙")
 			return
 		}
-		refresh_token, err := SignToken(creator, user, a, REFRESH_TOKEN_EXPIRE_TIME, rsa)
+		refresh_token, err := SignRefreshToken(creator, user, a, rsa)
 		if err != nil {
 			log.Error("生成令牌出错")
 			w.Failed(protocol.ERR_TOKEN_VALIDATE)
@@ -0,0 +1,689 @@
+package lox
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/log/flog"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/timer"
+	"github.com/nomos/go-lokas/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.uber.org/zap"
+)
+
+const (
+	LEADERBOARD_SERVICE    = "Leaderboard"
+	LEADERBOARD_COLLECTION = "leaderboard" //the final standings archived on reset
+
+	LEADERBOARD_KEY         lokas.Key = "leaderboard:%s:%d"      //sorted set of the board on the server
+	LEADERBOARD_META_KEY    lokas.Key = "leaderboard:%s:%d:meta" //start and season of the board on the server
+	LEADERBOARD_ARCHIVE_KEY lokas.Key = "leaderboard:%s:%d:archive"
+	LEADERBOARD_SERVERS_KEY lokas.Key = "leaderboard:%s:servers"  //servers having the board
+	LEADERBOARD_RESET_KEY   lokas.Key = "leaderboard:%s:reset:%d" //lock of the scheduled reset at the unix minute
+
+	LEADERBOARD_RESET_LOCK_TTL = 3600 //seconds the reset lock is kept
+)
+
+// LeaderboardPolicy how the score of an update is applied
+type LeaderboardPolicy string
+
+const (
+	LEADERBOARD_MAX    LeaderboardPolicy = "max"    //keep the best score
+	LEADERBOARD_SUM    LeaderboardPolicy = "sum"    //add to the score
+	LEADERBOARD_LATEST LeaderboardPolicy = "latest" //replace the score
+)
+
+// the redis score is score<<tieBits plus the seconds left to the end of the tie window from the start of the season,
+// so the equal scores reached earlier rank higher,an empty reply if the score applied is out of range
+const leaderboardUpdateScript = `
+local now = tonumber(ARGV[3])
+local base = tonumber(ARGV[4])
+local start = tonumber(redis.call('HGET', KEYS[2], 'start'))
+if not start then
+	start = now
+	redis.call('HSET', KEYS[2], 'start', start)
+end
+local elapsed = now - start
+if elapsed < 0 then elapsed = 0 end
+if elapsed > base - 1 then elapsed = base - 1 end
+local score = tonumber(ARGV[2])
+local old = redis.call('ZSCORE', KEYS[1], ARGV[5])
+local v
+if old and ARGV[1] == 'max' and math.floor(tonumber(old) / base) >= score then
+	v = tonumber(old)
+else
+	if old and ARGV[1] == 'sum' then
+		score = score + math.floor(tonumber(old) / base)
+	end
+	local limit = tonumber(ARGV[7])
+	if score >= limit or score <= -limit then
+		return {}
+	end
+	v = score * base + base - 1 - elapsed
+	redis.call('ZADD', KEYS[1], v, ARGV[5])
+	redis.call('SADD', KEYS[3], ARGV[6])
+end
+return {v, redis.call('ZREVRANK', KEYS[1], ARGV[5]), start}
+`
+
+// rename the board to archive and start a new season,return the season finished and its start,
+// the season is marked archiving in the meta until archived,{-1,0} if the last season is still archiving
+const leaderboardResetScript = `
+if redis.call('HGET', KEYS[2], 'archiving') then
+	return {-1, 0}
+end
+local season = redis.call('HINCRBY', KEYS[2], 'season', 1)
+local start = tonumber(redis.call('HGET', KEYS[2], 'start')) or 0
+redis.call('HSET', KEYS[2], 'start', ARGV[1])
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	redis.call('RENAME', KEYS[1], KEYS[3])
+end
+redis.call('HMSET', KEYS[2], 'archiving', season - 1, 'archive_start', start, 'archive_end', ARGV[1])
+return {season - 1, start}
+`
+
+// LeaderboardEntry the standing of a member,Rank starts from 1,Time is the unix second the score was reached
+type LeaderboardEntry struct {
+	Member int64
+	Score  int64
+	Rank   int64
+	Time   int64
+}
+
+func (this *LeaderboardEntry) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *LeaderboardEntry) Serializable() protocol.ISerializable {
+	return this
+}
+
+// LeaderboardUpdate apply the score of the member by the policy of the board,replied with the LeaderboardEntry
+type LeaderboardUpdate struct {
+	Board    string
+	ServerId int32
+	Member   int64
+	Score    int64
+}
+
+func (this *LeaderboardUpdate) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *LeaderboardUpdate) Serializable() protocol.ISerializable {
+	return this
+}
+
+// LeaderboardQuery the page of the top entries,replied with the LeaderboardPage
+type LeaderboardQuery struct {
+	Board    string
+	ServerId int32
+	Offset   int32
+	Limit    int32
+}
+
+func (this *LeaderboardQuery) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *LeaderboardQuery) Serializable() protocol.ISerializable {
+	return this
+}
+
+// LeaderboardAround the entries ranked within Range around the member,replied with the LeaderboardPage,
+// empty if the member is not ranked
+type LeaderboardAround struct {
+	Board    string
+	ServerId int32
+	Member   int64
+	Range    int32
+}
+
+func (this *LeaderboardAround) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *LeaderboardAround) Serializable() protocol.ISerializable {
+	return this
+}
+
+type LeaderboardPage struct {
+	Board    string
+	ServerId int32
+	Season   int64
+	Total    int64
+	Entries  []*LeaderboardEntry
+}
+
+func (this *LeaderboardPage) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *LeaderboardPage) Serializable() protocol.ISerializable {
+	return this
+}
+
+// LeaderboardArchive the final standings of a season kept in mongo
+type LeaderboardArchive struct {
+	Id       util.ID `bson:"_id"`
+	Board    string
+	ServerId int32
+	Season   int64
+	Start    time.Time
+	End      time.Time
+	Entries  []*LeaderboardEntry
+}
+
+// EncodeLeaderboardScore the redis score of the score reached elapsed seconds after the start of the season
+func EncodeLeaderboardScore(score int64, elapsed int64, tieBits uint) int64 {
+	base := int64(1) << tieBits
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	if elapsed > base-1 {
+		elapsed = base - 1
+	}
+	return score*base + base - 1 - elapsed
+}
+
+// DecodeLeaderboardScore the score and the unix second it was reached from the redis score
+func DecodeLeaderboardScore(v int64, start int64, tieBits uint) (int64, int64) {
+	base := int64(1) << tieBits
+	score := v / base
+	if v%base < 0 {
+		score--
+	}
+	tie := v - score*base
+	return score, start + base - 1 - tie
+}
+
+// LeaderboardBoard the config of a board
+type LeaderboardBoard struct {
+	Name    string
+	Policy  LeaderboardPolicy
+	Reset   string //cron of the reset,second minute hour day month weekday,empty for never
+	Archive int    //top entries archived to mongo on reset,0 for none,negative for all
+}
+
+var LeaderboardCtor = leaderboardCtor{}
+
+type leaderboardCtor struct{}
+
+func (this leaderboardCtor) Type() string {
+	return LEADERBOARD_SERVICE
+}
+
+func (this leaderboardCtor) Create() lokas.IModule {
+	ret := &Leaderboard{
+		Actor:      NewActor(),
+		Collection: LEADERBOARD_COLLECTION,
+		TieBits:    24,
+		MaxPage:    100,
+		Boards:     map[string]*LeaderboardBoard{},
+		crons:      []timer.TimeNoder{},
+	}
+	ret.SetType(this.Type())
+	ret.MsgHandler = ret.HandleMsg
+	return ret
+}
+
+var _ lokas.IActor = (*Leaderboard)(nil)
+
+// Leaderboard the ranking service on redis sorted sets,one board per name and server id,
+// registered as the Leaderboard service so the avatars reach it by RouteMsgToService
+//
+//	[Leaderboard]
+//	service_id = 0
+//	line_id = 1
+//	tie_bits = 24          //seconds of the tie window,the scores are limited to 53-tie_bits bits
+//	[Leaderboard.boards.level]
+//	policy = "max"         //max,sum or latest
+//	reset = "0 0 5 ? * 1"  //weekly on monday 5:00
+//	archive = 100
+type Leaderboard struct {
+	*Actor
+	ServiceId   uint16
+	LineId      uint16
+	Collection  string
+	TieBits     uint
+	MaxPage     int32
+	Boards      map[string]*LeaderboardBoard
+	crons       []timer.TimeNoder
+	serviceInfo *lokas.ServiceInfo
+}
+
+// Register add the board,overriding the config
+func (this *Leaderboard) Register(board *LeaderboardBoard) error {
+	switch board.Policy {
+	case LEADERBOARD_MAX, LEADERBOARD_SUM, LEADERBOARD_LATEST:
+	case "":
+		board.Policy = LEADERBOARD_MAX
+	default:
+		log.Error("leaderboard policy invalid", zap.String("board", board.Name), zap.String("policy", string(board.Policy)))
+		return protocol.ERR_CONFIG_ERROR
+	}
+	if board.Reset != "" && len(strings.Fields(board.Reset)) != 6 {
+		log.Error("leaderboard reset invalid", zap.String("board", board.Name), zap.String("reset", board.Reset))
+		return protocol.ERR_CONFIG_ERROR
+	}
+	this.Boards[board.Name] = board
+	return nil
+}
+
+func (this *Leaderboard) Load(conf lokas.IConfig) error {
+	if conf == nil {
+		return nil
+	}
+	this.ServiceId = uint16(conf.GetInt("service_id"))
+	this.LineId = uint16(conf.GetInt("line_id"))
+	if conf.IsSet("collection") {
+		this.Collection = conf.GetString("collection")
+	}
+	if conf.IsSet("tie_bits") {
+		this.TieBits = uint(conf.GetInt("tie_bits"))
+	}
+	if conf.IsSet("max_page") {
+		this.MaxPage = int32(conf.GetInt("max_page"))
+	}
+	if this.TieBits == 0 || this.TieBits > 40 {
+		log.Error("leaderboard tie_bits invalid", zap.Uint("tie_bits", this.TieBits))
+		return protocol.ERR_CONFIG_ERROR
+	}
+	for name := range conf.GetStringMap("boards") {
+		sub := conf.Sub("boards." + name)
+		err := this.Register(&LeaderboardBoard{
+			Name:    name,
+			Policy:  LeaderboardPolicy(sub.GetString("policy")),
+			Reset:   sub.GetString("reset"),
+			Archive: sub.GetInt("archive"),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *Leaderboard) Unload() error {
+	return nil
+}
+
+func (this *Leaderboard) Start() error {
+	if this.GetProcess().GetRedis() == nil {
+		log.Error("leaderboard needs redis")
+		return protocol.ERR_CONFIG_ERROR
+	}
+	this.StartMessagePump()
+	for _, board := range this.Boards {
+		if board.Reset == "" {
+			continue
+		}
+		name := board.Name
+		f := strings.Fields(board.Reset)
+		this.crons = append(this.crons, this.Cron(f[0], f[1], f[2], f[3], f[4], f[5], func(noder timer.TimeNoder) {
+			err := this.resetScheduled(name, time.Now())
+			if err != nil {
+				log.Error("reset leaderboard failed", zap.String("board", name), flog.Error(err))
+			}
+		}))
+	}
+	return nil
+}
+
+func (this *Leaderboard) Stop() error {
+	for _, c := range this.crons {
+		c.Stop()
+	}
+	this.crons = []timer.TimeNoder{}
+	this.Cancel()
+	return nil
+}
+
+func (this *Leaderboard) OnStart() error {
+	err := this.GetProcess().RegisterActorLocal(this)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	err = this.GetProcess().RegisterActorRemote(this)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	this.serviceInfo = &lokas.ServiceInfo{
+		ServiceType: LEADERBOARD_SERVICE,
+		ServiceId:   this.ServiceId,
+		LineId:      this.LineId,
+		ProcessId:   this.GetProcess().PId(),
+		ActorId:     this.GetId(),
+		Version:     this.GetProcess().Version(),
+	}
+	err = this.GetProcess().GetServiceRegisterMgr().Register(this.serviceInfo)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (this *Leaderboard) OnStop() error {
+	if this.serviceInfo != nil {
+		this.GetProcess().GetServiceRegisterMgr().Unregister(this.serviceInfo.ServiceType, this.serviceInfo.ServiceId, this.serviceInfo.LineId)
+		this.serviceInfo = nil
+	}
+	err := this.GetProcess().UnregisterActorLocal(this)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	err = this.GetProcess().UnregisterActorRemote(this)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (this *Leaderboard) HandleMsg(actorId util.ID, transId uint32, msg protocol.ISerializable) (protocol.ISerializable, error) {
+	switch m := msg.(type) {
+	case *LeaderboardUpdate:
+		return this.UpdateScore(m.Board, m.ServerId, m.Member, m.Score)
+	case *LeaderboardQuery:
+		return this.Top(m.Board, m.ServerId, m.Offset, m.Limit)
+	case *LeaderboardAround:
+		return this.Around(m.Board, m.ServerId, m.Member, m.Range)
+	}
+	return nil, protocol.ERR_TYPE_NOT_FOUND
+}
+
+func (this *Leaderboard) board(name string) (*LeaderboardBoard, error) {
+	board, ok := this.Boards[name]
+	if !ok {
+		log.Warn("leaderboard not found", zap.String("board", name))
+		return nil, protocol.ERR_PARAM_NOT_EXIST
+	}
+	return board, nil
+}
+
+// UpdateScore apply the score of the member by the policy of the board
+func (this *Leaderboard) UpdateScore(name string, serverId int32, member int64, score int64) (*LeaderboardEntry, error) {
+	board, err := this.board(name)
+	if err != nil {
+		return nil, err
+	}
+	limit := int64(1) << (52 - this.TieBits)
+	if score >= limit || score <= -limit {
+		return nil, protocol.ERR_PARAM_TYPE
+	}
+	now := time.Now().Unix()
+	values, err := this.GetProcess().GetRedis().Execute("EVAL", leaderboardUpdateScript, 3,
+		LEADERBOARD_KEY.Assemble(name, serverId), LEADERBOARD_META_KEY.Assemble(name, serverId), LEADERBOARD_SERVERS_KEY.Assemble(name),
+		string(board.Policy), score, now, int64(1)<<this.TieBits, member, serverId, limit).Values()
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	if len(values) == 0 {
+		log.Warn("leaderboard score out of range", zap.String("board", name), flog.ServerId(serverId), zap.Int64("member", member))
+		return nil, protocol.ERR_PARAM_TYPE
+	}
+	if len(values) != 3 {
+		return nil, protocol.ERR_DB_ERROR
+	}
+	v, err := redisInt64(values[0])
+	if err != nil {
+		return nil, err
+	}
+	rank, _ := redisInt64(values[1])
+	start, _ := redisInt64(values[2])
+	ret := &LeaderboardEntry{Member: member, Rank: rank + 1}
+	ret.Score, ret.Time = DecodeLeaderboardScore(v, start, this.TieBits)
+	return ret, nil
+}
+
+// Top the page of the entries from offset
+func (this *Leaderboard) Top(name string, serverId int32, offset int32, limit int32) (*LeaderboardPage, error) {
+	_, err := this.board(name)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || limit > this.MaxPage {
+		limit = this.MaxPage
+	}
+	return this.page(name, serverId, int64(offset), int64(offset+limit-1))
+}
+
+// Around the entries ranked within rng around the member
+func (this *Leaderboard) Around(name string, serverId int32, member int64, rng int32) (*LeaderboardPage, error) {
+	_, err := this.board(name)
+	if err != nil {
+		return nil, err
+	}
+	if rng < 0 || rng > this.MaxPage/2 {
+		rng = this.MaxPage / 2
+	}
+	reply := this.GetProcess().GetRedis().ZREVRank(LEADERBOARD_KEY.Assemble(name, serverId), strconv.FormatInt(member, 10))
+	if reply.Error != nil {
+		log.Error(reply.Error.Error())
+		return nil, reply.Error
+	}
+	if reply.Value == nil {
+		return this.page(name, serverId, 0, -1)
+	}
+	rank, err := reply.Int64()
+	if err != nil {
+		return nil, err
+	}
+	from := rank - int64(rng)
+	if from < 0 {
+		from = 0
+	}
+	return this.page(name, serverId, from, rank+int64(rng))
+}
+
+// page read the entries ranked from start to stop,none if stop is negative
+func (this *Leaderboard) page(name string, serverId int32, start int64, stop int64) (*LeaderboardPage, error) {
+	redis := this.GetProcess().GetRedis()
+	key := LEADERBOARD_KEY.Assemble(name, serverId)
+	meta, err := redis.HMGet(LEADERBOARD_META_KEY.Assemble(name, serverId), "start", "season").Values()
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	seasonStart, _ := redisInt64(meta[0])
+	season, _ := redisInt64(meta[1])
+	total, err := redis.ZCard(key).Int64()
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	ret := &LeaderboardPage{
+		Board:    name,
+		ServerId: serverId,
+		Season:   season,
+		Total:    total,
+		Entries:  []*LeaderboardEntry{},
+	}
+	if stop < 0 {
+		return ret, nil
+	}
+	ret.Entries, err = this.entries(key, start, stop, seasonStart)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (this *Leaderboard) entries(key string, start int64, stop int64, seasonStart int64) ([]*LeaderboardEntry, error) {
+	values, err := this.GetProcess().GetRedis().ZRevRange(key, int(start), int(stop), true).Strings()
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	ret := []*LeaderboardEntry{}
+	for i := 0; i+1 < len(values); i += 2 {
+		member, err := strconv.ParseInt(values[i], 10, 64)
+		if err != nil {
+			log.Error(err.Error())
+			return nil, protocol.ERR_DB_ERROR
+		}
+		v, err := strconv.ParseFloat(values[i+1], 64)
+		if err != nil {
+			log.Error(err.Error())
+			return nil, protocol.ERR_DB_ERROR
+		}
+		entry := &LeaderboardEntry{Member: member, Rank: start + int64(i/2) + 1}
+		entry.Score, entry.Time = DecodeLeaderboardScore(int64(v), seasonStart, this.TieBits)
+		ret = append(ret, entry)
+	}
+	return ret, nil
+}
+
+// resetScheduled reset the board fired by the cron,every process runs the cron,
+// only the one taking the lock of the board and the minute resets
+func (this *Leaderboard) resetScheduled(name string, at time.Time) error {
+	key := LEADERBOARD_RESET_KEY.Assemble(name, at.Truncate(time.Minute).Unix())
+	reply := this.GetProcess().GetRedis().Execute("SET", key, this.GetProcess().PId(), "NX", "EX", LEADERBOARD_RESET_LOCK_TTL)
+	if reply.Error != nil {
+		return reply.Error
+	}
+	if reply.Value == nil {
+		log.Info("leaderboard reset by other process", zap.String("board", name))
+		return nil
+	}
+	return this.Reset(name)
+}
+
+// Reset start a new season of the board on all the servers,the final standings are archived to mongo if configured,
+// a season failed to archive is kept and retried by the next reset,which is skipped on the server until archived
+func (this *Leaderboard) Reset(name string) error {
+	board, err := this.board(name)
+	if err != nil {
+		return err
+	}
+	redis := this.GetProcess().GetRedis()
+	servers, err := redis.SMembers(LEADERBOARD_SERVERS_KEY.Assemble(name)).Strings()
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	now := time.Now()
+	for _, s := range servers {
+		serverId, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+		err = this.archivePending(board, int32(serverId))
+		if err != nil {
+			log.Error("archive leaderboard failed,reset skipped", zap.String("board", name), flog.ServerId(int32(serverId)), flog.Error(err))
+			continue
+		}
+		values, err := redis.Execute("EVAL", leaderboardResetScript, 3,
+			LEADERBOARD_KEY.Assemble(name, serverId), LEADERBOARD_META_KEY.Assemble(name, serverId), LEADERBOARD_ARCHIVE_KEY.Assemble(name, serverId), now.Unix()).Values()
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		season, _ := redisInt64(values[0])
+		if season < 0 {
+			log.Error("leaderboard still archiving,reset skipped", zap.String("board", name), flog.ServerId(int32(serverId)))
+			continue
+		}
+		log.Warn("leaderboard reset", zap.String("board", name), flog.ServerId(int32(serverId)), zap.Int64("season", season))
+		err = this.archivePending(board, int32(serverId))
+		if err != nil {
+			//the standings are kept in the archive key and retried by the next reset
+			log.Error("archive leaderboard failed", zap.String("board", name), flog.ServerId(int32(serverId)), zap.Int64("season", season), flog.Error(err))
+		}
+	}
+	return nil
+}
+
+// archivePending archive the season marked archiving by the reset script,then remove the archive key and the mark
+func (this *Leaderboard) archivePending(board *LeaderboardBoard, serverId int32) error {
+	redis := this.GetProcess().GetRedis()
+	metaKey := LEADERBOARD_META_KEY.Assemble(board.Name, serverId)
+	meta, err := redis.HMGet(metaKey, "archiving", "archive_start", "archive_end").Values()
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	if len(meta) != 3 {
+		return protocol.ERR_DB_ERROR
+	}
+	if meta[0] == nil {
+		return nil
+	}
+	season, _ := redisInt64(meta[0])
+	start, _ := redisInt64(meta[1])
+	end, _ := redisInt64(meta[2])
+	archiveKey := LEADERBOARD_ARCHIVE_KEY.Assemble(board.Name, serverId)
+	if board.Archive != 0 {
+		err = this.archive(board, serverId, season, time.Unix(start, 0), time.Unix(end, 0), archiveKey, start)
+		if err != nil {
+			return err
+		}
+	}
+	reply := redis.Del(archiveKey)
+	if reply.Error != nil {
+		return reply.Error
+	}
+	reply = redis.Execute("HDEL", metaKey, "archiving", "archive_start", "archive_end")
+	if reply.Error != nil {
+		return reply.Error
+	}
+	return nil
+}
+
+// archive insert the standings of the season,skipped if inserted by a former try
+func (this *Leaderboard) archive(board *LeaderboardBoard, serverId int32, season int64, start time.Time, end time.Time, key string, seasonStart int64) error {
+	coll := this.GetProcess().GetMongo().Collection(this.Collection)
+	n, err := coll.Find(context.TODO(), bson.M{"board": board.Name, "serverid": serverId, "season": season}).Count()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	stop := int64(board.Archive) - 1
+	if board.Archive < 0 {
+		stop = -1
+	}
+	entries, err := this.entries(key, 0, stop, seasonStart)
+	if err != nil {
+		return err
+	}
+	_, err = coll.InsertOne(context.TODO(), &LeaderboardArchive{
+		Id:       this.GetProcess().GenId(),
+		Board:    board.Name,
+		ServerId: serverId,
+		Season:   season,
+		Start:    start,
+		End:      end,
+		Entries:  entries,
+	})
+	return err
+}
+
+func redisInt64(v interface{}) (int64, error) {
+	switch i := v.(type) {
+	case int64:
+		return i, nil
+	case []byte:
+		f, err := strconv.ParseFloat(string(i), 64)
+		return int64(f), err
+	case nil:
+		return 0, nil
+	}
+	return 0, protocol.ERR_DB_ERROR
+}
@@ -0,0 +1,638 @@
+package lox
+
+import (
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/log/flog"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/timer"
+	"github.com/nomos/go-lokas/util"
+	"go.uber.org/zap"
+)
+
+type MatchCancelReason int32
+
+const (
+	MATCH_CANCEL_LEFT    MatchCancelReason = iota + 1 //a member of the party left the queue
+	MATCH_CANCEL_TIMEOUT                              //waited longer than the timeout of the mode
+	MATCH_CANCEL_STOPPED                              //the matchmaker stopped,join again
+)
+
+// MatchTeam the avatars of a team
+type MatchTeam struct {
+	Members []int64
+}
+
+func (this *MatchTeam) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *MatchTeam) Serializable() protocol.ISerializable {
+	return this
+}
+
+// MatchJoin queue the party for a match of the mode,the sender alone if Party is empty,
+// the sender must be a member of the Party,replied with the Response
+type MatchJoin struct {
+	Mode  string
+	Party []int64
+	Skill int32
+}
+
+func (this *MatchJoin) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *MatchJoin) Serializable() protocol.ISerializable {
+	return this
+}
+
+// MatchCancel remove the party of the sender from the queue,AvatarId is the sender or 0,replied with the Response
+type MatchCancel struct {
+	Mode     string
+	AvatarId int64
+}
+
+func (this *MatchCancel) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *MatchCancel) Serializable() protocol.ISerializable {
+	return this
+}
+
+// MatchFound sent to every avatar of the match,Team is the index of the team of the receiver
+type MatchFound struct {
+	Mode      string
+	RoomId    int64
+	ServiceId int32
+	LineId    int32
+	Team      int32
+	Teams     []*MatchTeam
+}
+
+func (this *MatchFound) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *MatchFound) Serializable() protocol.ISerializable {
+	return this
+}
+
+// MatchRoom sent to the room service line to create the room of the match,handled by the RoomManager
+type MatchRoom struct {
+	Mode   string
+	RoomId int64
+	Teams  []*MatchTeam
+}
+
+func (this *MatchRoom) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *MatchRoom) Serializable() protocol.ISerializable {
+	return this
+}
+
+// MatchCanceled sent to the avatars removed from the queue not by themselves
+type MatchCanceled struct {
+	Mode   string
+	Reason MatchCancelReason
+}
+
+func (this *MatchCanceled) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *MatchCanceled) Serializable() protocol.ISerializable {
+	return this
+}
+
+// MatchMode the config of a queue
+type MatchMode struct {
+	Name          string
+	TeamSize      int           //avatars per team
+	Teams         int           //teams per match
+	Bucket        int32         //skill width of a bucket
+	WidenAfter    time.Duration //the search window widens by one bucket on each side every period waited
+	MaxWiden      int           //max buckets searched on each side
+	Timeout       time.Duration //tickets waiting longer are dropped,0 means never
+	Interval      time.Duration //matching interval
+	RoomService   string        //service type creating the rooms
+	RoomServiceId uint16        //0 for all
+	RoomSelector  string        //labels of the room lines,such as "region=eu"
+}
+
+func LoadMatchMode(name string, conf lokas.IConfig) (*MatchMode, error) {
+	ret := &MatchMode{
+		Name:          name,
+		TeamSize:      conf.GetInt("team_size"),
+		Teams:         conf.GetInt("teams"),
+		Bucket:        int32(conf.GetInt("bucket")),
+		WidenAfter:    conf.GetDuration("widen_after"),
+		MaxWiden:      conf.GetInt("max_widen"),
+		Timeout:       conf.GetDuration("timeout"),
+		Interval:      conf.GetDuration("interval"),
+		RoomService:   conf.GetString("room_service"),
+		RoomServiceId: uint16(conf.GetInt("room_service_id")),
+		RoomSelector:  conf.GetString("room_selector"),
+	}
+	if ret.Teams == 0 {
+		ret.Teams = 2
+	}
+	if ret.Bucket <= 0 {
+		ret.Bucket = 100
+	}
+	if ret.WidenAfter == 0 {
+		ret.WidenAfter = time.Second * 10
+	}
+	if ret.Interval == 0 {
+		ret.Interval = time.Second
+	}
+	if ret.RoomService == "" {
+		ret.RoomService = ROOM_SERVICE
+	}
+	if ret.TeamSize <= 0 || ret.Teams <= 0 || ret.MaxWiden < 0 {
+		log.Error("match mode invalid", zap.String("mode", name), zap.Int("team_size", ret.TeamSize), zap.Int("teams", ret.Teams))
+		return nil, protocol.ERR_CONFIG_ERROR
+	}
+	return ret, nil
+}
+
+// MatchTicket a party waiting in the queue
+type MatchTicket struct {
+	Members  []util.ID
+	Skill    int32
+	Enqueued time.Time
+}
+
+// Match the tickets matched into the teams
+type Match struct {
+	Id      util.ID
+	Teams   [][]util.ID
+	Tickets []*MatchTicket
+}
+
+func (this *Match) teams() []*MatchTeam {
+	ret := []*MatchTeam{}
+	for _, team := range this.Teams {
+		t := &MatchTeam{Members: []int64{}}
+		for _, id := range team {
+			t.Members = append(t.Members, id.Int64())
+		}
+		ret = append(ret, t)
+	}
+	return ret
+}
+
+// MatchQueue the tickets of a mode in the order of enqueue,
+// matched by skill buckets with the search window widening while waiting
+type MatchQueue struct {
+	Mode    *MatchMode
+	tickets []*MatchTicket
+	members map[util.ID]*MatchTicket
+}
+
+func NewMatchQueue(mode *MatchMode) *MatchQueue {
+	return &MatchQueue{
+		Mode:    mode,
+		tickets: []*MatchTicket{},
+		members: map[util.ID]*MatchTicket{},
+	}
+}
+
+func (this *MatchQueue) Len() int {
+	return len(this.tickets)
+}
+
+func (this *MatchQueue) Add(ticket *MatchTicket) error {
+	if len(ticket.Members) == 0 || len(ticket.Members) > this.Mode.TeamSize {
+		return protocol.ERR_MATCH_PARTY_INVALID
+	}
+	for i, id := range ticket.Members {
+		if _, ok := this.members[id]; ok {
+			return protocol.ERR_MATCH_QUEUED
+		}
+		for _, other := range ticket.Members[:i] {
+			if other == id {
+				return protocol.ERR_MATCH_PARTY_INVALID
+			}
+		}
+	}
+	this.tickets = append(this.tickets, ticket)
+	for _, id := range ticket.Members {
+		this.members[id] = ticket
+	}
+	return nil
+}
+
+// Remove the ticket of the avatar,nil if not queued
+func (this *MatchQueue) Remove(id util.ID) *MatchTicket {
+	ticket, ok := this.members[id]
+	if !ok {
+		return nil
+	}
+	this.remove(map[*MatchTicket]bool{ticket: true})
+	return ticket
+}
+
+func (this *MatchQueue) remove(tickets map[*MatchTicket]bool) {
+	rest := this.tickets[:0]
+	for _, t := range this.tickets {
+		if tickets[t] {
+			for _, id := range t.Members {
+				delete(this.members, id)
+			}
+			continue
+		}
+		rest = append(rest, t)
+	}
+	this.tickets = rest
+}
+
+// Requeue put the tickets of a match failed back in the order of enqueue
+func (this *MatchQueue) Requeue(tickets []*MatchTicket) {
+	sort.SliceStable(tickets, func(i, j int) bool {
+		return tickets[i].Enqueued.Before(tickets[j].Enqueued)
+	})
+	for _, t := range tickets {
+		for _, id := range t.Members {
+			this.members[id] = t
+		}
+	}
+	merged := make([]*MatchTicket, 0, len(this.tickets)+len(tickets))
+	i := 0
+	for _, t := range this.tickets {
+		for i < len(tickets) && !tickets[i].Enqueued.After(t.Enqueued) {
+			merged = append(merged, tickets[i])
+			i++
+		}
+		merged = append(merged, t)
+	}
+	this.tickets = append(merged, tickets[i:]...)
+}
+
+// Expire remove the tickets waiting longer than the timeout
+func (this *MatchQueue) Expire(now time.Time) []*MatchTicket {
+	ret := []*MatchTicket{}
+	if this.Mode.Timeout <= 0 {
+		return ret
+	}
+	expired := map[*MatchTicket]bool{}
+	for _, t := range this.tickets {
+		if now.Sub(t.Enqueued) >= this.Mode.Timeout {
+			expired[t] = true
+			ret = append(ret, t)
+		}
+	}
+	this.remove(expired)
+	return ret
+}
+
+func (this *MatchQueue) bucket(t *MatchTicket) int {
+	b := int(t.Skill / this.Mode.Bucket)
+	if t.Skill < 0 && t.Skill%this.Mode.Bucket != 0 {
+		b--
+	}
+	return b
+}
+
+// window the buckets searched on each side of the ticket
+func (this *MatchQueue) window(t *MatchTicket, now time.Time) int {
+	w := int(now.Sub(t.Enqueued) / this.Mode.WidenAfter)
+	if w > this.Mode.MaxWiden {
+		w = this.Mode.MaxWiden
+	}
+	return w
+}
+
+// Match the tickets from the oldest,each takes the tickets within its window in the order of enqueue,
+// the oldest waits longest so its window covers the windows of the others
+func (this *MatchQueue) Match(now time.Time, genId func() util.ID) []*Match {
+	ret := []*Match{}
+	matched := map[*MatchTicket]bool{}
+	for _, t := range this.tickets {
+		if matched[t] {
+			continue
+		}
+		b, w := this.bucket(t), this.window(t, now)
+		candidates := []*MatchTicket{t}
+		for _, o := range this.tickets {
+			if o == t || matched[o] {
+				continue
+			}
+			d := this.bucket(o) - b
+			if d >= -w && d <= w {
+				candidates = append(candidates, o)
+			}
+		}
+		m := this.fill(candidates)
+		if m == nil {
+			continue
+		}
+		m.Id = genId()
+		for _, c := range m.Tickets {
+			matched[c] = true
+		}
+		ret = append(ret, m)
+	}
+	this.remove(matched)
+	return ret
+}
+
+// fill the teams with the candidates,a party goes to the team with the most free places,nil if not all filled
+func (this *MatchQueue) fill(candidates []*MatchTicket) *Match {
+	need := this.Mode.TeamSize * this.Mode.Teams
+	cnt := 0
+	for _, c := range candidates {
+		cnt += len(c.Members)
+	}
+	if cnt < need {
+		return nil
+	}
+	ret := &Match{Teams: make([][]util.ID, this.Mode.Teams), Tickets: []*MatchTicket{}}
+	filled := 0
+	for _, c := range candidates {
+		team := -1
+		for i := range ret.Teams {
+			free := this.Mode.TeamSize - len(ret.Teams[i])
+			if free >= len(c.Members) && (team < 0 || free > this.Mode.TeamSize-len(ret.Teams[team])) {
+				team = i
+			}
+		}
+		if team < 0 {
+			continue
+		}
+		ret.Teams[team] = append(ret.Teams[team], c.Members...)
+		ret.Tickets = append(ret.Tickets, c)
+		filled += len(c.Members)
+		if filled == need {
+			return ret
+		}
+	}
+	return nil
+}
+
+// MatchmakerName the singleton name of the matchmaker of the mode
+func MatchmakerName(mode string) string {
+	return "matchmaker_" + mode
+}
+
+var _ lokas.IActor = (*Matchmaker)(nil)
+
+// Matchmaker the actor matching the queue of a mode,run as a cluster singleton,
+// the rooms are created on the least loaded line of the room service
+type Matchmaker struct {
+	*Actor
+	Mode   *MatchMode
+	Queue  *MatchQueue
+	ticker timer.TimeNoder
+}
+
+func NewMatchmaker(mode *MatchMode) *Matchmaker {
+	ret := &Matchmaker{
+		Actor: NewActor(),
+		Mode:  mode,
+		Queue: NewMatchQueue(mode),
+	}
+	ret.SetType("Matchmaker")
+	ret.MsgHandler = ret.HandleMsg
+	return ret
+}
+
+func (this *Matchmaker) Start() error {
+	this.StartMessagePump()
+	this.ticker = this.Schedule(this.Mode.Interval, func(noder timer.TimeNoder) {
+		this.tick(time.Now())
+	})
+	return nil
+}
+
+// Stop the queued avatars are notified to join again,the queue is not handed over
+func (this *Matchmaker) Stop() error {
+	if this.ticker != nil {
+		this.ticker.Stop()
+	}
+	for _, t := range this.Queue.tickets {
+		this.notify(t.Members, &MatchCanceled{Mode: this.Mode.Name, Reason: MATCH_CANCEL_STOPPED})
+	}
+	this.Queue = NewMatchQueue(this.Mode)
+	return this.Actor.Stop()
+}
+
+func (this *Matchmaker) HandleMsg(actorId util.ID, transId uint32, msg protocol.ISerializable) (protocol.ISerializable, error) {
+	switch m := msg.(type) {
+	case *MatchJoin:
+		ticket := &MatchTicket{Members: []util.ID{}, Skill: m.Skill, Enqueued: time.Now()}
+		member := false
+		for _, id := range m.Party {
+			ticket.Members = append(ticket.Members, util.ID(id))
+			member = member || util.ID(id) == actorId
+		}
+		if len(ticket.Members) == 0 {
+			ticket.Members = append(ticket.Members, actorId)
+			member = true
+		}
+		if !member {
+			//nobody queues a party without being part of it
+			return nil, protocol.ERR_MATCH_FORBIDDEN
+		}
+		err := this.Queue.Add(ticket)
+		if err != nil {
+			return nil, err
+		}
+		log.Info("match join", flog.AvatarId(ticket.Members[0]), zap.String("mode", this.Mode.Name), zap.Int("party", len(ticket.Members)), zap.Int32("skill", m.Skill))
+		return NewResponse(true), nil
+	case *MatchCancel:
+		if m.AvatarId != 0 && util.ID(m.AvatarId) != actorId {
+			return nil, protocol.ERR_MATCH_FORBIDDEN
+		}
+		id := actorId
+		ticket := this.Queue.Remove(id)
+		if ticket == nil {
+			return nil, protocol.ERR_MATCH_NOT_QUEUED
+		}
+		others := []util.ID{}
+		for _, member := range ticket.Members {
+			if member != id {
+				others = append(others, member)
+			}
+		}
+		this.notify(others, &MatchCanceled{Mode: this.Mode.Name, Reason: MATCH_CANCEL_LEFT})
+		return NewResponse(true), nil
+	}
+	return nil, protocol.ERR_TYPE_NOT_FOUND
+}
+
+func (this *Matchmaker) tick(now time.Time) {
+	for _, t := range this.Queue.Expire(now) {
+		this.notify(t.Members, &MatchCanceled{Mode: this.Mode.Name, Reason: MATCH_CANCEL_TIMEOUT})
+	}
+	if this.Queue.Len() == 0 {
+		return
+	}
+	matches := this.Queue.Match(now, this.GetProcess().GenId)
+	pending := map[uint16]int{}
+	for i, m := range matches {
+		err := this.dispatch(m, pending)
+		if err != nil {
+			//keep waiting until a room line is available
+			log.Error("dispatch match failed", zap.String("mode", this.Mode.Name), flog.Error(err))
+			for _, rest := range matches[i:] {
+				this.Queue.Requeue(rest.Tickets)
+			}
+			return
+		}
+	}
+}
+
+// dispatch create the room on the least loaded line and send the result to the avatars,
+// pending counts the rooms created in this round not reported by the lines yet
+func (this *Matchmaker) dispatch(m *Match, pending map[uint16]int) error {
+	process := this.GetProcess()
+	infos, err := process.GetServiceDiscoverMgr().FindServiceListBySelector(this.Mode.RoomService, this.Mode.RoomServiceId, this.Mode.RoomSelector)
+	if err != nil {
+		return err
+	}
+	line := LeastLoadedService(infos, pending)
+	if line == nil {
+		return protocol.ERR_SERVICE_NOT_FOUND
+	}
+	teams := m.teams()
+	err = process.RouteMsgToService(this.GetId(), line.ServiceType, line.ServiceId, line.LineId, 0, protocol.REQ_TYPE_MAIN, &MatchRoom{
+		Mode:   this.Mode.Name,
+		RoomId: m.Id.Int64(),
+		Teams:  teams,
+	}, protocol.BINARY)
+	if err != nil {
+		return err
+	}
+	pending[line.LineId]++
+	for i, team := range m.Teams {
+		this.notify(team, &MatchFound{
+			Mode:      this.Mode.Name,
+			RoomId:    m.Id.Int64(),
+			ServiceId: int32(line.ServiceId),
+			LineId:    int32(line.LineId),
+			Team:      int32(i),
+			Teams:     teams,
+		})
+	}
+	log.Info("match found", zap.String("mode", this.Mode.Name), zap.Int64("room", m.Id.Int64()), zap.Uint16("line", line.LineId))
+	return nil
+}
+
+func (this *Matchmaker) notify(ids []util.ID, msg protocol.ISerializable) {
+	for _, id := range ids {
+		err := this.SendMessage(id, 0, msg)
+		if err != nil {
+			log.Error("notify match failed", flog.AvatarId(id), flog.Error(err))
+		}
+	}
+}
+
+var MatchmakingCtor = matchmakingCtor{}
+
+type matchmakingCtor struct{}
+
+func (this matchmakingCtor) Type() string {
+	return "Matchmaking"
+}
+
+func (this matchmakingCtor) Create() lokas.IModule {
+	return &Matchmaking{
+		Modes: map[string]*MatchMode{},
+	}
+}
+
+var _ lokas.IModule = (*Matchmaking)(nil)
+
+// Matchmaking register a matchmaker singleton per mode to the SingletonManager,
+// every process loading the module campaigns for the matchmakers
+//
+//	[Matchmaking.modes.duel]
+//	team_size = 1
+//	teams = 2
+//	bucket = 100
+//	widen_after = "10s"
+//	max_widen = 5
+//	timeout = "2m"
+//	room_service = "Room"
+//	room_service_id = 1
+type Matchmaking struct {
+	process lokas.IProcess
+	Modes   map[string]*MatchMode
+}
+
+func (this *Matchmaking) Type() string {
+	return "Matchmaking"
+}
+
+func (this *Matchmaking) GetProcess() lokas.IProcess {
+	return this.process
+}
+
+func (this *Matchmaking) SetProcess(process lokas.IProcess) {
+	this.process = process
+}
+
+func (this *Matchmaking) Load(conf lokas.IConfig) error {
+	if conf == nil {
+		return nil
+	}
+	for name := range conf.GetStringMap("modes") {
+		mode, err := LoadMatchMode(name, conf.Sub("modes."+name))
+		if err != nil {
+			return err
+		}
+		this.Modes[name] = mode
+	}
+	return nil
+}
+
+func (this *Matchmaking) Unload() error {
+	return nil
+}
+
+func (this *Matchmaking) Start() error {
+	singletons, ok := this.process.Get(SingletonManagerCtor.Type()).(*SingletonManager)
+	if !ok {
+		log.Error("matchmaking needs the SingletonManager")
+		return protocol.ERR_CONFIG_ERROR
+	}
+	for _, mode := range this.Modes {
+		mode := mode
+		err := singletons.Register(MatchmakerName(mode.Name), func() lokas.IActor {
+			return NewMatchmaker(mode)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *Matchmaking) Stop() error {
+	return nil
+}
+
+func (this *Matchmaking) OnStart() error {
+	return nil
+}
+
+func (this *Matchmaking) OnStop() error {
+	return nil
+}
+
+// Address the actor id of the matchmaker of the mode to send MatchJoin and MatchCancel to
+func (this *Matchmaking) Address(mode string) (util.ID, error) {
+	singletons, ok := this.process.Get(SingletonManagerCtor.Type()).(*SingletonManager)
+	if !ok {
+		return 0, protocol.ERR_CONFIG_ERROR
+	}
+	return singletons.GetAddress(MatchmakerName(mode))
+}
@@ -0,0 +1,397 @@
+package lox
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/log/flog"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+const (
+	MIGRATION_COLLECTION = "migration"
+	DOC_VERSION          = COMPONENT_VERSION //the schema version of a document
+)
+
+// DocMigration upgrade the document by one version in place
+type DocMigration = ComponentMigration
+
+// MigrationReport the result of migrating a collection or a component
+type MigrationReport struct {
+	Target   string //collection,or collection.Component for the sub-documents
+	Version  int    //the current version
+	Pending  int64  //documents of older versions found
+	Migrated int64
+	Skipped  int64 //migrated by others meanwhile
+	Failed   int64
+	DryRun   bool
+}
+
+// MigrationState the state of a target kept in mongo,also the lock of the bulk migration
+type MigrationState struct {
+	Target   string    `bson:"_id"`
+	Version  int       `bson:"version"`
+	Migrated int64     `bson:"migrated"`
+	Owner    string    `bson:"owner"`
+	Expire   time.Time `bson:"expire"`
+	Updated  time.Time `bson:"updated"`
+}
+
+// migrationTarget the documents or sub-documents sharing a schema version
+type migrationTarget struct {
+	collection string
+	field      string //the sub-document,empty for the whole document
+	migrations []ComponentMigration
+}
+
+func (this *migrationTarget) name() string {
+	if this.field == "" {
+		return this.collection
+	}
+	return this.collection + "." + this.field
+}
+
+func (this *migrationTarget) versionKey() string {
+	if this.field == "" {
+		return DOC_VERSION
+	}
+	return this.field + "." + DOC_VERSION
+}
+
+// filter the documents of older versions
+func (this *migrationTarget) filter() bson.M {
+	key := this.versionKey()
+	ret := bson.M{"$or": bson.A{
+		bson.M{key: bson.M{"$lt": len(this.migrations)}},
+		bson.M{key: bson.M{"$exists": false}},
+	}}
+	if this.field != "" {
+		ret[this.field] = bson.M{"$exists": true}
+	}
+	return ret
+}
+
+// Migrator the ordered migrations of the documents per collection and of the components of the mapper,
+// applied lazily on load or in bulk
+type Migrator struct {
+	Mapper  *ComponentMapper //migrations of the components,nil if none
+	LockTTL time.Duration    //the bulk migration lock expires if the owner is gone
+	docs    map[string][]DocMigration
+}
+
+func NewMigrator(mapper *ComponentMapper) *Migrator {
+	return &Migrator{
+		Mapper:  mapper,
+		LockTTL: time.Minute * 10,
+		docs:    map[string][]DocMigration{},
+	}
+}
+
+// Register append the migration of the documents of the collection from its current version,
+// the version of a collection is the count of its migrations
+func (this *Migrator) Register(collection string, migration DocMigration) *Migrator {
+	this.docs[collection] = append(this.docs[collection], migration)
+	return this
+}
+
+// Version the current version of the collection,0 if the Migrator is nil
+func (this *Migrator) Version(collection string) int {
+	if this == nil {
+		return 0
+	}
+	return len(this.docs[collection])
+}
+
+// Migrate upgrade the document loaded to the current version,true if changed
+func (this *Migrator) Migrate(collection string, doc bson.M) (bool, error) {
+	return applyMigrations(this.docs[collection], doc)
+}
+
+// Load find the document into ret,a document of an older version is migrated and the changed keys are written back
+// like Run does,a nil Migrator loads the document as is
+func (this *Migrator) Load(coll *qmgo.Collection, filter bson.M, ret interface{}) error {
+	if this.Version(coll.GetCollectionName()) == 0 {
+		return coll.Find(context.TODO(), filter).One(ret)
+	}
+	var doc bson.Raw
+	err := coll.Find(context.TODO(), filter).One(&doc)
+	if err != nil {
+		return err
+	}
+	target := &migrationTarget{collection: coll.GetCollectionName(), migrations: this.docs[coll.GetCollectionName()]}
+	raw, err := coll.CloneCollection()
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	m, _, err := this.migrateOne(raw, target, doc)
+	if err != nil {
+		log.Error("migrate document failed", zap.String("target", target.name()), zap.Any("id", doc.Lookup("_id")), flog.Error(err))
+		return err
+	}
+	if m != nil {
+		//written back or changed by others meanwhile,the migrated one is returned either way
+		doc, err = bson.Marshal(m)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+	}
+	return bson.Unmarshal(doc, ret)
+}
+
+// Collections the collections having migrations
+func (this *Migrator) Collections() []string {
+	ret := []string{}
+	for _, t := range this.targets("") {
+		found := false
+		for _, c := range ret {
+			if c == t.collection {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ret = append(ret, t.collection)
+		}
+	}
+	return ret
+}
+
+// targets of the collection,all if empty
+func (this *Migrator) targets(collection string) []*migrationTarget {
+	ret := []*migrationTarget{}
+	for coll, migrations := range this.docs {
+		if len(migrations) > 0 && (collection == "" || coll == collection) {
+			ret = append(ret, &migrationTarget{collection: coll, migrations: migrations})
+		}
+	}
+	if this.Mapper != nil {
+		for _, tag := range this.Mapper.tags {
+			migrations := this.Mapper.migrations[tag]
+			coll := this.Mapper.collection(tag)
+			if len(migrations) == 0 || collection != "" && coll != collection {
+				continue
+			}
+			ret = append(ret, &migrationTarget{collection: coll, field: this.Mapper.Field(tag), migrations: migrations})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].name() < ret[j].name()
+	})
+	return ret
+}
+
+// Run migrate the documents of older versions of the collection,all the collections if empty,
+// only count them if dryRun,owner identifies the runner holding the lock
+func (this *Migrator) Run(db *qmgo.Database, collection string, owner string, dryRun bool) ([]*MigrationReport, error) {
+	targets := this.targets(collection)
+	if len(targets) == 0 {
+		return nil, protocol.ERR_PARAM_NOT_EXIST
+	}
+	ret := []*MigrationReport{}
+	for _, target := range targets {
+		report, err := this.run(db, target, owner, dryRun)
+		if err != nil {
+			log.Error("migrate failed", zap.String("target", target.name()), flog.Error(err))
+			return ret, err
+		}
+		ret = append(ret, report)
+	}
+	return ret, nil
+}
+
+func (this *Migrator) run(db *qmgo.Database, target *migrationTarget, owner string, dryRun bool) (*MigrationReport, error) {
+	report := &MigrationReport{Target: target.name(), Version: len(target.migrations), DryRun: dryRun}
+	coll := db.Collection(target.collection)
+	cnt, err := coll.Find(context.TODO(), target.filter()).Count()
+	if err != nil {
+		return nil, err
+	}
+	report.Pending = cnt
+	if dryRun || cnt == 0 {
+		return report, nil
+	}
+	err = this.lock(db, target, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer this.unlock(db, target, owner, report)
+	raw, err := coll.CloneCollection()
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := raw.Find(context.TODO(), target.filter())
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+	for cursor.Next(context.TODO()) {
+		_, ok, err := this.migrateOne(raw, target, cursor.Current)
+		if err != nil {
+			report.Failed++
+			log.Error("migrate document failed", zap.String("target", target.name()), zap.Any("id", cursor.Current.Lookup("_id")), flog.Error(err))
+		} else if ok {
+			report.Migrated++
+		} else {
+			report.Skipped++
+		}
+		if (report.Migrated+report.Skipped+report.Failed)%100 == 0 {
+			err = this.lock(db, target, owner)
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+	log.Warn("migrated", zap.String("target", target.name()), zap.Int("version", report.Version), zap.Int64("migrated", report.Migrated), zap.Int64("skipped", report.Skipped), zap.Int64("failed", report.Failed))
+	return report, cursor.Err()
+}
+
+// migrateOne write the keys changed by the migrations only if they and the version are not changed meanwhile,
+// so the fields written by the savers concurrently are kept,the migrated document is nil if already current
+func (this *Migrator) migrateOne(coll *mongo.Collection, target *migrationTarget, doc bson.Raw) (bson.M, bool, error) {
+	id := doc.Lookup("_id")
+	sub := doc
+	prefix := ""
+	if target.field != "" {
+		v := doc.Lookup(target.field)
+		if v.Type != bsontype.EmbeddedDocument {
+			return nil, false, protocol.ERR_DB_ERROR
+		}
+		sub = v.Document()
+		prefix = target.field + "."
+	}
+	origin := bson.M{}
+	err := bson.Unmarshal(sub, &origin)
+	if err != nil {
+		return nil, false, err
+	}
+	m := bson.M{}
+	err = bson.Unmarshal(sub, &m)
+	if err != nil {
+		return nil, false, err
+	}
+	ok, err := applyMigrations(target.migrations, m)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	filter := bson.M{"_id": id}
+	set := bson.M{}
+	unset := bson.M{}
+	for k, v := range m {
+		if k == "_id" {
+			continue
+		}
+		if ov, ok := origin[k]; ok && reflect.DeepEqual(ov, v) {
+			continue
+		}
+		set[prefix+k] = v
+		filter[prefix+k] = originValue(sub, k)
+	}
+	for k := range origin {
+		if _, ok := m[k]; !ok && k != "_id" {
+			unset[prefix+k] = ""
+			filter[prefix+k] = originValue(sub, k)
+		}
+	}
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if len(update) == 0 {
+		return m, false, nil
+	}
+	res, err := coll.UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		return nil, false, err
+	}
+	return m, res.ModifiedCount > 0, nil
+}
+
+// originValue the filter matching the key of the document read,the raw value keeps the order of the sub-documents
+func originValue(doc bson.Raw, key string) interface{} {
+	v, err := doc.LookupErr(key)
+	if err != nil {
+		return bson.M{"$exists": false}
+	}
+	return v
+}
+
+// lock acquire or renew the lock of the target,fails if held by another owner not expired
+func (this *Migrator) lock(db *qmgo.Database, target *migrationTarget, owner string) error {
+	coll, err := db.Collection(MIGRATION_COLLECTION).CloneCollection()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	filter := bson.M{"_id": target.name(), "$or": bson.A{
+		bson.M{"owner": ""},
+		bson.M{"owner": owner},
+		bson.M{"expire": bson.M{"$lt": now}},
+	}}
+	_, err = coll.UpdateOne(context.TODO(), filter, bson.M{"$set": bson.M{"owner": owner, "expire": now.Add(this.LockTTL)}}, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		log.Warn("migration is running by others", zap.String("target", target.name()))
+		return protocol.ERR_MIGRATION_RUNNING
+	}
+	return err
+}
+
+func (this *Migrator) unlock(db *qmgo.Database, target *migrationTarget, owner string, report *MigrationReport) {
+	_, err := db.Collection(MIGRATION_COLLECTION).UpdateAll(context.TODO(), bson.M{"_id": target.name(), "owner": owner}, bson.M{
+		"$set": bson.M{"owner": "", "version": report.Version, "updated": time.Now()},
+		"$inc": bson.M{"migrated": report.Migrated},
+	})
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// States the migration states kept in mongo
+func (this *Migrator) States(db *qmgo.Database) ([]*MigrationState, error) {
+	ret := []*MigrationState{}
+	err := db.Collection(MIGRATION_COLLECTION).Find(context.TODO(), bson.M{}).Sort("_id").All(&ret)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	return ret, nil
+}
+
+// applyMigrations upgrade the document from its version,true if changed
+func applyMigrations(migrations []ComponentMigration, doc bson.M) (bool, error) {
+	version := 0
+	switch v := doc[DOC_VERSION].(type) {
+	case int32:
+		version = int(v)
+	case int64:
+		version = int(v)
+	case int:
+		version = v
+	case float64:
+		version = int(v)
+	}
+	if version >= len(migrations) {
+		return false, nil
+	}
+	for _, migration := range migrations[version:] {
+		err := migration(doc)
+		if err != nil {
+			return false, err
+		}
+	}
+	doc[DOC_VERSION] = int32(len(migrations))
+	return true, nil
+}
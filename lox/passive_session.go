@@ -3,12 +3,15 @@ package lox
 import (
 	"encoding/json"
 	"github.com/nomos/go-lokas/log/flog"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nomos/go-lokas"
 	"github.com/nomos/go-lokas/log"
 	"github.com/nomos/go-lokas/protocol"
 	"github.com/nomos/go-lokas/util"
+	"go.uber.org/zap"
 )
 
 type PassiveSessionOption func(*PassiveSession)
@@ -35,7 +38,7 @@ func NewPassiveSession(conn lokas.IConn, id util.ID, manager lokas.ISessionManag
 
 type PassiveSession struct {
 	*Actor
-	Verified         bool
+	Verified         bool //written by the handshake under authMu,read by IsVerified out of the session
 	Messages         chan []byte
 	Conn             lokas.IConn
 	Protocol         protocol.TYPE
@@ -46,8 +49,32 @@ type PassiveSession struct {
 	OnOpenFunc       func(conn lokas.IConn)
 	ClientMsgHandler func(msg *protocol.BinaryMessage)
 	AuthFunc         func(data []byte) (interface{}, error)
+	Authenticator    Authenticator   //used instead of AuthFunc if set
+	HandshakeTimeout time.Duration   //close the connection if not verified in time,0 means no limit
+	Identity         *Identity       //the user identity authenticated in the handshake,read by GetIdentity out of the session
+	Limiter          *SessionLimiter //rate limits of the client messages,nil means unlimited
+	Router           *GateRouter     //forward the client messages by command id before ClientMsgHandler
+	Codec            *CodecConfig    //the codecs accepted in the negotiation,only plaintext if nil
+	rejected         bool
+	refused          bool          //refused by the limiter of the gate on accept
+	encrypted        bool          //the connection is encrypted by the negotiated codec
+	ResumeGrace      time.Duration //keep the session for resuming after the connection dropped,the outbound messages are numbered by ReliableMessage,0 means disabled
+	ResumeBufferSize int           //max outbound messages kept for replay
+	ResumeFunc       func(sess *PassiveSession, transId uint32, msg *SessionResume) (*PassiveSession, error)
+	TakeoverFunc     func(sess *PassiveSession) error //bind the avatar authenticated to the session before the handshake is replied
+	Reliable         bool                             //number the outbound messages and accept acks and duplicates suppression from the client
 	timeout          time.Duration
 	ticker           *time.Ticker
+
+	authMu      sync.RWMutex
+	connMu      sync.Mutex
+	resumeToken string
+	replay      *replayBuffer
+	resumeGen   int
+	lastConn    lokas.IConn
+	recvSeq     uint32          //the latest sequence number received from the client
+	relay       *PassiveSession //the resumed session this connection relays to
+	roomId      int64           //the room bound by RoomBind,accessed atomically
 }
 
 func (this *PassiveSession) Load(conf lokas.IConfig) error {
@@ -59,11 +86,11 @@ func (this *PassiveSession) Unload() error {
 }
 
 func (this *PassiveSession) OnStart() error {
-	panic("implement me")
+	return nil
 }
 
 func (this *PassiveSession) OnStop() error {
-	panic("implement me")
+	return nil
 }
 
 func (this *PassiveSession) OnCreate() error {
@@ -82,10 +109,25 @@ func (this *PassiveSession) OnDestroy() error {
 	return nil
 }
 
+// GetConn return the connection of the session,nil while the session is detached for resuming
 func (this *PassiveSession) GetConn() lokas.IConn {
+	this.connMu.Lock()
+	defer this.connMu.Unlock()
 	return this.Conn
 }
 
+// closeConn close the current connection,after the pending writes are flushed if wait
+func (this *PassiveSession) closeConn(wait bool) {
+	conn := this.GetConn()
+	if conn == nil {
+		return
+	}
+	if wait {
+		conn.Wait()
+	}
+	conn.Close()
+}
+
 func (this *PassiveSession) StartMessagePump() {
 	log.Info("PassiveSession:StartMessagePump", lokas.LogActorInfo(this)...)
 
@@ -100,7 +142,7 @@ func (this *PassiveSession) StartMessagePump() {
 				if e, ok := r.(error); ok {
 					log.Errorf(e.Error())
 					log.Error("客户端协议出错")
-					this.Conn.Close()
+					this.closeConn(false)
 				}
 			}
 		}()
@@ -118,7 +160,7 @@ func (this *PassiveSession) StartMessagePump() {
 			if r != nil {
 				if util.Recover(r, true) != nil {
 					log.Error("服务端协议出错")
-					this.Conn.Close()
+					this.closeConn(false)
 				}
 			}
 		}()
@@ -131,27 +173,50 @@ func (this *PassiveSession) StartMessagePump() {
 }
 
 func (this *PassiveSession) clientLoop() {
+	var handshakeTimeout <-chan time.Time
+	if this.HandshakeTimeout > 0 {
+		timer := time.NewTimer(this.HandshakeTimeout)
+		defer timer.Stop()
+		handshakeTimeout = timer.C
+	}
 	for {
 		select {
+		case <-handshakeTimeout:
+			if this.Verified || this.rejected || this.getRelay() != nil {
+				continue
+			}
+			log.Warn("handshake timeout", lokas.LogActorInfo(this)...)
+			this.reject(0, protocol.NewError(protocol.ERR_HANDSHAKE_TIMEOUT))
 		case <-this.ticker.C:
 			if this.OnUpdateFunc != nil && this.Verified {
 				this.OnUpdateFunc()
 			}
 		case data := <-this.Messages:
+			if this.rejected {
+				continue
+			}
+			if this.Limiter != nil && !this.Limiter.Allow(data) {
+				log.Warn("rate limited", lokas.LogActorInfo(this)...)
+				this.Limiter.Kick()
+				this.reject(0, protocol.NewError(protocol.ERR_RATE_LIMITED))
+				continue
+			}
+			if relay := this.getRelay(); relay != nil {
+				relay.OnRecv(nil, data)
+				continue
+			}
 			cmdId := protocol.GetCmdId16(data)
-			if !this.Verified && cmdId != protocol.TAG_HandShake {
+			if !this.Verified && cmdId != protocol.TAG_HandShake && cmdId != TAG_SESSION_RESUME && cmdId != TAG_CODEC_OFFER {
 				var msg []byte
 				msg, err := protocol.MarshalMessage(0, protocol.NewError(protocol.ERR_AUTH_FAILED), this.Protocol)
 				if err != nil {
 					log.Error(err.Error())
-					this.Conn.Wait()
-					this.Conn.Close()
+					this.closeConn(true)
 					return
 				}
 				log.Error("Auth Failed", lokas.LogActorInfo(this).Append(protocol.LogCmdId(cmdId))...)
-				this.Conn.Write(msg)
-				this.Conn.Wait()
-				this.Conn.Close()
+				this.write(msg)
+				this.closeConn(true)
 				return
 			}
 			msg, err := protocol.UnmarshalMessage(data, this.Protocol)
@@ -160,13 +225,54 @@ func (this *PassiveSession) clientLoop() {
 					lokas.LogActorInfo(this).Append(protocol.LogCmdId(cmdId))...,
 				)
 				msg1, _ := protocol.NewError(protocol.ERR_MSG_FORMAT).Marshal()
-				_, err = this.Conn.Write(msg1)
+				err = this.write(msg1)
 				if err != nil {
 					log.Error(err.Error())
 				}
-				this.Conn.Close()
+				this.closeConn(false)
 				return
 			}
+			if cmdId == TAG_CODEC_OFFER {
+				err = this.acceptCodec(msg.TransId, msg.Body.(*CodecOffer))
+				if err != nil {
+					log.Warn("codec negotiation failed", lokas.LogActorInfo(this).Append(flog.Error(err))...)
+					this.reject(msg.TransId, protocol.NewError(protocol.ERR_CODEC_FAILED))
+				}
+				continue
+			}
+			if (cmdId == protocol.TAG_HandShake || cmdId == TAG_SESSION_RESUME) && this.Codec != nil && this.Codec.Require && !this.encrypted {
+				log.Warn("encryption required", lokas.LogActorInfo(this)...)
+				this.reject(msg.TransId, protocol.NewError(protocol.ERR_CODEC_FAILED))
+				continue
+			}
+			if cmdId == TAG_SESSION_RESUME {
+				err = this.resume(msg.TransId, msg.Body.(*SessionResume))
+				if err != nil {
+					log.Warn("resume session failed", lokas.LogActorInfo(this).Append(flog.Error(err))...)
+					msg1, err1 := protocol.MarshalMessage(msg.TransId, protocol.NewError(protocol.ERR_SESSION_RESUME_FAILED), this.Protocol)
+					if err1 == nil {
+						this.write(msg1)
+					}
+					this.closeConn(true)
+					return
+				}
+				continue
+			}
+			if cmdId == TAG_RELIABLE_MESSAGE {
+				data = this.recvReliable(msg.Body.(*ReliableMessage))
+				if data == nil {
+					continue
+				}
+				cmdId = protocol.GetCmdId16(data)
+				msg, err = protocol.UnmarshalMessage(data, this.Protocol)
+				if err != nil {
+					log.Error("unmarshal reliable message error",
+						lokas.LogActorInfo(this).Append(protocol.LogCmdId(cmdId))...,
+					)
+					this.closeConn(false)
+					return
+				}
+			}
 			if cmdId == protocol.TAG_HandShake {
 				if this.Verified {
 					log.Warn("duplicated handshake")
@@ -174,23 +280,30 @@ func (this *PassiveSession) clientLoop() {
 				}
 
 				var ret interface{}
-				if this.AuthFunc != nil {
+				var identity *Identity
+				if this.Authenticator != nil {
+					identity, err = this.Authenticator.Authenticate(msg.Body.(*protocol.HandShake).Data)
+					if err == nil && identity != nil {
+						ret = identity.Reply
+					}
+				} else if this.AuthFunc != nil {
 					ret, err = this.AuthFunc(msg.Body.(*protocol.HandShake).Data)
 				}
 				if err != nil {
-					log.Error(err.Error())
-					msg1, err1 := protocol.MarshalMessage(msg.TransId, protocol.NewError(protocol.ERR_AUTH_FAILED), this.Protocol)
-					if err1 != nil {
-						log.Error(err1.Error())
-						this.Conn.Wait()
-						this.Conn.Close()
-						return
+					log.Warn("Auth Failed", lokas.LogActorInfo(this).Append(protocol.LogCmdId(cmdId)).Append(flog.Error(err))...)
+					this.reject(msg.TransId, authReject(err))
+					continue
+				}
+				this.authMu.Lock()
+				this.Identity = identity
+				this.authMu.Unlock()
+				if identity != nil && identity.AvatarId != 0 && this.TakeoverFunc != nil {
+					err = this.TakeoverFunc(this)
+					if err != nil {
+						log.Warn("takeover avatar session failed", lokas.LogActorInfo(this).Append(flog.AvatarId(identity.AvatarId)).Append(flog.Error(err))...)
+						this.reject(msg.TransId, authReject(err))
+						continue
 					}
-					log.Warn("Auth Failed", lokas.LogActorInfo(this).Append(protocol.LogCmdId(cmdId))...)
-					this.Conn.Write(msg1)
-					this.Conn.Wait()
-					this.Conn.Close()
-					return
 				}
 
 				if ret != nil {
@@ -215,13 +328,24 @@ func (this *PassiveSession) clientLoop() {
 					data, _ = protocol.MarshalMessage(msg.TransId, hs, this.Protocol)
 
 				}
-				_, err = this.Conn.Write(data)
+				err = this.write(data)
 				if err != nil {
 					log.Error(err.Error())
-					this.Conn.Close()
+					this.closeConn(false)
 					return
 				}
+				this.authMu.Lock()
 				this.Verified = true
+				this.authMu.Unlock()
+				if this.Reliable || this.ResumeGrace > 0 {
+					this.initReplay()
+				}
+				if this.ResumeGrace > 0 {
+					err = this.issueResumeToken()
+					if err != nil {
+						log.Error(err.Error())
+					}
+				}
 				continue
 			}
 			if cmdId == protocol.TAG_Ping {
@@ -231,19 +355,30 @@ func (this *PassiveSession) clientLoop() {
 				data, err = protocol.MarshalMessage(msg.TransId, pong, this.Protocol)
 				if err != nil {
 					log.Error(err.Error())
-					this.Conn.Wait()
-					this.Conn.Close()
+					this.closeConn(true)
 					return
 				}
-				_, err = this.Conn.Write(data)
+				err = this.write(data)
 				//log.Info("send ping",zap.Int64("client_session_id",this.GetId().Int64()))
 				if err != nil {
 					log.Error(err.Error())
-					this.Conn.Close()
+					this.closeConn(false)
 					return
 				}
 				continue
 			}
+			if this.Router != nil {
+				routed, err := this.Router.Route(this, msg)
+				if err != nil {
+					log.Warn("route client msg failed", lokas.LogActorInfo(this).Append(protocol.LogCmdId(cmdId)).Append(flog.Error(err))...)
+					if msg.TransId != 0 {
+						this.WriteMessage(msg.TransId, authReject(err))
+					}
+				}
+				if routed {
+					continue
+				}
+			}
 			if this.ClientMsgHandler != nil {
 				this.ClientMsgHandler(msg)
 			} else {
@@ -261,23 +396,73 @@ func (this *PassiveSession) inLoop() {
 		select {
 		case rMsg := <-this.MsgChan:
 			this.OnMessage(rMsg)
+		case rMsg := <-this.ReplyChan:
+			this.onReply(rMsg)
+		case dataMsg := <-this.ReplyDataChan:
+			body, err := dataMsg.UnmarshalData()
+			if err != nil {
+				continue
+			}
+			this.onReply(protocol.NewRouteMsg(dataMsg.FromActor, dataMsg.ToActor, dataMsg.TransId, body, protocol.REQ_TYPE_REPLAY))
 		case <-this.doneServer:
 			return
 		}
 	}
 }
 
+// onReply write the replies of the routed client messages back to the client with their TransId
+func (this *PassiveSession) onReply(msg *protocol.RouteMessage) {
+	if this.Router == nil {
+		this.OnMessage(msg)
+		return
+	}
+	msg = this.HookReceive(msg)
+	if msg == nil {
+		return
+	}
+	if kick, ok := msg.Body.(*SessionKicked); ok {
+		this.kick(kick)
+		return
+	}
+	err := this.WriteMessage(msg.TransId, msg.Body)
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
+
 func (this *PassiveSession) OnMessage(msg *protocol.RouteMessage) {
 	msg = this.HookReceive(msg)
-	if msg != nil {
-		err := this.HandleMsg(msg.FromActor, msg.TransId, msg.Body)
-		if err != nil {
-			log.Error("Actor:OnMessage:Error",
-				lokas.LogActorReceiveMsgInfo(this, msg.Body, msg.TransId, msg.FromActor).
-					Append(flog.Error(err))...,
-			)
+	//dropped by the hook
+	if msg == nil {
+		return
+	}
+	if kick, ok := msg.Body.(*SessionKicked); ok {
+		this.kick(kick)
+		return
+	}
+	if bind, ok := msg.Body.(*RoomBind); ok {
+		this.bindRoom(bind)
+		return
+	}
+	if gate, ok := this.Manager.(*Gate); ok {
+		handled, err := gate.handleGroupMsg(this.GetId(), msg.Body)
+		if handled {
+			if err != nil {
+				log.Warn("handle group msg failed", lokas.LogActorInfo(this).Append(flog.Error(err))...)
+			}
+			if msg.TransId != 0 {
+				this.SendReply(msg.FromActor, msg.TransId, NewResponse(err == nil))
+			}
+			return
 		}
 	}
+	err := this.HandleMsg(msg.FromActor, msg.TransId, msg.Body)
+	if err != nil {
+		log.Error("Actor:OnMessage:Error",
+			lokas.LogActorReceiveMsgInfo(this, msg.Body, msg.TransId, msg.FromActor).
+				Append(flog.Error(err))...,
+		)
+	}
 }
 
 func (this *PassiveSession) closeSession() {
@@ -299,6 +484,9 @@ func (this *PassiveSession) stop() {
 }
 
 func (this *PassiveSession) OnOpen(conn lokas.IConn) {
+	if this.refused {
+		return
+	}
 	this.StartMessagePump()
 	log.Info("PassiveSession:OnOpen", lokas.LogActorInfo(this)...)
 	if this.Manager != nil {
@@ -310,6 +498,21 @@ func (this *PassiveSession) OnOpen(conn lokas.IConn) {
 }
 
 func (this *PassiveSession) OnClose(conn lokas.IConn) {
+	if this.refused {
+		return
+	}
+	if this.Limiter != nil {
+		this.Limiter.Release()
+	}
+	if relay := this.getRelay(); relay != nil {
+		relay.detach(conn)
+	} else if this.detach(conn) {
+		return
+	}
+	this.close(conn)
+}
+
+func (this *PassiveSession) close(conn lokas.IConn) {
 	if this.Manager != nil {
 		this.Manager.RemoveSession(this.GetId())
 	}
@@ -321,6 +524,226 @@ func (this *PassiveSession) OnClose(conn lokas.IConn) {
 	this.stop()
 }
 
+// WriteMessage write a message to the client,
+// when resuming or reliable mode is enabled the message is wrapped with its sequence number and the ack of the client messages,
+// and kept for replay,it is only buffered while the client is away
+func (this *PassiveSession) WriteMessage(transId uint32, msg protocol.ISerializable) error {
+	data, err := protocol.MarshalMessage(transId, msg, this.Protocol)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	return this.writeData(data)
+}
+
+// writeData write an encoded message,shared by the group members so it is only wrapped here
+func (this *PassiveSession) writeData(data []byte) error {
+	var err error
+	this.connMu.Lock()
+	defer this.connMu.Unlock()
+	if this.replay != nil {
+		data, err = marshalReliable(this.replay.seq+1, this.recvSeq, data, this.Protocol)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		this.replay.push(data)
+	}
+	if this.Conn == nil {
+		return nil
+	}
+	_, err = this.Conn.Write(data)
+	return err
+}
+
+// recvReliable apply the ack from the client and return the inner message,nil for duplicates and standalone acks
+func (this *PassiveSession) recvReliable(msg *ReliableMessage) []byte {
+	this.connMu.Lock()
+	defer this.connMu.Unlock()
+	if this.replay != nil {
+		this.replay.ack(msg.Ack)
+	}
+	if msg.Seq == 0 {
+		if len(msg.Data) == 0 {
+			return nil
+		}
+		return msg.Data
+	}
+	if msg.Seq <= this.recvSeq {
+		log.Warn("duplicated client message", lokas.LogActorInfo(this).Append(zap.Uint32("seq", msg.Seq))...)
+		return nil
+	}
+	this.recvSeq = msg.Seq
+	return msg.Data
+}
+
+func (this *PassiveSession) initReplay() {
+	this.connMu.Lock()
+	defer this.connMu.Unlock()
+	if this.replay == nil {
+		this.replay = newReplayBuffer(this.ResumeBufferSize)
+	}
+}
+
+// GetIdentity return the user identity authenticated in the handshake,nil if not authenticated by an Authenticator
+func (this *PassiveSession) GetIdentity() *Identity {
+	this.authMu.RLock()
+	defer this.authMu.RUnlock()
+	return this.Identity
+}
+
+// IsVerified return whether the handshake is verified
+func (this *PassiveSession) IsVerified() bool {
+	this.authMu.RLock()
+	defer this.authMu.RUnlock()
+	return this.Verified
+}
+
+// GetRoomId return the room the ROUTE_ROOM messages go to,0 if not bound
+func (this *PassiveSession) GetRoomId() util.ID {
+	return util.ID(atomic.LoadInt64(&this.roomId))
+}
+
+// bindRoom route the room messages to the room and forward the binding to the client
+func (this *PassiveSession) bindRoom(msg *RoomBind) {
+	atomic.StoreInt64(&this.roomId, msg.RoomId)
+	log.Info("session room bound", lokas.LogActorInfo(this).Append(zap.Int64("room", msg.RoomId))...)
+	err := this.WriteMessage(0, msg)
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// reject send the reason to the client and close the connection after a while for the message to be flushed,
+// the later messages are dropped until the session is closed
+func (this *PassiveSession) reject(transId uint32, reason *protocol.ErrMsg) {
+	this.rejected = true
+	data, err := protocol.MarshalMessage(transId, reason, this.Protocol)
+	if err != nil {
+		log.Error(err.Error())
+		this.closeConn(false)
+		return
+	}
+	this.write(data)
+	time.AfterFunc(time.Second, func() {
+		this.closeConn(false)
+	})
+}
+
+func (this *PassiveSession) write(data []byte) error {
+	this.connMu.Lock()
+	defer this.connMu.Unlock()
+	if this.Conn == nil {
+		return nil
+	}
+	_, err := this.Conn.Write(data)
+	return err
+}
+
+func (this *PassiveSession) getRelay() *PassiveSession {
+	this.connMu.Lock()
+	defer this.connMu.Unlock()
+	return this.relay
+}
+
+// issueResumeToken send the resume token to the client after the handshake
+func (this *PassiveSession) issueResumeToken() error {
+	token, err := genResumeToken()
+	if err != nil {
+		return err
+	}
+	this.connMu.Lock()
+	this.resumeToken = token
+	this.connMu.Unlock()
+	data, err := protocol.MarshalMessage(0, &SessionToken{SessionId: this.GetId(), Token: token}, this.Protocol)
+	if err != nil {
+		return err
+	}
+	return this.write(data)
+}
+
+// resume hand the connection over to the resumed session,the later messages are relayed to it
+func (this *PassiveSession) resume(transId uint32, msg *SessionResume) error {
+	if this.Verified || this.ResumeFunc == nil {
+		return protocol.ERR_SESSION_RESUME_FAILED
+	}
+	target, err := this.ResumeFunc(this, transId, msg)
+	if err != nil {
+		return err
+	}
+	this.connMu.Lock()
+	this.relay = target
+	this.connMu.Unlock()
+	return nil
+}
+
+// attach bind the connection to a detached session,reply SessionResumed and replay the messages after lastSeq
+func (this *PassiveSession) attach(conn lokas.IConn, transId uint32, token string, lastSeq uint32) error {
+	this.connMu.Lock()
+	defer this.connMu.Unlock()
+	if this.Conn != nil || this.replay == nil || this.resumeToken == "" || this.resumeToken != token {
+		return protocol.ERR_SESSION_RESUME_FAILED
+	}
+	datas, ok := this.replay.since(lastSeq)
+	if !ok {
+		return protocol.ERR_SESSION_RESUME_FAILED
+	}
+	this.replay.ack(lastSeq)
+	reply, err := protocol.MarshalMessage(transId, &SessionResumed{SessionId: this.GetId(), Seq: this.replay.seq, Ack: this.recvSeq}, this.Protocol)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(reply)
+	if err != nil {
+		return err
+	}
+	for _, data := range datas {
+		_, err = conn.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	this.Conn = conn
+	this.resumeGen++
+	log.Info("PassiveSession:resumed", lokas.LogActorInfo(this).Append(zap.Int("replayed", len(datas)))...)
+	return nil
+}
+
+// detach keep the session for ResumeGrace after its connection dropped,return false if it should be closed
+func (this *PassiveSession) detach(conn lokas.IConn) bool {
+	this.connMu.Lock()
+	defer this.connMu.Unlock()
+	if this.ResumeGrace <= 0 || this.replay == nil {
+		return false
+	}
+	if this.Conn != conn {
+		//a stale connection,the session has been resumed on another one
+		return true
+	}
+	this.lastConn = conn
+	this.Conn = nil
+	this.resumeGen++
+	gen := this.resumeGen
+	time.AfterFunc(this.ResumeGrace, func() {
+		this.expire(gen)
+	})
+	log.Info("PassiveSession:detached", lokas.LogActorInfo(this)...)
+	return true
+}
+
+func (this *PassiveSession) expire(gen int) {
+	this.connMu.Lock()
+	if gen != this.resumeGen || this.Conn != nil {
+		this.connMu.Unlock()
+		return
+	}
+	conn := this.lastConn
+	this.replay = nil
+	this.connMu.Unlock()
+	log.Info("PassiveSession:resume expired", lokas.LogActorInfo(this)...)
+	this.close(conn)
+}
+
 func (this *PassiveSession) OnRecv(conn lokas.IConn, data []byte) {
 	d := make([]byte, len(data), len(data))
 	copy(d, data)
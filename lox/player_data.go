@@ -0,0 +1,507 @@
+package lox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/log/flog"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+	"github.com/nomos/go-lokas/util/zip"
+	"github.com/nomos/qmgo"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.uber.org/zap"
+)
+
+const (
+	PLAYER_ARCHIVE_VERSION  = 1
+	PLAYER_ARCHIVE_MANIFEST = "manifest.json"
+	PLAYER_ARCHIVE_USER     = "user.bson"
+	PLAYER_ARCHIVE_AVATARS  = "avatarmap.bson"
+	PLAYER_ARCHIVE_DOCS     = "docs/" //the avatar documents,one file of concatenated bson per collection
+)
+
+// PlayerArchiveManifest describe the archive
+type PlayerArchiveManifest struct {
+	Version     int
+	Created     time.Time
+	UserId      util.ID
+	UserName    string
+	Avatars     []util.ID
+	Collections map[string]string //collection of the avatar documents,and the field of the avatar id
+}
+
+// PlayerArchive the full state of a user,the user,the avatar maps and the documents of the avatars
+type PlayerArchive struct {
+	Manifest   *PlayerArchiveManifest
+	User       *User
+	AvatarMaps []*AvatarMap
+	Docs       map[string][]bson.D //documents by collection
+}
+
+// Marshal the archive as a zip
+func (this *PlayerArchive) Marshal() ([]byte, error) {
+	files := map[string][]byte{}
+	manifest, err := json.Marshal(this.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	files[PLAYER_ARCHIVE_MANIFEST] = manifest
+	files[PLAYER_ARCHIVE_USER], err = bson.Marshal(this.User)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	for _, am := range this.AvatarMaps {
+		data, err := bson.Marshal(am)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(data)
+	}
+	files[PLAYER_ARCHIVE_AVATARS] = buf.Bytes()
+	for coll, docs := range this.Docs {
+		buf := &bytes.Buffer{}
+		for _, doc := range docs {
+			data, err := bson.Marshal(doc)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(data)
+		}
+		files[PLAYER_ARCHIVE_DOCS+coll+".bson"] = buf.Bytes()
+	}
+	return zip.CompressBytes(files)
+}
+
+// UnmarshalPlayerArchive read the archive,the versions newer than PLAYER_ARCHIVE_VERSION are rejected
+func UnmarshalPlayerArchive(data []byte) (*PlayerArchive, error) {
+	files, err := zip.DeCompressBytes(data)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, protocol.ERR_ARCHIVE_INVALID
+	}
+	ret := &PlayerArchive{
+		Manifest: &PlayerArchiveManifest{},
+		User:     &User{},
+		Docs:     map[string][]bson.D{},
+	}
+	manifest, ok := files[PLAYER_ARCHIVE_MANIFEST]
+	if !ok {
+		return nil, protocol.ERR_ARCHIVE_INVALID
+	}
+	err = json.Unmarshal(manifest, ret.Manifest)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, protocol.ERR_ARCHIVE_INVALID
+	}
+	if ret.Manifest.Version < 1 || ret.Manifest.Version > PLAYER_ARCHIVE_VERSION {
+		log.Error("player archive version not supported", zap.Int("version", ret.Manifest.Version))
+		return nil, protocol.ERR_ARCHIVE_INVALID
+	}
+	err = bson.Unmarshal(files[PLAYER_ARCHIVE_USER], ret.User)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, protocol.ERR_ARCHIVE_INVALID
+	}
+	err = eachBson(files[PLAYER_ARCHIVE_AVATARS], func(doc bson.Raw) error {
+		am := &AvatarMap{}
+		ret.AvatarMaps = append(ret.AvatarMaps, am)
+		return bson.Unmarshal(doc, am)
+	})
+	if err != nil {
+		log.Error(err.Error())
+		return nil, protocol.ERR_ARCHIVE_INVALID
+	}
+	for coll := range ret.Manifest.Collections {
+		err = eachBson(files[PLAYER_ARCHIVE_DOCS+coll+".bson"], func(doc bson.Raw) error {
+			d := bson.D{}
+			ret.Docs[coll] = append(ret.Docs[coll], d)
+			return bson.Unmarshal(doc, &ret.Docs[coll][len(ret.Docs[coll])-1])
+		})
+		if err != nil {
+			log.Error(err.Error())
+			return nil, protocol.ERR_ARCHIVE_INVALID
+		}
+	}
+	return ret, nil
+}
+
+// eachBson iterate the concatenated bson documents
+func eachBson(data []byte, f func(doc bson.Raw) error) error {
+	for len(data) > 0 {
+		doc, rem, ok := bsoncore.ReadDocument(data)
+		if !ok {
+			return protocol.ERR_ARCHIVE_INVALID
+		}
+		err := f(bson.Raw(doc))
+		if err != nil {
+			return err
+		}
+		data = rem
+	}
+	return nil
+}
+
+// Remap give the user and the avatars new ids and move the avatars to the game and the server,
+// an empty gameId or a negative serverId keeps the original,only the id fields of the documents are rewritten,
+// the documents keyed by other fields get new ids in order,return the new avatar ids by the old
+func (this *PlayerArchive) Remap(gameId string, serverId int32, genId func() util.ID) (map[util.ID]util.ID, error) {
+	ids := map[util.ID]util.ID{}
+	userId := genId()
+	avatars := map[string]util.ID{}
+	for _, am := range this.AvatarMaps {
+		id := genId()
+		ids[am.Id] = id
+		am.Id = id
+		am.UserId = userId
+		am.UserName = this.User.UserName
+		if gameId != "" {
+			am.GameId = gameId
+		}
+		if serverId >= 0 {
+			am.ServerId = serverId
+		}
+		key := ServerKey(am.GameId, am.ServerId)
+		if _, ok := avatars[key]; ok {
+			log.Error("avatars of the archive on the same server", zap.String("server", key))
+			return nil, protocol.ERR_GAME_ACC_EXIST
+		}
+		avatars[key] = id
+	}
+	for coll, field := range this.Manifest.Collections {
+		for i, doc := range this.Docs[coll] {
+			for j := 0; j < len(doc); j++ {
+				e := &doc[j]
+				if e.Key == field {
+					old, ok := idOf(e.Value)
+					if !ok {
+						return nil, protocol.ERR_ARCHIVE_INVALID
+					}
+					if ids[old] == 0 {
+						log.Error("document of avatar not in the archive", zap.String("collection", coll), flog.AvatarId(old))
+						return nil, protocol.ERR_ARCHIVE_INVALID
+					}
+					e.Value = ids[old]
+				} else if e.Key == "_id" {
+					if _, ok := idOf(e.Value); !ok {
+						//ObjectId generated by mongo
+						doc = append(doc[:j], doc[j+1:]...)
+						j--
+						continue
+					}
+					e.Value = genId()
+				}
+			}
+			this.Docs[coll][i] = doc
+		}
+	}
+	this.User.Id = userId
+	this.User.Avatars = avatars
+	this.User.Token = ""
+	this.User.RefreshToken = ""
+	this.Manifest.UserId = userId
+	this.Manifest.Avatars = []util.ID{}
+	for _, am := range this.AvatarMaps {
+		this.Manifest.Avatars = append(this.Manifest.Avatars, am.Id)
+	}
+	return ids, nil
+}
+
+func idOf(v interface{}) (util.ID, bool) {
+	switch id := v.(type) {
+	case int64:
+		return util.ID(id), true
+	case util.ID:
+		return id, true
+	case int32:
+		return util.ID(id), true
+	}
+	return 0, false
+}
+
+// PlayerDeleteReport the data removed by the hard delete
+type PlayerDeleteReport struct {
+	UserId    util.ID
+	Avatars   []util.ID
+	Documents map[string]int64 //documents removed by collection
+	RedisKeys int64
+	Sessions  int
+	Kicked    int
+}
+
+// PlayerData export,import and hard delete the full state of the users
+type PlayerData struct {
+	Collections     map[string]string //collections of the avatar documents,and the field of the avatar id
+	AvatarRedisKeys []lokas.Key       //redis keys of an avatar,assembled with the avatar id
+	UserRedisKeys   []lokas.Key       //redis keys of a user,assembled with the user id
+}
+
+// NewPlayerData with the avatar collection and the separate component collections of the mapper,and the inbox
+func NewPlayerData(mapper *ComponentMapper) *PlayerData {
+	ret := &PlayerData{
+		Collections: map[string]string{
+			AVATAR_COLLECTION: "_id",
+			INBOX_COLLECTION:  "to",
+		},
+		AvatarRedisKeys: []lokas.Key{},
+		UserRedisKeys:   []lokas.Key{},
+	}
+	if mapper != nil {
+		ret.Collections[mapper.Collection] = "_id"
+		for _, coll := range mapper.collections {
+			ret.Collections[coll] = "_id"
+		}
+	}
+	return ret
+}
+
+// RegisterCollection add a collection of the avatar documents with the field of the avatar id
+func (this *PlayerData) RegisterCollection(collection string, field string) *PlayerData {
+	if field == "" {
+		field = "_id"
+	}
+	this.Collections[collection] = field
+	return this
+}
+
+func (this *PlayerData) collections() []string {
+	ret := []string{}
+	for coll := range this.Collections {
+		ret = append(ret, coll)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Export the user with all the avatar maps and the avatar documents
+func (this *PlayerData) Export(db *qmgo.Database, userId util.ID) (*PlayerArchive, error) {
+	user := &User{}
+	err := db.Collection(USER_COLLECTION).Find(context.TODO(), bson.M{"_id": userId}).One(user)
+	if err == qmgo.ErrNoSuchDocuments {
+		return nil, protocol.ERR_ACC_NOT_FIND
+	}
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	ret := &PlayerArchive{
+		Manifest: &PlayerArchiveManifest{
+			Version:     PLAYER_ARCHIVE_VERSION,
+			Created:     time.Now(),
+			UserId:      user.Id,
+			UserName:    user.UserName,
+			Avatars:     []util.ID{},
+			Collections: map[string]string{},
+		},
+		User:       user,
+		AvatarMaps: []*AvatarMap{},
+		Docs:       map[string][]bson.D{},
+	}
+	err = db.Collection(AVATAR_MAP_COLLECTION).Find(context.TODO(), bson.M{"userid": userId}).Sort("_id").All(&ret.AvatarMaps)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	for _, am := range ret.AvatarMaps {
+		ret.Manifest.Avatars = append(ret.Manifest.Avatars, am.Id)
+	}
+	for _, coll := range this.collections() {
+		field := this.Collections[coll]
+		ret.Manifest.Collections[coll] = field
+		docs := []bson.D{}
+		err = db.Collection(coll).Find(context.TODO(), bson.M{field: bson.M{"$in": ret.Manifest.Avatars}}).Sort("_id").All(&docs)
+		if err != nil {
+			log.Error(err.Error())
+			return nil, err
+		}
+		ret.Docs[coll] = docs
+	}
+	log.Warn("PlayerData:Export", flog.UserId(userId), zap.Int("avatars", len(ret.AvatarMaps)))
+	return ret, nil
+}
+
+// Import the archive as a new user,remapped to the game and the server,
+// userName replaces the name of the user if not empty,the documents written are removed on failure
+func (this *PlayerData) Import(process lokas.IProcess, archive *PlayerArchive, gameId string, serverId int32, userName string) (*User, error) {
+	db := process.GetMongo()
+	if userName != "" {
+		archive.User.UserName = userName
+		archive.Manifest.UserName = userName
+	}
+	cnt, err := db.Collection(USER_COLLECTION).Find(context.TODO(), bson.M{"username": archive.User.UserName}).Count()
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	if cnt > 0 {
+		return nil, protocol.ERR_ACC_EXIST
+	}
+	_, err = archive.Remap(gameId, serverId, process.GenId)
+	if err != nil {
+		return nil, err
+	}
+	err = this.insert(db, archive)
+	if err != nil {
+		log.Error("import player failed", flog.UserId(archive.User.Id), flog.Error(err))
+		_, rerr := this.remove(db, archive.User.Id, archive.Manifest.Avatars)
+		if rerr != nil {
+			log.Error(rerr.Error())
+		}
+		return nil, err
+	}
+	log.Warn("PlayerData:Import", flog.UserId(archive.User.Id), flog.UserName(archive.User.UserName), zap.Int("avatars", len(archive.AvatarMaps)))
+	return archive.User, nil
+}
+
+// insert the avatar documents first and the user last,so that the user is not seen before complete
+func (this *PlayerData) insert(db *qmgo.Database, archive *PlayerArchive) error {
+	for coll, docs := range archive.Docs {
+		if len(docs) == 0 {
+			continue
+		}
+		_, err := db.Collection(coll).InsertMany(context.TODO(), docs)
+		if err != nil {
+			return err
+		}
+	}
+	if len(archive.AvatarMaps) > 0 {
+		_, err := db.Collection(AVATAR_MAP_COLLECTION).InsertMany(context.TODO(), archive.AvatarMaps)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := db.Collection(USER_COLLECTION).InsertOne(context.TODO(), archive.User)
+	return err
+}
+
+// remove the mongo documents of the user and the avatars
+func (this *PlayerData) remove(db *qmgo.Database, userId util.ID, avatars []util.ID) (map[string]int64, error) {
+	ret := map[string]int64{}
+	if len(avatars) > 0 {
+		for _, coll := range this.collections() {
+			res, err := db.Collection(coll).RemoveAll(context.TODO(), bson.M{this.Collections[coll]: bson.M{"$in": avatars}})
+			if err != nil {
+				return ret, err
+			}
+			ret[coll] += res.DeletedCount
+		}
+	}
+	res, err := db.Collection(AVATAR_MAP_COLLECTION).RemoveAll(context.TODO(), bson.M{"userid": userId})
+	if err != nil {
+		return ret, err
+	}
+	ret[AVATAR_MAP_COLLECTION] = res.DeletedCount
+	res, err = db.Collection(USER_COLLECTION).RemoveAll(context.TODO(), bson.M{"_id": userId})
+	if err != nil {
+		return ret, err
+	}
+	ret[USER_COLLECTION] = res.DeletedCount
+	return ret, nil
+}
+
+// Delete the user hard across mongo,redis and the avatar sessions in etcd,
+// the gate sessions of the avatars are kicked,fails if any avatar is loaded for it would be saved again
+func (this *PlayerData) Delete(process lokas.IProcess, userId util.ID) (*PlayerDeleteReport, error) {
+	db := process.GetMongo()
+	report := &PlayerDeleteReport{UserId: userId, Avatars: []util.ID{}}
+	user := &User{}
+	err := db.Collection(USER_COLLECTION).Find(context.TODO(), bson.M{"_id": userId}).One(user)
+	if err != nil && err != qmgo.ErrNoSuchDocuments {
+		log.Error(err.Error())
+		return nil, err
+	}
+	ams := []*AvatarMap{}
+	err = db.Collection(AVATAR_MAP_COLLECTION).Find(context.TODO(), bson.M{"userid": userId}).All(&ams)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	for _, am := range ams {
+		report.Avatars = append(report.Avatars, am.Id)
+	}
+	for _, id := range user.Avatars {
+		found := false
+		for _, a := range report.Avatars {
+			if a == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			report.Avatars = append(report.Avatars, id)
+		}
+	}
+	if user.Id == 0 && len(report.Avatars) == 0 {
+		return nil, protocol.ERR_ACC_NOT_FIND
+	}
+	for _, id := range report.Avatars {
+		if _, err := process.GetProcessIdByActor(id); err == nil {
+			log.Warn("avatar is loaded,delete the user later", flog.UserId(userId), flog.AvatarId(id))
+			return nil, protocol.ERR_AVATAR_LOADED
+		}
+	}
+	if process.GetEtcd() != nil {
+		err = this.deleteSessions(process, report)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if process.GetRedis() != nil {
+		keys := []interface{}{}
+		for _, id := range report.Avatars {
+			for _, k := range this.AvatarRedisKeys {
+				keys = append(keys, k.Assemble(id))
+			}
+		}
+		for _, k := range this.UserRedisKeys {
+			keys = append(keys, k.Assemble(userId))
+		}
+		if len(keys) > 0 {
+			report.RedisKeys, err = process.GetRedis().Del(keys...).Int64()
+			if err != nil {
+				log.Error(err.Error())
+				return nil, err
+			}
+		}
+	}
+	report.Documents, err = this.remove(db, userId, report.Avatars)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	log.Warn("PlayerData:Delete", flog.UserId(userId), zap.Int("avatars", len(report.Avatars)), zap.Any("documents", report.Documents))
+	return report, nil
+}
+
+// deleteSessions kick the gate sessions bound to the avatars and delete the avatar sessions
+func (this *PlayerData) deleteSessions(process lokas.IProcess, report *PlayerDeleteReport) error {
+	etcd := process.GetEtcd()
+	for _, id := range report.Avatars {
+		key := AVATAR_SESSION_KEY.Assemble(id)
+		res, err := etcd.Delete(context.TODO(), key, clientv3.WithPrevKV())
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		for _, kv := range res.PrevKvs {
+			report.Sessions++
+			sess := NewAvatarSession(0)
+			if json.Unmarshal(kv.Value, sess) != nil || sess.GateId == 0 {
+				continue
+			}
+			msg := protocol.NewRouteMessage(0, sess.GateId, 0, NewSessionKicked(id, KICK_ADMIN), true)
+			msg.ToPid = sess.GatePid
+			process.RouteMsg(msg)
+			report.Kicked++
+		}
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package lox
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/nomos/go-lokas/log/flog"
@@ -9,7 +10,9 @@ import (
 
 	"github.com/nomos/go-lokas"
 	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/network/codec"
 	"github.com/nomos/go-lokas/network/tcp"
+	"github.com/nomos/go-lokas/network/tlsconf"
 	"github.com/nomos/go-lokas/protocol"
 	"github.com/nomos/go-lokas/util"
 	"github.com/nomos/go-lokas/util/promise"
@@ -40,6 +43,8 @@ type Proxy struct {
 	server  lokas.Server
 	started bool
 	mu      sync.Mutex
+	TLS     *tlsconf.Loader   //mutual tls between processes if set
+	Codec   lokas.PacketCodec //compress the packets between processes if set,the peers decode them without configuration
 
 	dialerCloseChans map[util.ProcessId]chan struct{}
 	process          lokas.IProcess
@@ -84,7 +89,22 @@ func (this *Proxy) OnDestroy() error {
 }
 
 func (this *Proxy) Load(conf lokas.IConfig) error {
-
+	if opts := tlsconf.FromConfig(conf); opts != nil {
+		loader, err := tlsconf.NewLoader(opts)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		this.TLS = loader
+	}
+	if compress := conf.GetString("codec.compress"); compress != "" {
+		c, err := codec.New(compress, conf.GetInt("codec.threshold"), nil, nil)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		this.Codec = c
+	}
 	context := &lokas.Context{
 		SessionCreator:    passiveSessionCreator(this),
 		Splitter:          protocol.Split,
@@ -93,6 +113,10 @@ func (this *Proxy) Load(conf lokas.IConfig) error {
 		LongPacketPicker:  protocol.PickLongPacket(protocol.BINARY),
 		LongPacketCreator: protocol.CreateLongPacket(protocol.BINARY),
 		MaxPacketWriteLen: protocol.DEFAULT_PACKET_LEN,
+		Codec:             this.Codec,
+	}
+	if this.TLS != nil {
+		context.TLSConfig = this.TLS.ServerConfig()
 	}
 	this.server = tcp.NewServer(context)
 	return nil
@@ -108,7 +132,7 @@ type processHandShake struct {
 
 func activeSessionCreator(id util.ID, p *Proxy) func(conn lokas.IConn) lokas.ISession {
 	return func(conn lokas.IConn) lokas.ISession {
-		sess := NewProxySession(conn, id, p.Sessions, false)
+		sess := NewProxySession(conn, id, p.Sessions, false, WithMsgHandler(p.handleMsg))
 		sess.AuthFunc = func(data []byte) error {
 			sess.Verified = true
 			p.Sessions.AddSession(sess.GetId(), sess)
@@ -123,25 +147,17 @@ func activeSessionCreator(id util.ID, p *Proxy) func(conn lokas.IConn) lokas.ISe
 
 func passiveSessionCreator(p *Proxy) func(conn lokas.IConn) lokas.ISession {
 	return func(conn lokas.IConn) lokas.ISession {
-		sess := NewProxySession(conn, p.GetProcess().GenId(), p.Sessions, true)
+		sess := NewProxySession(conn, p.GetProcess().GenId(), p.Sessions, true, WithMsgHandler(p.handleMsg))
 		sess.AuthFunc = func(data []byte) error {
 			var hs processHandShake
-			err := json.Unmarshal(data, hs)
-			if err != nil {
-				log.Error(err.Error())
-				return err
-			}
-			p.Sessions.AddSession(hs.Id, sess)
-			data, _ = protocol.MarshalMessage(0, hs, protocol.BINARY)
-			_, err = sess.Conn.Write(data)
+			err := json.Unmarshal(data, &hs)
 			if err != nil {
 				log.Error(err.Error())
-				sess.Conn.Close()
-				sess.closeSession()
-				sess.OnVerified(false)
 				return err
 			}
-			sess.OnVerified(true)
+			//按对端进程id索引会话,握手包由会话原样回写作为应答
+			p.Sessions.ResetSession(hs.Id, sess)
+			sess.SetId(hs.Id)
 			return nil
 		}
 		sess.Protocol = protocol.BINARY
@@ -190,6 +206,10 @@ func (this *Proxy) connect(id util.ProcessId, addr string) (*ProxySession, error
 		LongPacketPicker:  protocol.PickLongPacket(protocol.BINARY),
 		LongPacketCreator: protocol.CreateLongPacket(protocol.BINARY),
 		MaxPacketWriteLen: protocol.DEFAULT_PACKET_LEN,
+		Codec:             this.Codec,
+	}
+	if this.TLS != nil {
+		context.TLSConfig = this.TLS.ClientConfig()
 	}
 	//如果没有连接,尝试连接
 	conn, err := tcp.Dial(addr, context)
@@ -203,6 +223,11 @@ func (this *Proxy) connect(id util.ProcessId, addr string) (*ProxySession, error
 	}
 	//握手协议
 	activeSession := conn.Session.(*ProxySession)
+	hsData, err := json.Marshal(&processHandShake{Id: selfId.Snowflake()})
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
 	_, err = promise.Async(func(resolve func(interface{}), reject func(interface{})) {
 		timeout := promise.SetTimeout(time.Second*14, func(timeout *promise.Timeout) {
 			reject("connect to server timeout:" + id.ToString())
@@ -218,6 +243,19 @@ func (this *Proxy) connect(id util.ProcessId, addr string) (*ProxySession, error
 				reject("connect to server failed:" + id.ToString())
 			}
 		}
+		data, err := protocol.MarshalMessage(0, &protocol.HandShake{Data: hsData}, protocol.BINARY)
+		if err != nil {
+			timeout.Close()
+			reject(err.Error())
+			return
+		}
+		_, err = activeSession.Conn.Write(data)
+		if err != nil {
+			timeout.Close()
+			reject(err.Error())
+			activeSession.Conn.Close()
+			activeSession.closeSession()
+		}
 	}).Await()
 	if err != nil {
 		log.Error(err.Error())
@@ -235,19 +273,22 @@ func (this *Proxy) getProxySession(id util.ProcessId) *ProxySession {
 }
 
 func (this *Proxy) Send(id util.ProcessId, msg *protocol.RouteMessage) error {
-	sess := this.getProxySession(id)
-	if sess == nil {
-		//info:=this.GetProcess().GetProcessInfo
-		//sess,err:=this.connect(id,addr)
-		//if err != nil {
-		//	log.Error(err.Error())ss
-		//	return err
-		//}
-		//TODO
-		return nil
+	sess, err := this.getOrConnect(id)
+	if err != nil {
+		log.Error(err.Error())
+		return err
 	}
-	data, _ := msg.Marshal()
-	_, err := sess.Conn.Write(data)
+	proxyMsg, err := NewProxyMessage(msg)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	data, err := protocol.MarshalMessage(0, proxyMsg, protocol.BINARY)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	_, err = sess.Conn.Write(data)
 	if err != nil {
 		log.Error(err.Error())
 		return err
@@ -255,6 +296,60 @@ func (this *Proxy) Send(id util.ProcessId, msg *protocol.RouteMessage) error {
 	return nil
 }
 
+// getOrConnect return the session to the process,dial it with the address registered in etcd if not connected
+func (this *Proxy) getOrConnect(id util.ProcessId) (*ProxySession, error) {
+	sess := this.getProxySession(id)
+	if sess != nil {
+		return sess, nil
+	}
+	addr, err := this.getProcessAddr(id)
+	if err != nil {
+		return nil, err
+	}
+	return this.connect(id, addr)
+}
+
+func (this *Proxy) getProcessAddr(id util.ProcessId) (string, error) {
+	client := this.GetProcess().GetEtcd()
+	if client == nil {
+		return "", protocol.ERR_ETCD_ERROR
+	}
+	resp, err := client.Get(context.TODO(), "/process/"+id.ToString()+"/info")
+	if err != nil {
+		log.Error(err.Error())
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", protocol.ERR_SERVICE_NOT_FOUND
+	}
+	info := &ProcessRegistryInfo{}
+	err = json.Unmarshal(resp.Kvs[0].Value, info)
+	if err != nil {
+		log.Error(err.Error())
+		return "", err
+	}
+	host := info.Host
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return host + ":" + info.Port, nil
+}
+
+// handleMsg unwrap the messages from other processes and route them locally
+func (this *Proxy) handleMsg(msg *protocol.BinaryMessage) {
+	proxyMsg, ok := msg.Body.(*ProxyMessage)
+	if !ok {
+		log.Warn("proxy recv unknown msg", protocol.LogCmdId(msg.CmdId))
+		return
+	}
+	routeMsg, err := proxyMsg.RouteMessage()
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+	this.GetProcess().RouteMsg(routeMsg)
+}
+
 func (this *Proxy) SendData(pid util.ProcessId, data []byte) error {
 
 	//no use this
@@ -0,0 +1,108 @@
+package lox
+
+import (
+	"encoding/binary"
+	"reflect"
+
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+)
+
+// ProxyMessage 进程间转发的RouteMessage,携带路由信息和编码后的消息体
+type ProxyMessage struct {
+	FromActor util.ID
+	ToActor   util.ID
+	TransId   uint32
+	ReqType   uint8
+	Req       bool
+	Body      []byte
+}
+
+func (this *ProxyMessage) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *ProxyMessage) Serializable() protocol.ISerializable {
+	return this
+}
+
+func NewProxyMessage(msg *protocol.RouteMessage) (*ProxyMessage, error) {
+	body, err := protocol.MarshalBinary(msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyMessage{
+		FromActor: msg.FromActor,
+		ToActor:   msg.ToActor,
+		TransId:   msg.TransId,
+		ReqType:   msg.ReqType,
+		Req:       msg.Req,
+		Body:      body,
+	}, nil
+}
+
+// RouteMessage decode the envelope back to a RouteMessage
+func (this *ProxyMessage) RouteMessage() (*protocol.RouteMessage, error) {
+	body, err := unmarshalProxyBody(this.Body)
+	if err != nil {
+		return nil, err
+	}
+	cmdId, _ := body.GetId()
+	return &protocol.RouteMessage{
+		TransId:   this.TransId,
+		Req:       this.Req,
+		ReqType:   this.ReqType,
+		CmdId:     cmdId,
+		InnerId:   cmdId,
+		FromActor: this.FromActor,
+		ToActor:   this.ToActor,
+		Body:      body,
+	}, nil
+}
+
+// TopicMessage 发布到主题的消息,按进程投递后由Router分发给本地订阅者
+type TopicMessage struct {
+	Topic string
+	Body  []byte
+}
+
+func (this *TopicMessage) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *TopicMessage) Serializable() protocol.ISerializable {
+	return this
+}
+
+func NewTopicMessage(topic string, msg protocol.ISerializable) (*TopicMessage, error) {
+	body, err := protocol.MarshalBinary(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &TopicMessage{
+		Topic: topic,
+		Body:  body,
+	}, nil
+}
+
+// Message decode the published message
+func (this *TopicMessage) Message() (protocol.ISerializable, error) {
+	return unmarshalProxyBody(this.Body)
+}
+
+// body is encoded by protocol.MarshalBinary,started with the tag of the message
+func unmarshalProxyBody(data []byte) (protocol.ISerializable, error) {
+	if len(data) < 2 {
+		return nil, protocol.ERR_MSG_FORMAT
+	}
+	tag := protocol.BINARY_TAG(binary.LittleEndian.Uint16(data[0:2]))
+	body, err := protocol.GetTypeRegistry().GetInterfaceByTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	err = protocol.Unmarshal(data, body)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
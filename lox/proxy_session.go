@@ -249,6 +249,7 @@ func (this *ProxySession) startMessagePumpPassive() {
 					}
 					continue
 				}
+				this.handleMsg(msg)
 			case <-this.done:
 				this.Conn.Close()
 				this.closeSession()
@@ -344,12 +345,7 @@ func (this *ProxySession) startMessagePumpActive() {
 						this.Conn.Close()
 						break LOOP
 					}
-					_, err = this.Conn.Write(data)
-					if err != nil {
-						log.Error(err.Error())
-						this.Conn.Close()
-						break LOOP
-					}
+					//主动连接收到的是对端的握手回复,无需再回写
 					this.Verified = true
 					continue
 				}
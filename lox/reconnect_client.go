@@ -0,0 +1,324 @@
+package lox
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/log/flog"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util/events"
+	"github.com/nomos/go-lokas/util/promise"
+	"go.uber.org/zap"
+)
+
+type ClientState int
+
+const (
+	CLIENT_DISCONNECTED ClientState = iota
+	CLIENT_CONNECTING
+	CLIENT_CONNECTED
+	CLIENT_RECONNECTING
+	CLIENT_CLOSED //closed by Disconnect or gave up reconnecting
+)
+
+func (this ClientState) String() string {
+	switch this {
+	case CLIENT_DISCONNECTED:
+		return "disconnected"
+	case CLIENT_CONNECTING:
+		return "connecting"
+	case CLIENT_CONNECTED:
+		return "connected"
+	case CLIENT_RECONNECTING:
+		return "reconnecting"
+	case CLIENT_CLOSED:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// EVENT_CLIENT_STATE emitted with the new and the old ClientState
+const EVENT_CLIENT_STATE events.EventName = "state"
+
+var (
+	ErrClientClosed = errors.New("client closed")
+	ErrDisconnected = errors.New("disconnect")        //the requests pending when the connection dropped
+	ErrConnClosed   = errors.New("connection closed") //the request sent without a connection
+)
+
+// isConnError whether err is caused by the connection rather than by the request
+func isConnError(err error) bool {
+	if errors.Is(err, ErrDisconnected) || errors.Is(err, ErrConnClosed) || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && !netErr.Timeout()
+}
+
+// ReconnectPolicy exponential backoff between the reconnect attempts
+type ReconnectPolicy struct {
+	MinDelay    time.Duration
+	MaxDelay    time.Duration
+	Multiplier  float64
+	Jitter      float64 //random fraction added to the delay,0~1
+	MaxAttempts int     //give up after so many failed attempts,0 means forever
+	MaxReplay   int     //max times an idempotent request is sent again
+	ReplayWait  time.Duration
+}
+
+func DefaultReconnectPolicy() *ReconnectPolicy {
+	return &ReconnectPolicy{
+		MinDelay:    time.Millisecond * 200,
+		MaxDelay:    time.Second * 10,
+		Multiplier:  2,
+		Jitter:      0.2,
+		MaxAttempts: 0,
+		MaxReplay:   3,
+		ReplayWait:  time.Second * 30,
+	}
+}
+
+// Delay the wait before the attempt,started from 1
+func (this *ReconnectPolicy) Delay(attempt int) time.Duration {
+	d := float64(this.MinDelay)
+	for i := 1; i < attempt && d < float64(this.MaxDelay); i++ {
+		d *= this.Multiplier
+	}
+	if this.MaxDelay > 0 && d > float64(this.MaxDelay) {
+		d = float64(this.MaxDelay)
+	}
+	if this.Jitter > 0 {
+		d += d * this.Jitter * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+type eventNetClient interface {
+	lokas.INetClient
+	events.EventEmmiter
+}
+
+// NewNetClient create the client of the transport,TcpClient for tcp and kcp,WsClient for websocket
+func NewNetClient(connType ConnType, p protocol.TYPE) lokas.INetClient {
+	if connType == Websocket {
+		ret := NewWsClient()
+		ret.SetProtocol(p)
+		return ret
+	}
+	ret := NewTcpClient()
+	ret.ConnType = connType
+	ret.SetProtocol(p)
+	return ret
+}
+
+// ReconnectClient reconnect the transport client when the connection dropped,
+// handshake again after every connect,and send the idempotent requests failed by the disconnection again
+type ReconnectClient struct {
+	events.EventEmmiter
+	lokas.INetClient
+	Policy     *ReconnectPolicy
+	HandShake  func(client lokas.INetClient) error //called after every connect,e.g. the login handshake
+	Idempotent func(req interface{}) bool          //whether the request is safe to be sent again,no replay if nil
+
+	addr       string
+	state      ClientState
+	generation int //increased on every successful connect
+	closed     bool
+	changed    chan struct{}
+	mu         sync.Mutex
+}
+
+func NewReconnectClient(connType ConnType, p protocol.TYPE, policy *ReconnectPolicy) *ReconnectClient {
+	if policy == nil {
+		policy = DefaultReconnectPolicy()
+	}
+	ret := &ReconnectClient{
+		EventEmmiter: events.New(),
+		INetClient:   NewNetClient(connType, p),
+		Policy:       policy,
+		changed:      make(chan struct{}),
+	}
+	ret.INetClient.(eventNetClient).On("close", func(i ...interface{}) {
+		ret.onTransportClose()
+	})
+	return ret
+}
+
+func (this *ReconnectClient) State() ClientState {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.state
+}
+
+// OnStateChange listen the state changes
+func (this *ReconnectClient) OnStateChange(f func(state ClientState, old ClientState)) {
+	this.On(EVENT_CLIENT_STATE, func(i ...interface{}) {
+		f(i[0].(ClientState), i[1].(ClientState))
+	})
+}
+
+func (this *ReconnectClient) setState(state ClientState) {
+	this.mu.Lock()
+	old := this.state
+	if old == state {
+		this.mu.Unlock()
+		return
+	}
+	this.state = state
+	if state == CLIENT_CONNECTED {
+		this.generation++
+	}
+	close(this.changed)
+	this.changed = make(chan struct{})
+	this.mu.Unlock()
+	log.Info("client state changed", zap.String("addr", this.addr), zap.String("state", state.String()), zap.String("old", old.String()))
+	this.Emit(EVENT_CLIENT_STATE, state, old)
+}
+
+func (this *ReconnectClient) open() error {
+	_, err := this.INetClient.Connect(this.addr).Await()
+	if err != nil {
+		return err
+	}
+	if this.HandShake != nil {
+		err = this.HandShake(this.INetClient)
+		if err != nil {
+			this.INetClient.Disconnect(true).Await()
+			return err
+		}
+	}
+	return nil
+}
+
+// Connect connect and handshake,the later disconnections are reconnected by the policy
+func (this *ReconnectClient) Connect(addr string) *promise.Promise[interface{}] {
+	return promise.Async(func(resolve func(interface{}), reject func(interface{})) {
+		this.mu.Lock()
+		this.addr = addr
+		this.closed = false
+		this.mu.Unlock()
+		this.setState(CLIENT_CONNECTING)
+		err := this.open()
+		if err != nil {
+			log.Error(err.Error())
+			this.setState(CLIENT_DISCONNECTED)
+			reject(err)
+			return
+		}
+		this.setState(CLIENT_CONNECTED)
+		resolve(nil)
+	})
+}
+
+// Disconnect close the connection without reconnecting
+func (this *ReconnectClient) Disconnect(force bool) *promise.Promise[interface{}] {
+	this.mu.Lock()
+	this.closed = true
+	this.mu.Unlock()
+	this.setState(CLIENT_CLOSED)
+	return this.INetClient.Disconnect(force)
+}
+
+func (this *ReconnectClient) Connected() bool {
+	return this.State() == CLIENT_CONNECTED && this.INetClient.Connected()
+}
+
+func (this *ReconnectClient) onTransportClose() {
+	this.mu.Lock()
+	if this.closed || this.state != CLIENT_CONNECTED {
+		this.mu.Unlock()
+		return
+	}
+	this.mu.Unlock()
+	this.setState(CLIENT_RECONNECTING)
+	go this.reconnect()
+}
+
+func (this *ReconnectClient) reconnect() {
+	for attempt := 1; this.Policy.MaxAttempts == 0 || attempt <= this.Policy.MaxAttempts; attempt++ {
+		time.Sleep(this.Policy.Delay(attempt))
+		this.mu.Lock()
+		closed := this.closed
+		this.mu.Unlock()
+		if closed {
+			return
+		}
+		err := this.open()
+		if err == nil {
+			this.setState(CLIENT_CONNECTED)
+			return
+		}
+		log.Warn("reconnect failed", flog.Address(this.addr), zap.Int("attempt", attempt), flog.Error(err))
+	}
+	log.Error("reconnect gave up", flog.Address(this.addr), zap.Int("attempts", this.Policy.MaxAttempts))
+	this.mu.Lock()
+	this.closed = true
+	this.mu.Unlock()
+	this.setState(CLIENT_CLOSED)
+}
+
+// waitReconnected wait for a connection newer than generation,false if closed or timeout
+func (this *ReconnectClient) waitReconnected(generation int) bool {
+	timeout := time.After(this.Policy.ReplayWait)
+	for {
+		this.mu.Lock()
+		state, gen, changed := this.state, this.generation, this.changed
+		this.mu.Unlock()
+		if state == CLIENT_CLOSED {
+			return false
+		}
+		if state == CLIENT_CONNECTED && gen > generation {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+// Request send the request,the idempotent ones failed by a disconnection are sent again after reconnected,
+// the other failures are rejected at once
+func (this *ReconnectClient) Request(req interface{}) *promise.Promise[interface{}] {
+	return promise.Async(func(resolve func(interface{}), reject func(interface{})) {
+		for replay := 0; ; replay++ {
+			this.mu.Lock()
+			state, generation := this.state, this.generation
+			this.mu.Unlock()
+			if state == CLIENT_CLOSED {
+				reject(ErrClientClosed)
+				return
+			}
+			resp, err := this.INetClient.Request(req).Await()
+			if err == nil {
+				resolve(resp)
+				return
+			}
+			if this.Idempotent == nil || !this.Idempotent(req) || replay >= this.Policy.MaxReplay {
+				reject(err)
+				return
+			}
+			//the timeouts and the errors of the request itself are not replayed
+			this.mu.Lock()
+			reconnected := this.generation != generation
+			this.mu.Unlock()
+			if !reconnected && !isConnError(err) {
+				reject(err)
+				return
+			}
+			if !this.waitReconnected(generation) {
+				reject(err)
+				return
+			}
+			log.Info("replay request", flog.Address(this.addr), zap.Int("replay", replay+1))
+		}
+	})
+}
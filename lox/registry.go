@@ -7,10 +7,12 @@ import (
 	"github.com/nomos/go-lokas/log/flog"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/nomos/go-lokas"
 	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/network/etcdclient"
 	"github.com/nomos/go-lokas/protocol"
 	"github.com/nomos/go-lokas/util"
 	"go.etcd.io/etcd/api/v3/mvccpb"
@@ -28,12 +30,17 @@ type Registry struct {
 	actorWatchCloseChan   chan struct{}
 	processWatchCloseChan chan struct{}
 	serviceWatchCloseChan chan struct{}
+	topicWatchCloseChan   chan struct{}
 
 	serviceRegisterMgr *ServiceRegisterMgr
 	serviceDiscoverMgr *ServiceDiscoverMgr
 
+	events *registryEventDispatcher
+	topics *topicRegistry
+
 	timer   *time.Ticker
 	done    chan struct{}
+	leaseMu sync.Mutex
 	leaseId clientv3.LeaseID
 }
 
@@ -44,10 +51,45 @@ func NewRegistry(process lokas.IProcess) *Registry {
 		GlobalRegistry:     NewCommonRegistry(),
 		serviceRegisterMgr: NewServiceRegisterMgr(process),
 		serviceDiscoverMgr: NewServiceDiscoverMgr(process),
+		events:             newRegistryEventDispatcher(),
+		topics:             newTopicRegistry(),
 	}
+	ret.serviceDiscoverMgr.onEvent = ret.events.emit
 	return ret
 }
 
+func (this *Registry) Watch(mask lokas.RegistryEventType, sink lokas.RegistryEventSink) func() {
+	return this.events.watch(mask, sink)
+}
+
+func (this *Registry) OnProcessJoined(sink lokas.RegistryEventSink) func() {
+	return this.events.watch(lokas.EVT_PROCESS_JOINED, sink)
+}
+
+func (this *Registry) OnProcessLeft(sink lokas.RegistryEventSink) func() {
+	return this.events.watch(lokas.EVT_PROCESS_LEFT, sink)
+}
+
+func (this *Registry) OnServiceAdded(sink lokas.RegistryEventSink) func() {
+	return this.events.watch(lokas.EVT_SERVICE_ADDED, sink)
+}
+
+func (this *Registry) OnServiceRemoved(sink lokas.RegistryEventSink) func() {
+	return this.events.watch(lokas.EVT_SERVICE_REMOVED, sink)
+}
+
+func (this *Registry) OnServiceUpdated(sink lokas.RegistryEventSink) func() {
+	return this.events.watch(lokas.EVT_SERVICE_UPDATED, sink)
+}
+
+func (this *Registry) OnActorRegistered(sink lokas.RegistryEventSink) func() {
+	return this.events.watch(lokas.EVT_ACTOR_REGISTERED, sink)
+}
+
+func (this *Registry) OnActorUnregistered(sink lokas.RegistryEventSink) func() {
+	return this.events.watch(lokas.EVT_ACTOR_UNREGISTERED, sink)
+}
+
 func (reg *Registry) GetServiceRegisterMgr() lokas.IServiceRegisterMgr {
 	return reg.serviceRegisterMgr
 }
@@ -86,6 +128,8 @@ func (this *Registry) OnDestroy() error {
 
 // return leaseId,(bool)is registered,error
 func (this *Registry) GetLeaseId() (clientv3.LeaseID, bool, error) {
+	this.leaseMu.Lock()
+	defer this.leaseMu.Unlock()
 	c := this.process.GetEtcd()
 	if this.leaseId != 0 {
 		resToLive, err := c.Lease.TimeToLive(context.Background(), this.leaseId)
@@ -188,8 +232,10 @@ func (this *Registry) Load(conf lokas.IConfig) error {
 	if this.process.GetEtcd() == nil {
 		return nil
 	}
+	this.events.start()
 	this.startUpdateRemoteActorInfo()
 	this.startUpdateRemoteProcessInfo()
+	this.startUpdateRemoteTopicInfo()
 	// err := this.startUpdateRemoteService()
 	err := this.serviceDiscoverMgr.StartDiscover()
 	if err != nil {
@@ -200,37 +246,64 @@ func (this *Registry) Load(conf lokas.IConfig) error {
 }
 
 func (this *Registry) Unload() error {
-	this.actorWatchCloseChan <- struct{}{}
-	this.processWatchCloseChan <- struct{}{}
+	stopWatch(&this.actorWatchCloseChan)
+	stopWatch(&this.processWatchCloseChan)
+	stopWatch(&this.topicWatchCloseChan)
+	this.events.stop()
 	return nil
 }
 
-// check if actor key exist,otherwise add it
-func (this *Registry) checkOrCreateActorRegistry(kv *mvccpb.KeyValue) {
+// stopWatch end the watch loop of closeChan if started,the loop closes the chan itself
+func stopWatch(closeChan *chan struct{}) {
+	if *closeChan == nil {
+		return
+	}
+	*closeChan <- struct{}{}
+	*closeChan = nil
+}
+
+func parseActorRegistry(kv *mvccpb.KeyValue) *ActorRegistry {
 	id, _ := strconv.Atoi(regexp.MustCompile(`[/]actor[/]([0-9]+)`).ReplaceAllString(string(kv.Key), "$1"))
 	actorId := util.ID(id)
 	actorReg := NewActorRegistry(actorId)
 	json.Unmarshal(kv.Value, actorReg)
+	return actorReg
+}
+
+// check if actor key exist,otherwise add it
+func (this *Registry) checkOrCreateActorRegistry(kv *mvccpb.KeyValue) {
+	actorReg := parseActorRegistry(kv)
 	// log.Warn("add actor registry success", flog.FuncInfo(this, "checkOrCreateActorRegistry").Append(flog.Result(log.PrettyStruct(actorReg)))...)
 
-	log.Debug("add actor registry success", zap.Uint64("actor", uint64(actorId)), zap.Any("reg", actorReg))
-	this.GlobalRegistry.AddActor(actorReg)
+	log.Debug("add actor registry success", zap.Uint64("actor", uint64(actorReg.Id)), zap.Any("reg", actorReg))
+	old := this.GlobalRegistry.AddActor(actorReg)
+	if old == nil || old.ProcessId != actorReg.ProcessId {
+		this.events.emit(newActorEvent(lokas.EVT_ACTOR_REGISTERED, actorReg))
+	}
 }
 
 func (this *Registry) deleteActorRegistry(kv *mvccpb.KeyValue) {
 	id, _ := strconv.Atoi(regexp.MustCompile(`[/]actor[/]([0-9]+)`).ReplaceAllString(string(kv.Key), "$1"))
 	actorId := util.ID(id)
-	this.GlobalRegistry.RemoveActor(actorId)
+	if old := this.GlobalRegistry.RemoveActor(actorId); old != nil {
+		this.events.emit(newActorEvent(lokas.EVT_ACTOR_UNREGISTERED, old))
+	}
+}
+
+func parseProcessRegistry(kv *mvccpb.KeyValue) *ProcessRegistry {
+	id, _ := strconv.Atoi(regexp.MustCompile(`[/]processids[/]([0-9]+)`).ReplaceAllString(string(kv.Key), "$1"))
+	return NewProcessRegistry(util.ProcessId(id))
 }
 
 // check if process key exist,otherwise add it
 func (this *Registry) checkOrCreateProcessRegistry(kv *mvccpb.KeyValue) {
-	id, _ := strconv.Atoi(regexp.MustCompile(`[/]processids[/]([0-9]+)`).ReplaceAllString(string(kv.Key), "$1"))
 	// log.Debug("checkOrCreateProcessRegistry", zap.Int("id", id))
 
-	pid := util.ProcessId(id)
-	processReg := NewProcessRegistry(pid)
-	this.GlobalRegistry.AddProcess(processReg)
+	processReg := parseProcessRegistry(kv)
+	pid := processReg.Id
+	if this.GlobalRegistry.AddProcess(processReg) {
+		this.events.emit(newProcessEvent(lokas.EVT_PROCESS_JOINED, pid))
+	}
 
 	log.Debug("add process registry success", zap.Uint16("pid", uint16(pid)), zap.Any("reg", processReg))
 }
@@ -238,94 +311,133 @@ func (this *Registry) checkOrCreateProcessRegistry(kv *mvccpb.KeyValue) {
 func (this *Registry) deleteProcessRegistry(kv *mvccpb.KeyValue) {
 	id, _ := strconv.Atoi(regexp.MustCompile(`[/]processids[/]([0-9]+)`).ReplaceAllString(string(kv.Key), "$1"))
 	pid := util.ProcessId(id)
-	this.GlobalRegistry.RemoveProcess(pid)
+	if this.GlobalRegistry.RemoveProcess(pid) {
+		this.events.emit(newProcessEvent(lokas.EVT_PROCESS_LEFT, pid))
+	}
 }
 
-// update actor registries via etcd
-func (this *Registry) startUpdateRemoteActorInfo() error {
-	log.Info("start", flog.FuncInfo(this, "startUpdateRemoteActorInfo")...)
+// load all the actor registries from etcd and replace the local cache,return the etcd revision
+func (this *Registry) syncRemoteActorInfo() (int64, error) {
 	client := this.GetProcess().GetEtcd()
 	res, err := client.Get(context.TODO(), "/actor/", clientv3.WithPrefix())
-
 	if err != nil {
 		log.Error(err.Error())
-		return err
+		return 0, err
 	}
+	actors := make([]*ActorRegistry, 0, len(res.Kvs))
 	for _, v := range res.Kvs {
-		this.checkOrCreateActorRegistry(v)
+		actors = append(actors, parseActorRegistry(v))
+	}
+	added, removed := this.GlobalRegistry.ResetActors(actors)
+	for _, actor := range added {
+		this.events.emit(newActorEvent(lokas.EVT_ACTOR_REGISTERED, actor))
+	}
+	for _, actor := range removed {
+		this.events.emit(newActorEvent(lokas.EVT_ACTOR_UNREGISTERED, actor))
+	}
+	log.Info("sync actor registries", flog.FuncInfo(this, "syncRemoteActorInfo").Append(zap.Int("count", len(actors)))...)
+	return res.Header.Revision, nil
+}
+
+// update actor registries via etcd
+func (this *Registry) startUpdateRemoteActorInfo() error {
+	log.Info("start", flog.FuncInfo(this, "startUpdateRemoteActorInfo")...)
+	rev, err := this.syncRemoteActorInfo()
+	if err != nil {
+		return err
 	}
-	watcher := client.Watch(context.TODO(), "/actor/", clientv3.WithPrefix())
 	this.actorWatchCloseChan = make(chan struct{})
-	go func() {
-	LOOP:
-		for {
-			select {
-			case resp := <-watcher:
-				for _, e := range resp.Events {
-					if e.Type == mvccpb.PUT {
-						//log.Warn("PUT actor",
-						//	flog.FuncInfo(this, "startUpdateRemoteActorInfo").
-						//		Concat(flog.KeyValue(string(e.Kv.Key), string(e.Kv.Value)))...,
-						//)
-						this.checkOrCreateActorRegistry(e.Kv)
-					} else if e.Type == mvccpb.DELETE {
-						//log.Warn("DELETE actor",
-						//	flog.FuncInfo(this, "startUpdateRemoteActorInfo").
-						//		Concat(flog.KeyValue(string(e.Kv.Key), string(e.Kv.Value)))...
-						//)
-						this.deleteActorRegistry(e.Kv)
-					}
-				}
-			case <-this.actorWatchCloseChan:
-				break LOOP
-			}
+	go watchWithResync(this.GetProcess().GetEtcd(), "/actor/", rev, this.actorWatchCloseChan, this.syncRemoteActorInfo, func(e *clientv3.Event) {
+		if e.Type == mvccpb.PUT {
+			this.checkOrCreateActorRegistry(e.Kv)
+		} else if e.Type == mvccpb.DELETE {
+			this.deleteActorRegistry(e.Kv)
 		}
-		close(this.actorWatchCloseChan)
-	}()
+	})
 	return nil
 }
 
-// update process registries information via etcd
-func (this *Registry) startUpdateRemoteProcessInfo() error {
-	log.Info("start", flog.FuncInfo(this, "startUpdateRemoteProcessInfo")...)
+// load all the process registries from etcd,return the etcd revision
+func (this *Registry) syncRemoteProcessInfo() (int64, error) {
 	client := this.GetProcess().GetEtcd()
 	res, err := client.Get(context.TODO(), "/processids/", clientv3.WithPrefix())
 	if err != nil {
 		log.Error(err.Error())
-		return err
+		return 0, err
 	}
+	processes := make([]*ProcessRegistry, 0, len(res.Kvs))
 	for _, v := range res.Kvs {
-		this.checkOrCreateProcessRegistry(v)
+		processes = append(processes, parseProcessRegistry(v))
+	}
+	joined, left := this.GlobalRegistry.ResetProcesses(processes)
+	for _, pid := range joined {
+		this.events.emit(newProcessEvent(lokas.EVT_PROCESS_JOINED, pid))
+	}
+	for _, pid := range left {
+		this.events.emit(newProcessEvent(lokas.EVT_PROCESS_LEFT, pid))
+	}
+	return res.Header.Revision, nil
+}
+
+// update process registries information via etcd
+func (this *Registry) startUpdateRemoteProcessInfo() error {
+	log.Info("start", flog.FuncInfo(this, "startUpdateRemoteProcessInfo")...)
+	rev, err := this.syncRemoteProcessInfo()
+	if err != nil {
+		return err
 	}
-	watchChan := client.Watch(context.TODO(), "/processids/", clientv3.WithPrefix(), clientv3.WithRev(res.Header.Revision))
 	this.processWatchCloseChan = make(chan struct{})
-	go func() {
-	LOOP:
-		for {
-			select {
-			case resp := <-watchChan:
+	go watchWithResync(this.GetProcess().GetEtcd(), "/processids/", rev, this.processWatchCloseChan, this.syncRemoteProcessInfo, func(e *clientv3.Event) {
+		if e.Type == mvccpb.PUT {
+			this.checkOrCreateProcessRegistry(e.Kv)
+		} else if e.Type == mvccpb.DELETE {
+			this.deleteProcessRegistry(e.Kv)
+		}
+	})
+	return nil
+}
+
+// watch the prefix after rev,if the watch is compacted or canceled,
+// reload the whole prefix through sync and watch again from the new revision
+func watchWithResync(client *etcdclient.Client, prefix string, rev int64, closeChan chan struct{}, sync func() (int64, error), onEvent func(e *clientv3.Event)) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	watcher := client.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+LOOP:
+	for {
+		select {
+		case resp, ok := <-watcher:
+			if ok && resp.Err() == nil {
 				for _, e := range resp.Events {
-					if e.Type == mvccpb.PUT {
-						//log.Warn("PUT Process Registry",
-						//	flog.FuncInfo(this, "startUpdateRemoteProcessInfo").
-						//		Concat(flog.KeyValue(string(e.Kv.Key), string(e.Kv.Value)))...
-						//)
-						this.checkOrCreateProcessRegistry(e.Kv)
-					} else if e.Type == mvccpb.DELETE {
-						//log.Warn("DELETE Process Registry",
-						//	flog.FuncInfo(this, "startUpdateRemoteProcessInfo").
-						//		Concat(flog.KeyValue(string(e.Kv.Key), string(e.Kv.Value)))...
-						//)
-						this.deleteProcessRegistry(e.Kv)
-					}
+					onEvent(e)
 				}
-			case <-this.processWatchCloseChan:
-				break LOOP
+				continue
+			}
+			cancel()
+			if ok {
+				log.Warn("watch broken, resync", zap.String("prefix", prefix), zap.Int64("compact_rev", resp.CompactRevision), flog.Error(resp.Err()))
+			} else {
+				log.Warn("watch closed, resync", zap.String("prefix", prefix))
 			}
+			for {
+				var err error
+				rev, err = sync()
+				if err == nil {
+					break
+				}
+				select {
+				case <-time.After(time.Second):
+				case <-closeChan:
+					break LOOP
+				}
+			}
+			ctx, cancel = context.WithCancel(context.TODO())
+			watcher = client.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+		case <-closeChan:
+			break LOOP
 		}
-		close(this.processWatchCloseChan)
-	}()
-	return nil
+	}
+	cancel()
+	close(closeChan)
 }
 
 func (this *Registry) addServiceFromEtcd(kv *mvccpb.KeyValue) error {
@@ -427,6 +539,7 @@ func (this *Registry) updateProcessInfo() error {
 			return err
 		}
 		log.Warnf("res", res)
+		this.registerTopics(leaseId)
 	}
 	return nil
 }
@@ -534,14 +647,22 @@ func (this *Registry) UnregisterActorRemote(actor lokas.IActor) error {
 	return nil
 }
 
-func (this *Registry) QueryRemoteActorsByType(typ string) []*Actor {
-	ret := []*Actor{}
-	return ret
+// QueryActors query the cluster actor registries,return a snapshot of the matched registries
+func (this *Registry) QueryActors(query *ActorQuery) []*ActorRegistry {
+	return this.GlobalRegistry.QueryActors(query)
 }
 
-func (this *Registry) QueryRemoteActorsByServer(typ string, ServerId int32) []*Actor {
-	ret := []*Actor{}
-	return ret
+// QueryLocalActors query the actor registries of this process
+func (this *Registry) QueryLocalActors(query *ActorQuery) []*ActorRegistry {
+	return this.LocalRegistry.QueryActors(query)
+}
+
+func (this *Registry) QueryRemoteActorsByType(typ string) []*ActorRegistry {
+	return this.GlobalRegistry.QueryActors(&ActorQuery{Type: typ})
+}
+
+func (this *Registry) QueryRemoteActorsByServer(typ string, serverId int32) []*ActorRegistry {
+	return this.GlobalRegistry.QueryActors(&ActorQuery{Type: typ, ServerId: serverId})
 }
 
 func (this *Registry) RegisterActorLocal(actor lokas.IActor) error {
@@ -556,6 +677,7 @@ func (this *Registry) RegisterActorLocal(actor lokas.IActor) error {
 		GameId:    this.process.GameId(),
 		Version:   this.process.Version(),
 		ServerId:  this.process.ServerId(),
+		Labels:    GetActorLabels(actor),
 		Ts:        time.Now(),
 	}
 	this.LocalRegistry.AddActor(re)
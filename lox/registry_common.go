@@ -11,24 +11,60 @@ import (
 
 func NewCommonRegistry() *CommonRegistry {
 	ret := &CommonRegistry{
-		Processes:      map[util.ProcessId]*ProcessRegistry{},
-		Services:       map[string]map[uint16]*ServiceRegistry{},
-		Actors:         map[util.ID]*ActorRegistry{},
-		ActorsByType:   map[string][]util.ID{},
-		ActorsByServer: map[int32][]util.ID{},
-		Ts:             time.Time{},
+		Processes:       map[util.ProcessId]*ProcessRegistry{},
+		Services:        map[string]map[uint16]*ServiceRegistry{},
+		Actors:          map[util.ID]*ActorRegistry{},
+		ActorsByType:    map[string]IdSet{},
+		ActorsByServer:  map[int32]IdSet{},
+		ActorsByProcess: map[util.ProcessId]IdSet{},
+		ActorsByLabel:   map[string]map[string]IdSet{},
+		Ts:              time.Time{},
 	}
 	return ret
 }
 
 type CommonRegistry struct {
-	Processes      map[util.ProcessId]*ProcessRegistry
-	Services       map[string]map[uint16]*ServiceRegistry
-	Actors         map[util.ID]*ActorRegistry
-	ActorsByType   map[string][]util.ID
-	ActorsByServer map[int32][]util.ID
-	Ts             time.Time
-	mu             sync.RWMutex
+	Processes       map[util.ProcessId]*ProcessRegistry
+	Services        map[string]map[uint16]*ServiceRegistry
+	Actors          map[util.ID]*ActorRegistry
+	ActorsByType    map[string]IdSet
+	ActorsByServer  map[int32]IdSet
+	ActorsByProcess map[util.ProcessId]IdSet
+	ActorsByLabel   map[string]map[string]IdSet //label key -> label value -> actor ids
+	Ts              time.Time
+	mu              sync.RWMutex
+}
+
+// IdSet set of actor ids used by the registry indexes
+type IdSet map[util.ID]struct{}
+
+func (this IdSet) Add(id util.ID) {
+	this[id] = struct{}{}
+}
+
+func (this IdSet) Remove(id util.ID) {
+	delete(this, id)
+}
+
+func (this IdSet) Contains(id util.ID) bool {
+	_, ok := this[id]
+	return ok
+}
+
+func (this IdSet) ToSlice() []util.ID {
+	ret := make([]util.ID, 0, len(this))
+	for id := range this {
+		ret = append(ret, id)
+	}
+	return ret
+}
+
+// ActorQuery conditions for querying actor registries, zero value fields are ignored
+type ActorQuery struct {
+	Type      string
+	ServerId  int32
+	ProcessId util.ProcessId
+	Labels    map[string]string
 }
 
 func (this *CommonRegistry) GetActorRegistry(id util.ID) *ActorRegistry {
@@ -38,89 +74,195 @@ func (this *CommonRegistry) GetActorRegistry(id util.ID) *ActorRegistry {
 }
 
 func (this *CommonRegistry) GetActorIdsByTypeAndServerId(serverId int32, typ string) []util.ID {
-	this.mu.Lock()
-	defer this.mu.Unlock()
 	ret := []util.ID{}
-	serverIds, ok := this.ActorsByServer[serverId]
-	if !ok {
-		return ret
+	for _, v := range this.QueryActors(&ActorQuery{Type: typ, ServerId: serverId}) {
+		ret = append(ret, v.Id)
 	}
-	typeIds, ok := this.ActorsByType[typ]
-	if !ok {
+	return ret
+}
+
+// QueryActors return a snapshot of actor registries matching all the conditions of query,
+// the returned registries are copies and safe to keep after the registry changes
+func (this *CommonRegistry) QueryActors(query *ActorQuery) []*ActorRegistry {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	ret := []*ActorRegistry{}
+	sets := []IdSet{}
+	if query.Type != "" {
+		sets = append(sets, this.ActorsByType[query.Type])
+	}
+	if query.ServerId != 0 {
+		sets = append(sets, this.ActorsByServer[query.ServerId])
+	}
+	if query.ProcessId != 0 {
+		sets = append(sets, this.ActorsByProcess[query.ProcessId])
+	}
+	for k, v := range query.Labels {
+		sets = append(sets, this.ActorsByLabel[k][v])
+	}
+	if len(sets) == 0 {
+		for _, actor := range this.Actors {
+			ret = append(ret, actor.Clone())
+		}
 		return ret
 	}
-	for _, a := range serverIds {
-		for _, b := range typeIds {
-			if a == b {
-				ret = append(ret, a)
+	//iterate the smallest index and check the others
+	smallest := 0
+	for i, set := range sets {
+		if len(set) == 0 {
+			return ret
+		}
+		if len(set) < len(sets[smallest]) {
+			smallest = i
+		}
+	}
+LOOP:
+	for id := range sets[smallest] {
+		for i, set := range sets {
+			if i != smallest && !set.Contains(id) {
+				continue LOOP
 			}
 		}
+		if actor, ok := this.Actors[id]; ok {
+			ret = append(ret, actor.Clone())
+		}
 	}
 	return ret
 }
 
-func removeIdFromArr(id util.ID, arr []util.ID) []util.ID {
-	ret := []util.ID{}
-	for _, v := range arr {
-		if v != id {
-			ret = append(ret, v)
-		}
-	}
-	return ret
+// AddActor add or replace the actor registry,return the replaced one
+func (this *CommonRegistry) AddActor(actor *ActorRegistry) *ActorRegistry {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.addActor(actor)
 }
 
-func addId2ArrOnce(id util.ID, arr []util.ID) []util.ID {
-	for _, v := range arr {
-		if v == id {
-			return arr
+func (this *CommonRegistry) addActor(actor *ActorRegistry) *ActorRegistry {
+	old, ok := this.Actors[actor.Id]
+	if ok {
+		this.removeActorIndex(old)
+	}
+	this.Actors[actor.Id] = actor
+	addToIndex(this.ActorsByType, actor.Type, actor.Id)
+	addToIndex(this.ActorsByServer, actor.ServerId, actor.Id)
+	addToIndex(this.ActorsByProcess, actor.ProcessId, actor.Id)
+	for k, v := range actor.Labels {
+		if _, ok := this.ActorsByLabel[k]; !ok {
+			this.ActorsByLabel[k] = map[string]IdSet{}
 		}
+		addToIndex(this.ActorsByLabel[k], v, actor.Id)
 	}
-	arr = append(arr, id)
-	return arr
+	return old
 }
 
-func (this *CommonRegistry) AddActor(actor *ActorRegistry) {
+// RemoveActor remove the actor registry,return the removed one
+func (this *CommonRegistry) RemoveActor(actorId util.ID) *ActorRegistry {
 	this.mu.Lock()
 	defer this.mu.Unlock()
-	this.Actors[actor.Id] = actor
-	if actorArr, ok := this.ActorsByType[actor.Type]; ok {
-		actorArr = addId2ArrOnce(actor.Id, actorArr)
-		this.ActorsByType[actor.Type] = actorArr
-	} else {
-		this.ActorsByType[actor.Type] = []util.ID{actor.Id}
+	actor, ok := this.Actors[actorId]
+	if ok {
+		delete(this.Actors, actorId)
+		this.removeActorIndex(actor)
 	}
-	if actorArr, ok := this.ActorsByServer[actor.ServerId]; ok {
-		actorArr = addId2ArrOnce(actor.Id, actorArr)
-		this.ActorsByServer[actor.ServerId] = actorArr
-	} else {
-		this.ActorsByServer[actor.ServerId] = []util.ID{actor.Id}
+	return actor
+}
+
+func (this *CommonRegistry) removeActorIndex(actor *ActorRegistry) {
+	removeFromIndex(this.ActorsByType, actor.Type, actor.Id)
+	removeFromIndex(this.ActorsByServer, actor.ServerId, actor.Id)
+	removeFromIndex(this.ActorsByProcess, actor.ProcessId, actor.Id)
+	for k, v := range actor.Labels {
+		if index, ok := this.ActorsByLabel[k]; ok {
+			removeFromIndex(index, v, actor.Id)
+			if len(index) == 0 {
+				delete(this.ActorsByLabel, k)
+			}
+		}
 	}
 }
 
-func (this *CommonRegistry) RemoveActor(actorId util.ID) {
+// ResetActors replace all the actor registries and rebuild the indexes,used when resync from etcd,
+// return the actors which are new or moved to another process and the actors which are removed
+func (this *CommonRegistry) ResetActors(actors []*ActorRegistry) (added []*ActorRegistry, removed []*ActorRegistry) {
 	this.mu.Lock()
 	defer this.mu.Unlock()
-	if actor, ok := this.Actors[actorId]; ok {
-		delete(this.Actors, actorId)
-		if actorArr, ok1 := this.ActorsByType[actor.Type]; ok1 {
-			this.ActorsByType[actor.Type] = removeIdFromArr(actor.Id, actorArr)
+	olds := this.Actors
+	for _, actor := range actors {
+		if old, ok := olds[actor.Id]; !ok || old.ProcessId != actor.ProcessId {
+			added = append(added, actor)
 		}
-		if actorArr, ok1 := this.ActorsByServer[actor.ServerId]; ok1 {
-			this.ActorsByServer[actor.ServerId] = removeIdFromArr(actor.Id, actorArr)
+	}
+	this.Actors = map[util.ID]*ActorRegistry{}
+	this.ActorsByType = map[string]IdSet{}
+	this.ActorsByServer = map[int32]IdSet{}
+	this.ActorsByProcess = map[util.ProcessId]IdSet{}
+	this.ActorsByLabel = map[string]map[string]IdSet{}
+	for _, actor := range actors {
+		this.addActor(actor)
+	}
+	for id, old := range olds {
+		if _, ok := this.Actors[id]; !ok {
+			removed = append(removed, old)
+		}
+	}
+	return added, removed
+}
+
+func addToIndex[K comparable](index map[K]IdSet, key K, id util.ID) {
+	set, ok := index[key]
+	if !ok {
+		set = IdSet{}
+		index[key] = set
+	}
+	set.Add(id)
+}
+
+func removeFromIndex[K comparable](index map[K]IdSet, key K, id util.ID) {
+	if set, ok := index[key]; ok {
+		set.Remove(id)
+		if len(set) == 0 {
+			delete(index, key)
 		}
 	}
 }
 
-func (this *CommonRegistry) AddProcess(process *ProcessRegistry) {
+// AddProcess add or replace the process registry,return true if the process is new
+func (this *CommonRegistry) AddProcess(process *ProcessRegistry) bool {
 	this.mu.Lock()
 	defer this.mu.Unlock()
+	_, ok := this.Processes[process.Id]
 	this.Processes[process.Id] = process
+	return !ok
 }
 
-func (this *CommonRegistry) RemoveProcess(id util.ProcessId) {
+// RemoveProcess remove the process registry,return true if the process existed
+func (this *CommonRegistry) RemoveProcess(id util.ProcessId) bool {
 	this.mu.Lock()
 	defer this.mu.Unlock()
+	_, ok := this.Processes[id]
 	delete(this.Processes, id)
+	return ok
+}
+
+// ResetProcesses replace all the process registries,used when resync from etcd,
+// return the joined and left process ids
+func (this *CommonRegistry) ResetProcesses(processes []*ProcessRegistry) (joined []util.ProcessId, left []util.ProcessId) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	olds := this.Processes
+	this.Processes = map[util.ProcessId]*ProcessRegistry{}
+	for _, process := range processes {
+		this.Processes[process.Id] = process
+		if _, ok := olds[process.Id]; !ok {
+			joined = append(joined, process.Id)
+		}
+	}
+	for id := range olds {
+		if _, ok := this.Processes[id]; !ok {
+			left = append(left, id)
+		}
+	}
+	return joined, left
 }
 
 func (this *CommonRegistry) AddService(service *ServiceRegistry) {
@@ -191,10 +333,22 @@ type ActorRegistry struct {
 	GameId    string
 	Version   string
 	ServerId  int32
+	Labels    map[string]string
 	//Health    lokas.ActorState
 	Ts time.Time
 }
 
+func (this *ActorRegistry) Clone() *ActorRegistry {
+	ret := *this
+	if this.Labels != nil {
+		ret.Labels = make(map[string]string, len(this.Labels))
+		for k, v := range this.Labels {
+			ret.Labels[k] = v
+		}
+	}
+	return &ret
+}
+
 func NewActorRegistry(id util.ID) *ActorRegistry {
 	ret := &ActorRegistry{
 		Id:        id,
@@ -257,9 +411,22 @@ type ActorRegistryInfo struct {
 	GameId    string
 	Version   string
 	ServerId  int32
+	Labels    map[string]string
 	Ts        time.Time
 }
 
+// IActorLabels actors implement it to register custom labels which can be queried by ActorQuery
+type IActorLabels interface {
+	GetLabels() map[string]string
+}
+
+func GetActorLabels(actor lokas.IActor) map[string]string {
+	if labeled, ok := actor.(IActorLabels); ok {
+		return labeled.GetLabels()
+	}
+	return nil
+}
+
 func CreateActorRegistryInfo(actor lokas.IActor) *ActorRegistryInfo {
 	ret := &ActorRegistryInfo{
 		Id:        actor.GetId(),
@@ -268,6 +435,7 @@ func CreateActorRegistryInfo(actor lokas.IActor) *ActorRegistryInfo {
 		GameId:    actor.GetProcess().GameId(),
 		Version:   actor.GetProcess().Version(),
 		ServerId:  actor.GetProcess().ServerId(),
+		Labels:    GetActorLabels(actor),
 		Ts:        time.Now(),
 	}
 	return ret
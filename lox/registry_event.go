@@ -0,0 +1,147 @@
+package lox
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+	"go.uber.org/zap"
+)
+
+type registryWatcher struct {
+	mask lokas.RegistryEventType
+	sink lokas.RegistryEventSink
+}
+
+// registryEventDispatcher deliver topology events to watchers in order on a single goroutine,
+// so the etcd watch loops never block on user code,the events are dropped if the queue is full
+type registryEventDispatcher struct {
+	mu       sync.RWMutex
+	idGen    int64
+	watchers map[int64]*registryWatcher
+	events   chan lokas.IRegistryEvent
+	done     chan struct{}
+	dropped  int64
+}
+
+func newRegistryEventDispatcher() *registryEventDispatcher {
+	return &registryEventDispatcher{
+		watchers: map[int64]*registryWatcher{},
+		events:   make(chan lokas.IRegistryEvent, 1024),
+	}
+}
+
+// start run the dispatch goroutine,calling it again before stop does nothing
+func (this *registryEventDispatcher) start() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.done != nil {
+		return
+	}
+	done := make(chan struct{})
+	this.done = done
+	go func() {
+		for {
+			select {
+			case e := <-this.events:
+				this.dispatch(e)
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// stop end the dispatch goroutine,the events queued are kept for the next start
+func (this *registryEventDispatcher) stop() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.done == nil {
+		return
+	}
+	close(this.done)
+	this.done = nil
+}
+
+func (this *registryEventDispatcher) dispatch(e lokas.IRegistryEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			util.Recover(r, false)
+		}
+	}()
+	this.mu.RLock()
+	sinks := []lokas.RegistryEventSink{}
+	for _, w := range this.watchers {
+		if w.mask&e.EventType() != 0 {
+			sinks = append(sinks, w.sink)
+		}
+	}
+	this.mu.RUnlock()
+	for _, sink := range sinks {
+		sink(e)
+	}
+}
+
+func (this *registryEventDispatcher) emit(e lokas.IRegistryEvent) {
+	this.mu.RLock()
+	empty := len(this.watchers) == 0
+	this.mu.RUnlock()
+	if empty {
+		return
+	}
+	select {
+	case this.events <- e:
+	default:
+		dropped := atomic.AddInt64(&this.dropped, 1)
+		log.Warn("registry event queue full,event dropped", zap.String("event", e.EventType().String()), zap.Int64("dropped", dropped))
+	}
+}
+
+func (this *registryEventDispatcher) watch(mask lokas.RegistryEventType, sink lokas.RegistryEventSink) func() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.idGen++
+	id := this.idGen
+	this.watchers[id] = &registryWatcher{
+		mask: mask,
+		sink: sink,
+	}
+	return func() {
+		this.mu.Lock()
+		defer this.mu.Unlock()
+		delete(this.watchers, id)
+	}
+}
+
+// ActorEventSink deliver registry events to the mailbox of a local actor,
+// the actor receives them in its MsgHandler with actorId and transId zero
+func ActorEventSink(process lokas.IProcess, actorId util.ID) lokas.RegistryEventSink {
+	return func(e lokas.IRegistryEvent) {
+		err := process.RouteMsgLocal(protocol.NewRouteMessage(0, actorId, 0, e, true))
+		if err != nil {
+			log.Warn("deliver registry event failed", zap.Uint64("actor", uint64(actorId)), zap.String("event", e.EventType().String()))
+		}
+	}
+}
+
+func newActorEvent(typ lokas.RegistryEventType, actor *ActorRegistry) *lokas.ActorEvent {
+	return &lokas.ActorEvent{
+		Type:      typ,
+		ActorId:   actor.Id,
+		ActorType: actor.Type,
+		ProcessId: actor.ProcessId,
+		GameId:    actor.GameId,
+		ServerId:  actor.ServerId,
+		Labels:    actor.Clone().Labels,
+	}
+}
+
+func newProcessEvent(typ lokas.RegistryEventType, pid util.ProcessId) *lokas.ProcessEvent {
+	return &lokas.ProcessEvent{
+		Type:      typ,
+		ProcessId: pid,
+	}
+}
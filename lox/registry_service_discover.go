@@ -2,9 +2,11 @@ package lox
 
 import (
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"github.com/nomos/go-lokas/log/flog"
+	"hash/fnv"
 	"math/rand"
 	"regexp"
 	"sort"
@@ -13,6 +15,7 @@ import (
 
 	"github.com/nomos/go-lokas"
 	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/protocol"
 	"go.etcd.io/etcd/api/v3/mvccpb"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.uber.org/zap"
@@ -22,11 +25,20 @@ const (
 	ETCD_SERVICE_PREFIX_KEY = "/service/"
 )
 
+type canaryRule struct {
+	selector lokas.ServiceSelector
+	percent  int
+}
+
 type ServiceDiscoverMgr struct {
 	process lokas.IProcess
 
 	serviceMap map[string]map[uint16]map[uint16]*lokas.ServiceInfo
 
+	canaryRules map[string]*canaryRule
+
+	onEvent func(e lokas.IRegistryEvent)
+
 	mutex sync.RWMutex
 
 	closeChan chan struct{}
@@ -34,8 +46,9 @@ type ServiceDiscoverMgr struct {
 
 func NewServiceDiscoverMgr(process lokas.IProcess) *ServiceDiscoverMgr {
 	return &ServiceDiscoverMgr{
-		process:    process,
-		serviceMap: make(map[string]map[uint16]map[uint16]*lokas.ServiceInfo),
+		process:     process,
+		serviceMap:  make(map[string]map[uint16]map[uint16]*lokas.ServiceInfo),
+		canaryRules: make(map[string]*canaryRule),
 	}
 }
 
@@ -109,49 +122,219 @@ func (mgr *ServiceDiscoverMgr) FindRandServiceInfo(serviceType string, serviceId
 
 }
 
+// get services of serviceType,if serviceId is zero,get all serviceIds,the result is sorted
+func (mgr *ServiceDiscoverMgr) getServiceList(serviceType string, serviceId uint16) lokas.ServiceInfos {
+	infos := lokas.ServiceInfos{}
+	for id, v1 := range mgr.serviceMap[serviceType] {
+		if serviceId != 0 && id != serviceId {
+			continue
+		}
+		for _, v2 := range v1 {
+			infos = append(infos, v2)
+		}
+	}
+	sort.Stable(infos)
+	return infos
+}
+
+// FindServiceListBySelector return the copies of the services matched,sorted
+func (mgr *ServiceDiscoverMgr) FindServiceListBySelector(serviceType string, serviceId uint16, selector string) ([]*lokas.ServiceInfo, error) {
+	sel, err := lokas.ParseServiceSelector(selector)
+	if err != nil {
+		log.Error(err.Error(), zap.String("selector", selector))
+		return nil, err
+	}
+
+	mgr.mutex.RLock()
+	defer mgr.mutex.RUnlock()
+
+	ret := []*lokas.ServiceInfo{}
+	for _, v := range mgr.getServiceList(serviceType, serviceId) {
+		if sel.Match(v) {
+			ret = append(ret, v.Clone())
+		}
+	}
+	return ret, nil
+}
+
+func (mgr *ServiceDiscoverMgr) FindRandServiceInfoBySelector(serviceType string, serviceId uint16, selector string) (*lokas.ServiceInfo, error) {
+	infos, err := mgr.FindServiceListBySelector(serviceType, serviceId, selector)
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 {
+		return nil, protocol.ERR_SERVICE_NOT_FOUND
+	}
+	return infos[rand.Intn(len(infos))], nil
+}
+
+// SetCanary weight the lines picked by PickServiceInfo and RouteMsgToServiceSticky,
+// RouteMsgToService addresses an explicit line and is not affected
+func (mgr *ServiceDiscoverMgr) SetCanary(serviceType string, selector string, percent int) error {
+	sel, err := lokas.ParseServiceSelector(selector)
+	if err != nil {
+		log.Error(err.Error(), zap.String("selector", selector))
+		return err
+	}
+	if percent < 0 || percent > 100 {
+		log.Error("canary percent out of range", zap.String("type", serviceType), zap.Int("percent", percent))
+		return protocol.ERR_PARAM_TYPE
+	}
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	mgr.canaryRules[serviceType] = &canaryRule{
+		selector: sel,
+		percent:  percent,
+	}
+	log.Info("set canary", zap.String("type", serviceType), zap.String("selector", selector), zap.Int("percent", percent))
+	return nil
+}
+
+func (mgr *ServiceDiscoverMgr) RemoveCanary(serviceType string) {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	delete(mgr.canaryRules, serviceType)
+}
+
+func (mgr *ServiceDiscoverMgr) PickServiceInfo(serviceType string, serviceId uint16, key uint64) (*lokas.ServiceInfo, bool) {
+	mgr.mutex.RLock()
+	defer mgr.mutex.RUnlock()
+
+	infos := mgr.getServiceList(serviceType, serviceId)
+	if len(infos) == 0 {
+		return nil, false
+	}
+	hash := hashKey(key)
+	if rule, ok := mgr.canaryRules[serviceType]; ok {
+		canary := lokas.ServiceInfos{}
+		stable := lokas.ServiceInfos{}
+		for _, v := range infos {
+			if rule.selector.Match(v) {
+				canary = append(canary, v)
+			} else {
+				stable = append(stable, v)
+			}
+		}
+		if len(canary) > 0 && (int(hash%100) < rule.percent || len(stable) == 0) {
+			infos = canary
+		} else if len(stable) > 0 {
+			infos = stable
+		}
+	}
+	return infos[(hash/100)%uint64(len(infos))].Clone(), true
+}
+
+func hashKey(key uint64) uint64 {
+	h := fnv.New64a()
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], key)
+	h.Write(b[:])
+	return h.Sum64()
+}
+
 func (mgr *ServiceDiscoverMgr) StartDiscover() error {
 
 	log.Info("start discover service", zap.String("path", ETCD_SERVICE_PREFIX_KEY))
+	rev, err := mgr.syncServices()
+	if err != nil {
+		return err
+	}
+
+	mgr.closeChan = make(chan struct{})
+
+	go watchWithResync(mgr.process.GetEtcd(), ETCD_SERVICE_PREFIX_KEY, rev, mgr.closeChan, mgr.syncServices, func(e *clientv3.Event) {
+		switch e.Type {
+		case mvccpb.PUT:
+			mgr.addServiceFromEtcd(e.Kv)
+		case mvccpb.DELETE:
+			mgr.delServiceFromEtcd(e.Kv)
+		}
+	})
+
+	return nil
+}
+
+func (mgr *ServiceDiscoverMgr) Stop() {
+	mgr.closeChan <- struct{}{}
+}
+
+func (mgr *ServiceDiscoverMgr) emit(e lokas.IRegistryEvent) {
+	if mgr.onEvent != nil {
+		mgr.onEvent(e)
+	}
+}
+
+// load all the services from etcd and replace the local cache,return the etcd revision
+func (mgr *ServiceDiscoverMgr) syncServices() (int64, error) {
 	etcdClient := mgr.process.GetEtcd()
 	resp, err := etcdClient.Get(context.TODO(), ETCD_SERVICE_PREFIX_KEY, clientv3.WithPrefix())
 	if err != nil {
 		log.Error(err.Error())
-		return err
+		return 0, err
 	}
 
+	serviceMap := make(map[string]map[uint16]map[uint16]*lokas.ServiceInfo)
+	events := []lokas.IRegistryEvent{}
+
+	mgr.mutex.Lock()
 	for _, v := range resp.Kvs {
-		mgr.addServiceFromEtcd(v)
+		serviceInfo := &lokas.ServiceInfo{}
+		err := json.Unmarshal(v.Value, serviceInfo)
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+		addServiceInfo(serviceMap, serviceInfo)
+		old := findServiceInfo(mgr.serviceMap, serviceInfo.ServiceType, serviceInfo.ServiceId, serviceInfo.LineId)
+		if old == nil {
+			events = append(events, &lokas.ServiceEvent{Type: lokas.EVT_SERVICE_ADDED, Service: serviceInfo.Clone()})
+		} else if !serviceInfoEqual(old, serviceInfo) {
+			events = append(events, &lokas.ServiceEvent{Type: lokas.EVT_SERVICE_UPDATED, Service: serviceInfo.Clone(), Old: old.Clone()})
+		}
 	}
-
-	mgr.closeChan = make(chan struct{})
-
-	watchChan := etcdClient.Watch(context.TODO(), ETCD_SERVICE_PREFIX_KEY, clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision))
-	go func() {
-	LOOP:
-		for {
-			select {
-			case resp := <-watchChan:
-				for _, v := range resp.Events {
-					switch v.Type {
-					case mvccpb.PUT:
-						mgr.addServiceFromEtcd(v.Kv)
-					case mvccpb.DELETE:
-						mgr.delServiceFromEtcd(v.Kv)
-					}
+	for _, v1 := range mgr.serviceMap {
+		for _, v2 := range v1 {
+			for _, old := range v2 {
+				if findServiceInfo(serviceMap, old.ServiceType, old.ServiceId, old.LineId) == nil {
+					events = append(events, &lokas.ServiceEvent{Type: lokas.EVT_SERVICE_REMOVED, Service: old.Clone()})
 				}
-			case <-mgr.closeChan:
-				break LOOP
 			}
 		}
-		close(mgr.closeChan)
+	}
+	mgr.serviceMap = serviceMap
+	mgr.mutex.Unlock()
 
-	}()
+	for _, e := range events {
+		mgr.emit(e)
+	}
+	return resp.Header.Revision, nil
+}
 
-	return nil
+func addServiceInfo(serviceMap map[string]map[uint16]map[uint16]*lokas.ServiceInfo, serviceInfo *lokas.ServiceInfo) {
+	if _, ok := serviceMap[serviceInfo.ServiceType]; !ok {
+		serviceMap[serviceInfo.ServiceType] = make(map[uint16]map[uint16]*lokas.ServiceInfo)
+	}
+
+	if _, ok := serviceMap[serviceInfo.ServiceType][serviceInfo.ServiceId]; !ok {
+		serviceMap[serviceInfo.ServiceType][serviceInfo.ServiceId] = make(map[uint16]*lokas.ServiceInfo)
+	}
+
+	serviceMap[serviceInfo.ServiceType][serviceInfo.ServiceId][serviceInfo.LineId] = serviceInfo
 }
 
-func (mgr *ServiceDiscoverMgr) Stop() {
-	mgr.closeChan <- struct{}{}
+func findServiceInfo(serviceMap map[string]map[uint16]map[uint16]*lokas.ServiceInfo, serviceType string, serviceId uint16, lineId uint16) *lokas.ServiceInfo {
+	if _, ok := serviceMap[serviceType]; !ok {
+		return nil
+	}
+	if _, ok := serviceMap[serviceType][serviceId]; !ok {
+		return nil
+	}
+	return serviceMap[serviceType][serviceId][lineId]
+}
+
+func serviceInfoEqual(a, b *lokas.ServiceInfo) bool {
+	return a.ProcessId == b.ProcessId && a.ActorId == b.ActorId && a.Host == b.Host && a.Port == b.Port &&
+		a.Version == b.Version && a.Cnt == b.Cnt && labelsEqual(a.Labels, b.Labels)
 }
 
 func (mgr *ServiceDiscoverMgr) addServiceFromEtcd(kv *mvccpb.KeyValue) error {
@@ -163,18 +346,16 @@ func (mgr *ServiceDiscoverMgr) addServiceFromEtcd(kv *mvccpb.KeyValue) error {
 	}
 
 	mgr.mutex.Lock()
-	defer mgr.mutex.Unlock()
-
-	if _, ok := mgr.serviceMap[serviceInfo.ServiceType]; !ok {
-		mgr.serviceMap[serviceInfo.ServiceType] = make(map[uint16]map[uint16]*lokas.ServiceInfo)
+	old := findServiceInfo(mgr.serviceMap, serviceInfo.ServiceType, serviceInfo.ServiceId, serviceInfo.LineId)
+	addServiceInfo(mgr.serviceMap, serviceInfo)
+	mgr.mutex.Unlock()
+
+	if old == nil {
+		mgr.emit(&lokas.ServiceEvent{Type: lokas.EVT_SERVICE_ADDED, Service: serviceInfo.Clone()})
+	} else if !serviceInfoEqual(old, serviceInfo) {
+		mgr.emit(&lokas.ServiceEvent{Type: lokas.EVT_SERVICE_UPDATED, Service: serviceInfo.Clone(), Old: old.Clone()})
 	}
 
-	if _, ok := mgr.serviceMap[serviceInfo.ServiceType][serviceInfo.ServiceId]; !ok {
-		mgr.serviceMap[serviceInfo.ServiceType][serviceInfo.ServiceId] = make(map[uint16]*lokas.ServiceInfo)
-	}
-
-	mgr.serviceMap[serviceInfo.ServiceType][serviceInfo.ServiceId][serviceInfo.LineId] = serviceInfo
-
 	log.Info("update service", zap.Any("serviceInfo", serviceInfo))
 	return nil
 }
@@ -206,11 +387,13 @@ func (mgr *ServiceDiscoverMgr) delServiceFromEtcd(kv *mvccpb.KeyValue) error {
 	}
 
 	mgr.mutex.Lock()
-	defer mgr.mutex.Unlock()
-	if _, ok := mgr.serviceMap[serviceType]; ok {
-		if _, ok := mgr.serviceMap[serviceType][uint16(serviceId)]; ok {
-			delete(mgr.serviceMap[serviceType][uint16(serviceId)], uint16(lineId))
-		}
+	old := findServiceInfo(mgr.serviceMap, serviceType, uint16(serviceId), uint16(lineId))
+	if old != nil {
+		delete(mgr.serviceMap[serviceType][uint16(serviceId)], uint16(lineId))
+	}
+	mgr.mutex.Unlock()
+	if old != nil {
+		mgr.emit(&lokas.ServiceEvent{Type: lokas.EVT_SERVICE_REMOVED, Service: old.Clone()})
 	}
 	serviceIdFind, _ := strconv.ParseUint(matchs[idIdx], 10, 64)
 	LineIdFind, _ := strconv.ParseUint(matchs[lineIdx], 10, 64)
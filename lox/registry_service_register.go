@@ -218,12 +218,13 @@ func (mgr *ServiceRegisterMgr) UpdateServiceInfo(info *lokas.ServiceInfo) error
 	}
 
 	mgr.mutex.Lock()
-	if register.serviceInfo.Version == info.Version && register.serviceInfo.Cnt == info.Cnt {
+	if register.serviceInfo.Version == info.Version && register.serviceInfo.Cnt == info.Cnt && labelsEqual(register.serviceInfo.Labels, info.Labels) {
 		mgr.mutex.Unlock()
 		return nil
 	}
 	register.serviceInfo.Version = info.Version
 	register.serviceInfo.Cnt = info.Cnt
+	register.serviceInfo.Labels = info.Clone().Labels
 	mgr.mutex.Unlock()
 
 	err := register.updateEtcd()
@@ -280,3 +281,15 @@ func (mgr *ServiceRegisterMgr) FindServiceList(serviceType string) ([]*lokas.Ser
 
 	return serviceInfos, true
 }
+
+func labelsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,297 @@
+package lox
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/log/flog"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	TOPIC_PREFIX_KEY           = "/topic/"
+	TOPIC_KEY        lokas.Key = "/topic/%s/%d" //topic,pid of the process holding subscribers,bound to the registry lease
+)
+
+// topicRegistry record the local subscribers of topics and the processes holding subscribers in the cluster
+type topicRegistry struct {
+	mu        sync.RWMutex
+	holderMu  sync.Mutex //serialize the holder keys of this process with the changes of the local subscribers
+	local     map[string]IdSet
+	processes map[string]map[util.ProcessId]struct{}
+}
+
+func newTopicRegistry() *topicRegistry {
+	return &topicRegistry{
+		local:     map[string]IdSet{},
+		processes: map[string]map[util.ProcessId]struct{}{},
+	}
+}
+
+// subscribe return true if it is the first subscriber of the topic in this process
+func (this *topicRegistry) subscribe(topic string, actorId util.ID) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	set, ok := this.local[topic]
+	if !ok {
+		set = IdSet{}
+		this.local[topic] = set
+	}
+	set.Add(actorId)
+	return !ok
+}
+
+// unsubscribe return whether the actor was subscribed,and whether it was the last subscriber of the topic
+func (this *topicRegistry) unsubscribe(topic string, actorId util.ID) (bool, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	set, ok := this.local[topic]
+	if !ok || !set.Contains(actorId) {
+		return false, false
+	}
+	set.Remove(actorId)
+	if len(set) == 0 {
+		delete(this.local, topic)
+		return true, true
+	}
+	return true, false
+}
+
+// unsubscribeAll return the topics left without local subscribers
+func (this *topicRegistry) unsubscribeAll(actorId util.ID) []string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	ret := []string{}
+	for topic, set := range this.local {
+		if !set.Contains(actorId) {
+			continue
+		}
+		set.Remove(actorId)
+		if len(set) == 0 {
+			delete(this.local, topic)
+			ret = append(ret, topic)
+		}
+	}
+	return ret
+}
+
+func (this *topicRegistry) subscribers(topic string) []util.ID {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.local[topic].ToSlice()
+}
+
+func (this *topicRegistry) topics() []string {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	ret := make([]string, 0, len(this.local))
+	for topic := range this.local {
+		ret = append(ret, topic)
+	}
+	return ret
+}
+
+func (this *topicRegistry) getProcesses(topic string) []util.ProcessId {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	ret := make([]util.ProcessId, 0, len(this.processes[topic]))
+	for pid := range this.processes[topic] {
+		ret = append(ret, pid)
+	}
+	return ret
+}
+
+func (this *topicRegistry) addProcess(topic string, pid util.ProcessId) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	pids, ok := this.processes[topic]
+	if !ok {
+		pids = map[util.ProcessId]struct{}{}
+		this.processes[topic] = pids
+	}
+	pids[pid] = struct{}{}
+}
+
+func (this *topicRegistry) removeProcess(topic string, pid util.ProcessId) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	pids, ok := this.processes[topic]
+	if !ok {
+		return
+	}
+	delete(pids, pid)
+	if len(pids) == 0 {
+		delete(this.processes, topic)
+	}
+}
+
+func (this *topicRegistry) resetProcesses(processes map[string]map[util.ProcessId]struct{}) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.processes = processes
+}
+
+// parseTopicKey split /topic/<topic>/<pid>,the topic may contain '/'
+func parseTopicKey(key string) (string, util.ProcessId, bool) {
+	if !strings.HasPrefix(key, TOPIC_PREFIX_KEY) {
+		return "", 0, false
+	}
+	key = key[len(TOPIC_PREFIX_KEY):]
+	idx := strings.LastIndex(key, "/")
+	if idx <= 0 {
+		return "", 0, false
+	}
+	pid, err := strconv.Atoi(key[idx+1:])
+	if err != nil {
+		return "", 0, false
+	}
+	return key[:idx], util.ProcessId(pid), true
+}
+
+// SubscribeTopic subscribe the built-in topic for a local actor,
+// the process is registered as a topic holder with the registry lease on the first subscriber
+func (this *Registry) SubscribeTopic(topic string, actorId util.ID) error {
+	this.topics.holderMu.Lock()
+	defer this.topics.holderMu.Unlock()
+	if !this.topics.subscribe(topic, actorId) {
+		return nil
+	}
+	this.topics.addProcess(topic, this.process.PId())
+	client := this.GetProcess().GetEtcd()
+	if client == nil {
+		return nil
+	}
+	leaseId, _, err := this.GetLeaseId()
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	_, err = client.Put(context.TODO(), TOPIC_KEY.Assemble(topic, this.process.PId()), "", clientv3.WithLease(leaseId))
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+// UnsubscribeTopic unsubscribe the built-in topic,the process holder key is removed with the last subscriber
+func (this *Registry) UnsubscribeTopic(topic string, actorId util.ID) error {
+	this.topics.holderMu.Lock()
+	defer this.topics.holderMu.Unlock()
+	ok, last := this.topics.unsubscribe(topic, actorId)
+	if !ok {
+		return protocol.ERR_MQ_SUBJ_NOT_FIND
+	}
+	if last {
+		return this.removeTopicHolder(topic)
+	}
+	return nil
+}
+
+// UnsubscribeAllTopics unsubscribe all the built-in topics of the actor,called when the actor stopped
+func (this *Registry) UnsubscribeAllTopics(actorId util.ID) {
+	this.topics.holderMu.Lock()
+	defer this.topics.holderMu.Unlock()
+	for _, topic := range this.topics.unsubscribeAll(actorId) {
+		this.removeTopicHolder(topic)
+	}
+}
+
+// GetTopicSubscribers return the local subscribers of the topic
+func (this *Registry) GetTopicSubscribers(topic string) []util.ID {
+	return this.topics.subscribers(topic)
+}
+
+// GetTopicProcesses return the processes holding subscribers of the topic,including this process
+func (this *Registry) GetTopicProcesses(topic string) []util.ProcessId {
+	return this.topics.getProcesses(topic)
+}
+
+// removeTopicHolder remove the holder key of this process,called with holderMu held
+func (this *Registry) removeTopicHolder(topic string) error {
+	this.topics.removeProcess(topic, this.process.PId())
+	client := this.GetProcess().GetEtcd()
+	if client == nil {
+		return nil
+	}
+	_, err := client.Delete(context.TODO(), TOPIC_KEY.Assemble(topic, this.process.PId()))
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+// registerTopics put all the topic holder keys again,used when the registry lease was renewed
+func (this *Registry) registerTopics(leaseId clientv3.LeaseID) {
+	this.topics.holderMu.Lock()
+	defer this.topics.holderMu.Unlock()
+	client := this.GetProcess().GetEtcd()
+	for _, topic := range this.topics.topics() {
+		_, err := client.Put(context.TODO(), TOPIC_KEY.Assemble(topic, this.process.PId()), "", clientv3.WithLease(leaseId))
+		if err != nil {
+			log.Error(err.Error())
+		}
+	}
+}
+
+// load all the topic holders from etcd,return the etcd revision
+func (this *Registry) syncRemoteTopicInfo() (int64, error) {
+	client := this.GetProcess().GetEtcd()
+	res, err := client.Get(context.TODO(), TOPIC_PREFIX_KEY, clientv3.WithPrefix())
+	if err != nil {
+		log.Error(err.Error())
+		return 0, err
+	}
+	processes := map[string]map[util.ProcessId]struct{}{}
+	for _, kv := range res.Kvs {
+		topic, pid, ok := parseTopicKey(string(kv.Key))
+		if !ok {
+			continue
+		}
+		if processes[topic] == nil {
+			processes[topic] = map[util.ProcessId]struct{}{}
+		}
+		processes[topic][pid] = struct{}{}
+	}
+	//local subscriptions are authoritative for this process
+	for _, topic := range this.topics.topics() {
+		if processes[topic] == nil {
+			processes[topic] = map[util.ProcessId]struct{}{}
+		}
+		processes[topic][this.process.PId()] = struct{}{}
+	}
+	this.topics.resetProcesses(processes)
+	return res.Header.Revision, nil
+}
+
+// update topic holders via etcd
+func (this *Registry) startUpdateRemoteTopicInfo() error {
+	log.Info("start", flog.FuncInfo(this, "startUpdateRemoteTopicInfo")...)
+	rev, err := this.syncRemoteTopicInfo()
+	if err != nil {
+		return err
+	}
+	this.topicWatchCloseChan = make(chan struct{})
+	go watchWithResync(this.GetProcess().GetEtcd(), TOPIC_PREFIX_KEY, rev, this.topicWatchCloseChan, this.syncRemoteTopicInfo, func(e *clientv3.Event) {
+		topic, pid, ok := parseTopicKey(string(e.Kv.Key))
+		if !ok {
+			log.Warn("invalid topic key", zap.String("key", string(e.Kv.Key)))
+			return
+		}
+		if e.Type == mvccpb.PUT {
+			this.topics.addProcess(topic, pid)
+		} else if e.Type == mvccpb.DELETE && pid != this.process.PId() {
+			this.topics.removeProcess(topic, pid)
+		}
+	})
+	return nil
+}
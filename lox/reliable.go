@@ -0,0 +1,158 @@
+package lox
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_RELIABLE_ACK_INTERVAL = 32
+)
+
+// ReliableMessage 可靠传输信封,Seq为发送方的消息序号(0表示不编号,只携带确认),Ack为已收到对端的最大序号
+type ReliableMessage struct {
+	Seq  uint32
+	Ack  uint32
+	Data []byte
+}
+
+func (this *ReliableMessage) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *ReliableMessage) Serializable() protocol.ISerializable {
+	return this
+}
+
+func marshalReliable(seq uint32, ack uint32, data []byte, t protocol.TYPE) ([]byte, error) {
+	return protocol.MarshalMessage(0, &ReliableMessage{Seq: seq, Ack: ack, Data: data}, t)
+}
+
+// control messages are never numbered
+func isReliableControl(cmdId protocol.BINARY_TAG) bool {
+	switch cmdId {
+	case protocol.TAG_HandShake, protocol.TAG_Ping, protocol.TAG_Pong, TAG_SESSION_RESUME, TAG_SESSION_RESUMED, TAG_SESSION_TOKEN, TAG_RELIABLE_MESSAGE:
+		return true
+	}
+	return false
+}
+
+// ReliableLink 客户端侧的可靠传输状态:给请求编号并捎带确认,丢弃重复消息,会话恢复后重发未确认的请求
+type ReliableLink struct {
+	AckInterval uint32 //send a standalone ack after receiving so many messages without a request
+
+	mu        sync.Mutex
+	sent      *replayBuffer
+	recvSeq   uint32
+	ackedSeq  uint32
+	sessionId util.ID
+	token     string
+}
+
+func NewReliableLink(bufferSize int) *ReliableLink {
+	return &ReliableLink{
+		AckInterval: DEFAULT_RELIABLE_ACK_INTERVAL,
+		sent:        newReplayBuffer(bufferSize),
+	}
+}
+
+// Wrap number the outbound message and piggyback the cumulative ack,control messages are returned as they are
+func (this *ReliableLink) Wrap(data []byte, t protocol.TYPE) ([]byte, error) {
+	if isReliableControl(protocol.GetCmdId16(data)) {
+		return data, nil
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	ret, err := marshalReliable(this.sent.seq+1, this.recvSeq, data, t)
+	if err != nil {
+		return nil, err
+	}
+	this.sent.push(ret)
+	this.ackedSeq = this.recvSeq
+	return ret, nil
+}
+
+// Unwrap return the inner message of a reliable envelope,nil if it is a duplicate or carries the ack only
+func (this *ReliableLink) Unwrap(msg *protocol.BinaryMessage, t protocol.TYPE) (*protocol.BinaryMessage, error) {
+	switch body := msg.Body.(type) {
+	case *SessionToken:
+		this.mu.Lock()
+		this.sessionId = body.SessionId
+		this.token = body.Token
+		this.mu.Unlock()
+		return msg, nil
+	case *ReliableMessage:
+		if !this.recv(body) {
+			return nil, nil
+		}
+		return protocol.UnmarshalMessage(body.Data, t)
+	default:
+		return msg, nil
+	}
+}
+
+func (this *ReliableLink) recv(msg *ReliableMessage) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.sent.ack(msg.Ack)
+	if msg.Seq == 0 {
+		return len(msg.Data) > 0
+	}
+	if msg.Seq <= this.recvSeq {
+		log.Warn("duplicated reliable message", zap.Uint32("seq", msg.Seq), zap.Uint32("recv_seq", this.recvSeq))
+		return false
+	}
+	if msg.Seq != this.recvSeq+1 {
+		log.Warn("reliable message lost", zap.Uint32("seq", msg.Seq), zap.Uint32("recv_seq", this.recvSeq))
+	}
+	this.recvSeq = msg.Seq
+	return true
+}
+
+// PendingAck return a standalone ack when too many messages were received without a request to piggyback on
+func (this *ReliableLink) PendingAck(t protocol.TYPE) []byte {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.AckInterval == 0 || this.recvSeq-this.ackedSeq < this.AckInterval {
+		return nil
+	}
+	ret, err := marshalReliable(0, this.recvSeq, nil, t)
+	if err != nil {
+		log.Error(err.Error())
+		return nil
+	}
+	this.ackedSeq = this.recvSeq
+	return ret
+}
+
+// ResumeMessage return the resume request of the current session,false if no resume token was issued
+func (this *ReliableLink) ResumeMessage() (*SessionResume, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.token == "" {
+		return nil, false
+	}
+	return &SessionResume{
+		SessionId: this.sessionId,
+		Token:     this.token,
+		LastSeq:   this.recvSeq,
+	}, true
+}
+
+// OnResumed return the requests not received by the gate,which should be sent again in order
+func (this *ReliableLink) OnResumed(msg *SessionResumed) ([][]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	datas, ok := this.sent.since(msg.Ack)
+	if !ok {
+		return nil, protocol.ERR_SESSION_RESUME_FAILED
+	}
+	this.sent.ack(msg.Ack)
+	this.ackedSeq = this.recvSeq
+	return datas, nil
+}
@@ -0,0 +1,507 @@
+package lox
+
+import (
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/ecs"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/log/flog"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/timer"
+	"github.com/nomos/go-lokas/util"
+	"go.uber.org/zap"
+)
+
+const ROOM_SERVICE = "Room"
+
+type RoomCloseReason int32
+
+const (
+	ROOM_CLOSE_EMPTY   RoomCloseReason = iota + 1 //no member for the empty timeout
+	ROOM_CLOSE_TIMEOUT                            //lived longer than the lifetime
+	ROOM_CLOSE_STOPPED                            //the room manager stopped
+	ROOM_CLOSE_GAME                               //closed by the game logic
+)
+
+func (this RoomCloseReason) String() string {
+	switch this {
+	case ROOM_CLOSE_EMPTY:
+		return "empty"
+	case ROOM_CLOSE_TIMEOUT:
+		return "timeout"
+	case ROOM_CLOSE_STOPPED:
+		return "stopped"
+	case ROOM_CLOSE_GAME:
+		return "game"
+	default:
+		return "unknown"
+	}
+}
+
+// RoomJoin join the avatar to the room,the sender if AvatarId is empty,replied with the RoomInfo,
+// sent to the RoomManager a new room is created if RoomId is empty,ERR_ROOM_NOT_FOUND if no room has the RoomId
+type RoomJoin struct {
+	RoomId   int64
+	AvatarId int64
+	Mode     string
+}
+
+func (this *RoomJoin) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *RoomJoin) Serializable() protocol.ISerializable {
+	return this
+}
+
+// RoomLeave remove the avatar from the room,the sender if AvatarId is empty,replied with the Response
+type RoomLeave struct {
+	RoomId   int64
+	AvatarId int64
+}
+
+func (this *RoomLeave) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *RoomLeave) Serializable() protocol.ISerializable {
+	return this
+}
+
+// RoomInfo the room and its members
+type RoomInfo struct {
+	RoomId    int64
+	Mode      string
+	ServiceId int32
+	LineId    int32
+	Members   []int64
+}
+
+func (this *RoomInfo) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *RoomInfo) Serializable() protocol.ISerializable {
+	return this
+}
+
+// RoomBind sent to the gate session of a member,the room routes of the session go to the room,0 unbinds,
+// forwarded to the client too
+type RoomBind struct {
+	RoomId int64
+}
+
+func (this *RoomBind) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *RoomBind) Serializable() protocol.ISerializable {
+	return this
+}
+
+// RoomClosed sent to the avatars of the members when the room closed
+type RoomClosed struct {
+	RoomId int64
+	Reason RoomCloseReason
+}
+
+func (this *RoomClosed) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *RoomClosed) Serializable() protocol.ISerializable {
+	return this
+}
+
+// RoomClose sent by the RoomManager to close the room in its own message pump
+type RoomClose struct {
+	RoomId int64
+	Reason RoomCloseReason
+}
+
+func (this *RoomClose) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *RoomClose) Serializable() protocol.ISerializable {
+	return this
+}
+
+// LeastLoadedService the service line with the least Cnt plus pending,the lower line on ties,nil if infos is empty
+func LeastLoadedService(infos []*lokas.ServiceInfo, pending map[uint16]int) *lokas.ServiceInfo {
+	var ret *lokas.ServiceInfo
+	for _, info := range infos {
+		if ret == nil {
+			ret = info
+			continue
+		}
+		cnt, min := info.Cnt+pending[info.LineId], ret.Cnt+pending[ret.LineId]
+		if cnt < min || cnt == min && info.LineId < ret.LineId {
+			ret = info
+		}
+	}
+	return ret
+}
+
+// RoomHandler the game logic of the rooms,called in the message pump of the room,nil funcs are skipped
+type RoomHandler struct {
+	OnCreate func(room *Room) error
+	OnJoin   func(room *Room, avatarId util.ID) error //the member is rejected if error returned
+	OnLeave  func(room *Room, avatarId util.ID)
+	OnMsg    func(room *Room, avatarId util.ID, transId uint32, msg protocol.ISerializable) (protocol.ISerializable, error)
+	OnUpdate func(room *Room, now time.Time)
+	OnClose  func(room *Room, reason RoomCloseReason)
+}
+
+// RoomMember a member of the room and its gate session
+type RoomMember struct {
+	AvatarId util.ID
+	GateId   util.ID
+	GatePid  util.ProcessId
+	Joined   time.Time
+}
+
+var _ lokas.IActor = (*Room)(nil)
+
+// Room a short-lived actor of a battle,dungeon or lobby with its own ecs runtime,
+// created and closed by the RoomManager
+type Room struct {
+	*Actor
+	Mode       string
+	Runtime    lokas.IRuntime
+	Members    map[util.ID]*RoomMember
+	Reserved   map[util.ID]int32 //the avatars matched into the room and their teams,anyone may join if empty
+	Created    time.Time
+	manager    *RoomManager
+	handler    *RoomHandler
+	sessions   map[util.ID]util.ID //gate session to avatar
+	emptySince time.Time
+	ticker     timer.TimeNoder
+	closed     bool
+}
+
+func NewRoom(id util.ID, mode string, manager *RoomManager) *Room {
+	now := time.Now()
+	ret := &Room{
+		Actor:      NewActor(),
+		Mode:       mode,
+		Runtime:    ecs.CreateRuntime(manager.Tick.Milliseconds(), 1, true),
+		Members:    map[util.ID]*RoomMember{},
+		Reserved:   map[util.ID]int32{},
+		Created:    now,
+		manager:    manager,
+		handler:    manager.Handler,
+		sessions:   map[util.ID]util.ID{},
+		emptySince: now,
+	}
+	ret.SetType("Room")
+	ret.SetId(id)
+	ret.MsgHandler = ret.HandleMsg
+	ret.OnUpdateFunc = ret.OnUpdate
+	return ret
+}
+
+// Reserve only the avatars of the teams may join
+func (this *Room) Reserve(teams []*MatchTeam) {
+	for i, team := range teams {
+		for _, id := range team.Members {
+			this.Reserved[util.ID(id)] = int32(i)
+		}
+	}
+}
+
+// Team the team of the avatar reserved,-1 if not
+func (this *Room) Team(avatarId util.ID) int32 {
+	team, ok := this.Reserved[avatarId]
+	if !ok {
+		return -1
+	}
+	return team
+}
+
+func (this *Room) Start() error {
+	this.Runtime.Start()
+	this.StartMessagePump()
+	this.ticker = this.Schedule(this.manager.Tick, func(noder timer.TimeNoder) {
+		this.tick(time.Now())
+	})
+	if this.handler.OnCreate != nil {
+		err := this.handler.OnCreate(this)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop close the room if not closed yet
+func (this *Room) Stop() error {
+	this.Close(ROOM_CLOSE_STOPPED)
+	if this.ticker != nil {
+		this.ticker.Stop()
+	}
+	this.Runtime.Stop()
+	return this.Actor.Stop()
+}
+
+func (this *Room) OnStart() error {
+	err := this.GetProcess().RegisterActorLocal(this)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	err = this.GetProcess().RegisterActorRemote(this)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (this *Room) OnStop() error {
+	err := this.GetProcess().UnregisterActorLocal(this)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	err = this.GetProcess().UnregisterActorRemote(this)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (this *Room) OnUpdate() {
+	this.GetProcess().RegisterActorRemote(this)
+}
+
+// HandleMsg the messages of the members are passed to the OnMsg of the handler,
+// the client messages routed by the gate come from the gate sessions of the members
+func (this *Room) HandleMsg(actorId util.ID, transId uint32, msg protocol.ISerializable) (protocol.ISerializable, error) {
+	switch m := msg.(type) {
+	case *RoomJoin:
+		return this.join(this.sender(actorId, m.AvatarId))
+	case *RoomLeave:
+		err := this.leave(this.sender(actorId, m.AvatarId))
+		if err != nil {
+			return nil, err
+		}
+		return NewResponse(true), nil
+	case *RoomClose:
+		if actorId != this.manager.GetId() {
+			return nil, protocol.ERR_ROOM_FORBIDDEN
+		}
+		this.Close(m.Reason)
+		return nil, nil
+	}
+	avatarId := this.member(actorId)
+	if avatarId == 0 {
+		return nil, protocol.ERR_ROOM_NOT_JOINED
+	}
+	if this.handler.OnMsg == nil {
+		return nil, protocol.ERR_TYPE_NOT_FOUND
+	}
+	return this.handler.OnMsg(this, avatarId, transId, msg)
+}
+
+// sender the members act for themselves only,the server actors for the avatar given,
+// the others such as the gate sessions for themselves
+func (this *Room) sender(actorId util.ID, avatarId int64) util.ID {
+	if id := this.member(actorId); id != 0 {
+		return id
+	}
+	if avatarId != 0 && this.trusted(actorId) {
+		return util.ID(avatarId)
+	}
+	return actorId
+}
+
+// trusted the actor is registered in the cluster like the matchmaker and the avatars,
+// the gate sessions are never registered
+func (this *Room) trusted(actorId util.ID) bool {
+	process := this.GetProcess()
+	if process == nil {
+		return false
+	}
+	_, err := process.GetProcessIdByActor(actorId)
+	return err == nil
+}
+
+// member the avatar of the member or of its gate session,0 if not a member
+func (this *Room) member(actorId util.ID) util.ID {
+	if _, ok := this.Members[actorId]; ok {
+		return actorId
+	}
+	return this.sessions[actorId]
+}
+
+// join add the member,joining again rebinds the current gate session of the member
+func (this *Room) join(avatarId util.ID) (protocol.ISerializable, error) {
+	if this.closed {
+		return nil, protocol.ERR_ROOM_CLOSED
+	}
+	member := this.Members[avatarId]
+	if member == nil {
+		if _, ok := this.Reserved[avatarId]; len(this.Reserved) > 0 && !ok {
+			return nil, protocol.ERR_ROOM_FORBIDDEN
+		}
+		if this.manager.Capacity > 0 && len(this.Members) >= this.manager.Capacity {
+			return nil, protocol.ERR_ROOM_FULL
+		}
+		member = &RoomMember{AvatarId: avatarId, Joined: time.Now()}
+		this.Members[avatarId] = member
+		if this.handler.OnJoin != nil {
+			err := this.handler.OnJoin(this, avatarId)
+			if err != nil {
+				delete(this.Members, avatarId)
+				return nil, err
+			}
+		}
+		log.Info("room join", flog.ActorId(this.GetId()), flog.AvatarId(avatarId), zap.String("mode", this.Mode), zap.Int("members", len(this.Members)))
+	}
+	this.bind(member)
+	return this.Info(), nil
+}
+
+func (this *Room) leave(avatarId util.ID) error {
+	member := this.Members[avatarId]
+	if member == nil {
+		return protocol.ERR_ROOM_NOT_JOINED
+	}
+	delete(this.Members, avatarId)
+	this.unbind(member)
+	if this.handler.OnLeave != nil {
+		this.handler.OnLeave(this, avatarId)
+	}
+	if len(this.Members) == 0 {
+		this.emptySince = time.Now()
+	}
+	log.Info("room leave", flog.ActorId(this.GetId()), flog.AvatarId(avatarId), zap.Int("members", len(this.Members)))
+	return nil
+}
+
+// bind read the gate session of the member and bind it to the room
+func (this *Room) bind(member *RoomMember) {
+	process := this.GetProcess()
+	if process == nil || process.GetEtcd() == nil {
+		return
+	}
+	sess := NewAvatarSession(member.AvatarId)
+	err := sess.Deserialize(process)
+	if err != nil {
+		log.Warn("room member has no gate session", flog.ActorId(this.GetId()), flog.AvatarId(member.AvatarId))
+		return
+	}
+	delete(this.sessions, member.GateId)
+	member.GateId, member.GatePid = sess.GetGate()
+	if member.GateId == 0 {
+		return
+	}
+	this.sessions[member.GateId] = member.AvatarId
+	err = this.sendToGate(member, &RoomBind{RoomId: this.GetId().Int64()})
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
+
+func (this *Room) unbind(member *RoomMember) {
+	if member.GateId == 0 {
+		return
+	}
+	delete(this.sessions, member.GateId)
+	err := this.sendToGate(member, &RoomBind{})
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
+
+func (this *Room) sendToGate(member *RoomMember, msg protocol.ISerializable) error {
+	if member.GateId == 0 {
+		return protocol.ERR_SESSION_NOT_FOUND
+	}
+	if member.GatePid == 0 {
+		return this.SendMessage(member.GateId, 0, msg)
+	}
+	routeMsg := protocol.NewRouteMessage(this.GetId(), member.GateId, 0, msg, true)
+	routeMsg.ToPid = member.GatePid
+	this.GetProcess().RouteMsg(routeMsg)
+	return nil
+}
+
+// SendEvent send the message to the client of the member by its gate session
+func (this *Room) SendEvent(avatarId util.ID, msg protocol.ISerializable) error {
+	member := this.Members[avatarId]
+	if member == nil {
+		return protocol.ERR_ROOM_NOT_JOINED
+	}
+	return this.sendToGate(member, msg)
+}
+
+// Broadcast send the message to the clients of all the members
+func (this *Room) Broadcast(msg protocol.ISerializable) {
+	for id, member := range this.Members {
+		err := this.sendToGate(member, msg)
+		if err != nil {
+			log.Warn("room broadcast failed", flog.ActorId(this.GetId()), flog.AvatarId(id), flog.Error(err))
+		}
+	}
+}
+
+func (this *Room) Info() *RoomInfo {
+	ret := &RoomInfo{
+		RoomId:    this.GetId().Int64(),
+		Mode:      this.Mode,
+		ServiceId: int32(this.manager.ServiceId),
+		LineId:    int32(this.manager.LineId),
+		Members:   []int64{},
+	}
+	for id := range this.Members {
+		ret.Members = append(ret.Members, id.Int64())
+	}
+	sort.Slice(ret.Members, func(i, j int) bool {
+		return ret.Members[i] < ret.Members[j]
+	})
+	return ret
+}
+
+func (this *Room) tick(now time.Time) {
+	if this.closed {
+		return
+	}
+	if this.manager.Lifetime > 0 && now.Sub(this.Created) >= this.manager.Lifetime {
+		this.Close(ROOM_CLOSE_TIMEOUT)
+		return
+	}
+	if len(this.Members) == 0 && now.Sub(this.emptySince) >= this.manager.EmptyTimeout {
+		this.Close(ROOM_CLOSE_EMPTY)
+		return
+	}
+	if this.handler.OnUpdate != nil {
+		this.handler.OnUpdate(this, now)
+	}
+}
+
+// Close unbind the members and tell their avatars,then remove the room from the manager
+func (this *Room) Close(reason RoomCloseReason) {
+	if this.closed {
+		return
+	}
+	this.closed = true
+	if this.handler.OnClose != nil {
+		this.handler.OnClose(this, reason)
+	}
+	for id, member := range this.Members {
+		this.unbind(member)
+		err := this.SendMessage(id, 0, &RoomClosed{RoomId: this.GetId().Int64(), Reason: reason})
+		if err != nil {
+			log.Warn("notify room closed failed", flog.ActorId(this.GetId()), flog.AvatarId(id), flog.Error(err))
+		}
+	}
+	log.Info("room closed", flog.ActorId(this.GetId()), zap.String("mode", this.Mode), zap.String("reason", reason.String()), zap.Duration("lived", time.Since(this.Created)))
+	this.manager.RemoveRoom(this.GetId())
+}
@@ -0,0 +1,280 @@
+package lox
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/log/flog"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+	"go.uber.org/zap"
+)
+
+type roomManagerCtor struct {
+	handler *RoomHandler
+}
+
+func NewRoomManagerCtor(handler *RoomHandler) roomManagerCtor {
+	return roomManagerCtor{handler: handler}
+}
+
+func (this roomManagerCtor) Type() string {
+	return "RoomManager"
+}
+
+func (this roomManagerCtor) Create() lokas.IModule {
+	ret := &RoomManager{
+		Actor:        NewActor(),
+		Rooms:        map[util.ID]*Room{},
+		Handler:      this.handler,
+		Tick:         time.Millisecond * 100,
+		EmptyTimeout: time.Second * 30,
+	}
+	if ret.Handler == nil {
+		ret.Handler = &RoomHandler{}
+	}
+	ret.SetType(this.Type())
+	ret.OnUpdateFunc = ret.OnUpdate
+	ret.MsgHandler = ret.HandleMsg
+	return ret
+}
+
+var _ lokas.IActor = (*RoomManager)(nil)
+
+// RoomManager create the room actors on demand and register the line of the ROOM_SERVICE,
+// the count of the rooms is reported as the Cnt of the service for balancing the new rooms across the lines
+//
+//	[RoomManager]
+//	service_id = 1
+//	line_id = 1
+//	tick = "100ms"          # update interval of the rooms
+//	empty_timeout = "30s"   # close the rooms without member
+//	lifetime = "30m"        # close the rooms lived longer,0 means never
+//	capacity = 10           # max members of a room,0 means unlimited
+type RoomManager struct {
+	*Actor
+	Rooms        map[util.ID]*Room
+	Handler      *RoomHandler
+	ServiceId    uint16
+	LineId       uint16
+	Tick         time.Duration
+	EmptyTimeout time.Duration
+	Lifetime     time.Duration
+	Capacity     int
+	Mu           sync.Mutex
+	serviceInfo  *lokas.ServiceInfo
+}
+
+// HandleMsg create the rooms of the matches,the joins and leaves are passed to the rooms which reply the sender
+func (this *RoomManager) HandleMsg(actorId util.ID, transId uint32, msg protocol.ISerializable) (protocol.ISerializable, error) {
+	switch m := msg.(type) {
+	case *MatchRoom:
+		_, err := this.CreateRoom(util.ID(m.RoomId), m.Mode, m.Teams)
+		if err != nil {
+			return nil, err
+		}
+		return NewResponse(true), nil
+	case *RoomJoin:
+		room := this.GetRoom(util.ID(m.RoomId))
+		if m.RoomId == 0 {
+			var err error
+			room, err = this.CreateRoom(0, m.Mode, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if room == nil {
+			return nil, protocol.ERR_ROOM_NOT_FOUND
+		}
+		room.ReceiveMessage(protocol.NewRouteMessage(actorId, room.GetId(), transId, msg, true))
+		return nil, nil
+	case *RoomLeave:
+		room := this.GetRoom(util.ID(m.RoomId))
+		if room == nil {
+			return nil, protocol.ERR_ROOM_NOT_JOINED
+		}
+		room.ReceiveMessage(protocol.NewRouteMessage(actorId, room.GetId(), transId, msg, true))
+		return nil, nil
+	}
+	return nil, protocol.ERR_TYPE_NOT_FOUND
+}
+
+func (this *RoomManager) GetRoom(id util.ID) *Room {
+	this.Mu.Lock()
+	defer this.Mu.Unlock()
+	return this.Rooms[id]
+}
+
+// CreateRoom return the room if created,otherwise start a new one,a new id is generated if id is empty,
+// only the avatars of the teams may join if teams given,the ids of the other actors are refused
+func (this *RoomManager) CreateRoom(id util.ID, mode string, teams []*MatchTeam) (*Room, error) {
+	this.Mu.Lock()
+	defer this.Mu.Unlock()
+	if room := this.Rooms[id]; room != nil {
+		return room, nil
+	}
+	if id == 0 {
+		id = this.GetProcess().GenId()
+	} else if this.idInUse(id) {
+		log.Warn("room id used by other actor", flog.ActorId(id), zap.String("mode", mode))
+		return nil, protocol.ERR_ROOM_ID_IN_USE
+	}
+	room := NewRoom(id, mode, this)
+	room.Reserve(teams)
+	this.GetProcess().AddActor(room)
+	err := this.GetProcess().StartActor(room)
+	if err != nil {
+		log.Error(err.Error())
+		this.GetProcess().RemoveActor(room)
+		return nil, err
+	}
+	this.Rooms[id] = room
+	this.report()
+	log.Info("CreateRoom", flog.ActorId(id), zap.String("mode", mode), zap.Int("rooms", len(this.Rooms)))
+	return room, nil
+}
+
+// idInUse an actor of the process or of the cluster has the id
+func (this *RoomManager) idInUse(id util.ID) bool {
+	process := this.GetProcess()
+	if process.GetActor(id) != nil {
+		return true
+	}
+	_, err := process.GetProcessIdByActor(id)
+	return err == nil
+}
+
+// RemoveRoom remove the room closed and stop its actor
+func (this *RoomManager) RemoveRoom(id util.ID) {
+	this.Mu.Lock()
+	room, ok := this.Rooms[id]
+	delete(this.Rooms, id)
+	if ok {
+		this.report()
+	}
+	this.Mu.Unlock()
+	if ok {
+		this.GetProcess().RemoveActor(room)
+	}
+}
+
+func (this *RoomManager) RoomCnt() int {
+	this.Mu.Lock()
+	defer this.Mu.Unlock()
+	return len(this.Rooms)
+}
+
+// report update the Cnt of the service,called with the lock held so the counts are reported in order
+func (this *RoomManager) report() {
+	if this.serviceInfo == nil {
+		return
+	}
+	info := *this.serviceInfo
+	info.Cnt = len(this.Rooms)
+	err := this.GetProcess().GetServiceRegisterMgr().UpdateServiceInfo(&info)
+	if err != nil {
+		log.Error("report room count failed", flog.ServiceInfo(info.ServiceType, info.ServiceId, info.LineId).Append(flog.Error(err))...)
+	}
+}
+
+func (this *RoomManager) Load(conf lokas.IConfig) error {
+	if conf == nil {
+		return nil
+	}
+	this.ServiceId = uint16(conf.GetInt("service_id"))
+	this.LineId = uint16(conf.GetInt("line_id"))
+	if conf.IsSet("tick") {
+		this.Tick = conf.GetDuration("tick")
+	}
+	if conf.IsSet("empty_timeout") {
+		this.EmptyTimeout = conf.GetDuration("empty_timeout")
+	}
+	this.Lifetime = conf.GetDuration("lifetime")
+	this.Capacity = conf.GetInt("capacity")
+	if this.Tick <= 0 || this.EmptyTimeout < 0 || this.Lifetime < 0 || this.Capacity < 0 {
+		log.Error("room manager config invalid", zap.Duration("tick", this.Tick), zap.Duration("empty_timeout", this.EmptyTimeout), zap.Int("capacity", this.Capacity))
+		return protocol.ERR_CONFIG_ERROR
+	}
+	return nil
+}
+
+func (this *RoomManager) Unload() error {
+	return nil
+}
+
+func (this *RoomManager) Start() error {
+	this.StartMessagePump()
+	return nil
+}
+
+// Stop tell all the rooms to close in their own message pumps,the members are told by RoomClosed
+func (this *RoomManager) Stop() error {
+	this.Mu.Lock()
+	rooms := make([]*Room, 0, len(this.Rooms))
+	for _, room := range this.Rooms {
+		rooms = append(rooms, room)
+	}
+	this.Mu.Unlock()
+	for _, room := range rooms {
+		room.ReceiveMessage(protocol.NewRouteMessage(this.GetId(), room.GetId(), 0, &RoomClose{RoomId: room.GetId().Int64(), Reason: ROOM_CLOSE_STOPPED}, true))
+	}
+	this.Cancel()
+	return nil
+}
+
+func (this *RoomManager) OnUpdate() {
+	this.GetProcess().RegisterActorRemote(this)
+}
+
+func (this *RoomManager) OnStart() error {
+	err := this.GetProcess().RegisterActorLocal(this)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	err = this.GetProcess().RegisterActorRemote(this)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	this.Mu.Lock()
+	defer this.Mu.Unlock()
+	this.serviceInfo = &lokas.ServiceInfo{
+		ServiceType: ROOM_SERVICE,
+		ServiceId:   this.ServiceId,
+		LineId:      this.LineId,
+		ProcessId:   this.GetProcess().PId(),
+		ActorId:     this.GetId(),
+		Version:     this.GetProcess().Version(),
+		Cnt:         len(this.Rooms),
+	}
+	err = this.GetProcess().GetServiceRegisterMgr().Register(this.serviceInfo)
+	if err != nil {
+		log.Error(err.Error())
+		this.serviceInfo = nil
+		return err
+	}
+	return nil
+}
+
+func (this *RoomManager) OnStop() error {
+	this.Mu.Lock()
+	if this.serviceInfo != nil {
+		this.GetProcess().GetServiceRegisterMgr().Unregister(this.serviceInfo.ServiceType, this.serviceInfo.ServiceId, this.serviceInfo.LineId)
+		this.serviceInfo = nil
+	}
+	this.Mu.Unlock()
+	err := this.GetProcess().UnregisterActorLocal(this)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	err = this.GetProcess().UnregisterActorRemote(this)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/nomos/go-lokas/log/flog"
 	"github.com/nomos/go-lokas/protocol"
 	"github.com/nomos/go-lokas/util"
+	"go.uber.org/zap"
 )
 
 var _ lokas.IModule = (*Router)(nil)
@@ -22,6 +23,7 @@ func NewRouter(process lokas.IProcess) *Router {
 //路由信息到本机或调用Proxy建立连接
 type Router struct {
 	process lokas.IProcess
+	inbox   *Inbox
 }
 
 func (this *Router) GetProcess() lokas.IProcess {
@@ -34,6 +36,7 @@ func (this *Router) SetProcess(process lokas.IProcess) {
 
 func (this *Router) RouteMsg(msg *protocol.RouteMessage) {
 	if msg.ToActor.IsValidProcessId() {
+		this.routeProcessMsg(msg)
 	} else if msg.ToActor != 0 {
 		a := this.process.GetActor(msg.ToActor)
 
@@ -47,6 +50,10 @@ func (this *Router) RouteMsg(msg *protocol.RouteMessage) {
 		if msg.ToPid == 0 {
 			pid, err = this.process.GetProcessIdByActor(msg.ToActor)
 			if err != nil {
+				//keep the persistent messages for the avatars not loaded
+				if this.inbox != nil && this.inbox.IsPersistent(msg) {
+					this.inbox.Put(msg)
+				}
 				return
 			}
 		} else {
@@ -113,6 +120,16 @@ func (router *Router) RouteMsgToService(fromActorId util.ID, serviceType string,
 	return nil
 }
 
+func (router *Router) RouteMsgToServiceSticky(fromActorId util.ID, serviceType string, serviceId uint16, transId uint32, reqType uint8, msg protocol.ISerializable, protocolType protocol.TYPE) error {
+	serviceInfo, ok := router.GetProcess().GetServiceDiscoverMgr().PickServiceInfo(serviceType, serviceId, uint64(fromActorId))
+	if !ok {
+		cmd, _ := msg.GetId()
+		log.Debug("route msg err, not find service", flog.ServiceInfo(serviceType, serviceId, 0).Append(protocol.LogCmdId(cmd))...)
+		return protocol.ERR_SERVICE_NOT_FOUND
+	}
+	return router.RouteMsgToService(fromActorId, serviceInfo.ServiceType, serviceInfo.ServiceId, serviceInfo.LineId, transId, reqType, msg, protocolType)
+}
+
 func (router *Router) RouteDataByService(dataMsg *protocol.RouteDataMsg, serviceType string, serviceId uint16, lineId uint16) error {
 
 	serviceInfo, ok := router.GetProcess().GetServiceDiscoverMgr().FindServiceInfo(serviceType, serviceId, lineId)
@@ -162,6 +179,56 @@ func (router *Router) RouteDataMsgLocal(dataMsg *protocol.RouteDataMsg) error {
 	return actor.ReceiveData(dataMsg)
 }
 
+// routeProcessMsg handle the messages addressed to this process
+func (this *Router) routeProcessMsg(msg *protocol.RouteMessage) {
+	switch body := msg.Body.(type) {
+	case *TopicMessage:
+		inner, err := body.Message()
+		if err != nil {
+			log.Error("unmarshal topic msg err", msg.LogInfo().Append(flog.Error(err))...)
+			return
+		}
+		this.publishTopicLocal(msg.FromActor, body.Topic, inner)
+	default:
+		log.Warn("route process msg, unknown msg", msg.LogInfo()...)
+	}
+}
+
+func (this *Router) PublishTopic(fromActorId util.ID, topic string, msg protocol.ISerializable) error {
+	var topicMsg *TopicMessage
+	var lastErr error
+	for _, pid := range this.process.GetTopicProcesses(topic) {
+		if pid == this.process.PId() {
+			this.publishTopicLocal(fromActorId, topic, msg)
+			continue
+		}
+		if topicMsg == nil {
+			var err error
+			topicMsg, err = NewTopicMessage(topic, msg)
+			if err != nil {
+				log.Error(err.Error())
+				return err
+			}
+		}
+		err := this.process.Send(pid, protocol.NewRouteMessage(fromActorId, pid.Snowflake(), 0, topicMsg, true))
+		if err != nil {
+			log.Warn("publish topic err", zap.String("topic", topic), zap.Uint16("pid", uint16(pid)), flog.Error(err))
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (this *Router) publishTopicLocal(fromActorId util.ID, topic string, msg protocol.ISerializable) {
+	for _, id := range this.process.GetTopicSubscribers(topic) {
+		a := this.process.GetActor(id)
+		if a == nil {
+			continue
+		}
+		a.ReceiveMessage(protocol.NewRouteMessage(fromActorId, id, 0, msg, true))
+	}
+}
+
 func (this *Router) Type() string {
 	return "Router"
 }
@@ -175,6 +242,9 @@ func (this *Router) Unload() error {
 }
 
 func (this *Router) Start() error {
+	if inbox, ok := this.process.Get(InboxCtor.Type()).(*Inbox); ok {
+		this.inbox = inbox
+	}
 	return nil
 }
 
@@ -0,0 +1,131 @@
+package lox
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"reflect"
+
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+)
+
+const (
+	DEFAULT_RESUME_BUFFER_SIZE = 256
+)
+
+// SessionToken 握手成功后下发给客户端,断线重连时凭此恢复会话
+type SessionToken struct {
+	SessionId util.ID
+	Token     string
+}
+
+func (this *SessionToken) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *SessionToken) Serializable() protocol.ISerializable {
+	return this
+}
+
+// SessionResume 客户端重连后代替握手包发送,LastSeq为客户端最后收到的消息序号
+type SessionResume struct {
+	SessionId util.ID
+	Token     string
+	LastSeq   uint32
+}
+
+func (this *SessionResume) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *SessionResume) Serializable() protocol.ISerializable {
+	return this
+}
+
+// SessionResumed 会话恢复成功,之后重发序号大于LastSeq的消息,Ack为服务端最后收到的客户端消息序号
+type SessionResumed struct {
+	SessionId util.ID
+	Seq       uint32
+	Ack       uint32
+}
+
+func (this *SessionResumed) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *SessionResumed) Serializable() protocol.ISerializable {
+	return this
+}
+
+func genResumeToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type replayEntry struct {
+	seq  uint32
+	data []byte
+}
+
+// replayBuffer keep the latest outbound messages of a session by sequence number
+type replayBuffer struct {
+	size    int
+	seq     uint32
+	entries []replayEntry
+}
+
+func newReplayBuffer(size int) *replayBuffer {
+	if size <= 0 {
+		size = DEFAULT_RESUME_BUFFER_SIZE
+	}
+	return &replayBuffer{
+		size:    size,
+		entries: make([]replayEntry, 0, size),
+	}
+}
+
+// push append the message and return its sequence number,the oldest one is dropped when full
+func (this *replayBuffer) push(data []byte) uint32 {
+	this.seq++
+	if len(this.entries) >= this.size {
+		copy(this.entries, this.entries[1:])
+		this.entries = this.entries[:len(this.entries)-1]
+	}
+	this.entries = append(this.entries, replayEntry{seq: this.seq, data: data})
+	return this.seq
+}
+
+// ack drop the messages acknowledged by the client
+func (this *replayBuffer) ack(seq uint32) {
+	i := 0
+	for i < len(this.entries) && this.entries[i].seq <= seq {
+		i++
+	}
+	if i > 0 {
+		this.entries = append(this.entries[:0], this.entries[i:]...)
+	}
+}
+
+// since return the messages after seq,false if some of them were already dropped
+func (this *replayBuffer) since(seq uint32) ([][]byte, bool) {
+	if seq > this.seq {
+		return nil, false
+	}
+	if seq == this.seq {
+		return [][]byte{}, true
+	}
+	if len(this.entries) == 0 || this.entries[0].seq > seq+1 {
+		return nil, false
+	}
+	ret := make([][]byte, 0, this.seq-seq)
+	for _, e := range this.entries {
+		if e.seq > seq {
+			ret = append(ret, e.data)
+		}
+	}
+	return ret, true
+}
@@ -0,0 +1,412 @@
+package lox
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/log/flog"
+	"github.com/nomos/go-lokas/network/etcdclient"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	SINGLETON_ID_KEY    lokas.Key = "/singleton/%s/id"    //stable actor id of the singleton,never expired
+	SINGLETON_OWNER_KEY lokas.Key = "/singleton/%s/owner" //pid of the owner process,bound to the owner's registry lease
+
+	singletonRetryInterval = time.Second
+)
+
+var SingletonManagerCtor = singletonManagerCtor{}
+
+type singletonManagerCtor struct{}
+
+func (this singletonManagerCtor) Type() string {
+	return "SingletonManager"
+}
+
+func (this singletonManagerCtor) Create() lokas.IModule {
+	ret := &SingletonManager{
+		singletons: map[string]*singleton{},
+	}
+	return ret
+}
+
+// SingletonCreator create the actor instance of a singleton,
+// the actor should start its message pump in Start like Avatar does
+type SingletonCreator func() lokas.IActor
+
+type singleton struct {
+	name    string
+	creator SingletonCreator
+	id      util.ID
+	actor   lokas.IActor
+	done    chan struct{}
+}
+
+var _ lokas.IModule = (*SingletonManager)(nil)
+
+// SingletonManager host cluster wide singleton actors,
+// every process registering the same name campaigns for the owner key with its registry lease,
+// the winner starts the actor,the others take over when the lease of the owner expired.
+// the actor id is allocated once and kept in etcd,so callers route messages by the id without knowing the pid
+type SingletonManager struct {
+	process    lokas.IProcess
+	mu         sync.Mutex
+	singletons map[string]*singleton
+	started    bool
+}
+
+func (this *SingletonManager) Type() string {
+	return "SingletonManager"
+}
+
+func (this *SingletonManager) GetProcess() lokas.IProcess {
+	return this.process
+}
+
+func (this *SingletonManager) SetProcess(process lokas.IProcess) {
+	this.process = process
+}
+
+func (this *SingletonManager) Load(conf lokas.IConfig) error {
+	return nil
+}
+
+func (this *SingletonManager) Unload() error {
+	return nil
+}
+
+func (this *SingletonManager) Start() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.started {
+		return nil
+	}
+	this.started = true
+	for _, s := range this.singletons {
+		this.startCampaign(s)
+	}
+	return nil
+}
+
+func (this *SingletonManager) Stop() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if !this.started {
+		return nil
+	}
+	this.started = false
+	for _, s := range this.singletons {
+		close(s.done)
+	}
+	return nil
+}
+
+func (this *SingletonManager) OnStart() error {
+	return nil
+}
+
+func (this *SingletonManager) OnStop() error {
+	return nil
+}
+
+// Register register a singleton to campaign for,use SingletonName to build a per server name
+func (this *SingletonManager) Register(name string, creator SingletonCreator) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if _, ok := this.singletons[name]; ok {
+		log.Error(protocol.ERR_SINGLETON_DUPLICATED.Error(), zap.String("singleton", name))
+		return protocol.ERR_SINGLETON_DUPLICATED
+	}
+	s := &singleton{
+		name:    name,
+		creator: creator,
+	}
+	this.singletons[name] = s
+	if this.started {
+		this.startCampaign(s)
+	}
+	return nil
+}
+
+// GetAddress return the stable actor id of the singleton,
+// messages sent to the id are routed to whichever process hosts it
+func (this *SingletonManager) GetAddress(name string) (util.ID, error) {
+	this.mu.Lock()
+	s, ok := this.singletons[name]
+	this.mu.Unlock()
+	if ok && s.id != 0 {
+		return s.id, nil
+	}
+	client := this.process.GetEtcd()
+	resp, err := client.Get(context.TODO(), SINGLETON_ID_KEY.Assemble(name))
+	if err != nil {
+		log.Error(err.Error())
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, protocol.ERR_SINGLETON_NOT_FOUND
+	}
+	return parseSingletonId(resp.Kvs[0].Value)
+}
+
+// GetOwner return the pid of the process hosting the singleton
+func (this *SingletonManager) GetOwner(name string) (util.ProcessId, error) {
+	client := this.process.GetEtcd()
+	resp, err := client.Get(context.TODO(), SINGLETON_OWNER_KEY.Assemble(name))
+	if err != nil {
+		log.Error(err.Error())
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, protocol.ERR_SINGLETON_NOT_FOUND
+	}
+	pid, err := strconv.Atoi(string(resp.Kvs[0].Value))
+	if err != nil {
+		log.Error(err.Error())
+		return 0, err
+	}
+	return util.ProcessId(pid), nil
+}
+
+// IsOwner return whether the singleton is running in this process
+func (this *SingletonManager) IsOwner(name string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	s, ok := this.singletons[name]
+	return ok && s.actor != nil
+}
+
+// SingletonName build a singleton name for one server
+func SingletonName(name string, serverId int32) string {
+	return name + "_" + strconv.Itoa(int(serverId))
+}
+
+func parseSingletonId(v []byte) (util.ID, error) {
+	id, err := strconv.ParseInt(string(v), 10, 64)
+	if err != nil {
+		log.Error(err.Error())
+		return 0, err
+	}
+	return util.ID(id), nil
+}
+
+func (this *SingletonManager) startCampaign(s *singleton) {
+	s.done = make(chan struct{})
+	go this.campaign(s, s.done)
+}
+
+// allocId get or create the stable id of the singleton under a global mutex
+func (this *SingletonManager) allocId(name string) (util.ID, error) {
+	key := SINGLETON_ID_KEY.Assemble(name)
+	mutex, err := this.process.GlobalMutex(key, 0)
+	if err != nil {
+		log.Error(err.Error())
+		return 0, err
+	}
+	err = mutex.Lock()
+	if err != nil {
+		log.Error(err.Error())
+		return 0, err
+	}
+	defer mutex.Unlock()
+	client := this.process.GetEtcd()
+	resp, err := client.Get(context.TODO(), key)
+	if err != nil {
+		log.Error(err.Error())
+		return 0, err
+	}
+	if len(resp.Kvs) > 0 {
+		return parseSingletonId(resp.Kvs[0].Value)
+	}
+	id := this.process.GenId()
+	_, err = client.Put(context.TODO(), key, id.String())
+	if err != nil {
+		log.Error(err.Error())
+		return 0, err
+	}
+	return id, nil
+}
+
+// campaign reconcile the ownership of the singleton until done is closed:
+// claim the owner key when it is free,start the actor when owned,stop it when lost
+func (this *SingletonManager) campaign(s *singleton, done chan struct{}) {
+	client := this.process.GetEtcd()
+	key := SINGLETON_OWNER_KEY.Assemble(s.name)
+	pid := this.process.PId().ToString()
+	for {
+		select {
+		case <-done:
+			this.resign(s, key)
+			return
+		default:
+		}
+		rev, owned, err := this.claim(s, key, pid)
+		if err != nil {
+			select {
+			case <-done:
+			case <-time.After(singletonRetryInterval):
+			}
+			continue
+		}
+		if owned {
+			if this.getActor(s) == nil {
+				err = this.startSingleton(s)
+				if err != nil {
+					this.resign(s, key)
+					select {
+					case <-done:
+					case <-time.After(singletonRetryInterval):
+					}
+					continue
+				}
+			}
+		} else if this.getActor(s) != nil {
+			log.Warn("singleton ownership lost", zap.String("singleton", s.name), flog.ActorId(s.id))
+			this.stopSingleton(s)
+		}
+		this.watchOwner(client, s, key, rev, done)
+	}
+}
+
+// claim try to put the owner key with the registry lease,return the revision and whether this process owns it
+func (this *SingletonManager) claim(s *singleton, key string, pid string) (int64, bool, error) {
+	if s.id == 0 {
+		id, err := this.allocId(s.name)
+		if err != nil {
+			return 0, false, err
+		}
+		this.mu.Lock()
+		s.id = id
+		this.mu.Unlock()
+	}
+	leaseId, _, err := this.process.GetLeaseId()
+	if err != nil {
+		log.Error(err.Error())
+		return 0, false, err
+	}
+	client := this.process.GetEtcd()
+	resp, err := client.Txn(context.TODO()).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, pid, clientv3.WithLease(leaseId))).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		log.Error(err.Error())
+		return 0, false, err
+	}
+	if resp.Succeeded {
+		log.Info("singleton elected", zap.String("singleton", s.name), flog.ActorId(s.id), zap.String("pid", pid))
+		return resp.Header.Revision, true, nil
+	}
+	kvs := resp.Responses[0].GetResponseRange().Kvs
+	if len(kvs) == 0 {
+		//deleted between the compare and the get,campaign again
+		return resp.Header.Revision, false, nil
+	}
+	return resp.Header.Revision, clientv3.LeaseID(kvs[0].Lease) == leaseId, nil
+}
+
+// watchOwner block until the owner key changed or done,keep the actor registration alive meanwhile
+func (this *SingletonManager) watchOwner(client *etcdclient.Client, s *singleton, key string, rev int64, done chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watchChan := client.Watch(ctx, key, clientv3.WithRev(rev+1))
+	ticker := time.NewTicker(UpdateTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if actor := this.getActor(s); actor != nil {
+				this.process.RegisterActorRemote(actor)
+			}
+		case resp, ok := <-watchChan:
+			if !ok || resp.Err() != nil {
+				return
+			}
+			for _, e := range resp.Events {
+				if e.Type == mvccpb.DELETE {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (this *SingletonManager) startSingleton(s *singleton) error {
+	actor := s.creator()
+	actor.SetId(s.id)
+	this.process.AddActor(actor)
+	err := this.process.StartActor(actor)
+	if err != nil {
+		log.Error(err.Error())
+		this.process.RemoveActor(actor)
+		return err
+	}
+	err = this.process.RegisterActorLocal(actor)
+	if err != nil {
+		log.Error(err.Error())
+		this.process.RemoveActor(actor)
+		return err
+	}
+	err = this.process.RegisterActorRemote(actor)
+	if err != nil {
+		log.Error(err.Error())
+		this.process.UnregisterActorLocal(actor)
+		this.process.RemoveActor(actor)
+		return err
+	}
+	this.mu.Lock()
+	s.actor = actor
+	this.mu.Unlock()
+	log.Info("singleton started", lokas.LogActorInfo(actor).Append(zap.String("singleton", s.name))...)
+	return nil
+}
+
+// getActor return the running actor of the singleton,nil if not owned
+func (this *SingletonManager) getActor(s *singleton) lokas.IActor {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return s.actor
+}
+
+func (this *SingletonManager) stopSingleton(s *singleton) {
+	this.mu.Lock()
+	actor := s.actor
+	s.actor = nil
+	this.mu.Unlock()
+	if actor == nil {
+		return
+	}
+	this.process.UnregisterActorRemote(actor)
+	this.process.UnregisterActorLocal(actor)
+	this.process.RemoveActor(actor)
+	log.Info("singleton stopped", lokas.LogActorInfo(actor).Append(zap.String("singleton", s.name))...)
+}
+
+// resign stop the actor and release the owner key if it is still ours,so other processes take over at once
+func (this *SingletonManager) resign(s *singleton, key string) {
+	this.stopSingleton(s)
+	leaseId, _, err := this.process.GetLeaseId()
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+	_, err = this.process.GetEtcd().Txn(context.TODO()).
+		If(clientv3.Compare(clientv3.LeaseValue(key), "=", leaseId)).
+		Then(clientv3.OpDelete(key)).
+		Commit()
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
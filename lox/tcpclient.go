@@ -2,12 +2,14 @@ package lox
 
 import (
 	"context"
-	"errors"
+	"crypto/ed25519"
+	"crypto/tls"
 	"github.com/nomos/go-lokas"
 	"github.com/nomos/go-lokas/log"
 	"github.com/nomos/go-lokas/log/flog"
 	"github.com/nomos/go-lokas/network"
 	"github.com/nomos/go-lokas/network/conn"
+	"github.com/nomos/go-lokas/network/kcp"
 	"github.com/nomos/go-lokas/network/tcp"
 	"github.com/nomos/go-lokas/protocol"
 	"github.com/nomos/go-lokas/util/events"
@@ -15,6 +17,7 @@ import (
 	"go.uber.org/zap"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -32,16 +35,20 @@ type TcpClient struct {
 	timeout      time.Duration
 	addr         string
 	idGen        uint32
-	isOpen       bool
+	isOpen       int32
 	Closing      bool
 	Opening      bool
 	ConnType     ConnType
 	Protocol     protocol.TYPE
+	TLSConfig    *tls.Config       //dial with tls if set
+	CodecKey     ed25519.PublicKey //the public key of the gate verifying the key exchange,required to encrypt
 	context      lokas.IReqContext
+	codec        clientCodec
 	reqContexts  map[uint32]lokas.IReqContext
 	openPending  *promise.Promise[interface{}]
 	closePending *promise.Promise[interface{}]
 	mu           sync.Mutex
+	closeMu      sync.Mutex
 	ctxMutex     sync.Mutex
 }
 
@@ -86,8 +93,15 @@ func (this *TcpClient) connect() error {
 		LongPacketPicker:  protocol.PickLongPacket(this.Protocol),
 		LongPacketCreator: protocol.CreateLongPacket(this.Protocol),
 		MaxPacketWriteLen: protocol.DEFAULT_PACKET_LEN,
+		TLSConfig:         this.TLSConfig,
+	}
+	var connect *conn.Conn
+	var err error
+	if this.ConnType == KCP {
+		connect, err = kcp.Dial(this.addr, context)
+	} else {
+		connect, err = tcp.Dial(this.addr, context)
 	}
-	connect, err := tcp.Dial(this.addr, context)
 	if err != nil {
 		return err
 	}
@@ -116,7 +130,7 @@ func (this *TcpClient) Connect(addr string) *promise.Promise[interface{}] {
 					return
 				}
 				for {
-					if this.isOpen {
+					if this.Connected() {
 						resolve(nil)
 						return
 					}
@@ -144,19 +158,23 @@ func (this *TcpClient) ClearContext(err error) {
 }
 
 func (this *TcpClient) Disconnect(b bool) *promise.Promise[interface{}] {
+	this.closeMu.Lock()
+	defer this.closeMu.Unlock()
 	if this.closePending != nil {
 		return this.closePending
 	}
 	this.closePending = promise.Async(func(resolve func(interface{}), reject func(interface{})) {
 		this.ActiveSession.stop()
-		resolve(nil)
+		this.closeMu.Lock()
 		this.closePending = nil
+		this.closeMu.Unlock()
+		resolve(nil)
 	})
 	return this.closePending
 }
 
 func (this *TcpClient) Connected() bool {
-	return this.isOpen
+	return atomic.LoadInt32(&this.isOpen) != 0
 }
 
 func (this *TcpClient) SetMessageHandler(handler func(msg *protocol.BinaryMessage)) {
@@ -166,21 +184,39 @@ func (this *TcpClient) SetMessageHandler(handler func(msg *protocol.BinaryMessag
 func (this *TcpClient) OnOpen(conn lokas.IConn) {
 	log.Warn("connected", flog.FuncInfo(this, "OnOpen").Append(flog.Address(this.addr))...)
 	this.Opening = false
-	this.isOpen = true
+	atomic.StoreInt32(&this.isOpen, 1)
 	this.Emit("open")
 }
 
+// OnRecv install the negotiated codec in the read loop before the following packets are read
+func (this *TcpClient) OnRecv(connect lokas.IConn, data []byte) {
+	if c, ok := this.codec.accept(data, this.Protocol); ok && this.conn != nil {
+		if c == nil {
+			this.conn.SetCodec(nil)
+		} else {
+			this.conn.SetCodec(c)
+		}
+	}
+	this.ActiveSession.OnRecv(connect, data)
+}
+
+// NegotiateCodec offer the compressions and optionally encryption to the gate and switch to the accepted codec,
+// should be called right after connected
+func (this *TcpClient) NegotiateCodec(compress []string, threshold int, encrypt bool) error {
+	return this.codec.negotiate(func(req interface{}) (interface{}, error) {
+		return this.Call(this.genId(), req)
+	}, compress, threshold, encrypt, this.CodecKey)
+}
+
 func (this *TcpClient) OnClose(conn lokas.IConn) {
 	log.Warn("disconnecting", flog.FuncInfo(this, "OnClose").Append(flog.Address(this.addr))...)
 	this.context = nil
 	this.openPending = nil
 	this.Opening = false
 	this.ActiveSession.stop()
-	this.ClearContext(errors.New("disconnect"))
-	if this.isOpen {
-		this.isOpen = false
+	this.ClearContext(ErrDisconnected)
+	if atomic.CompareAndSwapInt32(&this.isOpen, 1, 0) {
 		this.Disconnect(true).Await()
-		this.closePending = nil
 	}
 	this.conn.Close()
 	this.conn = nil
@@ -199,7 +235,7 @@ func (this *TcpClient) Request(req interface{}) *promise.Promise[interface{}] {
 			}
 		} else if !this.Connected() {
 			//log.Warn("connection closed",this)
-			reject(errors.New("connection closed"))
+			reject(ErrConnClosed)
 			return
 		}
 		id := this.genId()
@@ -233,6 +269,9 @@ func (this *TcpClient) MessageHandler(msg *protocol.BinaryMessage) {
 	log.Warnf("MessageHandler", id.String(), msg.TransId, id)
 	if msg.TransId != 0 {
 		ctx := this.GetContext(msg.TransId)
+		if ctx == nil {
+			return
+		}
 		ctx.SetResp(msg.Body)
 		ctx.Finish()
 	}
@@ -266,7 +305,10 @@ func (this *TcpClient) sendJsonMessage(transId uint32, msg interface{}) {
 		log.Error(err.Error())
 		return
 	}
-	this.conn.Write(rb)
+	err = this.write(rb)
+	if err != nil {
+		log.Error(err.Error())
+	}
 }
 
 func (this *TcpClient) sendBinaryMessage(transId uint32, msg interface{}) {
@@ -275,7 +317,74 @@ func (this *TcpClient) sendBinaryMessage(transId uint32, msg interface{}) {
 		log.Error(err.Error())
 		return
 	}
-	this.conn.Write(rb)
+	err = this.write(rb)
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// write the message,numbered with the piggybacked ack when reliable
+func (this *TcpClient) write(data []byte) error {
+	var err error
+	if this.Reliable != nil {
+		data, err = this.Reliable.Wrap(data, this.Protocol)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = this.conn.Write(data)
+	return err
+}
+
+// EnableReliable turn on the reliable layer,required by Resume,the gate should be configured reliable or resumable as well
+func (this *TcpClient) EnableReliable(bufferSize int) {
+	this.Reliable = NewReliableLink(bufferSize)
+}
+
+// Resume reconnect and resume the session on the gate,the requests not received by the gate are sent again
+func (this *TcpClient) Resume() *promise.Promise[interface{}] {
+	return promise.Async(func(resolve func(interface{}), reject func(interface{})) {
+		if this.Reliable == nil {
+			reject(protocol.ERR_SESSION_RESUME_FAILED)
+			return
+		}
+		req, ok := this.Reliable.ResumeMessage()
+		if !ok {
+			reject(protocol.ERR_SESSION_RESUME_FAILED)
+			return
+		}
+		_, err := this.Connect(this.addr).Await()
+		if err != nil {
+			reject(err)
+			return
+		}
+		resp, err := this.Call(this.genId(), req)
+		if err != nil {
+			log.Error(err.Error())
+			reject(err)
+			return
+		}
+		resumed, ok := resp.(*SessionResumed)
+		if !ok {
+			reject(protocol.ERR_SESSION_RESUME_FAILED)
+			return
+		}
+		datas, err := this.Reliable.OnResumed(resumed)
+		if err != nil {
+			log.Error(err.Error())
+			reject(err)
+			return
+		}
+		for _, data := range datas {
+			_, err = this.conn.Write(data)
+			if err != nil {
+				log.Error(err.Error())
+				reject(err)
+				return
+			}
+		}
+		resolve(resumed)
+	})
 }
 
 func (this *TcpClient) addContext(transId uint32, ctx lokas.IReqContext) {
@@ -315,7 +424,7 @@ func (this *TcpClient) doCall(ctx lokas.IReqContext, req interface{}) (interface
 		log.Error(err.Error())
 		return nil, err
 	}
-	_, err = this.conn.Write(rb)
+	err = this.write(rb)
 	if err != nil {
 		log.Error(err.Error())
 		return nil, err
@@ -327,7 +436,7 @@ func (this *TcpClient) doCall(ctx lokas.IReqContext, req interface{}) (interface
 			log.Warn("DeadlineExceeded", flog.FuncInfo(this, "doCall").
 				Append(flog.TransId(transId))...)
 			this.removeContext(transId)
-			if this.isOpen {
+			if this.Connected() {
 				this.Disconnect(false).Await()
 				go func() {
 					this.Connect(this.addr).Await()
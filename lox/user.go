@@ -1,11 +1,13 @@
 package lox
 
 import (
+	"context"
 	"github.com/nomos/go-lokas"
 	"github.com/nomos/go-lokas/log"
 	"github.com/nomos/go-lokas/log/flog"
 	"github.com/nomos/go-lokas/protocol"
 	"github.com/nomos/go-lokas/util"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.uber.org/zap"
 	"strconv"
 	"strings"
@@ -42,7 +44,10 @@ type User struct {
 	Token        string
 	RefreshToken string
 	UserName     string
-	Password     string
+	Password     string   //bcrypt hash of the password
+	State        AccState //the account state set by the admins
+	StateExpire  int64    //unix time the state ends,0 means forever
+	Version      int32    `bson:"_v" json:"-"` //the schema version of the document,see Migrator
 }
 
 func (this *User) Initialize(a lokas.IProcess) error {
@@ -54,11 +59,65 @@ func (this *User) GetId() util.ID {
 }
 
 func (this *User) Deserialize(a lokas.IProcess) error {
-	panic("implement me")
+	err := a.GetMongo().Collection(USER_COLLECTION).Find(context.TODO(), bson.M{"_id": this.Id}).One(this)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	if this.Avatars == nil {
+		this.Avatars = map[string]util.ID{}
+	}
+	return nil
 }
 
 func (this *User) Serialize(a lokas.IProcess) error {
-	panic("implement me")
+	_, err := a.GetMongo().Collection(USER_COLLECTION).UpsertId(context.TODO(), this.Id, this)
+	if err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+// GetAccState the state in effect,ACC_NORMAL after the state expired
+func (this *User) GetAccState() AccState {
+	if this.State != ACC_NORMAL && this.StateExpire != 0 && time.Now().Unix() >= this.StateExpire {
+		return ACC_NORMAL
+	}
+	return this.State
+}
+
+// CheckLogin reject the frozen and forbidden accounts
+func (this *User) CheckLogin() error {
+	switch this.GetAccState() {
+	case ACC_FROST:
+		return protocol.ERR_ACC_FROST
+	case ACC_FORBIDDEN:
+		return protocol.ERR_ACC_FORBIDDEN
+	}
+	return nil
+}
+
+// IsMuted the user is refused by the gate routes marked with mute,
+// the state is carried in the token so it takes effect on the next token
+func (this *User) IsMuted() bool {
+	return this.GetAccState() == ACC_MUTE
+}
+
+// ClaimUser the user carried by the tokens,without the password and the tokens
+func (this *User) ClaimUser() *User {
+	avatars := make(map[string]util.ID, len(this.Avatars))
+	for k, v := range this.Avatars {
+		avatars[k] = v
+	}
+	return &User{
+		Id:          this.Id,
+		Role:        this.Role,
+		Avatars:     avatars,
+		UserName:    this.UserName,
+		State:       this.State,
+		StateExpire: this.StateExpire,
+	}
 }
 
 func (this *User) SimpleUser() *User {
@@ -68,6 +127,11 @@ func (this *User) SimpleUser() *User {
 	}
 }
 
+// ServerKey the key of User.Avatars
+func ServerKey(gameId string, serverId int32) string {
+	return gameId + "_" + strconv.Itoa(int(serverId))
+}
+
 func (this *User) GetServerInfo(s string) (string, int32) {
 	sarr := strings.Split(s, "_")
 	gameId := sarr[0]
@@ -98,6 +162,7 @@ type ClaimUser struct {
 	Create time.Time
 	Expire int64
 	User   *User
+	Type   string `json:",omitempty"` //TOKEN_ACCESS or TOKEN_REFRESH
 }
 
 func (this *ClaimUser) Valid() error {
@@ -116,6 +181,14 @@ func (this *ClaimUser) Unmarshal(v []byte) error {
 	return protocol.Unmarshal(v, this)
 }
 
+func (this *ClaimUser) GetTokenType() string {
+	return this.Type
+}
+
+func (this *ClaimUser) SetTokenType(t string) {
+	this.Type = t
+}
+
 func (this *ClaimUser) SetUser(user interface{}) {
 	this.User = user.(*User)
 }
@@ -2,7 +2,8 @@ package lox
 
 import (
 	"context"
-	"errors"
+	"crypto/ed25519"
+	"crypto/tls"
 	"net/http"
 	"strconv"
 	"strings"
@@ -13,6 +14,7 @@ import (
 	"github.com/nomos/go-lokas"
 	"github.com/nomos/go-lokas/log"
 	"github.com/nomos/go-lokas/network"
+	"github.com/nomos/go-lokas/network/codec"
 	"github.com/nomos/go-lokas/protocol"
 	"github.com/nomos/go-lokas/util/events"
 	"github.com/nomos/go-lokas/util/promise"
@@ -35,6 +37,13 @@ type WsClient struct {
 	Opening        bool
 	Protocol       protocol.TYPE
 	MsgHandler     func(msg *protocol.BinaryMessage)
+	Reliable       *ReliableLink
+	codec          clientCodec
+	packetCodec    lokas.PacketCodec
+	codecMu        sync.Mutex
+	TLSConfig      *tls.Config       //used for wss://,the system roots are used if nil
+	CodecKey       ed25519.PublicKey //the public key of the gate verifying the key exchange,required to encrypt
+	writeMu        sync.Mutex        //number,encode and queue the messages in order
 	done           chan struct{}
 	contextMutex   sync.Mutex
 	openingPending *promise.Promise[interface{}]
@@ -65,13 +74,32 @@ func (this *WsClient) genId() uint32 {
 }
 
 func (this *WsClient) OnRecv(conn lokas.IConn, data []byte) {
+	if c, ok := this.codec.accept(data, this.Protocol); ok {
+		this.setPacketCodec(c)
+	}
 	cmdId := protocol.GetCmdId16(data)
 	msg, err := protocol.UnmarshalMessage(data, this.Protocol)
 	if err != nil {
 		log.Error("unmarshal client message error", protocol.LogCmdId(cmdId))
 		return
 	}
-
+	if this.Reliable != nil {
+		msg, err = this.Reliable.Unwrap(msg, this.Protocol)
+		if err != nil {
+			log.Error(err.Error())
+			return
+		}
+		if ack := this.Reliable.PendingAck(this.Protocol); ack != nil && this.ws != nil {
+			err = this.write(ack, false)
+			if err != nil {
+				log.Error(err.Error())
+				return
+			}
+		}
+		if msg == nil {
+			return
+		}
+	}
 	this.handleMsg(msg)
 }
 
@@ -97,13 +125,22 @@ func (this *WsClient) MessageHandler(msg *protocol.BinaryMessage) {
 	log.Warnf("MessageHandler", id.String(), msg.TransId, id)
 	if msg.TransId != 0 {
 		ctx := this.GetContext(msg.TransId)
+		if ctx == nil {
+			return
+		}
 		ctx.SetResp(msg.Body)
 		ctx.Finish()
 	}
 }
 
 func (this *WsClient) Connect(addr string) *promise.Promise[interface{}] {
-	addr = "ws://" + addr + "/ws"
+	if !strings.HasPrefix(addr, "ws://") && !strings.HasPrefix(addr, "wss://") {
+		if this.TLSConfig != nil {
+			addr = "wss://" + addr + "/ws"
+		} else {
+			addr = "ws://" + addr + "/ws"
+		}
+	}
 	if this.addr != "" && this.addr != addr {
 		return this.Close().Catch(func(err error) interface{} {
 			log.Error(err.Error())
@@ -121,7 +158,7 @@ func (this *WsClient) ClearContext() {
 	this.contextMutex.Lock()
 	defer this.contextMutex.Unlock()
 	for _, v := range this.reqContexts {
-		v.Cancel(errors.New("clear context"))
+		v.Cancel(ErrDisconnected)
 	}
 }
 
@@ -212,6 +249,8 @@ func (this *WsClient) Close() *promise.Promise[interface{}] {
 
 func (this *WsClient) OnOpen(conn *websocket.Conn) {
 	this.conn = this.ws.Conn
+	this.codec.cancel()
+	this.setPacketCodec(nil)
 	this.Opening = false
 	log.Warn(this.addr + " connected")
 	this.isOpen = true
@@ -259,7 +298,7 @@ func (this *WsClient) sendJsonMessage(transId uint32, msg interface{}) {
 		log.Error(err.Error())
 		return
 	}
-	err = this.conn.WriteMessage(websocket.BinaryMessage, rb)
+	err = this.write(rb, true)
 	if err != nil {
 		log.Error(err.Error())
 	}
@@ -271,7 +310,131 @@ func (this *WsClient) sendBinaryMessage(transId uint32, msg interface{}) {
 		log.Error(err.Error())
 		return
 	}
-	this.conn.WriteMessage(websocket.BinaryMessage, rb)
+	err = this.write(rb, true)
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// write queue the message to the write pump,numbered by wrap if wrap is set,or encoded only,
+// so that the seq of the reliable link and the codec are in the order written
+func (this *WsClient) write(data []byte, wrap bool) error {
+	this.writeMu.Lock()
+	defer this.writeMu.Unlock()
+	var err error
+	if wrap {
+		data, err = this.wrap(data)
+	} else {
+		data, err = this.encode(data)
+	}
+	if err != nil {
+		return err
+	}
+	this.ws.writeChan <- data
+	return nil
+}
+
+// wrap number the message with the piggybacked ack when reliable,and encode it by the negotiated codec
+func (this *WsClient) wrap(data []byte) ([]byte, error) {
+	if this.Reliable != nil {
+		var err error
+		data, err = this.Reliable.Wrap(data, this.Protocol)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return this.encode(data)
+}
+
+func (this *WsClient) setPacketCodec(c *codec.Codec) {
+	this.codecMu.Lock()
+	defer this.codecMu.Unlock()
+	if c == nil {
+		this.packetCodec = nil
+		return
+	}
+	this.packetCodec = c
+}
+
+func (this *WsClient) getPacketCodec() lokas.PacketCodec {
+	this.codecMu.Lock()
+	defer this.codecMu.Unlock()
+	return this.packetCodec
+}
+
+func (this *WsClient) encode(data []byte) ([]byte, error) {
+	c := this.getPacketCodec()
+	if c == nil {
+		return data, nil
+	}
+	return c.Encode(data)
+}
+
+func (this *WsClient) decode(data []byte) ([]byte, error) {
+	c := this.getPacketCodec()
+	if c == nil {
+		return (*codec.Codec)(nil).Decode(data)
+	}
+	return c.Decode(data)
+}
+
+// NegotiateCodec offer the compressions and optionally encryption to the gate and switch to the accepted codec,
+// should be called right after opened
+func (this *WsClient) NegotiateCodec(compress []string, threshold int, encrypt bool) error {
+	return this.codec.negotiate(func(req interface{}) (interface{}, error) {
+		return this.Call(this.genId(), req)
+	}, compress, threshold, encrypt, this.CodecKey)
+}
+
+// EnableReliable turn on the reliable layer,required by Resume,the gate should be configured reliable or resumable as well
+func (this *WsClient) EnableReliable(bufferSize int) {
+	this.Reliable = NewReliableLink(bufferSize)
+}
+
+// Resume reopen the connection and resume the session on the gate,the requests not received by the gate are sent again
+func (this *WsClient) Resume() *promise.Promise[interface{}] {
+	return promise.Async(func(resolve func(interface{}), reject func(interface{})) {
+		if this.Reliable == nil {
+			reject(protocol.ERR_SESSION_RESUME_FAILED)
+			return
+		}
+		req, ok := this.Reliable.ResumeMessage()
+		if !ok {
+			reject(protocol.ERR_SESSION_RESUME_FAILED)
+			return
+		}
+		_, err := this.Open().Await()
+		if err != nil {
+			reject(err)
+			return
+		}
+		resp, err := this.Call(this.genId(), req)
+		if err != nil {
+			log.Error(err.Error())
+			reject(err)
+			return
+		}
+		resumed, ok := resp.(*SessionResumed)
+		if !ok {
+			reject(protocol.ERR_SESSION_RESUME_FAILED)
+			return
+		}
+		datas, err := this.Reliable.OnResumed(resumed)
+		if err != nil {
+			log.Error(err.Error())
+			reject(err)
+			return
+		}
+		for _, data := range datas {
+			err = this.write(data, false)
+			if err != nil {
+				log.Error(err.Error())
+				reject(err)
+				return
+			}
+		}
+		resolve(resumed)
+	})
 }
 
 func (this *WsClient) addContext(transId uint32, ctx lokas.IReqContext) {
@@ -306,7 +469,7 @@ func (this *WsClient) Request(req interface{}) *promise.Promise[interface{}] {
 			}
 		} else if !this.Connected() {
 			//log.Warn("connection closed",this)
-			reject(errors.New("connection closed"))
+			reject(ErrConnClosed)
 			return
 		}
 		id := this.genId()
@@ -343,7 +506,11 @@ func (this *WsClient) doCall(ctx lokas.IReqContext, req interface{}, isSync bool
 		log.Error(err.Error())
 		return nil, err
 	}
-	this.ws.writeChan <- rb
+	err = this.write(rb, true)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
 	if !isSync {
 		return nil, nil
 	}
@@ -450,7 +617,13 @@ func NewWebSocket(url string, client *WsClient, p protocol.TYPE) (*wsImpl, error
 		writeChan: make(chan []byte),
 	}
 
-	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	dialer := websocket.DefaultDialer
+	if strings.HasPrefix(url, "wss://") && client != nil && client.TLSConfig != nil {
+		d := *websocket.DefaultDialer
+		d.TLSClientConfig = client.TLSConfig
+		dialer = &d
+	}
+	conn, _, err := dialer.Dial(url, nil)
 	if err != nil {
 		log.Error(err.Error())
 		return nil, err
@@ -519,6 +692,11 @@ func (this *wsImpl) readPump() {
 			data := this.readLongPacket(message)
 			log.Infof(len(data))
 			if data != nil {
+				data, err = this.client.decode(data)
+				if err != nil {
+					log.Error("decode packet failed", zap.Error(err))
+					return
+				}
 				this.client.OnRecv(nil, data)
 			}
 		}
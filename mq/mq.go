@@ -38,6 +38,11 @@ func Instance() *MsgQueue {
 	return ins
 }
 
+// IsConnected return whether the nats connection is initialized
+func IsConnected() bool {
+	return ins != nil
+}
+
 func Init(config lokas.IConfig) error {
 
 	if config == nil || config.Sub("db") == nil || config.Sub("db").Sub("nats") == nil {
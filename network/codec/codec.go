@@ -0,0 +1,322 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// encoded packet: len(2) transId(4)=0 cmdId(2)=TAG_CODEC flags(1) payload,
+// flags tell the compression and whether the payload is encrypted,so the packets are decoded without negotiation state except the key,
+// the encrypted payload is seq(8) sealed,seq counts the packets of the direction and is the nonce,so the replayed packets are refused
+const (
+	TAG_CODEC   = 49 //protocol.TAG_Codec
+	HEADER_SIZE = 9
+	MAX_LEN     = 65535
+
+	FLAG_GZIP      = 1
+	FLAG_SNAPPY    = 2
+	FLAG_COMPRESS  = 3
+	FLAG_ENCRYPTED = 0x80
+	SEQ_SIZE       = 8
+
+	COMPRESS_NONE   = ""
+	COMPRESS_GZIP   = "gzip"
+	COMPRESS_SNAPPY = "snappy"
+
+	DefaultThreshold = 1024
+	MAX_DECODED_LEN  = 8 * 1024 * 1024 //conn.ProtectLongPacketSize,the longest message read from a connection
+)
+
+var (
+	ErrFormat      = errors.New("codec: invalid packet")
+	ErrNoKey       = errors.New("codec: encrypted packet without key")
+	ErrPlaintext   = errors.New("codec: plaintext packet on encrypted connection")
+	ErrUnsupported = errors.New("codec: unsupported compression")
+	ErrTooLarge    = errors.New("codec: decoded packet too large")
+	ErrReplayed    = errors.New("codec: replayed packet")
+)
+
+// Supported the compressions in the order of preference
+func Supported() []string {
+	return []string{COMPRESS_SNAPPY, COMPRESS_GZIP}
+}
+
+// Pick the first offered compression supported
+func Pick(offered []string) string {
+	for _, c := range offered {
+		if c == COMPRESS_SNAPPY || c == COMPRESS_GZIP {
+			return c
+		}
+	}
+	return COMPRESS_NONE
+}
+
+// Codec compress the packets above Threshold and encrypt all the packets if the keys are set,
+// safe for concurrent use,but the packets must be written in the order encoded since the peer refuses the seq not increasing
+type Codec struct {
+	Compress  string
+	Threshold int
+	sealer    cipher.AEAD
+	opener    cipher.AEAD
+	sendSeq   uint64
+	recvSeq   uint64
+	recvMu    sync.Mutex
+}
+
+// New create the codec,send and recv are the 32 bytes AES-256-GCM keys of the two directions from SessionKeys,
+// nil for no encryption
+func New(compress string, threshold int, send []byte, recv []byte) (*Codec, error) {
+	if compress != COMPRESS_NONE && compress != COMPRESS_GZIP && compress != COMPRESS_SNAPPY {
+		return nil, ErrUnsupported
+	}
+	if (send == nil) != (recv == nil) {
+		return nil, ErrNoKey
+	}
+	if threshold <= 0 {
+		threshold = DefaultThreshold
+	}
+	ret := &Codec{
+		Compress:  compress,
+		Threshold: threshold,
+	}
+	if send != nil {
+		var err error
+		ret.sealer, err = newAEAD(send)
+		if err != nil {
+			return nil, err
+		}
+		ret.opener, err = newAEAD(recv)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (this *Codec) Encrypted() bool {
+	return this != nil && this.sealer != nil
+}
+
+// nonce the seq in the last 8 bytes,each direction has its own key so the nonces never repeat under a key
+func (this *Codec) nonce(seq uint64) []byte {
+	ret := make([]byte, this.sealer.NonceSize())
+	binary.BigEndian.PutUint64(ret[len(ret)-SEQ_SIZE:], seq)
+	return ret
+}
+
+// IsEncoded whether the packet is encoded by a codec
+func IsEncoded(data []byte) bool {
+	return len(data) >= HEADER_SIZE && binary.LittleEndian.Uint16(data[6:8]) == TAG_CODEC
+}
+
+// Encode return the packet as is when there is nothing to do
+func (this *Codec) Encode(data []byte) ([]byte, error) {
+	if this == nil {
+		return data, nil
+	}
+	var flags byte
+	payload := data
+	if this.Compress != COMPRESS_NONE && len(data) >= this.Threshold {
+		compressed, flag, err := compress(this.Compress, data)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(data) {
+			payload = compressed
+			flags |= flag
+		}
+	}
+	if this.sealer != nil {
+		flags |= FLAG_ENCRYPTED
+		seq := atomic.AddUint64(&this.sendSeq, 1)
+		sealed := make([]byte, SEQ_SIZE, SEQ_SIZE+len(payload)+this.sealer.Overhead())
+		binary.BigEndian.PutUint64(sealed, seq)
+		payload = this.sealer.Seal(sealed, this.nonce(seq), payload, []byte{flags})
+	}
+	if flags == 0 {
+		return data, nil
+	}
+	out := make([]byte, HEADER_SIZE+len(payload))
+	n := len(out)
+	if n > MAX_LEN {
+		n = 0 //only carried in long packets
+	}
+	binary.LittleEndian.PutUint16(out[0:2], uint16(n))
+	binary.LittleEndian.PutUint16(out[6:8], TAG_CODEC)
+	out[8] = flags
+	copy(out[HEADER_SIZE:], payload)
+	return out, nil
+}
+
+// Decode return the packet as is if it is not encoded,a nil codec decodes the packets not encrypted,
+// the packets not encrypted are rejected once encryption is on
+func (this *Codec) Decode(data []byte) ([]byte, error) {
+	if !IsEncoded(data) {
+		if this.Encrypted() {
+			return nil, ErrPlaintext
+		}
+		return data, nil
+	}
+	flags := data[8]
+	payload := data[HEADER_SIZE:]
+	if flags&FLAG_ENCRYPTED == 0 && this.Encrypted() {
+		return nil, ErrPlaintext
+	}
+	if flags&FLAG_ENCRYPTED != 0 {
+		if !this.Encrypted() {
+			return nil, ErrNoKey
+		}
+		var err error
+		payload, err = this.open(flags, payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch flags & FLAG_COMPRESS {
+	case 0:
+		return payload, nil
+	case FLAG_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		ret, err := io.ReadAll(io.LimitReader(r, MAX_DECODED_LEN+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(ret) > MAX_DECODED_LEN {
+			return nil, ErrTooLarge
+		}
+		return ret, nil
+	case FLAG_SNAPPY:
+		n, err := snappy.DecodedLen(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n > MAX_DECODED_LEN {
+			return nil, ErrTooLarge
+		}
+		return snappy.Decode(nil, payload)
+	default:
+		return nil, ErrUnsupported
+	}
+}
+
+// open decrypt the payload,the seq must be greater than the last one opened
+func (this *Codec) open(flags byte, payload []byte) ([]byte, error) {
+	if len(payload) < SEQ_SIZE {
+		return nil, ErrFormat
+	}
+	seq := binary.BigEndian.Uint64(payload)
+	this.recvMu.Lock()
+	defer this.recvMu.Unlock()
+	if seq <= this.recvSeq {
+		return nil, ErrReplayed
+	}
+	ret, err := this.opener.Open(nil, this.nonce(seq), payload[SEQ_SIZE:], []byte{flags})
+	if err != nil {
+		return nil, err
+	}
+	this.recvSeq = seq
+	return ret, nil
+}
+
+func compress(c string, data []byte) ([]byte, byte, error) {
+	switch c {
+	case COMPRESS_GZIP:
+		var b bytes.Buffer
+		w, _ := gzip.NewWriterLevel(&b, gzip.BestSpeed)
+		_, err := w.Write(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, 0, err
+		}
+		return b.Bytes(), FLAG_GZIP, nil
+	case COMPRESS_SNAPPY:
+		return snappy.Encode(nil, data), FLAG_SNAPPY, nil
+	}
+	return nil, 0, ErrUnsupported
+}
+
+// KeyPair the x25519 key pair of one side of the key exchange
+type KeyPair struct {
+	Private []byte
+	Public  []byte
+}
+
+func GenerateKey() (*KeyPair, error) {
+	private := make([]byte, curve25519.ScalarSize)
+	_, err := rand.Read(private)
+	if err != nil {
+		return nil, err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{Private: private, Public: public}, nil
+}
+
+// SessionKeys derive the 32 bytes keys of the two directions from the public key of the peer,
+// both the public keys are bound into the keys,server tells the side of this key pair
+func (this *KeyPair) SessionKeys(peer []byte, server bool) ([]byte, []byte, error) {
+	secret, err := curve25519.X25519(this.Private, peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, srv := this.Public, peer
+	if server {
+		client, srv = peer, this.Public
+	}
+	keys := make([]byte, 64)
+	_, err = io.ReadFull(hkdf.New(sha256.New, secret, nil, exchangeInfo(client, srv)), keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	//the first key encrypts from the client,the second from the server
+	if server {
+		return keys[32:], keys[:32], nil
+	}
+	return keys[:32], keys[32:], nil
+}
+
+func exchangeInfo(client []byte, server []byte) []byte {
+	ret := append([]byte("lokas codec"), client...)
+	return append(ret, server...)
+}
+
+// SignExchange sign the public keys of the exchange by the static key of the server,
+// the clients verify it with the public key known beforehand,so a man in the middle can not substitute the keys
+func SignExchange(key ed25519.PrivateKey, client []byte, server []byte) []byte {
+	return ed25519.Sign(key, exchangeInfo(client, server))
+}
+
+func VerifyExchange(key ed25519.PublicKey, client []byte, server []byte, sig []byte) bool {
+	return len(key) == ed25519.PublicKeySize && ed25519.Verify(key, exchangeInfo(client, server), sig)
+}
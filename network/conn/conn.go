@@ -7,6 +7,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/nomos/go-lokas/network/codec"
 	"github.com/nomos/go-lokas/network/internal/hub"
 	"github.com/nomos/go-lokas/network/netstat"
 )
@@ -36,6 +37,8 @@ type Conn struct {
 	stat      *netstat.NetStat
 	done      chan struct{}
 	closeOnce sync.Once
+	codec     lokas.PacketCodec
+	codecMu   sync.RWMutex
 }
 
 var errConnClosed = errors.New("connection already closed")
@@ -49,6 +52,7 @@ func newConn(c net.Conn, context *lokas.Context, msgChan MessageChan, hub *hub.H
 		hub:      hub,
 		ConnTime: time.Now(),
 		done:     done,
+		codec:    context.Codec,
 	}
 	if context.SessionCreator != nil {
 		conn.Session = context.SessionCreator(conn)
@@ -106,13 +110,68 @@ func (this *Conn) ServeIO() {
 	}()
 }
 
+// SetCodec replace the codec of the connection,the data written before is not affected
+func (this *Conn) SetCodec(c lokas.PacketCodec) {
+	this.codecMu.Lock()
+	defer this.codecMu.Unlock()
+	this.codec = c
+}
+
+func (this *Conn) GetCodec() lokas.PacketCodec {
+	this.codecMu.RLock()
+	defer this.codecMu.RUnlock()
+	return this.codec
+}
+
+// SwitchCodec write data with the current codec and replace the codec atomically,
+// so that the peer answering data is always decoded with the new one
+func (this *Conn) SwitchCodec(data []byte, c lokas.PacketCodec) error {
+	this.codecMu.Lock()
+	defer this.codecMu.Unlock()
+	var err error
+	if this.codec != nil {
+		data, err = this.codec.Encode(data)
+		if err != nil {
+			return err
+		}
+	}
+	select {
+	case this.inChan <- data:
+	case <-this.done:
+		return errConnClosed
+	}
+	this.codec = c
+	return nil
+}
+
+// decode the packet read,the packets not encrypted are decoded without a codec
+func (this *Conn) decode(data []byte) ([]byte, error) {
+	c := this.GetCodec()
+	if c == nil {
+		return (*codec.Codec)(nil).Decode(data)
+	}
+	return c.Decode(data)
+}
+
 func (this *Conn) Write(data []byte) (int, error) {
 	// if data == nil {
 	// 	return 0, nil
 	// }
+	//encode before queued,so that the codec changes take effect in order,
+	//and encode and queue under the lock,so that the packets are queued in the order of their seq
+	n := len(data)
+	this.codecMu.Lock()
+	defer this.codecMu.Unlock()
+	if this.codec != nil && data != nil {
+		encoded, err := this.codec.Encode(data)
+		if err != nil {
+			return 0, err
+		}
+		data = encoded
+	}
 	select {
 	case this.inChan <- data:
-		return len(data), nil
+		return n, nil
 	case <-this.done:
 		return 0, errConnClosed
 	}
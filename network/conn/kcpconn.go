@@ -0,0 +1,33 @@
+package conn
+
+import (
+	"net"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/network/internal/hub"
+)
+
+// NewKcpConn create a conn on a kcp session,kcp is a stream like tcp so the tcp pumper is shared
+func NewKcpConn(c net.Conn, context *lokas.Context, hub *hub.Hub) *Conn {
+	done := make(chan struct{})
+	msgChan := NewMessageChan(context.UseNoneBlockingChan, context.ChanSize, done)
+	conn := newConn(c, context, msgChan, hub, done)
+	readBuffSize := DefaultReadBuffSize
+	mergedWriteBuffSize := MinMergedWriteBuffSize
+	if context.ReadBufferSize > 0 {
+		readBuffSize = context.ReadBufferSize
+	}
+	if context.MergedWriteBufferSize > mergedWriteBuffSize {
+		mergedWriteBuffSize = context.MergedWriteBufferSize
+	}
+	conn.ioPumper = &TcpPumper{
+		done:                done,
+		readBuffSize:        readBuffSize,
+		mergedWriteBuffSize: mergedWriteBuffSize,
+		disableMergedWrite:  context.DisableMergedWrite,
+		longPacketPicker:    context.LongPacketPicker,
+		longPacketCreator:   context.LongPacketCreator,
+		maxPacketWriteLen:   context.MaxPacketWriteLen,
+	}
+	return conn
+}
@@ -2,6 +2,7 @@ package conn
 
 import (
 	"bufio"
+	"crypto/tls"
 	"net"
 	"time"
 
@@ -45,8 +46,14 @@ func NewTcpConn(c net.Conn, context *lokas.Context, hub *hub.Hub) *Conn {
 	if context.MergedWriteBufferSize > mergedWriteBuffSize {
 		mergedWriteBuffSize = context.MergedWriteBufferSize
 	}
-	c.(*net.TCPConn).SetReadBuffer(readBuffSize)
-	c.(*net.TCPConn).SetWriteBuffer(writeBuffSize)
+	tcpConn := c
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		tcpConn = tlsConn.NetConn()
+	}
+	if tc, ok := tcpConn.(*net.TCPConn); ok {
+		tc.SetReadBuffer(readBuffSize)
+		tc.SetWriteBuffer(writeBuffSize)
+	}
 	conn.ioPumper = &TcpPumper{
 		done:                done,
 		readBuffSize:        readBuffSize,
@@ -74,7 +81,12 @@ func (this *TcpPumper) readPump(conn *Conn) {
 			}
 
 			if data != nil {
-				conn.Session.OnRecv(conn, data)
+				decoded, err := conn.decode(data)
+				if err != nil {
+					log.Error("decode packet failed", zap.Error(err))
+					break
+				}
+				conn.Session.OnRecv(conn, decoded)
 			}
 
 			if stat != nil {
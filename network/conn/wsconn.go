@@ -94,7 +94,12 @@ func (this *WsPumper) readPump(conn *Conn) {
 		}
 
 		if data != nil {
-			conn.Session.OnRecv(conn, data)
+			decoded, err := conn.decode(data)
+			if err != nil {
+				log.Error("decode packet failed", zap.Error(err))
+				break
+			}
+			conn.Session.OnRecv(conn, decoded)
 		}
 
 		if stat != nil {
@@ -1,6 +1,7 @@
 package httpserver
 
 import (
+	"crypto/tls"
 	"net"
 	"net/http"
 	"sync"
@@ -37,6 +38,22 @@ func (this *HttpServer) Start(netAddr string) error {
 	return nil
 }
 
+// StartTLS start a https server with the tls config
+func (this *HttpServer) StartTLS(netAddr string, config *tls.Config) error {
+	l, err := net.Listen("tcp", netAddr)
+	if err != nil {
+		return err
+	}
+	this.listener = tls.NewListener(l, config)
+
+	this.wg.Add(1)
+	go func() {
+		this.serve()
+		this.wg.Done()
+	}()
+	return nil
+}
+
 func (this *HttpServer) Stop() {
 	this.closing = true
 	if this.listener != nil {
@@ -0,0 +1,16 @@
+package kcp
+
+import (
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/network/conn"
+)
+
+func Dial(addr string, ctx *lokas.Context) (*conn.Conn, error) {
+	sess, err := DialSession(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := conn.NewKcpConn(sess, ctx, nil)
+	conn.ServeIO()
+	return conn, nil
+}
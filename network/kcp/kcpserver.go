@@ -0,0 +1,87 @@
+package kcp
+
+import (
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/log/flog"
+	"github.com/nomos/go-lokas/network/conn"
+	"github.com/nomos/go-lokas/network/internal/hub"
+	"github.com/nomos/go-lokas/util"
+)
+
+var _ lokas.Server = (*Server)(nil)
+
+type Server struct {
+	Context  *lokas.Context
+	hub      *hub.Hub
+	listener *Listener
+}
+
+// NewServer create a new kcp server
+func NewServer(context *lokas.Context) *Server {
+	if context == nil || context.SessionCreator == nil || context.Splitter == nil {
+		panic("kcpserver.NewServer: context.SessionCreator is nil or context.Splitter is nil")
+	}
+
+	server := &Server{
+		Context: context,
+		hub:     hub.NewHub(context.IdleTimeAfterOpen),
+	}
+	return server
+}
+
+// Start start kcp server
+func (this *Server) Start(addr string) error {
+	l, err := Listen(addr)
+	if err != nil {
+		return err
+	}
+	this.listener = l
+	go this.serve()
+	return nil
+}
+
+func (this *Server) serve() {
+	l := this.listener
+	for {
+		sess, err := l.Accept()
+		if err != nil {
+			if err != errListenerClosed {
+				log.Info("kcpserver: listener.Accept() error", flog.Error(err))
+			}
+			break
+		}
+		if !this.Context.AllowAddr(sess.RemoteAddr().String()) {
+			sess.Close()
+			continue
+		}
+		conn := conn.NewKcpConn(sess, this.Context, this.hub)
+		conn.ServeIO()
+	}
+}
+
+// Stop stop kcp server
+func (this *Server) Stop() {
+	if this.listener != nil {
+		this.listener.Close()
+	}
+	this.hub.Stop()
+}
+
+// Addr return the listening address,nil if not started
+func (this *Server) Addr() string {
+	if this.listener == nil {
+		return ""
+	}
+	return this.listener.Addr().String()
+}
+
+// Broadcast broadcast data to all active connections
+func (this *Server) Broadcast(sessionIds []util.ID, data []byte) {
+	this.hub.Broadcast(sessionIds, data)
+}
+
+// GetActiveConnNum get count of active connections
+func (this *Server) GetActiveConnNum() int {
+	return this.hub.GetActiveConnNum()
+}
@@ -0,0 +1,185 @@
+package kcp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/log/flog"
+)
+
+var errListenerClosed = errors.New("kcp: listener closed")
+
+// Listener demultiplex the datagrams of a packet conn into sessions by remote address
+type Listener struct {
+	conn      net.PacketConn
+	mu        sync.Mutex
+	sessions  map[string]*Session
+	accept    chan *Session
+	die       chan struct{}
+	closeOnce sync.Once
+}
+
+// Listen listen on the udp address
+func Listen(addr string) (*Listener, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(conn), nil
+}
+
+// NewListener serve sessions on an existing packet conn
+func NewListener(conn net.PacketConn) *Listener {
+	l := &Listener{
+		conn:     conn,
+		sessions: map[string]*Session{},
+		accept:   make(chan *Session, 128),
+		die:      make(chan struct{}),
+	}
+	go l.readLoop()
+	return l
+}
+
+func (this *Listener) readLoop() {
+	buf := make([]byte, MTU*2)
+	for {
+		n, addr, err := this.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-this.die:
+			default:
+				log.Info("kcp: listener ReadFrom() error", flog.Error(err))
+				this.Close()
+			}
+			return
+		}
+		if n < headerSize {
+			continue
+		}
+		this.input(buf[:n], addr)
+	}
+}
+
+func (this *Listener) input(data []byte, addr net.Addr) {
+	conv := binary.LittleEndian.Uint32(data[0:4])
+	key := addr.String()
+	this.mu.Lock()
+	sess, ok := this.sessions[key]
+	if ok && sess.conv != conv {
+		//the peer restarted with a new conversation
+		delete(this.sessions, key)
+		go sess.Close()
+		ok = false
+	}
+	if !ok {
+		if data[4] != cmdPush {
+			this.mu.Unlock()
+			return
+		}
+		var s *Session
+		s = newSession(conv, this.conn.LocalAddr(), addr, func(data []byte) error {
+			_, err := this.conn.WriteTo(data, addr)
+			return err
+		}, func() {
+			this.remove(key, s)
+		})
+		sess = s
+		this.sessions[key] = sess
+		select {
+		case this.accept <- sess:
+		default:
+			delete(this.sessions, key)
+			this.mu.Unlock()
+			log.Warn("kcp: accept backlog full")
+			go sess.Close()
+			return
+		}
+	}
+	this.mu.Unlock()
+	sess.input(data)
+}
+
+func (this *Listener) remove(key string, sess *Session) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.sessions[key] == sess {
+		delete(this.sessions, key)
+	}
+}
+
+// Accept wait for the next session
+func (this *Listener) Accept() (*Session, error) {
+	select {
+	case sess := <-this.accept:
+		return sess, nil
+	case <-this.die:
+		return nil, errListenerClosed
+	}
+}
+
+// Close stop the listener,the accepted sessions are kept until they are closed
+func (this *Listener) Close() error {
+	var err error
+	this.closeOnce.Do(func() {
+		close(this.die)
+		err = this.conn.Close()
+	})
+	return err
+}
+
+func (this *Listener) Addr() net.Addr {
+	return this.conn.LocalAddr()
+}
+
+// DialSession open a session to the udp address
+func DialSession(addr string) (*Session, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	var b [4]byte
+	_, err = rand.Read(b[:])
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sess := newSession(binary.LittleEndian.Uint32(b[:]), conn.LocalAddr(), conn.RemoteAddr(), func(data []byte) error {
+		_, err := conn.Write(data)
+		return err
+	}, func() {
+		conn.Close()
+	})
+	go func() {
+		buf := make([]byte, MTU*2)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				select {
+				case <-sess.die:
+				default:
+					sess.mu.Lock()
+					if sess.err == nil {
+						sess.err = err
+					}
+					sess.mu.Unlock()
+					notify(sess.readEvent)
+				}
+				return
+			}
+			sess.input(buf[:n])
+		}
+	}()
+	return sess, nil
+}
@@ -0,0 +1,470 @@
+package kcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// a minimal kcp-style arq over udp,every datagram contains one or more segments:
+// conv(4) cmd(1) sn(4) una(4) len(2) data(len)
+const (
+	cmdPush uint8 = 1
+	cmdAck  uint8 = 2
+	cmdFin  uint8 = 3
+
+	headerSize = 15
+	MTU        = 1400
+	MSS        = MTU - headerSize
+
+	SendWindow  = 256
+	RecvWindow  = 256
+	Interval    = 10 * time.Millisecond
+	IdleTimeout = 60 * time.Second
+	LingerTime  = time.Second
+
+	rtoMin     = 30 * time.Millisecond
+	rtoDefault = 200 * time.Millisecond
+	rtoMax     = 5 * time.Second
+	deadLink   = 20
+)
+
+var (
+	ErrDeadLink = errors.New("kcp: dead link")
+	ErrTimeout  = &timeoutError{}
+	errClosed   = errors.New("kcp: use of closed session")
+)
+
+type timeoutError struct{}
+
+func (this *timeoutError) Error() string   { return "kcp: i/o timeout" }
+func (this *timeoutError) Timeout() bool   { return true }
+func (this *timeoutError) Temporary() bool { return true }
+
+type segment struct {
+	sn       uint32
+	data     []byte
+	xmit     int
+	sentAt   time.Time
+	resendAt time.Time
+}
+
+var _ net.Conn = (*Session)(nil)
+
+// Session a reliable ordered byte stream over udp,implements net.Conn
+type Session struct {
+	conv   uint32
+	local  net.Addr
+	remote net.Addr
+	output func(data []byte) error
+	onDie  func()
+
+	mu       sync.Mutex
+	sndQueue []*segment
+	sndBuf   []*segment
+	sndNxt   uint32
+	rcvNxt   uint32
+	rcvBuf   map[uint32][]byte
+	readBuf  bytes.Buffer
+	acks     []uint32
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+	lastRecv time.Time
+	eof      bool
+	err      error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readEvent  chan struct{}
+	writeEvent chan struct{}
+	die        chan struct{}
+	closeOnce  sync.Once
+}
+
+func newSession(conv uint32, local, remote net.Addr, output func(data []byte) error, onDie func()) *Session {
+	s := &Session{
+		conv:       conv,
+		local:      local,
+		remote:     remote,
+		output:     output,
+		onDie:      onDie,
+		rcvBuf:     map[uint32][]byte{},
+		rto:        rtoDefault,
+		lastRecv:   time.Now(),
+		readEvent:  make(chan struct{}, 1),
+		writeEvent: make(chan struct{}, 1),
+		die:        make(chan struct{}),
+	}
+	go s.update()
+	return s
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+func deadlineTimer(t time.Time) (<-chan time.Time, func()) {
+	if t.IsZero() {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(time.Until(t))
+	return timer.C, func() { timer.Stop() }
+}
+
+// Conv return the conversation id of the session
+func (this *Session) Conv() uint32 {
+	return this.conv
+}
+
+func (this *Session) Read(b []byte) (int, error) {
+	for {
+		this.mu.Lock()
+		if this.readBuf.Len() > 0 {
+			n, _ := this.readBuf.Read(b)
+			this.mu.Unlock()
+			return n, nil
+		}
+		if this.eof {
+			this.mu.Unlock()
+			return 0, io.EOF
+		}
+		if this.err != nil {
+			err := this.err
+			this.mu.Unlock()
+			return 0, err
+		}
+		deadline := this.readDeadline
+		this.mu.Unlock()
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, ErrTimeout
+		}
+		timeout, stop := deadlineTimer(deadline)
+		select {
+		case <-this.readEvent:
+		case <-timeout:
+		case <-this.die:
+			this.mu.Lock()
+			if this.readBuf.Len() == 0 && !this.eof && this.err == nil {
+				this.err = errClosed
+			}
+			this.mu.Unlock()
+		}
+		stop()
+	}
+}
+
+func (this *Session) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		this.mu.Lock()
+		if this.err != nil || this.eof {
+			err := this.err
+			this.mu.Unlock()
+			if err == nil {
+				err = errClosed
+			}
+			return n, err
+		}
+		if len(this.sndQueue) >= SendWindow {
+			deadline := this.writeDeadline
+			this.mu.Unlock()
+			if !deadline.IsZero() && !time.Now().Before(deadline) {
+				return n, ErrTimeout
+			}
+			timeout, stop := deadlineTimer(deadline)
+			select {
+			case <-this.writeEvent:
+			case <-timeout:
+			case <-this.die:
+			}
+			stop()
+			continue
+		}
+		for len(b) > 0 && len(this.sndQueue) < SendWindow {
+			size := len(b)
+			if size > MSS {
+				size = MSS
+			}
+			data := make([]byte, size)
+			copy(data, b[:size])
+			this.sndQueue = append(this.sndQueue, &segment{data: data})
+			b = b[size:]
+			n += size
+		}
+		this.flush()
+		this.mu.Unlock()
+	}
+	return n, nil
+}
+
+// Close send the pending data within LingerTime,then notify the peer and release the session
+func (this *Session) Close() error {
+	closed := false
+	this.closeOnce.Do(func() {
+		closed = true
+		deadline := time.Now().Add(LingerTime)
+		for time.Now().Before(deadline) {
+			this.mu.Lock()
+			pending := len(this.sndQueue) + len(this.sndBuf)
+			broken := this.eof || this.err != nil
+			this.mu.Unlock()
+			if pending == 0 || broken {
+				break
+			}
+			time.Sleep(Interval)
+		}
+		this.mu.Lock()
+		this.output(encodeSegment(nil, this.conv, cmdFin, 0, this.rcvNxt, nil))
+		if this.err == nil {
+			this.err = errClosed
+		}
+		this.mu.Unlock()
+		close(this.die)
+		if this.onDie != nil {
+			this.onDie()
+		}
+	})
+	if !closed {
+		return errClosed
+	}
+	return nil
+}
+
+func (this *Session) LocalAddr() net.Addr {
+	return this.local
+}
+
+func (this *Session) RemoteAddr() net.Addr {
+	return this.remote
+}
+
+func (this *Session) SetDeadline(t time.Time) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.readDeadline = t
+	this.writeDeadline = t
+	notify(this.readEvent)
+	notify(this.writeEvent)
+	return nil
+}
+
+func (this *Session) SetReadDeadline(t time.Time) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.readDeadline = t
+	notify(this.readEvent)
+	return nil
+}
+
+func (this *Session) SetWriteDeadline(t time.Time) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.writeDeadline = t
+	notify(this.writeEvent)
+	return nil
+}
+
+func encodeSegment(buf []byte, conv uint32, cmd uint8, sn uint32, una uint32, data []byte) []byte {
+	var header [headerSize]byte
+	binary.LittleEndian.PutUint32(header[0:4], conv)
+	header[4] = cmd
+	binary.LittleEndian.PutUint32(header[5:9], sn)
+	binary.LittleEndian.PutUint32(header[9:13], una)
+	binary.LittleEndian.PutUint16(header[13:15], uint16(len(data)))
+	buf = append(buf, header[:]...)
+	return append(buf, data...)
+}
+
+// input handle a datagram from the peer
+func (this *Session) input(data []byte) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.lastRecv = time.Now()
+	for len(data) >= headerSize {
+		conv := binary.LittleEndian.Uint32(data[0:4])
+		cmd := data[4]
+		sn := binary.LittleEndian.Uint32(data[5:9])
+		una := binary.LittleEndian.Uint32(data[9:13])
+		length := int(binary.LittleEndian.Uint16(data[13:15]))
+		if conv != this.conv || len(data) < headerSize+length {
+			return
+		}
+		body := data[headerSize : headerSize+length]
+		data = data[headerSize+length:]
+		this.ackUna(una)
+		switch cmd {
+		case cmdAck:
+			this.ackSn(sn)
+		case cmdPush:
+			this.recvPush(sn, body)
+		case cmdFin:
+			this.eof = true
+			notify(this.readEvent)
+			notify(this.writeEvent)
+		}
+	}
+	this.flush()
+}
+
+// ackUna drop the segments before una which the peer has received
+func (this *Session) ackUna(una uint32) {
+	i := 0
+	for i < len(this.sndBuf) && this.sndBuf[i].sn < una {
+		i++
+	}
+	if i > 0 {
+		this.sndBuf = append(this.sndBuf[:0], this.sndBuf[i:]...)
+		notify(this.writeEvent)
+	}
+}
+
+func (this *Session) ackSn(sn uint32) {
+	for i, seg := range this.sndBuf {
+		if seg.sn == sn {
+			if seg.xmit == 1 {
+				this.updateRtt(time.Since(seg.sentAt))
+			}
+			this.sndBuf = append(this.sndBuf[:i], this.sndBuf[i+1:]...)
+			notify(this.writeEvent)
+			return
+		}
+		if seg.sn > sn {
+			return
+		}
+	}
+}
+
+func (this *Session) recvPush(sn uint32, body []byte) {
+	if sn >= this.rcvNxt+RecvWindow {
+		return
+	}
+	this.acks = append(this.acks, sn)
+	if sn < this.rcvNxt {
+		return
+	}
+	if _, ok := this.rcvBuf[sn]; !ok {
+		data := make([]byte, len(body))
+		copy(data, body)
+		this.rcvBuf[sn] = data
+	}
+	moved := false
+	for {
+		data, ok := this.rcvBuf[this.rcvNxt]
+		if !ok {
+			break
+		}
+		delete(this.rcvBuf, this.rcvNxt)
+		this.readBuf.Write(data)
+		this.rcvNxt++
+		moved = true
+	}
+	if moved {
+		notify(this.readEvent)
+	}
+}
+
+func (this *Session) updateRtt(rtt time.Duration) {
+	if this.srtt == 0 {
+		this.srtt = rtt
+		this.rttvar = rtt / 2
+	} else {
+		delta := this.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		this.rttvar = (3*this.rttvar + delta) / 4
+		this.srtt = (7*this.srtt + rtt) / 8
+	}
+	rto := this.srtt + 4*this.rttvar
+	if rto < this.srtt+Interval {
+		rto = this.srtt + Interval
+	}
+	if rto < rtoMin {
+		rto = rtoMin
+	}
+	if rto > rtoMax {
+		rto = rtoMax
+	}
+	this.rto = rto
+}
+
+// flush send the acks,the new segments within the window and the timed out ones
+func (this *Session) flush() {
+	if this.err != nil {
+		return
+	}
+	buf := make([]byte, 0, MTU)
+	emit := func(seg []byte) {
+		if len(buf)+len(seg) > MTU {
+			this.output(buf)
+			buf = make([]byte, 0, MTU)
+		}
+		buf = append(buf, seg...)
+	}
+	for _, sn := range this.acks {
+		emit(encodeSegment(nil, this.conv, cmdAck, sn, this.rcvNxt, nil))
+	}
+	this.acks = this.acks[:0]
+
+	for len(this.sndQueue) > 0 && (len(this.sndBuf) == 0 || this.sndNxt < this.sndBuf[0].sn+SendWindow) {
+		seg := this.sndQueue[0]
+		this.sndQueue = this.sndQueue[1:]
+		seg.sn = this.sndNxt
+		this.sndNxt++
+		this.sndBuf = append(this.sndBuf, seg)
+		notify(this.writeEvent)
+	}
+
+	now := time.Now()
+	for _, seg := range this.sndBuf {
+		if seg.xmit > 0 && now.Before(seg.resendAt) {
+			continue
+		}
+		if seg.xmit >= deadLink {
+			this.err = ErrDeadLink
+			notify(this.readEvent)
+			notify(this.writeEvent)
+			return
+		}
+		seg.xmit++
+		seg.sentAt = now
+		backoff := this.rto << uint(seg.xmit-1)
+		if backoff > rtoMax || backoff <= 0 {
+			backoff = rtoMax
+		}
+		seg.resendAt = now.Add(backoff)
+		emit(encodeSegment(nil, this.conv, cmdPush, seg.sn, this.rcvNxt, seg.data))
+	}
+	if len(buf) > 0 {
+		this.output(buf)
+	}
+}
+
+func (this *Session) update() {
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			this.mu.Lock()
+			if time.Since(this.lastRecv) > IdleTimeout && this.err == nil {
+				this.err = ErrTimeout
+				notify(this.readEvent)
+				notify(this.writeEvent)
+			}
+			this.flush()
+			this.mu.Unlock()
+		case <-this.die:
+			return
+		}
+	}
+}
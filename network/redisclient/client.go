@@ -509,7 +509,7 @@ func (this *Client) ZRange(k string, start, end int, withScore bool) *RedisReply
 	args = append(args, start)
 	args = append(args, end)
 	if withScore {
-		args = append(args, "WITHSCORE")
+		args = append(args, "WITHSCORES")
 	}
 	return this.Execute("ZRANGE", args...)
 }
@@ -526,7 +526,7 @@ func (this *Client) ZRangeByScore(k string, min, max float64, withScore bool, li
 	args = append(args, min)
 	args = append(args, max)
 	if withScore {
-		args = append(args, "WITHSCORE")
+		args = append(args, "WITHSCORES")
 	}
 	for _, v := range limit {
 		args = append(args, v)
@@ -581,7 +581,7 @@ func (this *Client) ZRevRange(k string, start, end int, withScore bool) *RedisRe
 	args = append(args, start)
 	args = append(args, end)
 	if withScore {
-		args = append(args, "WITHSCORE")
+		args = append(args, "WITHSCORES")
 	}
 	return this.Execute("ZREVRANGE", args...)
 }
@@ -593,7 +593,7 @@ func (this *Client) ZRevRangeByScore(k string, min, max float64, withScore bool)
 	args = append(args, min)
 	args = append(args, max)
 	if withScore {
-		args = append(args, "WITHSCORE")
+		args = append(args, "WITHSCORES")
 	}
 	return this.Execute("ZREVRANGEBYSCORE", args...)
 }
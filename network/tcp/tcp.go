@@ -1,6 +1,7 @@
 package tcp
 
 import (
+	"crypto/tls"
 	"github.com/nomos/go-lokas/log"
 	"github.com/nomos/go-lokas"
 	"github.com/nomos/go-lokas/network/conn"
@@ -9,8 +10,15 @@ import (
 	"time"
 )
 
+func dial(addr string, ctx *lokas.Context) (net.Conn, error) {
+	if ctx.TLSConfig != nil {
+		return tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, ctx.TLSConfig)
+	}
+	return net.DialTimeout("tcp", addr, 5*time.Second)
+}
+
 func Dial(addr string, ctx *lokas.Context) (*conn.Conn, error) {
-	c, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	c, err := dial(addr, ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -39,7 +47,7 @@ func DialEx(addr string, ctx *lokas.Context, retryWait time.Duration) chan struc
 				} else {
 					needWait = true
 				}
-				c, err := net.DialTimeout("tcp", addr, 5*time.Second)
+				c, err := dial(addr, ctx)
 				if err != nil {
 					log.Debugf("connect error: %s", err.Error())
 					retryChan <- true
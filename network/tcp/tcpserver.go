@@ -1,6 +1,7 @@
 package tcp
 
 import (
+	"crypto/tls"
 	"net"
 	"runtime"
 	"strings"
@@ -38,6 +39,9 @@ func (this *Server) Start(addr string) error {
 	if err != nil {
 		return err
 	}
+	if this.Context.TLSConfig != nil {
+		l = tls.NewListener(l, this.Context.TLSConfig)
+	}
 	this.listener = l
 	go this.serve()
 	return nil
@@ -59,6 +63,10 @@ func (this *Server) serve() {
 			}
 			break
 		}
+		if !this.Context.AllowAddr(c.RemoteAddr().String()) {
+			c.Close()
+			continue
+		}
 		conn := conn.NewTcpConn(c, this.Context, this.hub)
 		conn.ServeIO()
 	}
@@ -72,6 +80,14 @@ func (this *Server) Stop() {
 	this.hub.Stop()
 }
 
+// Addr return the listening address,empty if not started
+func (this *Server) Addr() string {
+	if this.listener == nil {
+		return ""
+	}
+	return this.listener.Addr().String()
+}
+
 // Broadcast broadcast data to all active connections
 func (this *Server) Broadcast(sessionIds []util.ID, data []byte) {
 	this.hub.Broadcast(sessionIds, data)
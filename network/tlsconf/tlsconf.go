@@ -0,0 +1,235 @@
+package tlsconf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/log"
+	"go.uber.org/zap"
+)
+
+const DefaultReloadInterval = 10 * time.Second
+
+var ErrNoCertificate = errors.New("tls: no valid certificate found in ca file")
+
+// Options tls files of a module,read from the "tls" section of the module config:
+//
+//	tls:
+//	  cert: server.pem        # certificate,also used as the client certificate for mutual tls
+//	  key: server.key
+//	  client_ca: ca.pem       # require and verify the peer certificate,mutual tls between processes
+//	  ca: ca.pem              # verify the server certificate when dialing,system roots if empty
+//	  server_name: lokas
+//	  insecure: false
+type Options struct {
+	CertFile       string
+	KeyFile        string
+	ClientCAFile   string
+	CAFile         string
+	ServerName     string
+	Insecure       bool
+	ReloadInterval time.Duration
+}
+
+// FromConfig read the tls options,nil if tls is not configured
+func FromConfig(conf lokas.IConfig) *Options {
+	if conf == nil || conf.GetString("tls.cert") == "" && conf.GetString("tls.ca") == "" {
+		return nil
+	}
+	return &Options{
+		CertFile:       conf.GetString("tls.cert"),
+		KeyFile:        conf.GetString("tls.key"),
+		ClientCAFile:   conf.GetString("tls.client_ca"),
+		CAFile:         conf.GetString("tls.ca"),
+		ServerName:     conf.GetString("tls.server_name"),
+		Insecure:       conf.GetBool("tls.insecure"),
+		ReloadInterval: conf.GetDuration("tls.reload_interval"),
+	}
+}
+
+// Loader keep the certificates loaded from the files,
+// the files are checked at most once per ReloadInterval and reloaded when modified,so a renewed certificate takes effect without restarting
+type Loader struct {
+	opts     *Options
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	ca       *x509.CertPool
+	modTimes map[string]time.Time
+	checked  time.Time
+}
+
+func NewLoader(opts *Options) (*Loader, error) {
+	if opts.ReloadInterval <= 0 {
+		opts.ReloadInterval = DefaultReloadInterval
+	}
+	ret := &Loader{
+		opts:     opts,
+		modTimes: map[string]time.Time{},
+	}
+	err := ret.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Reload load all the files again
+func (this *Loader) Reload() error {
+	var cert *tls.Certificate
+	var clientCA, ca *x509.CertPool
+	modTimes := map[string]time.Time{}
+	if this.opts.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(this.opts.CertFile, this.opts.KeyFile)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		cert = &c
+	}
+	var err error
+	if this.opts.ClientCAFile != "" {
+		clientCA, err = loadCertPool(this.opts.ClientCAFile)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+	}
+	if this.opts.CAFile != "" {
+		ca, err = loadCertPool(this.opts.CAFile)
+		if err != nil {
+			log.Error(err.Error())
+			return err
+		}
+	}
+	for _, f := range this.files() {
+		modTimes[f] = modTime(f)
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.cert = cert
+	this.clientCA = clientCA
+	this.ca = ca
+	this.modTimes = modTimes
+	this.checked = time.Now()
+	return nil
+}
+
+func (this *Loader) files() []string {
+	ret := []string{}
+	for _, f := range []string{this.opts.CertFile, this.opts.KeyFile, this.opts.ClientCAFile, this.opts.CAFile} {
+		if f != "" {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// checkReload reload the files if any of them was modified,the old certificates are kept on failure
+func (this *Loader) checkReload() {
+	this.mu.RLock()
+	if time.Since(this.checked) < this.opts.ReloadInterval {
+		this.mu.RUnlock()
+		return
+	}
+	changed := false
+	for f, t := range this.modTimes {
+		if !modTime(f).Equal(t) {
+			changed = true
+			break
+		}
+	}
+	this.mu.RUnlock()
+	if !changed {
+		this.mu.Lock()
+		this.checked = time.Now()
+		this.mu.Unlock()
+		return
+	}
+	err := this.Reload()
+	if err != nil {
+		log.Warn("tls reload failed,keep the old certificates", zap.String("cert", this.opts.CertFile))
+		this.mu.Lock()
+		this.checked = time.Now()
+		this.mu.Unlock()
+		return
+	}
+	log.Info("tls certificates reloaded", zap.String("cert", this.opts.CertFile))
+}
+
+func (this *Loader) getCertificate() (*tls.Certificate, error) {
+	this.checkReload()
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	if this.cert == nil {
+		return nil, errors.New("tls: no certificate configured")
+	}
+	return this.cert, nil
+}
+
+// ServerConfig return the config for listeners,the client certificate is required when client_ca is set
+func (this *Loader) ServerConfig() *tls.Config {
+	base := &tls.Config{MinVersion: tls.VersionTLS12}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cert, err := this.getCertificate()
+		if err != nil {
+			return nil, err
+		}
+		ret := &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{*cert},
+		}
+		this.mu.RLock()
+		if this.clientCA != nil {
+			ret.ClientCAs = this.clientCA
+			ret.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		this.mu.RUnlock()
+		return ret, nil
+	}
+	return base
+}
+
+// ClientConfig return the config for dialers,the certificate is presented for mutual tls if configured
+func (this *Loader) ClientConfig() *tls.Config {
+	this.checkReload()
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	ret := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		RootCAs:            this.ca,
+		ServerName:         this.opts.ServerName,
+		InsecureSkipVerify: this.opts.Insecure,
+	}
+	if this.cert != nil {
+		ret.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return this.getCertificate()
+		}
+	}
+	return ret
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, ErrNoCertificate
+	}
+	return pool, nil
+}
+
+func modTime(file string) time.Time {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
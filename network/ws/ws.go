@@ -48,7 +48,12 @@ func NewWsServer(context *lokas.Context) *WsServer {
 func (this *WsServer) Start(addr string) error {
 	if len(addr) > 0 {
 		httpServer := httpserver.NewHttpServer()
-		err := httpServer.Start(addr)
+		var err error
+		if this.Context.TLSConfig != nil {
+			err = httpServer.StartTLS(addr, this.Context.TLSConfig)
+		} else {
+			err = httpServer.Start(addr)
+		}
 		if err != nil {
 			return err
 		}
@@ -60,6 +65,10 @@ func (this *WsServer) Start(addr string) error {
 
 // ServeHTTP serve http request
 func (this *WsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !this.Context.AllowAddr(r.RemoteAddr) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
 	c, err := this.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Info("wsserver.ServeHTTP upgrade error: %s", zap.String("err", err.Error()))
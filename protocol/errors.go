@@ -25,9 +25,32 @@ var (
 	ERR_REGISTER_SERVICE_DUPLICATED   = CreateError(-7001, "service register duplicate")
 	ERR_REGISTER_SERVICE_INFO_INVALID = CreateError(-7002, "service info invalid")
 	ERR_REGISTER_SERVICE_NOT_FOUND    = CreateError(-7003, "service registered not found")
+	ERR_SERVICE_SELECTOR_INVALID      = CreateError(-7004, "service selector invalid")
 
 	ERR_REGISTER_ROUTE_USER_DUPLICATED = CreateError(-7101, "user route register duplicate")
 
+	ERR_SINGLETON_DUPLICATED = CreateError(-7201, "singleton register duplicate")
+	ERR_SINGLETON_NOT_FOUND  = CreateError(-7202, "singleton not found")
+
+	ERR_SAVER_STOPPED     = CreateError(-7301, "saver stopped")
+	ERR_MIGRATION_RUNNING = CreateError(-7302, "migration is running")
+	ERR_ARCHIVE_INVALID   = CreateError(-7303, "player archive invalid")
+	ERR_AVATAR_LOADED     = CreateError(-7304, "avatar is loaded")
+	ERR_SAVER_NO_MAPPER   = CreateError(-7305, "saver without component mapper")
+	ERR_INBOX_FULL        = CreateError(-7306, "inbox queue full")
+
+	ERR_MATCH_QUEUED        = CreateError(-7401, "already in match queue")
+	ERR_MATCH_NOT_QUEUED    = CreateError(-7402, "not in match queue")
+	ERR_MATCH_PARTY_INVALID = CreateError(-7403, "match party invalid")
+	ERR_MATCH_FORBIDDEN     = CreateError(-7404, "match ticket of others")
+
+	ERR_ROOM_NOT_JOINED = CreateError(-7501, "not in the room")
+	ERR_ROOM_FULL       = CreateError(-7502, "room is full")
+	ERR_ROOM_FORBIDDEN  = CreateError(-7503, "room is reserved for others")
+	ERR_ROOM_CLOSED     = CreateError(-7504, "room is closed")
+	ERR_ROOM_NOT_FOUND  = CreateError(-7505, "room not found")
+	ERR_ROOM_ID_IN_USE  = CreateError(-7506, "room id used by other actor")
+
 	ERR_ETCD_ERROR       = CreateError(201, "数据错误")
 	ERR_DB_ERROR         = CreateError(202, "数据库错误")
 	ERR_CONFIG_ERROR     = CreateError(203, "配置错误")
@@ -54,6 +77,10 @@ var (
 	ERR_TOKEN_VALIDATE         = CreateError(1002, "Token无效")
 	ERR_ACC_NOT_FIND           = CreateError(1003, "找不到账户")
 	ERR_GAME_ACC_NOT_FOUND     = CreateError(1004, "找不到游戏账户")
+	ERR_ACC_EXIST              = CreateError(1005, "账户已存在")
+	ERR_ACC_FROST              = CreateError(1006, "账户已冻结")
+	ERR_ACC_FORBIDDEN          = CreateError(1007, "账户已封禁")
+	ERR_ACC_MUTE               = CreateError(1008, "账户已禁言")
 	ERR_GAME_ACC_EXIST         = CreateError(1011, "游戏账户已存在")
 	ERR_GAME_ACC_CREATE_FAILED = CreateError(1012, "创建游戏账户失败")
 	ERR_PARAM_NOT_EXIST        = CreateError(1101, "参数不存在")
@@ -63,6 +90,13 @@ var (
 	ERR_AUTH_FAILED            = CreateError(1201, "验证失败")
 	ERR_MSG_FORMAT             = CreateError(1202, "数据格式错误")
 	ERR_PROTOCOL_NOT_FOUND     = CreateError(1203, "协议未找到")
+	ERR_SESSION_RESUME_FAILED  = CreateError(1206, "会话恢复失败")
+	ERR_HANDSHAKE_TIMEOUT      = CreateError(1207, "握手超时")
+	ERR_AUTH_SERVICE_FAILED    = CreateError(1208, "验证服务不可用")
+	ERR_RATE_LIMITED           = CreateError(1209, "请求过于频繁")
+	ERR_SESSION_NOT_FOUND      = CreateError(1210, "会话不存在")
+	ERR_CODEC_FAILED           = CreateError(1211, "编解码协商失败")
+	ERR_HANDSHAKE_REPLAYED     = CreateError(1212, "握手重放")
 )
 
 func (this ErrCode) Error() string {
@@ -50,6 +50,7 @@ const (
 	TAG_HandShake     BINARY_TAG = 45
 	TAG_RouteMessage  BINARY_TAG = 46
 	TAG_OK            BINARY_TAG = 48
+	TAG_Codec         BINARY_TAG = 49 //压缩或加密的数据包,见network/codec
 	//内建类型
 
 )
@@ -0,0 +1,145 @@
+package lokas
+
+import (
+	"reflect"
+
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+	"go.uber.org/zap"
+)
+
+const (
+	TAG_PROCESS_EVENT protocol.BINARY_TAG = 141
+	TAG_SERVICE_EVENT protocol.BINARY_TAG = 142
+	TAG_ACTOR_EVENT   protocol.BINARY_TAG = 143
+)
+
+func init() {
+	protocol.GetTypeRegistry().RegistryType(TAG_PROCESS_EVENT, reflect.TypeOf((*ProcessEvent)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_SERVICE_EVENT, reflect.TypeOf((*ServiceEvent)(nil)).Elem())
+	protocol.GetTypeRegistry().RegistryType(TAG_ACTOR_EVENT, reflect.TypeOf((*ActorEvent)(nil)).Elem())
+}
+
+// RegistryEventType cluster topology event type,can be combined as a mask
+type RegistryEventType int
+
+const (
+	EVT_PROCESS_JOINED RegistryEventType = 1 << iota
+	EVT_PROCESS_LEFT
+	EVT_SERVICE_ADDED
+	EVT_SERVICE_REMOVED
+	EVT_SERVICE_UPDATED
+	EVT_ACTOR_REGISTERED
+	EVT_ACTOR_UNREGISTERED
+
+	EVT_PROCESS_ALL  = EVT_PROCESS_JOINED | EVT_PROCESS_LEFT
+	EVT_SERVICE_ALL  = EVT_SERVICE_ADDED | EVT_SERVICE_REMOVED | EVT_SERVICE_UPDATED
+	EVT_ACTOR_ALL    = EVT_ACTOR_REGISTERED | EVT_ACTOR_UNREGISTERED
+	EVT_REGISTRY_ALL = EVT_PROCESS_ALL | EVT_SERVICE_ALL | EVT_ACTOR_ALL
+)
+
+func (this RegistryEventType) String() string {
+	switch this {
+	case EVT_PROCESS_JOINED:
+		return "ProcessJoined"
+	case EVT_PROCESS_LEFT:
+		return "ProcessLeft"
+	case EVT_SERVICE_ADDED:
+		return "ServiceAdded"
+	case EVT_SERVICE_REMOVED:
+		return "ServiceRemoved"
+	case EVT_SERVICE_UPDATED:
+		return "ServiceUpdated"
+	case EVT_ACTOR_REGISTERED:
+		return "ActorRegistered"
+	case EVT_ACTOR_UNREGISTERED:
+		return "ActorUnregistered"
+	default:
+		return "Unknown"
+	}
+}
+
+// IRegistryEvent payload of topology events, also can be delivered as actor message
+type IRegistryEvent interface {
+	protocol.ISerializable
+	EventType() RegistryEventType
+}
+
+// RegistryEventSink receive registry events,called on the registry dispatch goroutine
+type RegistryEventSink func(e IRegistryEvent)
+
+// ChanEventSink deliver events to ch,the event is dropped if ch is full so the dispatcher never blocks,
+// ch should be buffered and drained
+func ChanEventSink(ch chan<- IRegistryEvent) RegistryEventSink {
+	return func(e IRegistryEvent) {
+		select {
+		case ch <- e:
+		default:
+			log.Warn("registry event sink full,event dropped", zap.String("event", e.EventType().String()))
+		}
+	}
+}
+
+var _ IRegistryEvent = (*ProcessEvent)(nil)
+
+type ProcessEvent struct {
+	Type      RegistryEventType
+	ProcessId util.ProcessId
+}
+
+func (this *ProcessEvent) EventType() RegistryEventType {
+	return this.Type
+}
+
+func (this *ProcessEvent) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *ProcessEvent) Serializable() protocol.ISerializable {
+	return this
+}
+
+var _ IRegistryEvent = (*ServiceEvent)(nil)
+
+type ServiceEvent struct {
+	Type    RegistryEventType
+	Service *ServiceInfo
+	Old     *ServiceInfo //previous info of EVT_SERVICE_UPDATED
+}
+
+func (this *ServiceEvent) EventType() RegistryEventType {
+	return this.Type
+}
+
+func (this *ServiceEvent) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *ServiceEvent) Serializable() protocol.ISerializable {
+	return this
+}
+
+var _ IRegistryEvent = (*ActorEvent)(nil)
+
+type ActorEvent struct {
+	Type      RegistryEventType
+	ActorId   util.ID
+	ActorType string
+	ProcessId util.ProcessId
+	GameId    string
+	ServerId  int32
+	Labels    map[string]string
+}
+
+func (this *ActorEvent) EventType() RegistryEventType {
+	return this.Type
+}
+
+func (this *ActorEvent) GetId() (protocol.BINARY_TAG, error) {
+	return protocol.GetTypeRegistry().GetTagByType(reflect.TypeOf(this).Elem())
+}
+
+func (this *ActorEvent) Serializable() protocol.ISerializable {
+	return this
+}
@@ -0,0 +1,43 @@
+package rpc
+
+import (
+	"time"
+
+	"github.com/nomos/go-lokas/cmds"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+	"go.uber.org/zap"
+)
+
+// RegisterAccountAdminFuncs register the admin commands of the account service:
+//
+//	acc_state <userid> <normal|mute|frost|forbidden> [duration]   forever if no duration
+func RegisterAccountAdminFuncs(account *lox.Account) {
+	RegisterAdminFunc("acc_state", func(cmd *lox.AdminCommand, params *cmds.ParamsValue, logger log.ILogger) ([]byte, error) {
+		userId := util.ID(params.Int64Opt())
+		if userId == 0 {
+			return nil, protocol.ERR_PARAM_NOT_EXIST
+		}
+		state, ok := lox.String2AccState(params.StringOpt())
+		if !ok {
+			return nil, protocol.ERR_PARAM_TYPE
+		}
+		var d time.Duration
+		if s := params.StringOpt(); s != "" {
+			var err error
+			d, err = time.ParseDuration(s)
+			if err != nil {
+				log.Error(err.Error())
+				return nil, protocol.ERR_PARAM_TYPE
+			}
+		}
+		err := account.SetAccState(userId, state, d)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("acc_state", zap.Int64("userid", userId.Int64()), zap.Uint32("state", uint32(state)), zap.Duration("duration", d))
+		return []byte("ok"), nil
+	})
+}
@@ -0,0 +1,58 @@
+package rpc
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/nomos/go-lokas/cmds"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/protocol"
+	"go.uber.org/zap"
+)
+
+// RegisterGateAdminFuncs register the flood protection admin commands of the gate:
+//
+//	gate_limit_stats           the counters and the ban list
+//	gate_ban <ip> [duration]   ban the ip,1h by default
+//	gate_unban <ip>
+func RegisterGateAdminFuncs(gate *lox.Gate) {
+	RegisterAdminFunc("gate_limit_stats", func(cmd *lox.AdminCommand, params *cmds.ParamsValue, logger log.ILogger) ([]byte, error) {
+		if gate.Limiter == nil {
+			return nil, protocol.ERR_CONFIG_ERROR
+		}
+		return json.Marshal(gate.Limiter.Stats())
+	})
+	RegisterAdminFunc("gate_ban", func(cmd *lox.AdminCommand, params *cmds.ParamsValue, logger log.ILogger) ([]byte, error) {
+		if gate.Limiter == nil {
+			return nil, protocol.ERR_CONFIG_ERROR
+		}
+		ip := params.StringOpt()
+		if ip == "" {
+			return nil, protocol.ERR_PARAM_NOT_EXIST
+		}
+		d := time.Hour
+		if s := params.StringOpt(); s != "" {
+			var err error
+			d, err = time.ParseDuration(s)
+			if err != nil {
+				log.Error(err.Error())
+				return nil, protocol.ERR_PARAM_TYPE
+			}
+		}
+		gate.Limiter.Ban(ip, d)
+		logger.Info("gate_ban", zap.String("ip", ip), zap.Duration("duration", d))
+		return []byte("ok"), nil
+	})
+	RegisterAdminFunc("gate_unban", func(cmd *lox.AdminCommand, params *cmds.ParamsValue, logger log.ILogger) ([]byte, error) {
+		if gate.Limiter == nil {
+			return nil, protocol.ERR_CONFIG_ERROR
+		}
+		ip := params.StringOpt()
+		if !gate.Limiter.Unban(ip) {
+			return nil, protocol.ERR_PARAM_NOT_EXIST
+		}
+		logger.Info("gate_unban", zap.String("ip", ip))
+		return []byte("ok"), nil
+	})
+}
@@ -0,0 +1,42 @@
+package rpc
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/cmds"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/lox"
+	"go.uber.org/zap"
+)
+
+// RegisterMigrationAdminFuncs register the admin commands of the data migrations:
+//
+//	migrate [collection|all] [dry]   migrate the documents of older versions,only count them if dry
+//	migrate_state                    the migration states kept in mongo
+func RegisterMigrationAdminFuncs(process lokas.IProcess, migrator *lox.Migrator) {
+	RegisterAdminFunc("migrate", func(cmd *lox.AdminCommand, params *cmds.ParamsValue, logger log.ILogger) ([]byte, error) {
+		collection := params.StringOpt()
+		if collection == "all" {
+			collection = ""
+		}
+		dryRun := params.StringOpt() == "dry"
+		owner := strconv.Itoa(int(process.PId()))
+		reports, err := migrator.Run(process.GetMongo(), collection, owner, dryRun)
+		for _, r := range reports {
+			logger.Info("migrate", zap.String("target", r.Target), zap.Int("version", r.Version), zap.Int64("pending", r.Pending), zap.Int64("migrated", r.Migrated), zap.Bool("dry", r.DryRun))
+		}
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(reports)
+	})
+	RegisterAdminFunc("migrate_state", func(cmd *lox.AdminCommand, params *cmds.ParamsValue, logger log.ILogger) ([]byte, error) {
+		states, err := migrator.States(process.GetMongo())
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(states)
+	})
+}
@@ -0,0 +1,84 @@
+package rpc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/cmds"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+	"go.uber.org/zap"
+)
+
+// RegisterPlayerDataAdminFuncs register the admin commands of the player data,the archive is base64 encoded:
+//
+//	player_export <userid>                                              the archive of the user and the avatars
+//	player_import <archive> [game_id|-] [server_id|-] [username]        import as a new user,- keeps the original
+//	player_delete <userid> confirm                                      delete the user hard
+func RegisterPlayerDataAdminFuncs(process lokas.IProcess, data *lox.PlayerData) {
+	RegisterAdminFunc("player_export", func(cmd *lox.AdminCommand, params *cmds.ParamsValue, logger log.ILogger) ([]byte, error) {
+		userId := util.ID(params.Int64Opt())
+		if userId == 0 {
+			return nil, protocol.ERR_PARAM_NOT_EXIST
+		}
+		archive, err := data.Export(process.GetMongo(), userId)
+		if err != nil {
+			return nil, err
+		}
+		b, err := archive.Marshal()
+		if err != nil {
+			log.Error(err.Error())
+			return nil, err
+		}
+		logger.Info("player_export", zap.Int64("userid", userId.Int64()), zap.Int("size", len(b)))
+		return []byte(base64.StdEncoding.EncodeToString(b)), nil
+	})
+	RegisterAdminFunc("player_import", func(cmd *lox.AdminCommand, params *cmds.ParamsValue, logger log.ILogger) ([]byte, error) {
+		b, err := base64.StdEncoding.DecodeString(params.StringOpt())
+		if err != nil || len(b) == 0 {
+			return nil, protocol.ERR_PARAM_TYPE
+		}
+		archive, err := lox.UnmarshalPlayerArchive(b)
+		if err != nil {
+			return nil, err
+		}
+		gameId := params.StringOpt()
+		if gameId == "-" {
+			gameId = ""
+		}
+		serverId := int32(-1)
+		if s := params.StringOpt(); s != "" && s != "-" {
+			id, err := strconv.ParseInt(s, 10, 32)
+			if err != nil || id < 0 {
+				return nil, protocol.ERR_PARAM_TYPE
+			}
+			serverId = int32(id)
+		}
+		from := archive.Manifest.UserId
+		user, err := data.Import(process, archive, gameId, serverId, params.StringOpt())
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("player_import", zap.Int64("from", from.Int64()), zap.Int64("userid", user.Id.Int64()), zap.String("username", user.UserName))
+		return json.Marshal(user.ClaimUser())
+	})
+	RegisterAdminFunc("player_delete", func(cmd *lox.AdminCommand, params *cmds.ParamsValue, logger log.ILogger) ([]byte, error) {
+		userId := util.ID(params.Int64Opt())
+		if userId == 0 {
+			return nil, protocol.ERR_PARAM_NOT_EXIST
+		}
+		if params.StringOpt() != "confirm" {
+			return nil, protocol.ERR_PARAM_NOT_EXIST
+		}
+		report, err := data.Delete(process, userId)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("player_delete", zap.Int64("userid", userId.Int64()), zap.Int("avatars", len(report.Avatars)), zap.Int("kicked", report.Kicked))
+		return json.Marshal(report)
+	})
+}
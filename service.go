@@ -1,6 +1,7 @@
 package lokas
 
 import (
+	"strconv"
 	"strings"
 
 	"github.com/nomos/go-lokas/protocol"
@@ -29,10 +30,112 @@ type ServiceInfo struct {
 	Port    uint16
 	Version string
 	Cnt     int
+	Labels  map[string]string //custom metadata,such as region,flavour,canary
 
 	// CreateAt time.Time
 }
 
+// GetLabel get label value by key,the reserved keys type,id,line,pid and version read the service fields
+func (this *ServiceInfo) GetLabel(key string) (string, bool) {
+	switch key {
+	case "type":
+		return this.ServiceType, true
+	case "id":
+		return strconv.Itoa(int(this.ServiceId)), true
+	case "line":
+		return strconv.Itoa(int(this.LineId)), true
+	case "pid":
+		return this.ProcessId.ToString(), true
+	case "version":
+		return this.Version, true
+	}
+	v, ok := this.Labels[key]
+	return v, ok
+}
+
+func (this *ServiceInfo) Clone() *ServiceInfo {
+	ret := *this
+	if this.Labels != nil {
+		ret.Labels = make(map[string]string, len(this.Labels))
+		for k, v := range this.Labels {
+			ret.Labels[k] = v
+		}
+	}
+	return &ret
+}
+
+type SelectorOp int
+
+const (
+	SELECTOR_EQUAL SelectorOp = iota + 1
+	SELECTOR_NOT_EQUAL
+	SELECTOR_EXISTS
+	SELECTOR_NOT_EXISTS
+)
+
+type SelectorRequirement struct {
+	Key   string
+	Op    SelectorOp
+	Value string
+}
+
+func (this SelectorRequirement) Match(info *ServiceInfo) bool {
+	v, ok := info.GetLabel(this.Key)
+	switch this.Op {
+	case SELECTOR_EQUAL:
+		return ok && v == this.Value
+	case SELECTOR_NOT_EQUAL:
+		return !ok || v != this.Value
+	case SELECTOR_EXISTS:
+		return ok
+	case SELECTOR_NOT_EXISTS:
+		return !ok
+	}
+	return false
+}
+
+// ServiceSelector all the requirements must be matched
+type ServiceSelector []SelectorRequirement
+
+// ParseServiceSelector parse selector like "version=1.2,region!=eu,canary,!deprecated"
+func ParseServiceSelector(s string) (ServiceSelector, error) {
+	ret := ServiceSelector{}
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		var req SelectorRequirement
+		if idx := strings.Index(term, "!="); idx >= 0 {
+			req = SelectorRequirement{Key: term[:idx], Op: SELECTOR_NOT_EQUAL, Value: term[idx+2:]}
+		} else if idx := strings.Index(term, "=="); idx >= 0 {
+			req = SelectorRequirement{Key: term[:idx], Op: SELECTOR_EQUAL, Value: term[idx+2:]}
+		} else if idx := strings.Index(term, "="); idx >= 0 {
+			req = SelectorRequirement{Key: term[:idx], Op: SELECTOR_EQUAL, Value: term[idx+1:]}
+		} else if strings.HasPrefix(term, "!") {
+			req = SelectorRequirement{Key: term[1:], Op: SELECTOR_NOT_EXISTS}
+		} else {
+			req = SelectorRequirement{Key: term, Op: SELECTOR_EXISTS}
+		}
+		req.Key = strings.TrimSpace(req.Key)
+		req.Value = strings.TrimSpace(req.Value)
+		if req.Key == "" || strings.ContainsAny(req.Key, "=!") || strings.ContainsAny(req.Value, "=!") {
+			return nil, protocol.ERR_SERVICE_SELECTOR_INVALID
+		}
+		ret = append(ret, req)
+	}
+	return ret, nil
+}
+
+func (this ServiceSelector) Match(info *ServiceInfo) bool {
+	for _, req := range this {
+		if !req.Match(info) {
+			return false
+		}
+	}
+	return true
+}
+
 type ServiceInfos []*ServiceInfo
 
 func (infos ServiceInfos) Len() int { return len(infos) }
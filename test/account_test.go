@@ -0,0 +1,92 @@
+package test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+	"github.com/nomos/jwt-go"
+)
+
+func TestAccount(t *testing.T) {
+	hash, err := lox.HashPassword("secret", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash == "secret" || !lox.CheckPassword(hash, "secret") || lox.CheckPassword(hash, "wrong") {
+		t.Fatal("unexpected password hash")
+	}
+
+	user := &lox.User{Id: 1, UserName: "lokas", Password: hash, Avatars: map[string]util.ID{lox.ServerKey("game", 2): 100}}
+	if err := user.CheckLogin(); err != nil {
+		t.Fatal(err)
+	}
+	user.State = lox.ACC_FROST
+	user.StateExpire = time.Now().Add(time.Hour).Unix()
+	if err := user.CheckLogin(); err != protocol.ERR_ACC_FROST {
+		t.Errorf("expect frozen,got %v", err)
+	}
+	user.StateExpire = time.Now().Add(-time.Second).Unix()
+	if user.GetAccState() != lox.ACC_NORMAL {
+		t.Error("expect the state expired")
+	}
+	user.State = lox.ACC_MUTE
+	user.StateExpire = 0
+	if !user.IsMuted() || user.CheckLogin() != nil {
+		t.Error("expect muted user allowed to login")
+	}
+	if claim := user.ClaimUser(); claim.Password != "" || claim.Avatars[lox.ServerKey("game", 2)] != 100 {
+		t.Errorf("unexpected claim user %+v", claim)
+	}
+
+	key := "signing key"
+	sign := func(user *lox.User) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, lox.ClaimUserCreator(user.ClaimUser(), time.Minute)).SignedString([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	signRefresh := func(user *lox.User) string {
+		claim := lox.SetTokenType(lox.ClaimUserCreator(user.ClaimUser(), time.Minute), lox.TOKEN_REFRESH)
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claim).SignedString([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	handshake := func(userId util.ID, avatarId util.ID, serverId int32, token string) []byte {
+		data, _ := json.Marshal(lox.NewLoginHandShake("game", "1.0", serverId, userId, avatarId, token))
+		return data
+	}
+	auth := lox.NewLoginAuthenticator(key, false)
+	identity, err := auth.Authenticate(handshake(1, 100, 2, sign(user)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.UserId != 1 || identity.AvatarId != 100 {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+	cases := []struct {
+		data []byte
+		err  protocol.ErrCode
+	}{
+		{handshake(2, 100, 2, sign(user)), protocol.ERR_TOKEN_VALIDATE},
+		{handshake(1, 100, 3, sign(user)), protocol.ERR_GAME_ACC_NOT_FOUND},
+		{handshake(1, 100, 2, "bad"), protocol.ERR_TOKEN_VALIDATE},
+		{handshake(1, 100, 2, signRefresh(user)), protocol.ERR_TOKEN_VALIDATE},
+		{[]byte("{"), protocol.ERR_MSG_FORMAT},
+	}
+	for i, c := range cases {
+		if _, err := auth.Authenticate(c.data); err != c.err {
+			t.Errorf("case %d:expect %v,got %v", i, c.err, err)
+		}
+	}
+	user.State = lox.ACC_FORBIDDEN
+	if _, err := auth.Authenticate(handshake(1, 100, 2, sign(user))); err != protocol.ERR_ACC_FORBIDDEN {
+		t.Errorf("expect forbidden,got %v", err)
+	}
+}
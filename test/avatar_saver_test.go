@@ -0,0 +1,130 @@
+package test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// saverStore record the latest written field of each document
+type saverStore struct {
+	mu     sync.Mutex
+	docs   map[util.ID]map[string]int32
+	writes int
+	fail   int //fail so many writes first
+}
+
+func (this *saverStore) write(collection string, entries []*lox.SaveEntry) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.fail > 0 {
+		this.fail--
+		return errors.New("db down")
+	}
+	this.writes++
+	for _, e := range entries {
+		doc := this.docs[e.Id]
+		if doc == nil {
+			doc = map[string]int32{}
+			this.docs[e.Id] = doc
+		}
+		doc[e.Field] = e.Data.Lookup("v").Int32()
+	}
+	return nil
+}
+
+func (this *saverStore) get(id util.ID, field string) int32 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.docs[id][field]
+}
+
+func saveEntry(id util.ID, field string, v int32) *lox.SaveEntry {
+	data, _ := bson.Marshal(bson.M{"v": v})
+	return &lox.SaveEntry{Collection: "avatar", Id: id, Field: field, Data: data}
+}
+
+func TestAvatarSaver(t *testing.T) {
+	journal := filepath.Join(t.TempDir(), "saver.journal")
+	config := lox.SaverConfig{Workers: 2, Batch: 10, Interval: time.Hour, Retry: 1, Journal: journal}
+
+	//the db is down,entries stay in the journal after stop
+	down := &saverStore{docs: map[util.ID]map[string]int32{}, fail: 1 << 20}
+	saver := lox.NewAvatarSaver(config, down.write)
+	if err := saver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := int32(1); i <= 3; i++ {
+		saver.Enqueue(saveEntry(1, "bag", i), saveEntry(2, "bag", i*10))
+	}
+	saver.Enqueue(saveEntry(1, "hero", 7))
+	if saver.Pending() != 3 {
+		t.Fatalf("expect snapshots coalesced,got %d", saver.Pending())
+	}
+	if err := saver.Stop(); err == nil {
+		t.Fatal("expect stop failed with the db down")
+	}
+	if err := saver.Enqueue(saveEntry(1, "bag", 4)); err == nil {
+		t.Error("expect enqueue after stop failed")
+	}
+	//a partial entry written by a crash is dropped on replay
+	f, _ := os.OpenFile(journal, os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{100, 0, 0})
+	f.Close()
+
+	store := &saverStore{docs: map[util.ID]map[string]int32{}, fail: 1}
+	saver = lox.NewAvatarSaver(config, store.write)
+	if err := saver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if saver.Pending() != 3 {
+		t.Fatalf("expect the journal replayed,got %d", saver.Pending())
+	}
+	//the first write fails and is retried
+	if err := saver.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if store.get(1, "bag") != 3 || store.get(2, "bag") != 30 || store.get(1, "hero") != 7 {
+		t.Fatalf("unexpected docs %v", store.docs)
+	}
+	if info, _ := os.Stat(journal); info.Size() != 0 {
+		t.Errorf("expect the journal truncated,got %d", info.Size())
+	}
+	//a full batch is written without waiting for the interval
+	for i := int32(0); i < 20; i++ {
+		saver.Enqueue(saveEntry(util.ID(i*2), "bag", i))
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for saver.Pending() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if saver.Pending() != 0 || store.get(38, "bag") != 19 {
+		t.Fatalf("expect full batches written,pending %d", saver.Pending())
+	}
+	//the entries of one avatar are written on demand,as the avatar stops
+	saver.Enqueue(saveEntry(5, "bag", 8))
+	if err := saver.FlushId(5); err != nil {
+		t.Fatal(err)
+	}
+	if store.get(5, "bag") != 8 {
+		t.Error("expect the entries of the avatar flushed")
+	}
+	if err := saver.Save(nil, true); err != protocol.ERR_SAVER_NO_MAPPER {
+		t.Errorf("expect save refused without mapper,got %v", err)
+	}
+	saver.Enqueue(saveEntry(3, "bag", 5))
+	if err := saver.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if store.get(3, "bag") != 5 {
+		t.Error("expect pending entries flushed on stop")
+	}
+}
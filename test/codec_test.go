@@ -0,0 +1,295 @@
+package test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/network/codec"
+	"github.com/nomos/go-lokas/network/conn"
+	"github.com/nomos/go-lokas/network/tcp"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+)
+
+func TestCodec(t *testing.T) {
+	packet, _ := protocol.MarshalBinaryMessage(1, &protocol.HandShake{Data: bytes.Repeat([]byte("lokas"), 1000)})
+	client, _ := codec.GenerateKey()
+	server, _ := codec.GenerateKey()
+	clientSend, clientRecv, err := client.SessionKeys(server.Public, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverSend, serverRecv, _ := server.SessionKeys(client.Public, true)
+	if !bytes.Equal(clientSend, serverRecv) || !bytes.Equal(clientRecv, serverSend) || bytes.Equal(clientSend, clientRecv) {
+		t.Fatal("expect the keys of the two directions shared")
+	}
+	for _, compress := range []string{codec.COMPRESS_NONE, codec.COMPRESS_GZIP, codec.COMPRESS_SNAPPY} {
+		for _, encrypt := range []bool{false, true} {
+			var c, peer *codec.Codec
+			if encrypt {
+				c, err = codec.New(compress, 100, clientSend, clientRecv)
+				peer, _ = codec.New(compress, 100, serverSend, serverRecv)
+			} else {
+				c, err = codec.New(compress, 100, nil, nil)
+				peer = c
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			encoded, err := c.Encode(packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (compress != codec.COMPRESS_NONE || encrypt) != codec.IsEncoded(encoded) {
+				t.Fatalf("%s %v:unexpected encoding", compress, encrypt)
+			}
+			if compress != codec.COMPRESS_NONE && len(encoded) >= len(packet) {
+				t.Errorf("%s:expect compressed,got %d", compress, len(encoded))
+			}
+			decoded, err := peer.Decode(encoded)
+			if err != nil || !bytes.Equal(decoded, packet) {
+				t.Fatalf("%s %v:decode failed %v", compress, encrypt, err)
+			}
+		}
+	}
+	//small packets are not compressed,and packets only compressed are decoded without the codec
+	c, _ := codec.New(codec.COMPRESS_GZIP, 100000, nil, nil)
+	if encoded, _ := c.Encode(packet); codec.IsEncoded(encoded) {
+		t.Error("expect packet below the threshold not encoded")
+	}
+	c, _ = codec.New(codec.COMPRESS_SNAPPY, 0, nil, nil)
+	encoded, _ := c.Encode(packet)
+	if decoded, err := (*codec.Codec)(nil).Decode(encoded); err != nil || !bytes.Equal(decoded, packet) {
+		t.Fatalf("expect decoded without codec,got %v", err)
+	}
+	//encrypted connections reject plaintext and the wrong key
+	c, _ = codec.New(codec.COMPRESS_NONE, 0, clientSend, clientRecv)
+	peer, _ := codec.New(codec.COMPRESS_NONE, 0, serverSend, serverRecv)
+	if _, err := peer.Decode(packet); err != codec.ErrPlaintext {
+		t.Errorf("expect plaintext rejected,got %v", err)
+	}
+	other, _ := codec.GenerateKey()
+	otherSend, otherRecv, _ := other.SessionKeys(client.Public, true)
+	c3, _ := codec.New(codec.COMPRESS_NONE, 0, otherSend, otherRecv)
+	encoded, _ = c.Encode(packet)
+	if _, err := c3.Decode(encoded); err == nil {
+		t.Error("expect decode with the wrong key failed")
+	}
+	//the packets of a direction are not accepted by the other direction
+	if _, err := c.Decode(encoded); err == nil {
+		t.Error("expect reflected packet refused")
+	}
+}
+
+// the replayed and reordered packets are refused
+func TestCodecReplay(t *testing.T) {
+	client, _ := codec.GenerateKey()
+	server, _ := codec.GenerateKey()
+	clientSend, clientRecv, _ := client.SessionKeys(server.Public, false)
+	serverSend, serverRecv, _ := server.SessionKeys(client.Public, true)
+	c, _ := codec.New(codec.COMPRESS_NONE, 0, clientSend, clientRecv)
+	peer, _ := codec.New(codec.COMPRESS_NONE, 0, serverSend, serverRecv)
+	packet, _ := protocol.MarshalBinaryMessage(1, &protocol.Ping{})
+	first, _ := c.Encode(packet)
+	second, _ := c.Encode(packet)
+	if _, err := peer.Decode(first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Decode(first); err != codec.ErrReplayed {
+		t.Errorf("expect replayed packet refused,got %v", err)
+	}
+	if _, err := peer.Decode(second); err != nil {
+		t.Fatal(err)
+	}
+	third, _ := c.Encode(packet)
+	fourth, _ := c.Encode(packet)
+	if _, err := peer.Decode(fourth); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Decode(third); err != codec.ErrReplayed {
+		t.Errorf("expect older packet refused,got %v", err)
+	}
+	//a tampered seq fails the authentication and is not taken as the latest
+	tampered, _ := c.Encode(packet)
+	tampered[codec.HEADER_SIZE+codec.SEQ_SIZE-1] += 10
+	if _, err := peer.Decode(tampered); err == nil {
+		t.Error("expect tampered packet refused")
+	}
+	fifth, _ := c.Encode(packet)
+	if _, err := peer.Decode(fifth); err != nil {
+		t.Errorf("expect the next packet accepted,got %v", err)
+	}
+}
+
+// the exchange is signed by the gate,the keys substituted in the middle are refused
+func TestCodecExchangeSigned(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	client, _ := codec.GenerateKey()
+	server, _ := codec.GenerateKey()
+	sig := codec.SignExchange(private, client.Public, server.Public)
+	if !codec.VerifyExchange(public, client.Public, server.Public, sig) {
+		t.Fatal("expect exchange verified")
+	}
+	mitm, _ := codec.GenerateKey()
+	if codec.VerifyExchange(public, client.Public, mitm.Public, sig) || codec.VerifyExchange(public, mitm.Public, server.Public, sig) {
+		t.Error("expect substituted key refused")
+	}
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	if codec.VerifyExchange(public, client.Public, mitm.Public, codec.SignExchange(otherKey, client.Public, mitm.Public)) {
+		t.Error("expect exchange signed by other key refused")
+	}
+	if codec.VerifyExchange(nil, client.Public, server.Public, sig) {
+		t.Error("expect exchange refused without key")
+	}
+}
+
+// codecSession accept the codec offer and echo the other messages
+type codecSession struct {
+	config *lox.CodecConfig
+	codec  lokas.PacketCodec
+}
+
+func (this *codecSession) GetId() util.ID           { return 0 }
+func (this *codecSession) GetConn() lokas.IConn     { return nil }
+func (this *codecSession) OnOpen(conn lokas.IConn)  {}
+func (this *codecSession) OnClose(conn lokas.IConn) {}
+func (this *codecSession) OnRecv(connect lokas.IConn, data []byte) {
+	if protocol.GetCmdId16(data) == lox.TAG_CODEC_OFFER {
+		msg, _ := protocol.UnmarshalMessage(data, protocol.BINARY)
+		accept, c, err := this.config.Accept(msg.Body.(*lox.CodecOffer))
+		if err != nil {
+			connect.Close()
+			return
+		}
+		reply, _ := protocol.MarshalMessage(msg.TransId, accept, protocol.BINARY)
+		this.codec = c
+		connect.(*conn.Conn).SwitchCodec(reply, c)
+		return
+	}
+	d := make([]byte, len(data))
+	copy(d, data)
+	connect.Write(d)
+}
+
+// the compressed packets decoded beyond the longest message are refused
+func TestCodecDecompressBomb(t *testing.T) {
+	bomb := make([]byte, codec.MAX_DECODED_LEN+1)
+	for _, compress := range []string{codec.COMPRESS_GZIP, codec.COMPRESS_SNAPPY} {
+		c, _ := codec.New(compress, 0, nil, nil)
+		encoded, err := c.Encode(bomb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = c.Decode(encoded); err != codec.ErrTooLarge {
+			t.Errorf("%s: expect too large,got %v", compress, err)
+		}
+	}
+
+	//a snappy header claiming 1GB is refused before allocated
+	header := make([]byte, codec.HEADER_SIZE)
+	binary.LittleEndian.PutUint16(header[6:8], codec.TAG_CODEC)
+	header[8] = codec.FLAG_SNAPPY
+	packet := append(header, 0x80, 0x80, 0x80, 0x80, 0x04, 0)
+	if _, err := (*codec.Codec)(nil).Decode(packet); err != codec.ErrTooLarge {
+		t.Errorf("expect too large,got %v", err)
+	}
+}
+
+func TestCodecNegotiate(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	sess := &codecSession{config: &lox.CodecConfig{
+		Compress:  []string{codec.COMPRESS_GZIP},
+		Threshold: 256,
+		Encrypt:   true,
+		SignKey:   private,
+	}}
+	ctx := kcpTestContext(nil)
+	ctx.SessionCreator = func(conn lokas.IConn) lokas.ISession {
+		return sess
+	}
+	server := tcp.NewServer(ctx)
+	err := server.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client := lox.NewTcpClient()
+	client.SetProtocol(protocol.BINARY)
+	_, err = client.Connect(server.Addr()).Await()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(true)
+	if err := client.NegotiateCodec(codec.Supported(), 0, true); !protocol.ERR_CODEC_FAILED.Is(err) {
+		t.Fatalf("expect encryption refused without the gate key,got %v", err)
+	}
+	client.CodecKey = public
+	err = client.NegotiateCodec(codec.Supported(), 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := sess.codec.(*codec.Codec)
+	if !ok || c.Compress != codec.COMPRESS_GZIP || !c.Encrypted() {
+		t.Fatalf("unexpected codec %+v", sess.codec)
+	}
+	data := bytes.Repeat([]byte("lokas"), 10000)
+	resp, err := client.Request(&protocol.HandShake{Data: data}).Await()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hs, ok := resp.(*protocol.HandShake); !ok || !bytes.Equal(hs.Data, data) {
+		t.Fatalf("unexpected echo %T", resp)
+	}
+}
+
+// a gate signing with other key is taken as a man in the middle
+func TestCodecNegotiateWrongKey(t *testing.T) {
+	public, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, private, _ := ed25519.GenerateKey(rand.Reader)
+	sess := &codecSession{config: &lox.CodecConfig{Encrypt: true, SignKey: private}}
+	ctx := kcpTestContext(nil)
+	ctx.SessionCreator = func(conn lokas.IConn) lokas.ISession {
+		return sess
+	}
+	server := tcp.NewServer(ctx)
+	if err := server.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client := lox.NewTcpClient()
+	client.SetProtocol(protocol.BINARY)
+	if _, err := client.Connect(server.Addr()).Await(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(true)
+	client.CodecKey = public
+	if err := client.NegotiateCodec(nil, 0, true); !protocol.ERR_CODEC_FAILED.Is(err) {
+		t.Errorf("expect exchange refused,got %v", err)
+	}
+}
+
+func TestCodecConfig(t *testing.T) {
+	conf := lox.NewAppConfig("gate")
+	conf.Viper.ReadConfig(strings.NewReader(`
+[codec]
+encrypt = true
+`))
+	if _, err := lox.LoadCodecConfig(conf); !protocol.ERR_CONFIG_ERROR.Is(err) {
+		t.Errorf("expect encrypt refused without sign_key,got %v", err)
+	}
+	seed := bytes.Repeat([]byte{1}, ed25519.SeedSize)
+	conf.Set("codec.sign_key", base64.StdEncoding.EncodeToString(seed))
+	c, err := lox.LoadCodecConfig(conf)
+	if err != nil || !bytes.Equal(c.SignKey, ed25519.NewKeyFromSeed(seed)) {
+		t.Errorf("unexpected codec config %v %v", c, err)
+	}
+}
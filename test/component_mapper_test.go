@@ -0,0 +1,85 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/nomos/go-lokas/ecs"
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util/keys"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestComponentMapper(t *testing.T) {
+	mapper := lox.NewComponentMapper("").
+		Register(keys.TAG_KEY_EVENT).
+		RegisterSeparate(keys.TAG_MOUSE_EVENT, "mouse").
+		RegisterMigration(keys.TAG_KEY_EVENT, func(doc bson.M) error {
+			//version 0 stored the code as key
+			doc["code"] = doc["key"]
+			delete(doc, "key")
+			return nil
+		})
+	if mapper.Version(keys.TAG_KEY_EVENT) != 1 || mapper.Field(keys.TAG_MOUSE_EVENT) != "" {
+		t.Fatal("unexpected mapping")
+	}
+
+	//missing components are created with defaults and stay dirty
+	entity := ecs.CreateEntity()
+	entity.SetId(1)
+	if err := mapper.Decode(entity, map[string]bson.Raw{}); err != nil {
+		t.Fatal(err)
+	}
+	key, ok := entity.Get(keys.TAG_KEY_EVENT).(*keys.KeyEvent)
+	if !ok || entity.Get(keys.TAG_MOUSE_EVENT) == nil || !key.Dirty() {
+		t.Fatal("expect the components created with defaults")
+	}
+	key.Code = keys.KEY_A
+	entries, err := mapper.Snapshot(entity, false)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expect both components saved,got %d %v", len(entries), err)
+	}
+	if entity.Dirty() || key.Dirty() {
+		t.Error("expect dirty marks cleared")
+	}
+	docs := map[string]bson.Raw{}
+	for _, e := range entries {
+		if e.Id != 1 {
+			t.Errorf("unexpected id %d", e.Id)
+		}
+		if e.Field == "" && e.Collection != "mouse" || e.Field != "" && e.Collection != lox.AVATAR_COLLECTION {
+			t.Errorf("unexpected entry %s.%s", e.Collection, e.Field)
+		}
+		if e.Data.Lookup(lox.COMPONENT_VERSION).Int32() != int32(mapper.Version(keys.TAG_KEY_EVENT)) && e.Field != "" {
+			t.Error("expect the schema version saved")
+		}
+		name := e.Field
+		if name == "" {
+			name = protocol.GetTypeRegistry().GetTagName(keys.TAG_MOUSE_EVENT)
+		}
+		docs[name] = e.Data
+	}
+	//only the dirty components are saved
+	key.SetDirty(true)
+	if entries, _ = mapper.Snapshot(entity, false); len(entries) != 1 || entries[0].Field != "KeyEvent" {
+		t.Fatalf("expect only the dirty component saved,got %d", len(entries))
+	}
+
+	loaded := ecs.CreateEntity()
+	if err := mapper.Decode(loaded, docs); err != nil {
+		t.Fatal(err)
+	}
+	if k := loaded.Get(keys.TAG_KEY_EVENT).(*keys.KeyEvent); k.Code != keys.KEY_A || k.Dirty() {
+		t.Fatalf("unexpected loaded component %+v", k)
+	}
+
+	//documents of old versions are migrated and written back
+	old, _ := bson.Marshal(bson.M{"key": int32(keys.KEY_B)})
+	migrated := ecs.CreateEntity()
+	if err := mapper.Decode(migrated, map[string]bson.Raw{"KeyEvent": old}); err != nil {
+		t.Fatal(err)
+	}
+	if k := migrated.Get(keys.TAG_KEY_EVENT).(*keys.KeyEvent); k.Code != keys.KEY_B || !k.Dirty() {
+		t.Fatalf("expect the component migrated,got %+v", k)
+	}
+}
@@ -0,0 +1,224 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/log"
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/network/etcdclient"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// TEST_ETCD_ENV the env of the endpoint of an etcd only for the tests,its keys are cleared by every test using it
+const TEST_ETCD_ENV = "LOKAS_TEST_ETCD"
+
+// startTestEtcd clear the etcd of TEST_ETCD_ENV for the test,the test is skipped if not set
+func startTestEtcd(t *testing.T) string {
+	endpoint := os.Getenv(TEST_ETCD_ENV)
+	if endpoint == "" {
+		t.Skip(TEST_ETCD_ENV + " not set")
+	}
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{endpoint}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = client.Delete(ctx, "", clientv3.WithPrefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return endpoint
+}
+
+// waitUntil poll cond until it is true,fail the test after 10s
+func waitUntil(t *testing.T, msg string, cond func() bool) {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal(msg)
+}
+
+// testProcess stand for lox.Process which is a singleton,
+// only the methods used by the registry and the singletons are implemented
+type testProcess struct {
+	lokas.IProcess
+	pid      util.ProcessId
+	etcd     *etcdclient.Client
+	registry *lox.Registry
+	router   *lox.Router
+	peers    map[util.ProcessId]*testProcess
+	idGen    int64
+	crashed  int32
+	mu       sync.Mutex
+	actors   map[util.ID]lokas.IActor
+}
+
+// newTestProcess create a process connected to the etcd at endpoint,without etcd if endpoint is empty
+func newTestProcess(t *testing.T, endpoint string, pid util.ProcessId) *testProcess {
+	ret := &testProcess{
+		pid:    pid,
+		actors: map[util.ID]lokas.IActor{},
+	}
+	if endpoint != "" {
+		ret.etcd = etcdclient.New(etcdclient.WithEndPoints(endpoint))
+		t.Cleanup(func() {
+			ret.etcd.Client.Close()
+		})
+	}
+	ret.registry = lox.NewRegistry(ret)
+	ret.router = lox.NewRouter(ret)
+	return ret
+}
+
+// linkTestProcesses let the processes send messages to each other like the proxies do
+func linkTestProcesses(processes ...*testProcess) {
+	peers := map[util.ProcessId]*testProcess{}
+	for _, p := range processes {
+		peers[p.pid] = p
+		p.peers = peers
+	}
+}
+
+func (this *testProcess) Send(id util.ProcessId, msg *protocol.RouteMessage) error {
+	peer, ok := this.peers[id]
+	if !ok {
+		return protocol.ERR_MSG_ROUTE_NOT_FOUND
+	}
+	peer.router.RouteMsg(msg)
+	return nil
+}
+
+func (this *testProcess) SubscribeTopic(topic string, actorId util.ID) error {
+	return this.registry.SubscribeTopic(topic, actorId)
+}
+
+func (this *testProcess) UnsubscribeTopic(topic string, actorId util.ID) error {
+	return this.registry.UnsubscribeTopic(topic, actorId)
+}
+
+func (this *testProcess) GetTopicSubscribers(topic string) []util.ID {
+	return this.registry.GetTopicSubscribers(topic)
+}
+
+func (this *testProcess) GetTopicProcesses(topic string) []util.ProcessId {
+	return this.registry.GetTopicProcesses(topic)
+}
+
+// crash make the process unable to reach etcd,like a process killed before its lease expired
+func (this *testProcess) crash() {
+	atomic.StoreInt32(&this.crashed, 1)
+}
+
+func (this *testProcess) GetLeaseId() (clientv3.LeaseID, bool, error) {
+	if atomic.LoadInt32(&this.crashed) != 0 {
+		return 0, false, errors.New("process crashed")
+	}
+	return this.registry.GetLeaseId()
+}
+
+func (this *testProcess) GlobalMutex(key string, ttl int) (*etcdclient.Mutex, error) {
+	return this.etcd.NewMutex(key, ttl)
+}
+
+func (this *testProcess) GenId() util.ID {
+	return util.ID(int64(this.pid)<<32 | atomic.AddInt64(&this.idGen, 1))
+}
+
+func (this *testProcess) AddActor(actor lokas.IActor) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.actors[actor.GetId()] = actor
+}
+
+func (this *testProcess) GetActor(id util.ID) lokas.IActor {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.actors[id]
+}
+
+func (this *testProcess) StartActor(actor lokas.IActor) error {
+	err := actor.Start()
+	if err != nil {
+		return err
+	}
+	return actor.OnStart()
+}
+
+func (this *testProcess) RemoveActor(actor lokas.IActor) {
+	this.mu.Lock()
+	_, ok := this.actors[actor.GetId()]
+	delete(this.actors, actor.GetId())
+	this.mu.Unlock()
+	if ok {
+		actor.Stop()
+		actor.OnStop()
+	}
+}
+
+func (this *testProcess) RegisterActorLocal(actor lokas.IActor) error {
+	return nil
+}
+
+func (this *testProcess) UnregisterActorLocal(actor lokas.IActor) error {
+	return nil
+}
+
+func (this *testProcess) RegisterActorRemote(actor lokas.IActor) error {
+	return nil
+}
+
+func (this *testProcess) UnregisterActorRemote(actor lokas.IActor) error {
+	return nil
+}
+
+func (this *testProcess) GetLogger() *log.ComposeLogger {
+	return log.DefaultLogger()
+}
+
+func (this *testProcess) GetEtcd() *etcdclient.Client {
+	return this.etcd
+}
+
+func (this *testProcess) PId() util.ProcessId {
+	return this.pid
+}
+
+func (this *testProcess) GetId() util.ID {
+	return util.ID(this.pid)
+}
+
+func (this *testProcess) GameId() string {
+	return "test"
+}
+
+func (this *testProcess) ServerId() int32 {
+	return 1
+}
+
+func (this *testProcess) Version() string {
+	return "1.0.0"
+}
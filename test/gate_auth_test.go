@@ -0,0 +1,183 @@
+package test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/jwt-go"
+)
+
+func TestJwtAuthenticator(t *testing.T) {
+	key := "test_signing_key"
+	auth := lox.NewJwtAuthenticator(key, false)
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, lox.ClaimUserCreator(&lox.User{Id: 5}, time.Hour)).SignedString([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := auth.Authenticate([]byte(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.UserId != 5 {
+		t.Errorf("expect user 5,got %d", identity.UserId)
+	}
+
+	expired, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, lox.ClaimUserCreator(&lox.User{Id: 5}, -time.Second)).SignedString([]byte(key))
+	_, err = auth.Authenticate([]byte(expired))
+	if !protocol.ERR_TOKEN_EXPIRED.Is(err) {
+		t.Errorf("expect token expired,got %v", err)
+	}
+	_, err = auth.Authenticate([]byte(token + "x"))
+	if !protocol.ERR_TOKEN_VALIDATE.Is(err) {
+		t.Errorf("expect token invalid,got %v", err)
+	}
+
+	//the refresh tokens are only accepted by AuthenticateRefresh
+	refresh, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, lox.SetTokenType(lox.ClaimUserCreator(&lox.User{Id: 5}, time.Hour), lox.TOKEN_REFRESH)).SignedString([]byte(key))
+	_, err = auth.Authenticate([]byte(refresh))
+	if !protocol.ERR_TOKEN_VALIDATE.Is(err) {
+		t.Errorf("expect refresh token refused,got %v", err)
+	}
+	identity, err = auth.AuthenticateRefresh([]byte(refresh))
+	if err != nil || identity.UserId != 5 {
+		t.Errorf("expect refresh token accepted,got %v", err)
+	}
+	_, err = auth.AuthenticateRefresh([]byte(token))
+	if !protocol.ERR_TOKEN_VALIDATE.Is(err) {
+		t.Errorf("expect access token refused by refresh,got %v", err)
+	}
+}
+
+// jwtTestProcess the config of the signing keys
+type jwtTestProcess struct {
+	lokas.IProcess
+	conf lokas.IConfig
+}
+
+func (this *jwtTestProcess) Config() lokas.IConfig {
+	return this.conf
+}
+
+// the tokens signed with SigningKeyPrivate are verified by SigningKeyPublic
+func TestJwtRSA(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := lox.NewAppConfig("account")
+	conf.Set("SigningKeyPrivate", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})))
+	conf.Set("SigningKeyPublic", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})))
+	process := &jwtTestProcess{conf: conf}
+
+	token, err := lox.SignToken(lox.ClaimUserCreator, &lox.User{Id: 5}, process, time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh, err := lox.SignRefreshToken(lox.ClaimUserCreator, &lox.User{Id: 5}, process, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := lox.NewJwtAuthenticator(conf.GetString("SigningKeyPublic"), true)
+	if identity, err := auth.Authenticate([]byte(token)); err != nil || identity.UserId != 5 {
+		t.Errorf("expect token verified,got %v", err)
+	}
+	if identity, err := auth.AuthenticateRefresh([]byte(refresh)); err != nil || identity.UserId != 5 {
+		t.Errorf("expect refresh token verified,got %v", err)
+	}
+	if _, err := lox.NewJwtAuthenticator(conf.GetString("SigningKeyPublic"), false).Authenticate([]byte(token)); !protocol.ERR_TOKEN_VALIDATE.Is(err) {
+		t.Errorf("expect token refused without rsa,got %v", err)
+	}
+
+	conf.Set("SigningKeyPrivate", "not a pem key")
+	if _, err := lox.SignToken(lox.ClaimUserCreator, &lox.User{Id: 5}, process, time.Hour, true); err == nil {
+		t.Error("expect invalid private key refused")
+	}
+}
+
+func TestHmacAndHttpAuthenticator(t *testing.T) {
+	hmacAuth := lox.NewHmacAuthenticator("secret")
+	data, _ := lox.SignHmacHandShake("secret", 7)
+	identity, err := hmacAuth.Authenticate(data)
+	if err != nil || identity.UserId != 7 {
+		t.Fatalf("expect user 7,got %v %v", identity, err)
+	}
+	bad, _ := lox.SignHmacHandShake("other", 7)
+	_, err = hmacAuth.Authenticate(bad)
+	if !protocol.ERR_TOKEN_VALIDATE.Is(err) {
+		t.Errorf("expect token invalid,got %v", err)
+	}
+	//the same handshake is refused within the skew window
+	_, err = hmacAuth.Authenticate(data)
+	if !protocol.ERR_HANDSHAKE_REPLAYED.Is(err) {
+		t.Errorf("expect handshake replayed,got %v", err)
+	}
+	data2, _ := lox.SignHmacHandShake("secret", 7)
+	if _, err = hmacAuth.Authenticate(data2); err != nil {
+		t.Errorf("expect a new nonce accepted,got %v", err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		if req["ticket"] == "ok" {
+			w.Write([]byte(`{"code":0,"user_id":"9","data":{"name":"tom"}}`))
+			return
+		}
+		w.Write([]byte(`{"code":1103,"message":"banned"}`))
+	}))
+	defer srv.Close()
+	httpAuth := lox.NewHttpAuthenticator(srv.URL, time.Second)
+
+	//jwt and hmac reject the ticket,the http auth service accepts it
+	chain := lox.AuthChain(lox.NewJwtAuthenticator("k", false), hmacAuth, httpAuth)
+	identity, err = chain.Authenticate([]byte(`{"ticket":"ok"}`))
+	if err != nil || identity.UserId != 9 {
+		t.Fatalf("expect user 9,got %v %v", identity, err)
+	}
+	_, err = chain.Authenticate([]byte(`{"ticket":"no"}`))
+	errMsg, ok := err.(*protocol.ErrMsg)
+	if !ok || errMsg.ErrCode() != 1103 {
+		t.Errorf("expect typed reject 1103,got %v", err)
+	}
+}
+
+// the sessions are looked up by user while the handshake is verifying them
+func TestGateSessionByUserId(t *testing.T) {
+	g := newResumeTestGate(t, 0, 0)
+	conn := newResumeTestConn()
+	sess := g.open(1, conn)
+	sess.Authenticator = lox.AuthenticatorFunc(func(data []byte) (*lox.Identity, error) {
+		return &lox.Identity{UserId: 7}, nil
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for g.gate.GetSessionByUserId(7) == nil {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	sendResumeTest(sess, conn, &protocol.HandShake{Data: []byte("{}")})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("verified session not found")
+	}
+	if g.gate.GetSessionByUserId(7) != sess || g.gate.GetSessionByUserId(8) != nil {
+		t.Fatal("unexpected session of the user")
+	}
+}
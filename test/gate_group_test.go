@@ -0,0 +1,139 @@
+package test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+)
+
+func TestGroupPublishMessage(t *testing.T) {
+	publish, err := lox.NewGroupPublish("guild_1", lox.NewResponse(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lox.GroupTopic(publish.Group) != "gate_group/guild_1" {
+		t.Errorf("unexpected topic %s", lox.GroupTopic(publish.Group))
+	}
+	msg, err := publish.Message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, ok := msg.(*lox.Response)
+	if !ok || !resp.OK {
+		t.Fatalf("expect response true,got %+v", msg)
+	}
+}
+
+func newGroupTestGate(t *testing.T) (*lox.Gate, *testProcess) {
+	p := newTestProcess(t, startTestEtcd(t), 1)
+	gate := lox.GateCtor.Create().(*lox.Gate)
+	gate.SetProcess(p)
+	gate.SetId(100)
+	p.AddActor(gate)
+	return gate, p
+}
+
+func addGroupTestSession(gate *lox.Gate, id util.ID) *resumeTestConn {
+	conn := newResumeTestConn()
+	gate.AddSession(id, lox.NewPassiveSession(conn, id, gate))
+	return conn
+}
+
+// subscribedGroup return whether the gate subscribes the topic of the group
+func subscribedGroup(p *testProcess, gate *lox.Gate, group string) bool {
+	for _, id := range p.GetTopicSubscribers(lox.GroupTopic(group)) {
+		if id == gate.GetId() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestGateGroup(t *testing.T) {
+	gate, p := newGroupTestGate(t)
+	conn1 := addGroupTestSession(gate, 1)
+	conn2 := addGroupTestSession(gate, 2)
+	conn3 := addGroupTestSession(gate, 3)
+
+	if err := gate.JoinGroup("g", 99); err != protocol.ERR_SESSION_NOT_FOUND {
+		t.Fatalf("expect session not found, got %v", err)
+	}
+	for _, id := range []util.ID{1, 2} {
+		err := gate.JoinGroup("g", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(gate.GroupMembers("g")) != 2 || !subscribedGroup(p, gate, "g") {
+		t.Fatalf("members %v, subscribed %v", gate.GroupMembers("g"), subscribedGroup(p, gate, "g"))
+	}
+
+	//the message is written to the members only
+	err := gate.PublishGroupLocal("g", lox.NewResponse(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range []*resumeTestConn{conn1, conn2} {
+		msg := conn.recv(t)
+		if msg == nil {
+			t.Fatal("member not received")
+		}
+		if resp, ok := msg.Body.(*lox.Response); !ok || !resp.OK {
+			t.Errorf("group msg mismatch, got %+v", msg.Body)
+		}
+	}
+	if msg := conn3.recv(t); msg != nil {
+		t.Errorf("non member received %+v", msg.Body)
+	}
+
+	//the topic is kept until the last member left
+	gate.LeaveGroup("g", 1)
+	if !subscribedGroup(p, gate, "g") {
+		t.Error("topic unsubscribed with a member left")
+	}
+	gate.PublishGroupLocal("g", lox.NewResponse(true))
+	if conn1.recv(t) != nil || conn2.recv(t) == nil {
+		t.Error("group msg after leave")
+	}
+	gate.RemoveSession(2)
+	if len(gate.GroupMembers("g")) != 0 || subscribedGroup(p, gate, "g") {
+		t.Error("topic kept without members")
+	}
+	if err := gate.PublishGroupLocal("g", lox.NewResponse(true)); err != nil {
+		t.Error(err)
+	}
+}
+
+// a member joining while the last one leaves must keep the subscription of the gate
+func TestGateGroupJoinRace(t *testing.T) {
+	gate, p := newGroupTestGate(t)
+	addGroupTestSession(gate, 1)
+	addGroupTestSession(gate, 2)
+	for i := 0; i < 50; i++ {
+		err := gate.JoinGroup("g", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			gate.LeaveGroup("g", 1)
+		}()
+		go func() {
+			defer wg.Done()
+			gate.JoinGroup("g", 2)
+		}()
+		wg.Wait()
+		if len(gate.GroupMembers("g")) != 1 || !subscribedGroup(p, gate, "g") {
+			t.Fatalf("member left without subscription, round %d", i)
+		}
+		gate.LeaveGroup("g", 2)
+		if subscribedGroup(p, gate, "g") {
+			t.Fatalf("subscription kept without members, round %d", i)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/network"
+	"github.com/nomos/go-lokas/protocol"
+)
+
+func TestSessionKicked(t *testing.T) {
+	data, err := protocol.MarshalMessage(0, lox.NewSessionKicked(100, lox.KICK_DUPLICATE_LOGIN), protocol.BINARY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := protocol.UnmarshalMessage(data, protocol.BINARY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kick, ok := msg.Body.(*lox.SessionKicked)
+	if !ok || kick.AvatarId != 100 || kick.Reason != lox.KICK_DUPLICATE_LOGIN {
+		t.Fatalf("unexpected kick %+v", msg.Body)
+	}
+
+	//the gate process is kept in etcd so that the events go to the gate taking over
+	sess := lox.NewAvatarSession(100)
+	sess.SetGate(200, 3)
+	value, _ := json.Marshal(sess)
+	loaded := lox.NewAvatarSession(0)
+	if err := json.Unmarshal(value, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if id, pid := loaded.GetGate(); id != 200 || pid != 3 {
+		t.Errorf("unexpected gate %d %d", id, pid)
+	}
+}
+
+// the replies taken by the pending calls are not handled again by the session
+func TestSessionReplyHooked(t *testing.T) {
+	conn := newResumeTestConn()
+	sess := lox.NewPassiveSession(conn, 1, nil)
+	ctx := network.NewDefaultContextWithTimeout(context.TODO(), 7, time.Second)
+	sess.ReqContexts[7] = ctx
+	sess.OnMessage(protocol.NewRouteMessage(2, 1, 7, lox.NewResponse(true), false))
+	if resp, ok := ctx.GetResp().(*lox.Response); !ok || !resp.OK {
+		t.Errorf("reply not taken by the call,got %+v", ctx.GetResp())
+	}
+	if msg := conn.recv(t); msg != nil {
+		t.Errorf("hooked reply written to the client,got %+v", msg.Body)
+	}
+}
@@ -0,0 +1,162 @@
+package test
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/protocol"
+)
+
+func TestGateLimiter(t *testing.T) {
+	limiter := lox.NewGateLimiter(&lox.GateLimitConfig{
+		ConnPerIP:     2,
+		Msg:           lox.RateLimit{Rate: 1, Burst: 5},
+		Cmd:           map[protocol.BINARY_TAG]lox.RateLimit{protocol.TAG_Ping: {Rate: 1, Burst: 2}},
+		BanAfterKicks: 2,
+		BanWindow:     time.Minute,
+		BanDuration:   time.Minute,
+	})
+	ip := "10.0.0.1"
+	if !limiter.CheckIP(ip) {
+		t.Fatal("expect first conn allowed")
+	}
+	s1 := limiter.Acquire(ip)
+	s2 := limiter.Acquire(ip)
+	if limiter.CheckIP(ip) {
+		t.Fatal("expect conn_per_ip refused")
+	}
+	if limiter.Acquire(ip) != nil {
+		t.Fatal("expect acquire refused by conn_per_ip")
+	}
+	s2.Release()
+	s2.Release()
+	if !limiter.CheckIP(ip) {
+		t.Fatal("expect conn allowed after release")
+	}
+
+	ping, _ := protocol.MarshalMessage(0, &protocol.Ping{}, protocol.BINARY)
+	if !s1.Allow(ping) || !s1.Allow(ping) {
+		t.Fatal("expect ping burst allowed")
+	}
+	if s1.Allow(ping) {
+		t.Fatal("expect ping limited by cmd rate")
+	}
+	pong, _ := protocol.MarshalMessage(0, &protocol.Pong{}, protocol.BINARY)
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if s1.Allow(pong) {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Fatalf("expect the rest of msg burst allowed,got %d", allowed)
+	}
+
+	s1.Kick()
+	s1.Kick()
+	if limiter.CheckIP(ip) {
+		t.Fatal("expect ip banned after kicks")
+	}
+	if limiter.Acquire(ip) != nil {
+		t.Fatal("expect acquire refused by the ban")
+	}
+	stats := limiter.Stats()
+	if stats.Accepted != 2 || stats.Kicked != 2 || stats.Banned != 1 || stats.RefusedConn != 2 || stats.RefusedBanned != 2 || stats.Conns != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if !limiter.Unban(ip) || !limiter.CheckIP(ip) {
+		t.Fatal("expect ip allowed after unban")
+	}
+}
+
+// the connections accepted at once from an ip never exceed conn_per_ip
+func TestGateLimiterBurst(t *testing.T) {
+	limiter := lox.NewGateLimiter(&lox.GateLimitConfig{ConnPerIP: 3})
+	ip := "10.0.0.2"
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	acquired := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !limiter.CheckIP(ip) {
+				return
+			}
+			if limiter.Acquire(ip) != nil {
+				mu.Lock()
+				acquired++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	stats := limiter.Stats()
+	if acquired != 3 || stats.Conns != 3 || stats.Accepted != 3 {
+		t.Fatalf("expect 3 conns acquired,got %d %+v", acquired, stats)
+	}
+}
+
+// the kicks out of the ban window are forgotten
+func TestGateLimiterSweepKicks(t *testing.T) {
+	limiter := lox.NewGateLimiter(&lox.GateLimitConfig{
+		BanAfterKicks: 3,
+		BanWindow:     50 * time.Millisecond,
+		BanDuration:   50 * time.Millisecond,
+	})
+	for i := 0; i < 10; i++ {
+		s := limiter.Acquire(fmt.Sprintf("10.0.1.%d", i))
+		s.Kick()
+		s.Release()
+	}
+	if stats := limiter.Stats(); stats.KickedIPs != 10 {
+		t.Fatalf("expect 10 kicked ips,got %d", stats.KickedIPs)
+	}
+	time.Sleep(100 * time.Millisecond)
+	s := limiter.Acquire("10.0.2.1")
+	s.Kick()
+	if stats := limiter.Stats(); stats.KickedIPs != 1 {
+		t.Fatalf("expect the expired kicks swept,got %d", stats.KickedIPs)
+	}
+}
+
+// limitTestConn a client connection from the ip
+type limitTestConn struct {
+	*resumeTestConn
+	addr net.Addr
+}
+
+func (this *limitTestConn) RemoteAddr() net.Addr {
+	return this.addr
+}
+
+// the sessions refused by conn_per_ip are never registered nor started
+func TestGateLimiterRefused(t *testing.T) {
+	p := newTestProcess(t, "", 1)
+	gate := lox.GateCtor.Create().(*lox.Gate)
+	gate.SetProcess(p)
+	gate.Limiter = lox.NewGateLimiter(&lox.GateLimitConfig{ConnPerIP: 1})
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.3.1"), Port: 1000}
+	conn1 := &limitTestConn{resumeTestConn: newResumeTestConn(), addr: addr}
+	sess1 := gate.SessionCreator(conn1)
+	if conn1.isClosed() || gate.GetSession(sess1.GetId()) == nil || p.GetActor(sess1.GetId()) == nil {
+		t.Fatal("expect the first session registered")
+	}
+	conn2 := &limitTestConn{resumeTestConn: newResumeTestConn(), addr: addr}
+	sess2 := gate.SessionCreator(conn2)
+	if !conn2.isClosed() || gate.GetSession(sess2.GetId()) != nil || p.GetActor(sess2.GetId()) != nil {
+		t.Fatal("expect the refused session closed and not registered")
+	}
+	sess2.OnOpen(conn2)
+	sess2.OnClose(conn2)
+	if gate.GetSession(sess2.GetId()) != nil {
+		t.Fatal("expect the refused session not registered on open")
+	}
+	if stats := gate.Limiter.Stats(); stats.Conns != 1 || stats.RefusedConn != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,105 @@
+package test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/protocol"
+)
+
+func TestGateRouter(t *testing.T) {
+	conf := lox.NewAppConfig("gate")
+	err := conf.Viper.ReadConfig(strings.NewReader(`
+[routes.game]
+cmd = "1000-1999,2500"
+target = "avatar"
+[routes.chat]
+cmd = "1500-1599"
+target = "service"
+service = "chat"
+service_id = 1
+[routes.gm]
+cmd = "3000"
+target = "local"
+handler = "gm"
+[routes.say]
+cmd = "3100"
+target = "local"
+handler = "gm"
+mute = true
+[routes.lokas]
+package = "github.com/nomos/go-lokas/protocol"
+target = "local"
+handler = "gm"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := lox.LoadGateRouter(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[protocol.BINARY_TAG]string{
+		1000:              "game",
+		1550:              "chat",
+		1999:              "game",
+		2500:              "game",
+		3000:              "gm",
+		3100:              "say",
+		protocol.TAG_Ping: "lokas",
+	}
+	for cmdId, name := range expect {
+		route := router.Match(cmdId)
+		if route == nil || route.Name != name {
+			t.Errorf("expect cmd %d routed to %s,got %+v", cmdId, name, route)
+		}
+	}
+	if route := router.Match(2000); route != nil {
+		t.Errorf("expect cmd 2000 not routed,got %s", route.Name)
+	}
+	if route := router.Match(1550); route.Target != lox.ROUTE_SERVICE || route.Service != "chat" || route.ServiceId != 1 {
+		t.Errorf("unexpected chat route %+v", route)
+	}
+
+	called := false
+	router.Handle("gm", func(sess *lox.PassiveSession, msg *protocol.BinaryMessage) (protocol.ISerializable, error) {
+		called = msg.CmdId == 3000
+		return nil, nil
+	})
+	routed, err := router.Route(nil, &protocol.BinaryMessage{CmdId: 3000})
+	if !routed || err != nil || !called {
+		t.Fatalf("expect local handler called,got %v %v %v", routed, err, called)
+	}
+	//the muted users are refused by the mute routes
+	sess := lox.NewPassiveSession(nil, 1, nil)
+	sess.Identity = &lox.Identity{UserId: 1, User: &lox.User{Id: 1, State: lox.ACC_MUTE}}
+	called = false
+	routed, err = router.Route(sess, &protocol.BinaryMessage{CmdId: 3100})
+	if !routed || !protocol.ERR_ACC_MUTE.Is(err) || called {
+		t.Errorf("expect muted user refused,got %v %v %v", routed, err, called)
+	}
+	if _, err := router.Route(sess, &protocol.BinaryMessage{CmdId: 3000}); err != nil || !called {
+		t.Errorf("expect muted user routed by the other routes,got %v %v", err, called)
+	}
+	sess.Identity.User.(*lox.User).StateExpire = time.Now().Add(-time.Second).Unix()
+	if _, err := router.Route(sess, &protocol.BinaryMessage{CmdId: 3100}); err != nil {
+		t.Errorf("expect mute expired,got %v", err)
+	}
+	routed, _ = router.Route(nil, &protocol.BinaryMessage{CmdId: 2000})
+	if routed {
+		t.Fatal("expect unmatched cmd not routed")
+	}
+
+	bad := lox.NewAppConfig("gate")
+	bad.Viper.ReadConfig(strings.NewReader(`
+[routes.x]
+cmd = "20-10"
+target = "avatar"
+`))
+	_, err = lox.LoadGateRouter(bad)
+	if !protocol.ERR_CONFIG_ERROR.Is(err) {
+		t.Errorf("expect config error,got %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+package test
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestInbox(t *testing.T) {
+	conf := lox.NewAppConfig("inbox")
+	err := conf.Viper.ReadConfig(strings.NewReader(`
+ttl = "72h"
+max = 10
+max_size = "1KB"
+types = ["HandShake"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbox := lox.NewInbox()
+	if err := inbox.Load(conf); err != nil {
+		t.Fatal(err)
+	}
+	if inbox.TTL != time.Hour*72 || inbox.Max != 10 || inbox.MaxSize != 1024 {
+		t.Fatalf("unexpected inbox config %+v", inbox)
+	}
+	cases := []struct {
+		msg    *protocol.RouteMessage
+		expect bool
+	}{
+		{protocol.NewRouteMessage(1, 2, 0, &protocol.HandShake{}, true), true},
+		{protocol.NewRouteMessage(1, 2, 3, &protocol.HandShake{}, true), false},
+		{protocol.NewRouteMessage(1, 2, 0, &protocol.Ping{}, true), false},
+	}
+	for i, c := range cases {
+		if inbox.IsPersistent(c.msg) != c.expect {
+			t.Errorf("case %d:expect %v", i, c.expect)
+		}
+	}
+	large := protocol.NewRouteMessage(1, 2, 0, &protocol.HandShake{Data: bytes.Repeat([]byte("x"), 2048)}, true)
+	if err := inbox.Put(large); err != protocol.ERR_MSG_LEN_INVALID {
+		t.Errorf("expect large message rejected,got %v", err)
+	}
+
+	bad := lox.NewAppConfig("inbox")
+	bad.Viper.ReadConfig(strings.NewReader(`types = ["NotAType"]`))
+	if err := lox.NewInbox().Load(bad); err == nil {
+		t.Error("expect unknown type rejected")
+	}
+}
+
+// inboxTestStore keep the inbox messages in memory
+type inboxTestStore struct {
+	mu     sync.Mutex
+	msgs   map[util.ID]*lox.InboxMessage
+	onFind func() //called once after the next find
+}
+
+func (this *inboxTestStore) Insert(m *lox.InboxMessage) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.msgs[m.Id] = m
+	return nil
+}
+
+func (this *inboxTestStore) Find(to util.ID) ([]*lox.InboxMessage, error) {
+	this.mu.Lock()
+	ret := []*lox.InboxMessage{}
+	for _, m := range this.msgs {
+		if m.To == to {
+			ret = append(ret, m)
+		}
+	}
+	onFind := this.onFind
+	this.onFind = nil
+	this.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Id < ret[j].Id
+	})
+	if onFind != nil {
+		onFind()
+	}
+	return ret, nil
+}
+
+func (this *inboxTestStore) Remove(ids []util.ID) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, id := range ids {
+		delete(this.msgs, id)
+	}
+	return nil
+}
+
+func (this *inboxTestStore) count(to util.ID) int {
+	msgs, _ := this.Find(to)
+	return len(msgs)
+}
+
+func newInboxTest(t *testing.T, store *inboxTestStore) *lox.Inbox {
+	inbox := lox.NewInbox()
+	inbox.SetProcess(newTestProcess(t, "", 1))
+	inbox.Store = store
+	inbox.Max = 3
+	inbox.TTL = time.Hour
+	inbox.RegisterPersistent(protocol.TAG_HandShake)
+	return inbox
+}
+
+func TestInboxDeliver(t *testing.T) {
+	store := &inboxTestStore{msgs: map[util.ID]*lox.InboxMessage{}}
+	inbox := newInboxTest(t, store)
+	if err := inbox.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer inbox.Stop()
+	for i := byte(1); i <= 5; i++ {
+		err := inbox.Put(protocol.NewRouteMessage(1, 2, 0, &protocol.HandShake{Data: []byte{i}}, true))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	inbox.Put(protocol.NewRouteMessage(1, 3, 0, &protocol.HandShake{Data: []byte{9}}, true))
+
+	//stored in order,the oldest dropped beyond Max
+	msgs, err := inbox.Fetch(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("expect 3 messages kept,got %d", len(msgs))
+	}
+	for i, m := range msgs {
+		msg, err := protocol.UnmarshalBinaryMessage(m.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hs, ok := msg.Body.(*protocol.HandShake); !ok || hs.Data[0] != byte(i+3) || m.From != 1 || m.Cmd != protocol.TAG_HandShake {
+			t.Errorf("message %d mismatch,got %+v", i, msg.Body)
+		}
+		if d := time.Until(m.Expire); d < time.Minute*59 || d > time.Hour {
+			t.Errorf("message %d expire,got %v", i, m.Expire)
+		}
+	}
+
+	//the expired messages are not fetched
+	store.Insert(&lox.InboxMessage{Id: 1, To: 3, Expire: time.Now().Add(-time.Second)})
+	if msgs, _ := inbox.Fetch(3); len(msgs) != 1 {
+		t.Errorf("expect expired message skipped,got %d", len(msgs))
+	}
+
+	//delivered in order,a message stored meanwhile is kept even with a smaller id
+	actor := lox.NewActor()
+	actor.SetId(2)
+	store.onFind = func() {
+		store.Insert(&lox.InboxMessage{Id: 2, To: 2})
+	}
+	if err := inbox.Deliver(actor); err != nil {
+		t.Fatal(err)
+	}
+	for i := byte(3); i <= 5; i++ {
+		select {
+		case msg := <-actor.MsgChan:
+			if hs, ok := msg.Body.(*protocol.HandShake); !ok || hs.Data[0] != i || msg.FromActor != 1 {
+				t.Errorf("delivered message mismatch,got %+v", msg.Body)
+			}
+		default:
+			t.Fatalf("message %d not delivered", i)
+		}
+	}
+	if store.count(2) != 1 {
+		t.Errorf("expect the message stored meanwhile kept,got %d", store.count(2))
+	}
+}
+
+// the router never waits for the inbox
+func TestInboxQueueFull(t *testing.T) {
+	inbox := newInboxTest(t, &inboxTestStore{msgs: map[util.ID]*lox.InboxMessage{}})
+	msg := protocol.NewRouteMessage(1, 2, 0, &protocol.HandShake{}, true)
+	var err error
+	for i := 0; i < 2048 && err == nil; i++ {
+		err = inbox.Put(msg)
+	}
+	if err != protocol.ERR_INBOX_FULL {
+		t.Errorf("expect queue full,got %v", err)
+	}
+}
+
+// the messages never expire are stored without expire,otherwise the ttl index removes them at once
+func TestInboxNoExpire(t *testing.T) {
+	store := &inboxTestStore{msgs: map[util.ID]*lox.InboxMessage{}}
+	inbox := newInboxTest(t, store)
+	inbox.TTL = 0
+	if err := inbox.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer inbox.Stop()
+	if err := inbox.Put(protocol.NewRouteMessage(1, 2, 0, &protocol.HandShake{}, true)); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "message not stored", func() bool {
+		return store.count(2) == 1
+	})
+	msgs, _ := store.Find(2)
+	data, err := bson.Marshal(msgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bson.Raw(data).LookupErr("expire"); err == nil {
+		t.Errorf("expect no expire stored,got %v", bson.Raw(data))
+	}
+	data, _ = bson.Marshal(&lox.InboxMessage{Expire: time.Now()})
+	if _, err := bson.Raw(data).LookupErr("expire"); err != nil {
+		t.Errorf("expect expire stored,got %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/network/kcp"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+)
+
+type kcpTestSession struct {
+	conn lokas.IConn
+	echo bool
+	recv chan []byte
+}
+
+func (this *kcpTestSession) GetId() util.ID          { return 0 }
+func (this *kcpTestSession) GetConn() lokas.IConn    { return this.conn }
+func (this *kcpTestSession) OnOpen(conn lokas.IConn) {}
+func (this *kcpTestSession) OnClose(conn lokas.IConn) {
+}
+func (this *kcpTestSession) OnRecv(conn lokas.IConn, data []byte) {
+	d := make([]byte, len(data))
+	copy(d, data)
+	if this.echo {
+		conn.Write(d)
+		return
+	}
+	this.recv <- d
+}
+
+func kcpTestContext(sess *kcpTestSession) *lokas.Context {
+	return &lokas.Context{
+		SessionCreator: func(conn lokas.IConn) lokas.ISession {
+			sess.conn = conn
+			return sess
+		},
+		Splitter:          protocol.Split,
+		ChanSize:          200,
+		LongPacketPicker:  protocol.PickLongPacket(protocol.BINARY),
+		LongPacketCreator: protocol.CreateLongPacket(protocol.BINARY),
+		MaxPacketWriteLen: protocol.DEFAULT_PACKET_LEN,
+	}
+}
+
+func TestKcpEcho(t *testing.T) {
+	server := kcp.NewServer(kcpTestContext(&kcpTestSession{echo: true}))
+	err := server.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client := &kcpTestSession{recv: make(chan []byte, 100)}
+	conn, err := kcp.Dial(server.Addr(), kcpTestContext(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < 20; i++ {
+		data, _ := protocol.MarshalMessage(uint32(i+1), lox.NewResponse(true), protocol.BINARY)
+		conn.Write(data)
+	}
+	for i := 0; i < 20; i++ {
+		select {
+		case data := <-client.recv:
+			msg, err := protocol.UnmarshalMessage(data, protocol.BINARY)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.TransId != uint32(i+1) {
+				t.Fatalf("expect trans id %d,got %d", i+1, msg.TransId)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting message %d", i+1)
+		}
+	}
+}
+
+// lossyPacketConn drop every n-th outgoing datagram
+type lossyPacketConn struct {
+	net.PacketConn
+	n     int64
+	count int64
+}
+
+func (this *lossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if atomic.AddInt64(&this.count, 1)%this.n == 0 {
+		return len(b), nil
+	}
+	return this.PacketConn.WriteTo(b, addr)
+}
+
+func TestKcpLossyStream(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := kcp.NewListener(&lossyPacketConn{PacketConn: pc, n: 3})
+	defer l.Close()
+
+	payload := make([]byte, 200*1024)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	go func() {
+		sess, err := l.Accept()
+		if err != nil {
+			return
+		}
+		sess.Write(payload)
+	}()
+
+	sess, err := kcp.DialSession(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	//the server learns the session from the first push
+	sess.Write([]byte("hello"))
+	sess.SetReadDeadline(time.Now().Add(10 * time.Second))
+	recv := make([]byte, len(payload))
+	_, err = io.ReadFull(sess, recv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(recv, payload) {
+		t.Fatal("payload mismatch")
+	}
+}
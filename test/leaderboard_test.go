@@ -0,0 +1,70 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/protocol"
+)
+
+func TestLeaderboard(t *testing.T) {
+	conf := lox.NewAppConfig("leaderboard")
+	err := conf.Viper.ReadConfig(strings.NewReader(`
+line_id = 2
+tie_bits = 20
+[boards.level]
+policy = "max"
+reset = "0 0 5 ? * 1"
+archive = 100
+[boards.kills]
+policy = "sum"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	board := lox.LeaderboardCtor.Create().(*lox.Leaderboard)
+	if err := board.Load(conf); err != nil {
+		t.Fatal(err)
+	}
+	if board.LineId != 2 || board.TieBits != 20 || len(board.Boards) != 2 {
+		t.Fatalf("unexpected config %+v", board)
+	}
+	if b := board.Boards["level"]; b.Policy != lox.LEADERBOARD_MAX || b.Archive != 100 || b.Reset == "" {
+		t.Fatalf("unexpected board %+v", b)
+	}
+	if err := board.Register(&lox.LeaderboardBoard{Name: "bad", Policy: "min"}); !protocol.ERR_CONFIG_ERROR.Is(err) {
+		t.Errorf("expect ERR_CONFIG_ERROR,got %v", err)
+	}
+
+	//the equal scores reached earlier rank higher
+	early := lox.EncodeLeaderboardScore(100, 10, 20)
+	late := lox.EncodeLeaderboardScore(100, 20, 20)
+	if early <= late || lox.EncodeLeaderboardScore(101, 1<<30, 20) <= early {
+		t.Fatalf("unexpected order %d %d", early, late)
+	}
+	for _, score := range []int64{0, 100, -100} {
+		v := lox.EncodeLeaderboardScore(score, 30, 20)
+		s, tm := lox.DecodeLeaderboardScore(v, 1000, 20)
+		if s != score || tm != 1030 {
+			t.Errorf("unexpected decode %d %d of %d", s, tm, score)
+		}
+	}
+
+	data, err := protocol.MarshalMessage(0, &lox.LeaderboardPage{
+		Board:   "level",
+		Total:   2,
+		Entries: []*lox.LeaderboardEntry{{Member: 1, Score: 10, Rank: 1}, {Member: 2, Score: 9, Rank: 2}},
+	}, protocol.BINARY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := protocol.UnmarshalMessage(data, protocol.BINARY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, ok := msg.Body.(*lox.LeaderboardPage)
+	if !ok || len(page.Entries) != 2 || page.Entries[1].Member != 2 || page.Entries[1].Rank != 2 {
+		t.Fatalf("unexpected page %+v", msg.Body)
+	}
+}
@@ -0,0 +1,139 @@
+package test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+)
+
+func TestMatchQueue(t *testing.T) {
+	conf := lox.NewAppConfig("matchmaking")
+	err := conf.Viper.ReadConfig(strings.NewReader(`
+team_size = 1
+bucket = 100
+widen_after = "10s"
+max_widen = 2
+timeout = "1m"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mode, err := lox.LoadMatchMode("duel", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode.Teams != 2 || mode.Interval != time.Second || mode.RoomService == "" {
+		t.Fatalf("unexpected mode %+v", mode)
+	}
+	id := util.ID(1000)
+	genId := func() util.ID {
+		id++
+		return id
+	}
+	now := time.Now()
+	queue := lox.NewMatchQueue(mode)
+	if err := queue.Add(&lox.MatchTicket{Members: []util.ID{1, 2}}); !protocol.ERR_MATCH_PARTY_INVALID.Is(err) {
+		t.Errorf("expect ERR_MATCH_PARTY_INVALID,got %v", err)
+	}
+	queue.Add(&lox.MatchTicket{Members: []util.ID{1}, Skill: 1000, Enqueued: now})
+	if err := queue.Add(&lox.MatchTicket{Members: []util.ID{1}, Skill: 1000, Enqueued: now}); !protocol.ERR_MATCH_QUEUED.Is(err) {
+		t.Errorf("expect ERR_MATCH_QUEUED,got %v", err)
+	}
+	queue.Add(&lox.MatchTicket{Members: []util.ID{2}, Skill: 1150, Enqueued: now})
+
+	//the skills in the next bucket match after the window widens
+	if matches := queue.Match(now, genId); len(matches) != 0 {
+		t.Fatalf("unexpected matches %+v", matches)
+	}
+	matches := queue.Match(now.Add(time.Second*10), genId)
+	if len(matches) != 1 || matches[0].Id != 1001 || queue.Len() != 0 {
+		t.Fatalf("unexpected matches %+v", matches)
+	}
+	if m := matches[0]; m.Teams[0][0] != 1 || m.Teams[1][0] != 2 {
+		t.Fatalf("unexpected teams %v", m.Teams)
+	}
+
+	//the failed matches keep their places
+	queue.Add(&lox.MatchTicket{Members: []util.ID{3}, Skill: 0, Enqueued: now.Add(time.Second)})
+	queue.Requeue(matches[0].Tickets)
+	if queue.Len() != 3 || queue.Remove(2) == nil || queue.Remove(2) != nil {
+		t.Fatalf("unexpected queue %d", queue.Len())
+	}
+	expired := queue.Expire(now.Add(time.Minute))
+	if len(expired) != 1 || expired[0].Members[0] != 1 || queue.Len() != 1 {
+		t.Fatalf("unexpected expired %+v", expired)
+	}
+
+	//the parties fill the teams with the most free places
+	mode.TeamSize = 2
+	queue = lox.NewMatchQueue(mode)
+	queue.Add(&lox.MatchTicket{Members: []util.ID{1, 2}, Enqueued: now})
+	queue.Add(&lox.MatchTicket{Members: []util.ID{3}, Enqueued: now})
+	queue.Add(&lox.MatchTicket{Members: []util.ID{4, 5}, Enqueued: now})
+	queue.Add(&lox.MatchTicket{Members: []util.ID{6}, Enqueued: now})
+	matches = queue.Match(now, genId)
+	if len(matches) != 1 || queue.Len() != 1 {
+		t.Fatalf("unexpected matches %+v", matches)
+	}
+	if m := matches[0]; len(m.Teams[0]) != 2 || len(m.Teams[1]) != 2 || m.Teams[1][0] != 3 || m.Teams[1][1] != 6 {
+		t.Fatalf("unexpected teams %v", m.Teams)
+	}
+
+	data, err := protocol.MarshalMessage(0, &lox.MatchFound{
+		Mode:   "duel",
+		RoomId: 1001,
+		LineId: 2,
+		Team:   1,
+		Teams:  []*lox.MatchTeam{{Members: []int64{1}}, {Members: []int64{2}}},
+	}, protocol.BINARY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := protocol.UnmarshalMessage(data, protocol.BINARY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, ok := msg.Body.(*lox.MatchFound)
+	if !ok || found.LineId != 2 || len(found.Teams) != 2 || found.Teams[1].Members[0] != 2 {
+		t.Fatalf("unexpected found %+v", msg.Body)
+	}
+}
+
+func TestMatchmakerSender(t *testing.T) {
+	conf := lox.NewAppConfig("matchmaking")
+	err := conf.Viper.ReadConfig(strings.NewReader(`
+team_size = 2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mode, err := lox.LoadMatchMode("duo", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maker := lox.NewMatchmaker(mode)
+
+	//the sender queues only the parties it is part of
+	_, err = maker.HandleMsg(3, 0, &lox.MatchJoin{Mode: "duo", Party: []int64{1, 2}})
+	if !protocol.ERR_MATCH_FORBIDDEN.Is(err) || maker.Queue.Len() != 0 {
+		t.Fatalf("expect ERR_MATCH_FORBIDDEN,got %v", err)
+	}
+	_, err = maker.HandleMsg(1, 0, &lox.MatchJoin{Mode: "duo", Party: []int64{1, 2}})
+	if err != nil || maker.Queue.Len() != 1 {
+		t.Fatalf("join failed %v", err)
+	}
+
+	//the sender cancels only its own ticket
+	_, err = maker.HandleMsg(3, 0, &lox.MatchCancel{Mode: "duo", AvatarId: 1})
+	if !protocol.ERR_MATCH_FORBIDDEN.Is(err) || maker.Queue.Len() != 1 {
+		t.Fatalf("expect ERR_MATCH_FORBIDDEN,got %v", err)
+	}
+	_, err = maker.HandleMsg(3, 0, &lox.MatchCancel{Mode: "duo"})
+	if !protocol.ERR_MATCH_NOT_QUEUED.Is(err) || maker.Queue.Len() != 1 {
+		t.Fatalf("expect ERR_MATCH_NOT_QUEUED,got %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/util/keys"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMigrator(t *testing.T) {
+	mapper := lox.NewComponentMapper("").Register(keys.TAG_KEY_EVENT).RegisterMigration(keys.TAG_KEY_EVENT, func(doc bson.M) error {
+		return nil
+	})
+	migrator := lox.NewMigrator(mapper).
+		Register("user", func(doc bson.M) error {
+			doc["nick"] = doc["name"]
+			delete(doc, "name")
+			return nil
+		}).
+		Register("user", func(doc bson.M) error {
+			doc["level"] = int32(1)
+			return nil
+		})
+	if migrator.Version("user") != 2 {
+		t.Fatalf("unexpected version %d", migrator.Version("user"))
+	}
+	if colls := migrator.Collections(); len(colls) != 2 || colls[0] != lox.AVATAR_COLLECTION || colls[1] != "user" {
+		t.Fatalf("unexpected collections %v", colls)
+	}
+
+	//migrations apply from the version of the document in order
+	doc := bson.M{"name": "lokas"}
+	changed, err := migrator.Migrate("user", doc)
+	if err != nil || !changed {
+		t.Fatalf("expect migrated,got %v", err)
+	}
+	if doc["nick"] != "lokas" || doc["level"] != int32(1) || doc[lox.DOC_VERSION] != int32(2) {
+		t.Fatalf("unexpected doc %v", doc)
+	}
+	doc = bson.M{"nick": "lokas", lox.DOC_VERSION: int64(1)}
+	if changed, _ = migrator.Migrate("user", doc); !changed || doc["level"] != int32(1) {
+		t.Fatalf("expect only the second migration applied,got %v", doc)
+	}
+	if changed, _ = migrator.Migrate("user", doc); changed {
+		t.Error("expect the current version not migrated again")
+	}
+	if changed, _ = migrator.Migrate("other", bson.M{}); changed {
+		t.Error("expect collections without migrations unchanged")
+	}
+
+	//the version of the loaded users is kept by their saves
+	if (*lox.Migrator)(nil).Version(lox.USER_COLLECTION) != 0 {
+		t.Error("expect a nil Migrator of version 0")
+	}
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &lox.User{}
+	if err = bson.Unmarshal(data, user); err != nil || user.Version != 2 {
+		t.Fatalf("unexpected user version %d,%v", user.Version, err)
+	}
+}
@@ -0,0 +1,85 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+	"github.com/nomos/go-lokas/util/zip"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPlayerArchive(t *testing.T) {
+	archive := &lox.PlayerArchive{
+		Manifest: &lox.PlayerArchiveManifest{
+			Version:     lox.PLAYER_ARCHIVE_VERSION,
+			UserId:      1,
+			Avatars:     []util.ID{10, 11},
+			Collections: map[string]string{lox.AVATAR_COLLECTION: "_id", lox.INBOX_COLLECTION: "to"},
+		},
+		User: &lox.User{Id: 1, UserName: "lokas", Token: "token", Avatars: map[string]util.ID{"g_1": 10, "g_2": 11}},
+		AvatarMaps: []*lox.AvatarMap{
+			{Id: 10, UserId: 1, GameId: "g", ServerId: 1, UserName: "lokas"},
+			{Id: 11, UserId: 1, GameId: "g", ServerId: 2, UserName: "lokas"},
+		},
+		Docs: map[string][]bson.D{
+			lox.AVATAR_COLLECTION: {{{Key: "_id", Value: int64(10)}, {Key: "level", Value: int32(3)}}, {{Key: "_id", Value: int64(11)}}},
+			lox.INBOX_COLLECTION:  {{{Key: "_id", Value: int64(100)}, {Key: "to", Value: int64(10)}}, {{Key: "_id", Value: int64(101)}, {Key: "to", Value: int64(10)}}},
+		},
+	}
+	data, err := archive.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := lox.UnmarshalPlayerArchive(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.User.UserName != "lokas" || len(loaded.AvatarMaps) != 2 || len(loaded.Docs[lox.INBOX_COLLECTION]) != 2 {
+		t.Fatalf("unexpected archive %+v", loaded)
+	}
+
+	//the avatars on different servers can not be moved to the same one
+	id := util.ID(1000)
+	genId := func() util.ID {
+		id++
+		return id
+	}
+	if _, err := loaded.Remap("h", 5, genId); !protocol.ERR_GAME_ACC_EXIST.Is(err) {
+		t.Fatalf("expect ERR_GAME_ACC_EXIST,got %v", err)
+	}
+	loaded, _ = lox.UnmarshalPlayerArchive(data)
+	id = 1000
+	ids, err := loaded.Remap("h", -1, genId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.User.Id != 1001 || ids[10] != 1002 || ids[11] != 1003 || loaded.User.Token != "" {
+		t.Fatalf("unexpected ids %v %+v", ids, loaded.User)
+	}
+	if loaded.User.Avatars["h_1"] != 1002 || loaded.User.Avatars["h_2"] != 1003 || len(loaded.User.Avatars) != 2 {
+		t.Fatalf("unexpected avatars %v", loaded.User.Avatars)
+	}
+	am := loaded.AvatarMaps[1]
+	if am.UserId != 1001 || am.GameId != "h" || am.ServerId != 2 {
+		t.Fatalf("unexpected avatar map %+v", am)
+	}
+	avatar := loaded.Docs[lox.AVATAR_COLLECTION][0].Map()
+	if avatar["_id"] != util.ID(1002) || avatar["level"] != int32(3) {
+		t.Fatalf("unexpected avatar doc %v", avatar)
+	}
+	//the inbox messages keep their order with new ids
+	m0, m1 := loaded.Docs[lox.INBOX_COLLECTION][0].Map(), loaded.Docs[lox.INBOX_COLLECTION][1].Map()
+	if m0["to"] != util.ID(1002) || m1["to"] != util.ID(1002) || m0["_id"].(util.ID) >= m1["_id"].(util.ID) {
+		t.Fatalf("unexpected inbox docs %v %v", m0, m1)
+	}
+
+	//the archives of newer versions are rejected
+	files, _ := zip.DeCompressBytes(data)
+	files[lox.PLAYER_ARCHIVE_MANIFEST] = []byte(`{"Version":2}`)
+	data, _ = zip.CompressBytes(files)
+	if _, err := lox.UnmarshalPlayerArchive(data); !protocol.ERR_ARCHIVE_INVALID.Is(err) {
+		t.Errorf("expect ERR_ARCHIVE_INVALID,got %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/protocol"
+)
+
+func TestProxyMessage(t *testing.T) {
+	topicMsg, err := lox.NewTopicMessage("room/1", lox.NewResponse(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	routeMsg := protocol.NewRouteMessage(100, 3, 7, topicMsg, true)
+	proxyMsg, err := lox.NewProxyMessage(routeMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := protocol.MarshalMessage(0, proxyMsg, protocol.BINARY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := protocol.UnmarshalMessage(data, protocol.BINARY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv, err := msg.Body.(*lox.ProxyMessage).RouteMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recv.FromActor != 100 || recv.ToActor != 3 || recv.TransId != 7 || !recv.Req {
+		t.Errorf("route info mismatch, got %+v", recv)
+	}
+	recvTopic, ok := recv.Body.(*lox.TopicMessage)
+	if !ok || recvTopic.Topic != "room/1" {
+		t.Fatalf("topic msg mismatch, got %+v", recv.Body)
+	}
+	inner, err := recvTopic.Message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, ok := inner.(*lox.Response); !ok || !resp.OK {
+		t.Errorf("inner msg mismatch, got %+v", inner)
+	}
+}
@@ -0,0 +1,106 @@
+package test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/network/tcp"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+)
+
+// flakySession drop the connection on the first message of the first connection,echo the others
+type flakySession struct {
+	first bool
+}
+
+func (this *flakySession) GetId() util.ID           { return 0 }
+func (this *flakySession) GetConn() lokas.IConn     { return nil }
+func (this *flakySession) OnOpen(conn lokas.IConn)  {}
+func (this *flakySession) OnClose(conn lokas.IConn) {}
+func (this *flakySession) OnRecv(conn lokas.IConn, data []byte) {
+	if this.first {
+		conn.Close()
+		return
+	}
+	d := make([]byte, len(data))
+	copy(d, data)
+	conn.Write(d)
+}
+
+func TestReconnectClientReplay(t *testing.T) {
+	var conns int32
+	ctx := kcpTestContext(nil)
+	ctx.SessionCreator = func(conn lokas.IConn) lokas.ISession {
+		return &flakySession{first: atomic.AddInt32(&conns, 1) == 1}
+	}
+	server := tcp.NewServer(ctx)
+	err := server.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	policy := lox.DefaultReconnectPolicy()
+	policy.MinDelay = time.Millisecond * 50
+	client := lox.NewReconnectClient(lox.TCP, protocol.BINARY, policy)
+	var handshakes int32
+	client.HandShake = func(c lokas.INetClient) error {
+		atomic.AddInt32(&handshakes, 1)
+		return nil
+	}
+	client.Idempotent = func(req interface{}) bool {
+		return true
+	}
+	var mu sync.Mutex
+	states := []lox.ClientState{}
+	client.OnStateChange(func(state lox.ClientState, old lox.ClientState) {
+		mu.Lock()
+		states = append(states, state)
+		mu.Unlock()
+	})
+	_, err = client.Connect(server.Addr()).Await()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the first request is dropped with the connection,and sent again after reconnected
+	resp, err := client.Request(lox.NewResponse(true)).Await()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := resp.(*lox.Response); !ok || !r.OK {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	if atomic.LoadInt32(&conns) != 2 || atomic.LoadInt32(&handshakes) != 2 {
+		t.Fatalf("expect reconnected and handshaked again,conns %d handshakes %d", conns, handshakes)
+	}
+
+	//the errors of the request itself are rejected at once instead of waiting for a reconnection
+	start := time.Now()
+	if _, err = client.Request(&struct{ A int }{}).Await(); err == nil {
+		t.Fatal("expect unregistered request failed")
+	}
+	if time.Since(start) > time.Second || atomic.LoadInt32(&conns) != 2 {
+		t.Fatalf("request error treated as a disconnection,took %v", time.Since(start))
+	}
+	client.Disconnect(true).Await()
+	mu.Lock()
+	defer mu.Unlock()
+	expect := []lox.ClientState{lox.CLIENT_CONNECTING, lox.CLIENT_CONNECTED, lox.CLIENT_RECONNECTING, lox.CLIENT_CONNECTED, lox.CLIENT_CLOSED}
+	if len(states) != len(expect) {
+		t.Fatalf("expect states %v,got %v", expect, states)
+	}
+	for i := range expect {
+		if states[i] != expect[i] {
+			t.Fatalf("expect states %v,got %v", expect, states)
+		}
+	}
+	if _, err = client.Request(lox.NewResponse(true)).Await(); err != lox.ErrClientClosed {
+		t.Errorf("expect closed client error,got %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/util"
+)
+
+func TestRegistryQuery(t *testing.T) {
+	reg := lox.NewCommonRegistry()
+	reg.AddActor(&lox.ActorRegistry{Id: 1, Type: "Avatar", ServerId: 1, ProcessId: 10, Labels: map[string]string{"region": "eu"}})
+	reg.AddActor(&lox.ActorRegistry{Id: 2, Type: "Avatar", ServerId: 2, ProcessId: 10})
+	reg.AddActor(&lox.ActorRegistry{Id: 3, Type: "Room", ServerId: 1, ProcessId: 11, Labels: map[string]string{"region": "eu"}})
+
+	if ids := reg.GetActorIdsByTypeAndServerId(1, "Avatar"); len(ids) != 1 || ids[0] != 1 {
+		t.Errorf("query by type and server, got %v", ids)
+	}
+	if res := reg.QueryActors(&lox.ActorQuery{ProcessId: 10}); len(res) != 2 {
+		t.Errorf("query by process, got %d", len(res))
+	}
+	if res := reg.QueryActors(&lox.ActorQuery{Labels: map[string]string{"region": "eu"}, Type: "Room"}); len(res) != 1 || res[0].Id != 3 {
+		t.Errorf("query by label, got %v", res)
+	}
+
+	//snapshot must not be affected by later changes
+	snapshot := reg.QueryActors(&lox.ActorQuery{Type: "Avatar"})
+	snapshot[0].Labels = map[string]string{"region": "us"}
+	if res := reg.QueryActors(&lox.ActorQuery{Labels: map[string]string{"region": "us"}}); len(res) != 0 {
+		t.Errorf("snapshot modified the registry, got %v", res)
+	}
+
+	//re-adding an actor with a different type must move it between indexes
+	reg.AddActor(&lox.ActorRegistry{Id: 2, Type: "Room", ServerId: 2, ProcessId: 10})
+	if res := reg.QueryActors(&lox.ActorQuery{Type: "Avatar"}); len(res) != 1 {
+		t.Errorf("stale type index, got %d", len(res))
+	}
+
+	reg.RemoveActor(1)
+	if res := reg.QueryActors(&lox.ActorQuery{Labels: map[string]string{"region": "eu"}}); len(res) != 1 {
+		t.Errorf("stale label index, got %d", len(res))
+	}
+
+	reg.ResetActors([]*lox.ActorRegistry{{Id: util.ID(5), Type: "Avatar", ServerId: 3}})
+	if res := reg.QueryActors(&lox.ActorQuery{}); len(res) != 1 || res[0].Id != 5 {
+		t.Errorf("reset actors, got %v", res)
+	}
+}
+
+func TestRegistryResetDiff(t *testing.T) {
+	reg := lox.NewCommonRegistry()
+	reg.AddActor(&lox.ActorRegistry{Id: 1, Type: "Avatar", ProcessId: 10})
+	reg.AddActor(&lox.ActorRegistry{Id: 2, Type: "Avatar", ProcessId: 10})
+	reg.AddActor(&lox.ActorRegistry{Id: 3, Type: "Room", ProcessId: 11})
+
+	//1 kept,2 moved,3 removed,4 new
+	added, removed := reg.ResetActors([]*lox.ActorRegistry{
+		{Id: 1, Type: "Avatar", ProcessId: 10},
+		{Id: 2, Type: "Avatar", ProcessId: 11},
+		{Id: 4, Type: "Room", ProcessId: 11},
+	})
+	if len(added) != 2 || added[0].Id != 2 || added[1].Id != 4 {
+		t.Errorf("added actors, got %v", added)
+	}
+	if len(removed) != 1 || removed[0].Id != 3 {
+		t.Errorf("removed actors, got %v", removed)
+	}
+	added, removed = reg.ResetActors([]*lox.ActorRegistry{
+		{Id: 1, Type: "Avatar", ProcessId: 10},
+		{Id: 2, Type: "Avatar", ProcessId: 11},
+		{Id: 4, Type: "Room", ProcessId: 11},
+	})
+	if len(added) != 0 || len(removed) != 0 {
+		t.Errorf("reset unchanged, got %v %v", added, removed)
+	}
+
+	reg.AddProcess(lox.NewProcessRegistry(10))
+	reg.AddProcess(lox.NewProcessRegistry(11))
+	joined, left := reg.ResetProcesses([]*lox.ProcessRegistry{lox.NewProcessRegistry(11), lox.NewProcessRegistry(12)})
+	if len(joined) != 1 || joined[0] != 12 {
+		t.Errorf("joined processes, got %v", joined)
+	}
+	if len(left) != 1 || left[0] != 10 {
+		t.Errorf("left processes, got %v", left)
+	}
+}
+
+func waitRegistryEvent(t *testing.T, ch chan lokas.IRegistryEvent) lokas.IRegistryEvent {
+	select {
+	case e := <-ch:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("registry event timeout")
+	}
+	return nil
+}
+
+func TestRegistryWatch(t *testing.T) {
+	endpoint := startTestEtcd(t)
+	process := newTestProcess(t, endpoint, 1)
+	reg := lox.NewRegistry(process)
+	processes := make(chan lokas.IRegistryEvent, 16)
+	actors := make(chan lokas.IRegistryEvent, 16)
+	all := make(chan lokas.IRegistryEvent, 16)
+	reg.OnProcessJoined(lokas.ChanEventSink(processes))
+	reg.OnProcessLeft(lokas.ChanEventSink(processes))
+	reg.OnActorRegistered(lokas.ChanEventSink(actors))
+	unwatch := reg.OnActorUnregistered(lokas.ChanEventSink(actors))
+	reg.Watch(lokas.EVT_PROCESS_JOINED|lokas.EVT_ACTOR_REGISTERED, lokas.ChanEventSink(all))
+	err := reg.Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Unload()
+
+	ctx := context.Background()
+	process.GetEtcd().Put(ctx, "/processids/12", "")
+	if e := waitRegistryEvent(t, processes).(*lokas.ProcessEvent); e.Type != lokas.EVT_PROCESS_JOINED || e.ProcessId != 12 {
+		t.Errorf("process joined, got %v", e)
+	}
+	data, _ := json.Marshal(&lox.ActorRegistry{Id: 100, Type: "Room", ProcessId: 12})
+	process.GetEtcd().Put(ctx, "/actor/100", string(data))
+	if e := waitRegistryEvent(t, actors).(*lokas.ActorEvent); e.Type != lokas.EVT_ACTOR_REGISTERED || e.ActorId != 100 || e.ActorType != "Room" || e.ProcessId != 12 {
+		t.Errorf("actor registered, got %v", e)
+	}
+	if e := waitRegistryEvent(t, all); e.EventType() != lokas.EVT_PROCESS_JOINED {
+		t.Errorf("watch mask, got %v", e)
+	}
+	if e := waitRegistryEvent(t, all); e.EventType() != lokas.EVT_ACTOR_REGISTERED {
+		t.Errorf("watch mask, got %v", e)
+	}
+	process.GetEtcd().Delete(ctx, "/actor/100")
+	if e := waitRegistryEvent(t, actors).(*lokas.ActorEvent); e.Type != lokas.EVT_ACTOR_UNREGISTERED || e.ActorId != 100 {
+		t.Errorf("actor unregistered, got %v", e)
+	}
+	process.GetEtcd().Delete(ctx, "/processids/12")
+	if e := waitRegistryEvent(t, processes).(*lokas.ProcessEvent); e.Type != lokas.EVT_PROCESS_LEFT || e.ProcessId != 12 {
+		t.Errorf("process left, got %v", e)
+	}
+
+	//the registry restarts after unload
+	unwatch()
+	reg.Unload()
+	reg.Unload()
+	err = reg.Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	process.GetEtcd().Put(ctx, "/actor/101", string(data))
+	if e := waitRegistryEvent(t, actors).(*lokas.ActorEvent); e.Type != lokas.EVT_ACTOR_REGISTERED {
+		t.Errorf("actor registered after restart, got %v", e)
+	}
+	process.GetEtcd().Delete(ctx, "/actor/101")
+	process.GetEtcd().Put(ctx, "/processids/13", "")
+	waitRegistryEvent(t, processes)
+	select {
+	case e := <-actors:
+		t.Errorf("unwatched sink received %v", e)
+	default:
+	}
+}
+
+func TestRegistryEventSinkFull(t *testing.T) {
+	ch := make(chan lokas.IRegistryEvent, 1)
+	sink := lokas.ChanEventSink(ch)
+	done := make(chan struct{})
+	go func() {
+		sink(&lokas.ProcessEvent{Type: lokas.EVT_PROCESS_JOINED, ProcessId: 1})
+		sink(&lokas.ProcessEvent{Type: lokas.EVT_PROCESS_JOINED, ProcessId: 2})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sink blocked on a full chan")
+	}
+	if e := (<-ch).(*lokas.ProcessEvent); e.ProcessId != 1 {
+		t.Errorf("first event kept, got %v", e)
+	}
+}
@@ -0,0 +1,129 @@
+package test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+)
+
+func newTopicTestActor(process *testProcess, id util.ID) *lox.Actor {
+	actor := lox.NewActor()
+	actor.SetId(id)
+	process.AddActor(actor)
+	return actor
+}
+
+func waitTopicProcesses(t *testing.T, process *testProcess, topic string, expect int) {
+	waitUntil(t, "topic processes not synced", func() bool {
+		return len(process.GetTopicProcesses(topic)) == expect
+	})
+}
+
+func recvTopicMessage(actor *lox.Actor) *protocol.RouteMessage {
+	select {
+	case msg := <-actor.MsgChan:
+		return msg
+	case <-time.After(200 * time.Millisecond):
+		return nil
+	}
+}
+
+func TestTopicPublish(t *testing.T) {
+	endpoint := startTestEtcd(t)
+	a := newTestProcess(t, endpoint, 1)
+	b := newTestProcess(t, endpoint, 2)
+	linkTestProcesses(a, b)
+	for _, p := range []*testProcess{a, b} {
+		err := p.registry.Load(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.registry.Unload()
+	}
+	localSub := newTopicTestActor(a, 1001)
+	remoteSub := newTopicTestActor(b, 2001)
+
+	err := a.registry.SubscribeTopic("room/1", localSub.GetId())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.registry.SubscribeTopic("room/1", remoteSub.GetId())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitTopicProcesses(t, a, "room/1", 2)
+
+	err = a.router.PublishTopic(100, "room/1", lox.NewResponse(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []*lox.Actor{localSub, remoteSub} {
+		msg := recvTopicMessage(sub)
+		if msg == nil {
+			t.Fatalf("%d not received", sub.GetId())
+		}
+		if resp, ok := msg.Body.(*lox.Response); !ok || !resp.OK || msg.FromActor != 100 {
+			t.Errorf("topic msg mismatch, got %+v", msg)
+		}
+	}
+
+	err = b.registry.UnsubscribeTopic("room/1", remoteSub.GetId())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.registry.UnsubscribeTopic("room/1", remoteSub.GetId()); err == nil {
+		t.Error("unsubscribe twice")
+	}
+	waitTopicProcesses(t, a, "room/1", 1)
+	a.router.PublishTopic(100, "room/1", lox.NewResponse(true))
+	if recvTopicMessage(localSub) == nil {
+		t.Error("local subscriber not received")
+	}
+	if msg := recvTopicMessage(remoteSub); msg != nil {
+		t.Errorf("unsubscribed actor received %+v", msg)
+	}
+}
+
+// a subscriber joining while the last one leaves must keep the holder key of the process
+func TestTopicSubscribeRace(t *testing.T) {
+	endpoint := startTestEtcd(t)
+	p := newTestProcess(t, endpoint, 1)
+	key := lox.TOPIC_KEY.Assemble("room/1", p.PId())
+	for i := 0; i < 50; i++ {
+		err := p.registry.SubscribeTopic("room/1", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			p.registry.UnsubscribeTopic("room/1", 1)
+		}()
+		go func() {
+			defer wg.Done()
+			p.registry.SubscribeTopic("room/1", 2)
+		}()
+		wg.Wait()
+		resp, err := p.GetEtcd().Get(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Kvs) != 1 {
+			t.Fatalf("holder key removed with a subscriber left, round %d", i)
+		}
+		p.registry.UnsubscribeTopic("room/1", 2)
+		resp, err = p.GetEtcd().Get(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Kvs) != 0 {
+			t.Fatalf("holder key kept without subscribers, round %d", i)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/protocol"
+)
+
+func TestReliableLink(t *testing.T) {
+	client := lox.NewReliableLink(8)
+	server := lox.NewReliableLink(8)
+
+	//client request is numbered
+	req, _ := protocol.MarshalMessage(1, lox.NewResponse(true), protocol.BINARY)
+	wrapped, err := client.Wrap(req, protocol.BINARY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := protocol.UnmarshalMessage(wrapped, protocol.BINARY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env, ok := msg.Body.(*lox.ReliableMessage); !ok || env.Seq != 1 {
+		t.Fatalf("expect seq 1,got %+v", msg.Body)
+	}
+
+	//server push is delivered once
+	push, _ := protocol.MarshalMessage(0, lox.NewResponse(false), protocol.BINARY)
+	pushWrapped, _ := server.Wrap(push, protocol.BINARY)
+	pushMsg, _ := protocol.UnmarshalMessage(pushWrapped, protocol.BINARY)
+	inner, err := client.Unwrap(pushMsg, protocol.BINARY)
+	if err != nil || inner == nil {
+		t.Fatalf("expect inner message,got %v %v", inner, err)
+	}
+	if _, ok := inner.Body.(*lox.Response); !ok {
+		t.Fatalf("inner message mismatch,got %+v", inner.Body)
+	}
+	dup, err := client.Unwrap(pushMsg, protocol.BINARY)
+	if err != nil || dup != nil {
+		t.Fatalf("expect duplicate dropped,got %v %v", dup, err)
+	}
+
+	//ack piggybacked on the next request
+	wrapped, _ = client.Wrap(req, protocol.BINARY)
+	msg, _ = protocol.UnmarshalMessage(wrapped, protocol.BINARY)
+	if env := msg.Body.(*lox.ReliableMessage); env.Seq != 2 || env.Ack != 1 {
+		t.Fatalf("expect seq 2 ack 1,got %+v", env)
+	}
+
+	//resume with a token,the gate received the first request only
+	tokenMsg, _ := protocol.MarshalMessage(0, &lox.SessionToken{SessionId: 9, Token: "token"}, protocol.BINARY)
+	tokenBin, _ := protocol.UnmarshalMessage(tokenMsg, protocol.BINARY)
+	client.Unwrap(tokenBin, protocol.BINARY)
+	resume, ok := client.ResumeMessage()
+	if !ok || resume.SessionId != 9 || resume.LastSeq != 1 {
+		t.Fatalf("resume message mismatch,got %+v", resume)
+	}
+	datas, err := client.OnResumed(&lox.SessionResumed{SessionId: 9, Ack: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(datas) != 1 {
+		t.Fatalf("expect 1 retransmit,got %d", len(datas))
+	}
+}
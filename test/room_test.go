@@ -0,0 +1,151 @@
+package test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+)
+
+func TestRoom(t *testing.T) {
+	conf := lox.NewAppConfig("room")
+	err := conf.Viper.ReadConfig(strings.NewReader(`
+line_id = 3
+tick = "50ms"
+lifetime = "10m"
+capacity = 2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	joined := []util.ID{}
+	manager := lox.NewRoomManagerCtor(&lox.RoomHandler{
+		OnJoin: func(room *lox.Room, avatarId util.ID) error {
+			joined = append(joined, avatarId)
+			return nil
+		},
+		OnMsg: func(room *lox.Room, avatarId util.ID, transId uint32, msg protocol.ISerializable) (protocol.ISerializable, error) {
+			return lox.NewResponse(avatarId == 1), nil
+		},
+	}).Create().(*lox.RoomManager)
+	if err := manager.Load(conf); err != nil {
+		t.Fatal(err)
+	}
+	if manager.LineId != 3 || manager.Tick != time.Millisecond*50 || manager.EmptyTimeout != time.Second*30 || manager.Capacity != 2 {
+		t.Fatalf("unexpected config %+v", manager)
+	}
+
+	//the matched rooms are reserved for the teams
+	room := lox.NewRoom(100, "duel", manager)
+	room.Reserve([]*lox.MatchTeam{{Members: []int64{1}}, {Members: []int64{2}}})
+	if room.Team(2) != 1 || room.Team(3) != -1 {
+		t.Fatalf("unexpected teams %v", room.Reserved)
+	}
+	if _, err := room.HandleMsg(3, 0, &lox.RoomJoin{}); !protocol.ERR_ROOM_FORBIDDEN.Is(err) {
+		t.Errorf("expect ERR_ROOM_FORBIDDEN,got %v", err)
+	}
+	resp, err := room.HandleMsg(1, 0, &lox.RoomJoin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the gate sessions can not join for others
+	if _, err := room.HandleMsg(10, 0, &lox.RoomJoin{AvatarId: 2}); !protocol.ERR_ROOM_FORBIDDEN.Is(err) || room.Members[2] != nil {
+		t.Fatalf("expect ERR_ROOM_FORBIDDEN,got %v %v", err, room.Members)
+	}
+	//the server actors registered may
+	room.SetProcess(&roomTestProcess{testProcess: newTestProcess(t, "", 1), registered: map[util.ID]bool{20: true}})
+	if _, err := room.HandleMsg(20, 0, &lox.RoomJoin{AvatarId: 2}); err != nil {
+		t.Fatal(err)
+	}
+	//only the manager closes the room
+	if _, err := room.HandleMsg(2, 0, &lox.RoomClose{Reason: lox.ROOM_CLOSE_GAME}); !protocol.ERR_ROOM_FORBIDDEN.Is(err) {
+		t.Errorf("expect ERR_ROOM_FORBIDDEN,got %v", err)
+	}
+	info := resp.(*lox.RoomInfo)
+	if info.RoomId != 100 || info.LineId != 3 || len(info.Members) != 1 || len(room.Members) != 2 || len(joined) != 2 {
+		t.Fatalf("unexpected room %+v %v", info, joined)
+	}
+	//the members act for themselves only
+	if _, err := room.HandleMsg(1, 0, &lox.RoomLeave{AvatarId: 2}); err != nil || room.Members[2] == nil || room.Members[1] != nil {
+		t.Fatalf("unexpected leave %v %v", err, room.Members)
+	}
+	if _, err := room.HandleMsg(1, 0, &lox.Response{}); !protocol.ERR_ROOM_NOT_JOINED.Is(err) {
+		t.Errorf("expect ERR_ROOM_NOT_JOINED,got %v", err)
+	}
+	if resp, err := room.HandleMsg(2, 0, &lox.Response{}); err != nil || resp.(*lox.Response).OK {
+		t.Errorf("unexpected msg reply %v %v", resp, err)
+	}
+
+	lobby := lox.NewRoom(101, "lobby", manager)
+	lobby.HandleMsg(1, 0, &lox.RoomJoin{})
+	lobby.HandleMsg(2, 0, &lox.RoomJoin{})
+	if _, err := lobby.HandleMsg(3, 0, &lox.RoomJoin{}); !protocol.ERR_ROOM_FULL.Is(err) {
+		t.Errorf("expect ERR_ROOM_FULL,got %v", err)
+	}
+
+	//the new rooms go to the line with the least rooms
+	infos := []*lokas.ServiceInfo{{LineId: 1, Cnt: 3}, {LineId: 2, Cnt: 2}, {LineId: 3, Cnt: 2}}
+	if line := lox.LeastLoadedService(infos, nil); line.LineId != 2 {
+		t.Errorf("expect line 2,got %d", line.LineId)
+	}
+	if line := lox.LeastLoadedService(infos, map[uint16]int{2: 1}); line.LineId != 3 {
+		t.Errorf("expect line 3,got %d", line.LineId)
+	}
+	if lox.LeastLoadedService(nil, nil) != nil {
+		t.Error("expect no line")
+	}
+
+	//the rooms are created by the matches or under a new id only
+	process := &roomTestProcess{testProcess: newTestProcess(t, "", 1), registered: map[util.ID]bool{20: true}}
+	process.AddActor(lox.NewRoom(21, "lobby", manager))
+	manager.SetProcess(process)
+	if _, err := manager.HandleMsg(1, 0, &lox.RoomJoin{RoomId: 22}); !protocol.ERR_ROOM_NOT_FOUND.Is(err) {
+		t.Errorf("expect ERR_ROOM_NOT_FOUND,got %v", err)
+	}
+	for _, id := range []util.ID{20, 21} {
+		if _, err := manager.HandleMsg(1, 0, &lox.MatchRoom{RoomId: id.Int64(), Mode: "duel"}); !protocol.ERR_ROOM_ID_IN_USE.Is(err) {
+			t.Errorf("expect ERR_ROOM_ID_IN_USE,got %v", err)
+		}
+	}
+	if manager.RoomCnt() != 0 {
+		t.Errorf("unexpected rooms %d", manager.RoomCnt())
+	}
+
+	gateConf := lox.NewAppConfig("gate")
+	gateConf.Viper.ReadConfig(strings.NewReader(`
+[routes.battle]
+cmd = "4000-4999"
+target = "room"
+`))
+	router, err := lox.LoadGateRouter(gateConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := lox.NewPassiveSession(nil, 1, nil)
+	if routed, err := router.Route(sess, &protocol.BinaryMessage{CmdId: 4000}); !routed || !protocol.ERR_ROOM_NOT_JOINED.Is(err) {
+		t.Errorf("expect ERR_ROOM_NOT_JOINED,got %v %v", routed, err)
+	}
+
+	bad := lox.NewAppConfig("room")
+	bad.Viper.ReadConfig(strings.NewReader(`capacity = -1`))
+	if err := lox.NewRoomManagerCtor(nil).Create().Load(bad); !protocol.ERR_CONFIG_ERROR.Is(err) {
+		t.Errorf("expect ERR_CONFIG_ERROR,got %v", err)
+	}
+}
+
+// roomTestProcess the actors registered in the cluster
+type roomTestProcess struct {
+	*testProcess
+	registered map[util.ID]bool
+}
+
+func (this *roomTestProcess) GetProcessIdByActor(actorId util.ID) (util.ProcessId, error) {
+	if !this.registered[actorId] {
+		return 0, protocol.ERR_ACTOR_NOT_FOUND
+	}
+	return this.pid, nil
+}
@@ -0,0 +1,46 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/nomos/go-lokas"
+)
+
+func TestServiceSelector(t *testing.T) {
+	info := &lokas.ServiceInfo{
+		ServiceType: "battle",
+		ServiceId:   1,
+		LineId:      2,
+		Version:     "1.2",
+		Labels:      map[string]string{"region": "us", "canary": "true"},
+	}
+	cases := []struct {
+		selector string
+		match    bool
+	}{
+		{"", true},
+		{"version=1.2", true},
+		{"version==1.2,region!=eu", true},
+		{"version=1.3", false},
+		{"region!=us", false},
+		{"canary", true},
+		{"!canary", false},
+		{"!flavour,line=2", true},
+		{"flavour!=debug", true},
+	}
+	for _, c := range cases {
+		sel, err := lokas.ParseServiceSelector(c.selector)
+		if err != nil {
+			t.Errorf("parse %q: %v", c.selector, err)
+			continue
+		}
+		if sel.Match(info) != c.match {
+			t.Errorf("selector %q expect %v", c.selector, c.match)
+		}
+	}
+	for _, s := range []string{"=1.2", "a=b=c", "a!=!b"} {
+		if _, err := lokas.ParseServiceSelector(s); err == nil {
+			t.Errorf("selector %q should be invalid", s)
+		}
+	}
+}
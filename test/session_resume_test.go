@@ -0,0 +1,248 @@
+package test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/network"
+	"github.com/nomos/go-lokas/protocol"
+	"github.com/nomos/go-lokas/util"
+)
+
+// resumeTestConn record the data written to the client
+type resumeTestConn struct {
+	lokas.IConn
+	mu     sync.Mutex
+	writes chan []byte
+	closed bool
+}
+
+func newResumeTestConn() *resumeTestConn {
+	return &resumeTestConn{
+		writes: make(chan []byte, 64),
+	}
+}
+
+func (this *resumeTestConn) Write(data []byte) (int, error) {
+	d := make([]byte, len(data))
+	copy(d, data)
+	this.writes <- d
+	return len(data), nil
+}
+
+func (this *resumeTestConn) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.closed = true
+	return nil
+}
+
+func (this *resumeTestConn) isClosed() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.closed
+}
+
+func (this *resumeTestConn) Wait() {}
+
+// recv return the next message written,nil if nothing written in time
+func (this *resumeTestConn) recv(t *testing.T) *protocol.BinaryMessage {
+	select {
+	case data := <-this.writes:
+		msg, err := protocol.UnmarshalMessage(data, protocol.BINARY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	case <-time.After(500 * time.Millisecond):
+		return nil
+	}
+}
+
+// recvSeq return the sequence number of the next message,which must be numbered
+func (this *resumeTestConn) recvSeq(t *testing.T) uint32 {
+	msg := this.recv(t)
+	if msg == nil {
+		t.Fatal("no message written")
+	}
+	env, ok := msg.Body.(*lox.ReliableMessage)
+	if !ok {
+		t.Fatalf("message not numbered, got %+v", msg.Body)
+	}
+	return env.Seq
+}
+
+type resumeTestGate struct {
+	gate    *lox.Gate
+	process *testProcess
+	grace   time.Duration
+	buffer  int
+}
+
+func newResumeTestGate(t *testing.T, grace time.Duration, buffer int) *resumeTestGate {
+	return &resumeTestGate{
+		gate: &lox.Gate{
+			Actor:           lox.NewActor(),
+			ISessionManager: network.NewDefaultSessionManager(true),
+		},
+		process: newTestProcess(t, "", 1),
+		grace:   grace,
+		buffer:  buffer,
+	}
+}
+
+func (this *resumeTestGate) open(id util.ID, conn lokas.IConn) *lox.PassiveSession {
+	sess := lox.NewPassiveSession(conn, id, this.gate)
+	sess.SetProcess(this.process)
+	sess.ResumeGrace = this.grace
+	sess.ResumeBufferSize = this.buffer
+	sess.ResumeFunc = this.gate.ResumeSession
+	sess.AuthFunc = func(data []byte) (interface{}, error) {
+		return nil, nil
+	}
+	sess.OnOpen(conn)
+	return sess
+}
+
+func sendResumeTest(sess *lox.PassiveSession, conn lokas.IConn, msg protocol.ISerializable) {
+	data, _ := protocol.MarshalMessage(1, msg, protocol.BINARY)
+	sess.OnRecv(conn, data)
+}
+
+// handshake verify the session and return the resume token
+func handshakeResumeTest(t *testing.T, sess *lox.PassiveSession, conn *resumeTestConn) string {
+	sendResumeTest(sess, conn, &protocol.HandShake{Data: []byte("{}")})
+	if msg := conn.recv(t); msg == nil || msg.CmdId != protocol.TAG_HandShake {
+		t.Fatalf("handshake reply, got %+v", msg)
+	}
+	msg := conn.recv(t)
+	if msg == nil {
+		t.Fatal("no resume token")
+	}
+	token, ok := msg.Body.(*lox.SessionToken)
+	if !ok || token.SessionId != sess.GetId() || token.Token == "" {
+		t.Fatalf("resume token, got %+v", msg.Body)
+	}
+	return token.Token
+}
+
+func TestSessionResume(t *testing.T) {
+	g := newResumeTestGate(t, time.Second, 8)
+	conn1 := newResumeTestConn()
+	sess := g.open(1, conn1)
+	token := handshakeResumeTest(t, sess, conn1)
+
+	//the outbound messages are numbered for the client to report the last one received
+	for i := uint32(1); i <= 3; i++ {
+		sess.WriteMessage(0, lox.NewResponse(true))
+		if seq := conn1.recvSeq(t); seq != i {
+			t.Fatalf("expect seq %d, got %d", i, seq)
+		}
+	}
+
+	//detached,the messages are buffered
+	sess.OnClose(conn1)
+	if sess.GetConn() != nil {
+		t.Error("conn kept after detached")
+	}
+	err := sess.WriteMessage(0, lox.NewResponse(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.gate.GetSession(1) == nil {
+		t.Fatal("session removed within the grace")
+	}
+
+	//a wrong token is refused
+	connBad := newResumeTestConn()
+	bad := g.open(2, connBad)
+	sendResumeTest(bad, connBad, &lox.SessionResume{SessionId: 1, Token: "wrong", LastSeq: 3})
+	if msg := connBad.recv(t); msg == nil || msg.Body.(*protocol.ErrMsg).Code != int32(protocol.ERR_SESSION_RESUME_FAILED) {
+		t.Fatalf("expect resume failed, got %+v", msg)
+	}
+	waitUntil(t, "refused conn not closed", connBad.isClosed)
+
+	//resumed on a new connection,the messages after LastSeq are replayed
+	conn2 := newResumeTestConn()
+	relay := g.open(3, conn2)
+	sendResumeTest(relay, conn2, &lox.SessionResume{SessionId: 1, Token: token, LastSeq: 2})
+	msg := conn2.recv(t)
+	if msg == nil {
+		t.Fatal("no resume reply")
+	}
+	if resumed, ok := msg.Body.(*lox.SessionResumed); !ok || resumed.SessionId != 1 || resumed.Seq != 4 {
+		t.Fatalf("resume reply, got %+v", msg.Body)
+	}
+	if seq := conn2.recvSeq(t); seq != 3 {
+		t.Errorf("expect replay seq 3, got %d", seq)
+	}
+	if seq := conn2.recvSeq(t); seq != 4 {
+		t.Errorf("expect replay seq 4, got %d", seq)
+	}
+	if sess.GetConn() != conn2 {
+		t.Error("session not attached to the new conn")
+	}
+	sess.WriteMessage(0, lox.NewResponse(true))
+	if seq := conn2.recvSeq(t); seq != 5 {
+		t.Errorf("expect seq 5, got %d", seq)
+	}
+
+	//the dropped connection of the relay detaches the session again
+	relay.OnClose(conn2)
+	if sess.GetConn() != nil {
+		t.Error("conn kept after detached")
+	}
+}
+
+func TestSessionResumeExpire(t *testing.T) {
+	g := newResumeTestGate(t, 100*time.Millisecond, 2)
+	conn1 := newResumeTestConn()
+	sess := g.open(1, conn1)
+	token := handshakeResumeTest(t, sess, conn1)
+	for i := 0; i < 3; i++ {
+		sess.WriteMessage(0, lox.NewResponse(true))
+		conn1.recvSeq(t)
+	}
+	sess.OnClose(conn1)
+
+	//seq 1 was dropped from the buffer of 2
+	conn2 := newResumeTestConn()
+	relay := g.open(2, conn2)
+	sendResumeTest(relay, conn2, &lox.SessionResume{SessionId: 1, Token: token, LastSeq: 0})
+	if msg := conn2.recv(t); msg == nil || msg.Body.(*protocol.ErrMsg).Code != int32(protocol.ERR_SESSION_RESUME_FAILED) {
+		t.Fatalf("expect resume failed, got %+v", msg)
+	}
+
+	waitUntil(t, "session not expired", func() bool {
+		return g.gate.GetSession(1) == nil
+	})
+	conn3 := newResumeTestConn()
+	late := g.open(3, conn3)
+	sendResumeTest(late, conn3, &lox.SessionResume{SessionId: 1, Token: token, LastSeq: 3})
+	if msg := conn3.recv(t); msg == nil || msg.Body.(*protocol.ErrMsg).Code != int32(protocol.ERR_SESSION_RESUME_FAILED) {
+		t.Fatalf("expect resume failed after expired, got %+v", msg)
+	}
+}
+
+// the writes of a rejected session go through the session lock and never reach a dropped connection
+func TestSessionRejectDetached(t *testing.T) {
+	g := newResumeTestGate(t, time.Second, 8)
+	conn := newResumeTestConn()
+	sess := g.open(1, conn)
+	handshakeResumeTest(t, sess, conn)
+	sess.OnClose(conn)
+	sess.Limiter = lox.NewGateLimiter(&lox.GateLimitConfig{Msg: lox.RateLimit{Rate: 1, Burst: 1}}).Acquire("127.0.0.1")
+	for i := 0; i < 3; i++ {
+		sendResumeTest(sess, conn, &protocol.Ping{})
+	}
+	time.Sleep(100 * time.Millisecond)
+	if sess.GetConn() != nil {
+		t.Error("conn restored by reject")
+	}
+	if msg := conn.recv(t); msg != nil {
+		t.Errorf("written to the dropped conn, got %+v", msg.Body)
+	}
+}
@@ -1 +1,189 @@
 package test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nomos/go-lokas"
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/util"
+)
+
+type singletonTestActor struct {
+	*lox.Actor
+	fail    bool
+	started *int32
+	stopped *int32
+}
+
+func (this *singletonTestActor) Start() error {
+	if this.fail {
+		return errors.New("start failed")
+	}
+	atomic.AddInt32(this.started, 1)
+	return nil
+}
+
+func (this *singletonTestActor) Stop() error {
+	atomic.AddInt32(this.stopped, 1)
+	return nil
+}
+
+type singletonTestNode struct {
+	process *testProcess
+	manager *lox.SingletonManager
+	started int32
+	stopped int32
+}
+
+func newSingletonTestNode(t *testing.T, endpoint string, pid util.ProcessId, fail bool) *singletonTestNode {
+	ret := &singletonTestNode{
+		process: newTestProcess(t, endpoint, pid),
+		manager: lox.SingletonManagerCtor.Create().(*lox.SingletonManager),
+	}
+	ret.manager.SetProcess(ret.process)
+	err := ret.manager.Register("match", func() lokas.IActor {
+		return &singletonTestActor{
+			Actor:   lox.NewActor(),
+			fail:    fail,
+			started: &ret.started,
+			stopped: &ret.stopped,
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ret.manager.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ret.manager.Stop()
+	})
+	return ret
+}
+
+// electSingleton wait until one of the nodes owns the singleton,return the owner and the other
+func electSingleton(t *testing.T, a, b *singletonTestNode) (*singletonTestNode, *singletonTestNode) {
+	waitUntil(t, "no owner elected", func() bool {
+		return a.manager.IsOwner("match") || b.manager.IsOwner("match")
+	})
+	if a.manager.IsOwner("match") && b.manager.IsOwner("match") {
+		t.Fatal("both nodes own the singleton")
+	}
+	if a.manager.IsOwner("match") {
+		return a, b
+	}
+	return b, a
+}
+
+func TestSingletonCampaign(t *testing.T) {
+	endpoint := startTestEtcd(t)
+	a := newSingletonTestNode(t, endpoint, 1, false)
+	b := newSingletonTestNode(t, endpoint, 2, false)
+	owner, other := electSingleton(t, a, b)
+
+	idA, err := a.manager.GetAddress("match")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idB, err := b.manager.GetAddress("match")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idA == 0 || idA != idB {
+		t.Errorf("address differs, got %d %d", idA, idB)
+	}
+	pid, err := other.manager.GetOwner("match")
+	if err != nil || pid != owner.process.PId() {
+		t.Errorf("owner pid, got %d %v", pid, err)
+	}
+	if owner.process.GetActor(idA) == nil || other.process.GetActor(idA) != nil {
+		t.Error("actor must only run in the owner")
+	}
+	if atomic.LoadInt32(&owner.started) != 1 || atomic.LoadInt32(&other.started) != 0 {
+		t.Errorf("actor started, got %d %d", owner.started, other.started)
+	}
+	_, err = a.manager.GetAddress("unknown")
+	if err == nil {
+		t.Error("address of an unknown singleton")
+	}
+}
+
+func TestSingletonResign(t *testing.T) {
+	endpoint := startTestEtcd(t)
+	a := newSingletonTestNode(t, endpoint, 1, false)
+	b := newSingletonTestNode(t, endpoint, 2, false)
+	owner, other := electSingleton(t, a, b)
+	id, _ := owner.manager.GetAddress("match")
+
+	//the key is released at once,not after the lease expired
+	owner.manager.Stop()
+	waitUntil(t, "singleton not taken over", func() bool {
+		return other.manager.IsOwner("match")
+	})
+	if atomic.LoadInt32(&owner.stopped) != 1 || owner.manager.IsOwner("match") || owner.process.GetActor(id) != nil {
+		t.Error("resigned actor not stopped")
+	}
+	if other.process.GetActor(id) == nil {
+		t.Error("actor not started with the same id")
+	}
+	pid, err := owner.manager.GetOwner("match")
+	if err != nil || pid != other.process.PId() {
+		t.Errorf("owner pid, got %d %v", pid, err)
+	}
+}
+
+func TestSingletonFailover(t *testing.T) {
+	endpoint := startTestEtcd(t)
+	a := newSingletonTestNode(t, endpoint, 1, false)
+	b := newSingletonTestNode(t, endpoint, 2, false)
+	owner, other := electSingleton(t, a, b)
+	id, _ := owner.manager.GetAddress("match")
+
+	leaseId, _, err := owner.process.GetLeaseId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner.process.crash()
+	_, err = owner.process.GetEtcd().Revoke(context.Background(), leaseId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "singleton not failed over", func() bool {
+		return other.manager.IsOwner("match")
+	})
+	pid, err := other.manager.GetOwner("match")
+	if err != nil || pid != other.process.PId() {
+		t.Errorf("owner pid, got %d %v", pid, err)
+	}
+	if other.process.GetActor(id) == nil {
+		t.Error("actor not started with the same id")
+	}
+}
+
+func TestSingletonStartFailed(t *testing.T) {
+	endpoint := startTestEtcd(t)
+	a := newSingletonTestNode(t, endpoint, 1, true)
+	waitUntil(t, "singleton address not allocated", func() bool {
+		id, err := a.manager.GetAddress("match")
+		return err == nil && id != 0
+	})
+	id, _ := a.manager.GetAddress("match")
+	time.Sleep(200 * time.Millisecond)
+	if a.manager.IsOwner("match") {
+		t.Error("owner with a failed actor")
+	}
+	if a.process.GetActor(id) != nil {
+		t.Error("failed actor left in the process")
+	}
+
+	//the owner key is released for the healthy processes
+	b := newSingletonTestNode(t, endpoint, 2, false)
+	waitUntil(t, "singleton not taken over", func() bool {
+		return b.manager.IsOwner("match")
+	})
+}
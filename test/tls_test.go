@@ -0,0 +1,154 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nomos/go-lokas/lox"
+	"github.com/nomos/go-lokas/network/tcp"
+	"github.com/nomos/go-lokas/network/tlsconf"
+	"github.com/nomos/go-lokas/protocol"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "lokas test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	writePem(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", der)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue write a leaf certificate signed by the ca
+func (this *testCA) issue(t *testing.T, dir string, name string, serial int64) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"lokas"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, this.cert, &key.PublicKey, this.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	writePem(t, filepath.Join(dir, name+".pem"), "CERTIFICATE", der)
+	writePem(t, filepath.Join(dir, name+".key"), "EC PRIVATE KEY", keyDer)
+}
+
+func writePem(t *testing.T, file string, typ string, der []byte) {
+	err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTlsMutualAndReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	ca.issue(t, dir, "server", 2)
+	ca.issue(t, dir, "client", 3)
+
+	serverTls, err := tlsconf.NewLoader(&tlsconf.Options{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTls, err := tlsconf.NewLoader(&tlsconf.Options{
+		CertFile:   filepath.Join(dir, "client.pem"),
+		KeyFile:    filepath.Join(dir, "client.key"),
+		CAFile:     filepath.Join(dir, "ca.pem"),
+		ServerName: "lokas",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCtx := kcpTestContext(&kcpTestSession{echo: true})
+	serverCtx.TLSConfig = serverTls.ServerConfig()
+	server := tcp.NewServer(serverCtx)
+	err = server.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	addr := server.Addr()
+
+	client := &kcpTestSession{recv: make(chan []byte, 10)}
+	clientCtx := kcpTestContext(client)
+	clientCtx.TLSConfig = clientTls.ClientConfig()
+	conn, err := tcp.Dial(addr, clientCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := protocol.MarshalMessage(1, lox.NewResponse(true), protocol.BINARY)
+	conn.Write(data)
+	select {
+	case <-client.recv:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting echo over tls")
+	}
+	conn.Close()
+
+	//a client without certificate is rejected by mutual tls
+	noCert := clientTls.ClientConfig()
+	noCert.GetClientCertificate = nil
+	c, err := tls.Dial("tcp", addr, noCert)
+	if err == nil {
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = c.Read(make([]byte, 1))
+		c.Close()
+	}
+	if err == nil {
+		t.Fatal("expect handshake failure without client certificate")
+	}
+
+	//the renewed server certificate is served after reload
+	ca.issue(t, dir, "server", 4)
+	err = serverTls.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = tls.Dial("tcp", addr, clientTls.ClientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	serial := c.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	if serial != 4 {
+		t.Fatalf("expect reloaded certificate serial 4,got %d", serial)
+	}
+}
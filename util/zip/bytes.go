@@ -0,0 +1,56 @@
+package zip
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"sort"
+)
+
+// CompressBytes zip the files in memory keyed by their names
+func CompressBytes(files map[string][]byte) ([]byte, error) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for _, name := range names {
+		writer, err := w.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		_, err = writer.Write(files[name])
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DeCompressBytes unzip the files in memory keyed by their names
+func DeCompressBytes(data []byte) (map[string][]byte, error) {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string][]byte{}
+	for _, file := range reader.File {
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		ret[file.Name] = content
+	}
+	return ret, nil
+}